@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Limits of a PUT's "acl" field.
+const (
+	MaxACLTokens      = 16  // Read tokens one entry may list
+	MaxACLTokenLength = 256 // Bytes per token
+)
+
+// What snapshots and drains do with entries that have a read ACL, selected
+// with SetACLExport.
+const (
+	ACLExportInclude = "include" // Default: write them out with their ACL
+	ACLExportSkip    = "skip"    // Leave them out
+)
+
+// RuleACL names the PUT validation rule for the "acl" field.
+const RuleACL = "acl"
+
+// ACLRequest structure for the "acl" field of PUT bodies
+type ACLRequest struct {
+	ReadTokens []string `json:"read_tokens"` // Bearer tokens allowed to read and delete the entry
+}
+
+// ACLResponse structure for the "acl" field of GET replies
+type ACLResponse struct {
+	ReadTokens []string `json:"read_tokens"` // "token:" and a prefix of each token's SHA-256, never the tokens
+}
+
+// hashACLToken returns the form a read token is kept in: the hex SHA-256 of
+// the token, so neither the cache nor its snapshots hold the tokens.
+func hashACLToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validACLHash reports whether h is a token hash as written by hashACLToken.
+func validACLHash(h string) bool {
+	if len(h) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil && h == strings.ToLower(h)
+}
+
+// validate checks the "acl" field of a PUT request and returns the message
+// to send back, or "" if it is acceptable.
+func (acl *ACLRequest) validate() string {
+	if len(acl.ReadTokens) == 0 {
+		return "ACL read_tokens cannot be empty."
+	}
+	if len(acl.ReadTokens) > MaxACLTokens {
+		return fmt.Sprintf("ACL may list at most %d read tokens.", MaxACLTokens)
+	}
+	for _, token := range acl.ReadTokens {
+		if token == "" || len(token) > MaxACLTokenLength {
+			return fmt.Sprintf("ACL read tokens must be 1 to %d bytes long.", MaxACLTokenLength)
+		}
+	}
+	return ""
+}
+
+// readers returns the hashes of the ACL's read tokens, sorted and without
+// duplicates, or nil without an ACL.
+func (acl *ACLRequest) readers() []string {
+	if acl == nil {
+		return nil
+	}
+	readers := make([]string, len(acl.ReadTokens))
+	for i, token := range acl.ReadTokens {
+		readers[i] = hashACLToken(token)
+	}
+	slices.Sort(readers)
+	return slices.Compact(readers)
+}
+
+// requestReader identifies who a request reads as: the hash of its
+// "Authorization: Bearer <token>" token, or "" without one.
+func requestReader(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	return hashACLToken(token)
+}
+
+// readableBy reports whether reader (see requestReader) may read an entry
+// whose ACL lists readers. Entries without an ACL are readable by anyone,
+// entries with one only with a token on it.
+func readableBy(readers []string, reader string) bool {
+	return len(readers) == 0 || (reader != "" && slices.Contains(readers, reader))
+}
+
+// ReadableBy reports whether reader (see requestReader) may read the item.
+func (item Item) ReadableBy(reader string) bool {
+	return readableBy(item.Readers, reader)
+}
+
+// aclResponse describes readers for a GET reply, or returns nil without an
+// ACL. Tokens are only ever shown as a prefix of their SHA-256.
+func aclResponse(readers []string) *ACLResponse {
+	if len(readers) == 0 {
+		return nil
+	}
+	resp := &ACLResponse{ReadTokens: make([]string, len(readers))}
+	for i, h := range readers {
+		resp.ReadTokens[i] = "token:" + h[:12]
+	}
+	return resp
+}
+
+// forbidden returns ErrEntryForbidden for key.
+func forbidden(key string) error {
+	return fmt.Errorf("%w: %s", ErrEntryForbidden, key)
+}
+
+// DeleteAs is Delete on behalf of reader (see requestReader): it fails with
+// ErrEntryForbidden, and removes nothing, if key holds a live entry whose
+// ACL reader is not on.
+func (sc *ShardedCache) DeleteAs(key, reader string) (bool, error) {
+	return sc.remove(key, func(e *entry) error {
+		if !readableBy(e.readers, reader) {
+			return forbidden(key)
+		}
+		return nil
+	})
+}
+
+// SetACLExport chooses what snapshots and drains do with entries that have a
+// read ACL: ACLExportInclude writes them out, ACLExportSkip leaves them out,
+// so they never reach a file or another node. Must be called before the
+// cache starts serving requests.
+func (sc *ShardedCache) SetACLExport(mode string) error {
+	switch mode {
+	case ACLExportInclude, ACLExportSkip:
+	default:
+		return fmt.Errorf("unknown ACL export mode %q, expected %s or %s", mode, ACLExportInclude, ACLExportSkip)
+	}
+	for _, shard := range sc.shards {
+		shard.skipACLEntries = mode == ACLExportSkip
+	}
+	if mode == ACLExportSkip {
+		log.Printf("Leaving entries with a read ACL out of snapshots and drains")
+	}
+	return nil
+}
+
+// exported reports whether e goes into snapshots and drains taken at now.
+// Leases do not outlive the node.
+func (c *LRUCache) exported(e *entry, now int64) bool {
+	return c.live(e, now) && e.fence == 0 && (e.readers == nil || !c.skipACLEntries)
+}
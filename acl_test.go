@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"kv-go-cache/binproto"
+)
+
+// putWithACL stores value under key, readable only with token.
+func putWithACL(t *testing.T, cache *ShardedCache, key, value, token string) {
+	t.Helper()
+	acl := &ACLRequest{ReadTokens: []string{token}}
+	if res := cache.PutWithOptions(key, value, PutOptions{Readers: acl.readers()}); res.Refused {
+		t.Fatalf("PutWithOptions(%q) was refused", key)
+	}
+}
+
+func TestClaimHidesUnreadableValues(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	putWithACL(t, cache, "job:secret", "payload", "t0k3n")
+	cache.Put("job:open", "worker-b")
+
+	claimed, held, denied := cache.Claim([]string{"job:secret", "job:open", "job:new"}, "worker-a", time.Minute, "")
+	if !slices.Equal(claimed, []string{"job:new"}) {
+		t.Errorf("claimed = %v, want [job:new]", claimed)
+	}
+	if _, ok := held["job:secret"]; ok {
+		t.Errorf("held = %v, leaks the value of job:secret", held)
+	}
+	if held["job:open"] != "worker-b" {
+		t.Errorf("held[job:open] = %q, want worker-b", held["job:open"])
+	}
+	if !slices.Equal(denied, []string{"job:secret"}) {
+		t.Errorf("denied = %v, want [job:secret]", denied)
+	}
+
+	_, held, denied = cache.Claim([]string{"job:secret"}, "worker-a", time.Minute, hashACLToken("t0k3n"))
+	if held["job:secret"] != "payload" || len(denied) != 0 {
+		t.Errorf("with the token: held = %v, denied = %v", held, denied)
+	}
+}
+
+func TestRenameChecksBothACLs(t *testing.T) {
+	reader := hashACLToken("t0k3n")
+	for _, tc := range []struct {
+		name        string
+		src, dst    string // Token guarding the key, "" for none, "-" for absent
+		reader      string
+		wantErr     error
+		wantDstHeld string // Value under the new key afterwards
+	}{
+		{"source unreadable", "t0k3n", "-", "", ErrEntryForbidden, ""},
+		{"destination unreadable", "", "t0k3n", "", ErrEntryForbidden, "old"},
+		{"both readable with token", "t0k3n", "t0k3n", reader, nil, "new"},
+		{"no ACLs", "", "", "", nil, "new"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := NewShardedCache(4, 100, false)
+			put := func(key, value, token string) {
+				switch token {
+				case "-":
+				case "":
+					cache.Put(key, value)
+				default:
+					putWithACL(t, cache, key, value, token)
+				}
+			}
+			put("a", "new", tc.src)
+			put("b", "old", tc.dst)
+
+			err := cache.Rename("a", "b", tc.reader)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Rename = %v, want %v", err, tc.wantErr)
+			}
+			value, ok := cache.shards[cache.getShardIndex("b")].Get("b")
+			if tc.wantDstHeld == "" {
+				if ok {
+					t.Errorf("b holds %q, want absent", value)
+				}
+			} else if !ok || value != tc.wantDstHeld {
+				t.Errorf("b = %q, %v, want %q", value, ok, tc.wantDstHeld)
+			}
+		})
+	}
+}
+
+func TestRenameReportsReplacedEntryAsDeleted(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.Put("a", "new")
+	cache.Put("b", "old")
+	var events []string
+	cache.OnEvict(func(key, value string, reason EvictionReason) {
+		events = append(events, key+"="+value+" "+reason.String())
+	})
+
+	if err := cache.Rename("a", "b", ""); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	want := []string{"b=old deleted", "a=new renamed"}
+	if !slices.Equal(events, want) {
+		t.Errorf("evictions = %v, want %v", events, want)
+	}
+}
+
+// aclRequest builds a request with body, sending token as the bearer token
+// if it is set.
+func aclRequest(method, target, body, token string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// serveACL runs handler on req and returns the reply.
+func serveACL(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// newACLCache returns a cache holding "secret" readable only with t0k3n and
+// an unguarded "open", both with values starting with "val".
+func newACLCache(t *testing.T) *ShardedCache {
+	cache := NewShardedCache(4, 100, false)
+	cache.EnableValueIndex(3, 100)
+	putWithACL(t, cache, "secret", "value-s", "t0k3n")
+	cache.Put("open", "value-o")
+	return cache
+}
+
+func TestBatchReadsEnforceACLs(t *testing.T) {
+	cache := newACLCache(t)
+	body := `{"keys": ["secret", "open"]}`
+	for _, token := range []string{"", "wrong", "t0k3n"} {
+		allowed := token == "t0k3n"
+
+		var bulk GetBulkResponse
+		json.Unmarshal(serveACL(HandleGetBulk(cache, nil, 10), aclRequest(http.MethodPost, "/get/bulk", body, token)).Body.Bytes(), &bulk)
+		if _, leaked := bulk.Found["secret"]; leaked != allowed || bulk.Found["open"] != "value-o" || slices.Contains(bulk.Forbidden, "secret") == allowed {
+			t.Errorf("/get/bulk with token %q: %+v", token, bulk)
+		}
+
+		rec := serveACL(HandleGetFallback(cache, nil, 10), aclRequest(http.MethodGet, "/get/fallback?key=secret&key=open", "", token))
+		if allowed && (rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "value-s")) ||
+			!allowed && (rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "entry_forbidden")) {
+			t.Errorf("/get/fallback with token %q: status %d: %s", token, rec.Code, rec.Body)
+		}
+
+		var search SearchResponse
+		json.Unmarshal(serveACL(HandleSearch(cache), aclRequest(http.MethodGet, "/search?value-prefix=val", "", token)).Body.Bytes(), &search)
+		if slices.Contains(search.Keys, "secret") != allowed || !slices.Contains(search.Keys, "open") {
+			t.Errorf("/search with token %q: %v", token, search.Keys)
+		}
+	}
+}
+
+func TestReleaseEnforcesACLs(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	putWithACL(t, cache, "job:secret", "worker-a", "t0k3n")
+	cache.Put("job:open", "worker-a")
+	body := `{"keys": ["job:secret", "job:open"], "owner": "worker-b"}` // Neither is held by worker-b
+
+	var resp ReleaseResponse
+	json.Unmarshal(serveACL(HandleRelease(cache), aclRequest(http.MethodPost, "/release", body, "")).Body.Bytes(), &resp)
+	if len(resp.Released) != 0 || !slices.Equal(resp.Forbidden, []string{"job:secret"}) {
+		t.Errorf("wrong owner, no token: %+v", resp)
+	}
+	body = strings.ReplaceAll(body, "worker-b", "worker-a")
+	resp = ReleaseResponse{}
+	json.Unmarshal(serveACL(HandleRelease(cache), aclRequest(http.MethodPost, "/release", body, "")).Body.Bytes(), &resp)
+	if !slices.Equal(resp.Released, []string{"job:open"}) || !slices.Equal(resp.Forbidden, []string{"job:secret"}) || !cache.Exists("job:secret") {
+		t.Errorf("right owner, no token: %+v", resp)
+	}
+	resp = ReleaseResponse{}
+	json.Unmarshal(serveACL(HandleRelease(cache), aclRequest(http.MethodPost, "/release", body, "t0k3n")).Body.Bytes(), &resp)
+	if !slices.Equal(resp.Released, []string{"job:secret"}) || len(resp.Forbidden) != 0 {
+		t.Errorf("right owner, with the token: %+v", resp)
+	}
+}
+
+func TestWritesCannotReplaceGuardedEntries(t *testing.T) {
+	decoder, err := NewPutDecoder(NewMetrics(), false, NullValueReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		handler func(cache *ShardedCache) http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		refused func(rec *httptest.ResponseRecorder) bool
+	}{
+		{"put", func(c *ShardedCache) http.HandlerFunc {
+			return HandlePut(c, decoder, WritePolicy{}, PressurePolicy{}, nil, false)
+		}, http.MethodPut, "/put", `{"key": "secret", "value": "{\"x\": 1}"}`,
+			func(rec *httptest.ResponseRecorder) bool {
+				return rec.Code == http.StatusForbidden && strings.Contains(rec.Body.String(), "entry_forbidden")
+			}},
+		{"import/ndjson", func(c *ShardedCache) http.HandlerFunc {
+			return HandleImportNDJSON(c, NewDrainer(c, time.Second, nil), WritePolicy{})
+		}, http.MethodPost, "/import/ndjson", `{"key": "secret", "value": "{\"x\": 1}"}`,
+			func(rec *httptest.ResponseRecorder) bool {
+				var resp StreamImportResponse
+				json.Unmarshal(rec.Body.Bytes(), &resp)
+				return resp.Rejected == 1 && resp.Imported == 0
+			}},
+		{"import/redis", func(c *ShardedCache) http.HandlerFunc { return HandleImportRedis(c, nil) }, http.MethodPost, "/import/redis", `SET secret "{\"x\": 1}"`,
+			func(rec *httptest.ResponseRecorder) bool {
+				var resp ImportResponse
+				json.Unmarshal(rec.Body.Bytes(), &resp)
+				return resp.Rejected == 1 && resp.Imported == 0
+			}},
+		{"add/bulk", func(c *ShardedCache) http.HandlerFunc { return HandleAddBulk(c, 10, nil) },
+			http.MethodPost, "/add/bulk", `{"pairs": {"secret": "{\"x\": 1}"}}`,
+			func(rec *httptest.ResponseRecorder) bool { return rec.Code == http.StatusConflict }},
+		{"merge", func(c *ShardedCache) http.HandlerFunc { return HandleMergeFields(c, nil) }, http.MethodPatch, "/merge", `{"key": "secret", "patch": {"x": 1}}`,
+			func(rec *httptest.ResponseRecorder) bool { return rec.Code == http.StatusForbidden }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, token := range []string{"", "wrong", "t0k3n"} {
+				cache := NewShardedCache(4, 100, false)
+				acl := &ACLRequest{ReadTokens: []string{"t0k3n"}}
+				cache.PutWithOptions("secret", `{"y": 2}`, PutOptions{Encoding: EncodingJSON, Readers: acl.readers()})
+
+				rec := serveACL(tc.handler(cache), aclRequest(tc.method, tc.target, tc.body, token))
+				value, _ := cache.Get("secret")
+				if token != "t0k3n" {
+					if !tc.refused(rec) || value != `{"y": 2}` {
+						t.Errorf("token %q: status %d: %s, left %q", token, rec.Code, rec.Body, value)
+					}
+				} else if tc.name != "add/bulk" && value == `{"y": 2}` { // add/bulk never replaces a live key
+					t.Errorf("with the token: status %d: %s, left %q", rec.Code, rec.Body, value)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferedPutsCannotReplaceGuardedEntries(t *testing.T) {
+	cache := NewShardedCache(1, 100, false)
+	cache.EnableWriteBuffer(16, time.Hour)
+	putWithACL(t, cache, "secret", "v1", "t0k3n")
+	writer := hashACLToken("t0k3n")
+
+	// The writer's put is not merged into the refused one that follows it
+	cache.PutBuffered(t.Context(), "secret", "v2", PutOptions{CheckACL: true, Reader: writer, Readers: []string{writer}})
+	cache.PutBuffered(t.Context(), "secret", "intruder", PutOptions{CheckACL: true})
+	cache.FlushWriteBuffers()
+	if value, _ := cache.Get("secret"); value != "v2" {
+		t.Errorf("secret = %q, want the writer's v2", value)
+	}
+}
+
+func TestBinaryProtocolCannotTouchGuardedEntries(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	putWithACL(t, cache, "secret", "v", "t0k3n")
+	client := startBinaryServer(t, cache)
+
+	var serverErr binproto.ServerError
+	if _, _, err := client.Get("secret"); !errors.As(err, &serverErr) {
+		t.Errorf("Get = %v, want a ServerError", err)
+	}
+	if err := client.Put("secret", "changed"); !errors.As(err, &serverErr) {
+		t.Errorf("Put = %v, want a ServerError", err)
+	}
+	if _, err := client.Delete("secret"); !errors.As(err, &serverErr) {
+		t.Errorf("Delete = %v, want a ServerError", err)
+	}
+	if value, _ := cache.Get("secret"); value != "v" {
+		t.Errorf("secret = %q after the binary requests", value)
+	}
+}
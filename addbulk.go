@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"unicode/utf8"
+)
+
+// maxBulkAddKeys is the default bound on how many keys one POST /add/bulk
+// may insert, and so how long it holds its shard locks (-max-bulk-add-keys).
+const maxBulkAddKeys = 1000
+
+var (
+	errKeysPresent   = errors.New("at least one key already exists")
+	errGroupTooLarge = fmt.Errorf("%w: a shard cannot hold all of its keys, nothing was added", ErrCapacityExhausted)
+)
+
+// AddBulkRequest structure for POST /add/bulk bodies
+type AddBulkRequest struct {
+	Pairs map[string]string `json:"pairs"`
+}
+
+// AddBulkResponse structure for POST /add/bulk replies
+type AddBulkResponse struct {
+	Status string `json:"status"`
+	Added  int    `json:"added"`
+}
+
+// PutAllIfAbsent inserts every pair if none of the keys is present, and
+// otherwise inserts nothing and returns errKeysPresent. The locks of all
+// shards involved are held together, taken in shard order like Rename's, so
+// the check and the writes are atomic across shards and concurrent callers
+// cannot deadlock. Each shard makes room for all of its keys before the first
+// is inserted, so the keys never evict one another; a shard whose keys do not
+// fit next to its pinned entries fails the call with errGroupTooLarge.
+func (sc *ShardedCache) PutAllIfAbsent(pairs map[string]string) error {
+	return sc.putAllIfAbsent(pairs, nil)
+}
+
+// putAllIfAbsent is PutAllIfAbsent with transforms naming the write
+// transforms that changed each value, kept with its entry.
+func (sc *ShardedCache) putAllIfAbsent(pairs map[string]string, transforms map[string][]string) error {
+	keys := slices.Collect(maps.Keys(pairs))
+	groups := sc.groupByShard(keys)
+	var locked []*LRUCache
+	for index, shardKeys := range groups {
+		if len(shardKeys) > 0 {
+			sc.shards[index].mutex.Lock()
+			locked = append(locked, sc.shards[index])
+		}
+	}
+	unlock := func() {
+		for _, shard := range locked {
+			shard.mutex.Unlock()
+		}
+	}
+
+	// Phase one: every key must be absent or no longer live, and every shard
+	// must be able to hold its keys.
+	now := sc.now()
+	for index, shardKeys := range groups {
+		shard := sc.shards[index]
+		if len(shardKeys) > shard.capacity-shard.pinned {
+			unlock()
+			return fmt.Errorf("%w: shard %d holds %d entries besides its %d pinned ones, but %d keys go to it",
+				errGroupTooLarge, index, shard.capacity-shard.pinned, shard.pinned, len(shardKeys))
+		}
+		for _, key := range shardKeys {
+			if elem, hit := shard.lookupLocked(key); hit && shard.live(elem.Value.(*entry), now) {
+				unlock()
+				return errKeysPresent
+			}
+		}
+	}
+
+	// Phase two: remove what is left of the keys, make room for all of them
+	// and insert them.
+	expired := make(map[*LRUCache][]*entry)
+	evicted := make(map[*LRUCache][]*entry)
+	items := make(map[string]Item, len(pairs))
+	for index, shardKeys := range groups {
+		shard := sc.shards[index]
+		for _, key := range shardKeys {
+			if elem, hit := shard.items[key]; hit {
+				expired[shard] = append(expired[shard], shard.removeElement(elem))
+			}
+		}
+		for shard.lenLocked()+len(shardKeys) > shard.capacity {
+			e := shard.evictOne()
+			if e == nil {
+				break // Only pinned entries are left, which phase one ruled out
+			}
+			evicted[shard] = append(evicted[shard], e)
+		}
+		for _, key := range shardKeys {
+			shard.putLocked(key, pairs[key], PutOptions{Transforms: transforms[key]}) // Never evicts: there is room
+			items[key] = shard.items[key].Value.(*entry).item()
+		}
+	}
+	unlock()
+
+	for shard, entries := range expired {
+		for _, e := range entries {
+			shard.notifyEvict(e, EvictionExpired)
+		}
+	}
+	for shard, entries := range evicted {
+		for _, e := range entries {
+			shard.notifyEvict(e, EvictionCapacity)
+		}
+	}
+	for key, item := range items {
+		sc.waiters.wake(key, item)
+	}
+	return nil
+}
+
+// HandleAddBulk handles POST /add/bulk: insert every pair, each value passed
+// through transforms, or none of them if a key is present.
+func HandleAddBulk(cache *ShardedCache, maxKeys int, transforms *TransformChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AddBulkRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Pairs) == 0 {
+			writeJSONError(w, "Pairs cannot be empty.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Pairs) > maxKeys {
+			writeCacheError(w, fmt.Errorf("%w: at most %d pairs may be added at once", errTooManyKeys, maxKeys))
+			return
+		}
+		pairs := make(map[string]string, len(req.Pairs))
+		changed := make(map[string][]string)
+		for key, value := range req.Pairs {
+			key = cache.trimKey(key)
+			if msg := validateKey(key); msg != "" {
+				writeJSONError(w, msg, http.StatusBadRequest)
+				return
+			}
+			if utf8.RuneCountInString(value) > MaxValueLength {
+				writeJSONError(w, fmt.Sprintf("Value of %q exceeds maximum length (%d characters).", key, MaxValueLength), http.StatusBadRequest)
+				return
+			}
+			value, names, err := transforms.Apply(key, value)
+			if err != nil {
+				writeCacheError(w, fmt.Errorf("value of %q %w", key, err))
+				return
+			}
+			pairs[key], changed[key] = value, names
+		}
+
+		err := cache.putAllIfAbsent(pairs, changed)
+		switch {
+		case errors.Is(err, errKeysPresent):
+			writeJSONError(w, "At least one key already exists, nothing was added.", http.StatusConflict)
+			return
+		case err != nil:
+			writeCacheError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(AddBulkResponse{
+			Status: "OK",
+			Added:  len(pairs),
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestPutAllIfAbsentKeysNeverEvictEachOther(t *testing.T) {
+	cache := NewShardedCache(1, 5, false)
+	if err := cache.SetEvictionPolicy(EvictionPolicyCostAware, 5); err != nil {
+		t.Fatal(err)
+	}
+	// Costlier than the group's keys, so cost-aware eviction would rather
+	// take a key of the group once one is among its candidates.
+	for i := range 3 {
+		cache.PutWithOptions("old:"+strconv.Itoa(i), "v", PutOptions{Cost: 50})
+	}
+
+	pairs := make(map[string]string)
+	for i := range 5 {
+		pairs["new:"+strconv.Itoa(i)] = "v"
+	}
+	if err := cache.PutAllIfAbsent(pairs); err != nil {
+		t.Fatalf("PutAllIfAbsent: %v", err)
+	}
+	for key := range pairs {
+		if !cache.Exists(key) {
+			t.Errorf("%s was evicted by its own group", key)
+		}
+	}
+}
+
+func TestPutAllIfAbsentRefusals(t *testing.T) {
+	cache := NewShardedCache(1, 4, false)
+	if err := cache.SetPinLimit(0.5); err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("pinned", "v")
+	if err := cache.Pin("pinned", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tooMany := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	if err := cache.PutAllIfAbsent(tooMany); !errors.Is(err, ErrCapacityExhausted) {
+		t.Errorf("PutAllIfAbsent of 4 keys beside a pinned one in a shard of 4 = %v, want ErrCapacityExhausted", err)
+	}
+	if cache.Exists("a") {
+		t.Error("a refused group was partly written")
+	}
+
+	if err := cache.PutAllIfAbsent(map[string]string{"a": "1", "pinned": "2"}); !errors.Is(err, errKeysPresent) {
+		t.Errorf("PutAllIfAbsent with a present key = %v, want errKeysPresent", err)
+	}
+	if cache.Exists("a") {
+		t.Error("a group with a present key was partly written")
+	}
+}
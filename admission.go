@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rejectionTrackerSize bounds how many distinct keys the tracker remembers.
+const rejectionTrackerSize = 1024
+
+// OversizedErrorResponse structure for 413 replies to repeated oversized PUTs
+type OversizedErrorResponse struct {
+	Status            string `json:"status"`
+	Message           string `json:"message"`
+	ObservedSize      int    `json:"observed_size"`
+	Limit             int    `json:"limit"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// RejectionReport describes one tracked key in GET /admin/rejections.
+type RejectionReport struct {
+	KeyHash   string    `json:"key_hash"` // fnv64a of the key, hex; keys themselves are not retained
+	Count     int       `json:"count"`
+	LastSize  int       `json:"last_size"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// RejectionsResponse structure for GET /admin/rejections replies
+type RejectionsResponse struct {
+	Status     string            `json:"status"`
+	Rejections []RejectionReport `json:"rejections"` // Most rejections first
+}
+
+// rejectionRecord counts oversized PUTs for one key within the current window.
+type rejectionRecord struct {
+	count     int
+	lastSize  int
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// RejectionTracker counts oversized-value rejections per key hash so clients
+// stuck retrying a doomed PUT can be told to stop and found by operators.
+// Counts expire after window and at most maxKeys hashes are kept.
+type RejectionTracker struct {
+	threshold int
+	window    time.Duration
+	maxKeys   int
+
+	mutex   sync.Mutex
+	records map[uint64]*rejectionRecord
+}
+
+// NewRejectionTracker creates a tracker that flags a key once it has been
+// rejected more than threshold times within window.
+func NewRejectionTracker(threshold int, window time.Duration, maxKeys int) *RejectionTracker {
+	return &RejectionTracker{
+		threshold: threshold,
+		window:    window,
+		maxKeys:   maxKeys,
+		records:   make(map[uint64]*rejectionRecord),
+	}
+}
+
+func hashKey64(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	return hasher.Sum64()
+}
+
+// Record counts a rejection of key with the measured value size. It reports
+// whether the key has now exceeded the threshold within the window, and if so
+// how long until its window resets.
+func (t *RejectionTracker) Record(key string, size int) (retryAfter time.Duration, repeated bool) {
+	now := time.Now()
+	hash := hashKey64(key)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rec, ok := t.records[hash]
+	if ok && now.Sub(rec.firstSeen) >= t.window {
+		ok = false // Window over, start counting again
+	}
+	if !ok {
+		if _, exists := t.records[hash]; !exists && len(t.records) >= t.maxKeys {
+			t.makeRoom(now)
+		}
+		rec = &rejectionRecord{firstSeen: now}
+		t.records[hash] = rec
+	}
+	rec.count++
+	rec.lastSize = size
+	rec.lastSeen = now
+
+	if rec.count <= t.threshold {
+		return 0, false
+	}
+	return rec.firstSeen.Add(t.window).Sub(now), true
+}
+
+// makeRoom drops expired records, or the least recently seen one if none have
+// expired. MUST be called with the mutex held.
+func (t *RejectionTracker) makeRoom(now time.Time) {
+	var oldestHash uint64
+	var oldest *rejectionRecord
+	for hash, rec := range t.records {
+		if now.Sub(rec.firstSeen) >= t.window {
+			delete(t.records, hash)
+			continue
+		}
+		if oldest == nil || rec.lastSeen.Before(oldest.lastSeen) {
+			oldestHash, oldest = hash, rec
+		}
+	}
+	if len(t.records) >= t.maxKeys && oldest != nil {
+		delete(t.records, oldestHash)
+	}
+}
+
+// Report lists the keys rejected within the current window, most first.
+func (t *RejectionTracker) Report() []RejectionReport {
+	now := time.Now()
+	t.mutex.Lock()
+	out := make([]RejectionReport, 0, len(t.records))
+	for hash, rec := range t.records {
+		if now.Sub(rec.firstSeen) >= t.window {
+			continue
+		}
+		out = append(out, RejectionReport{
+			KeyHash:   fmt.Sprintf("%016x", hash),
+			Count:     rec.count,
+			LastSize:  rec.lastSize,
+			FirstSeen: rec.firstSeen,
+			LastSeen:  rec.lastSeen,
+		})
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	return out
+}
+
+// writeOversizedError sends a 413 telling the client its value will never fit.
+func writeOversizedError(w http.ResponseWriter, verr *validationError, retryAfter time.Duration) {
+	seconds := max(int((retryAfter+time.Second-1)/time.Second), 1) // Round up
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(OversizedErrorResponse{
+		Status: "ERROR",
+		Message: fmt.Sprintf("%s Repeated attempts with a %d character value will keep failing; shrink the value instead of retrying.",
+			verr.Message, verr.Measured),
+		ObservedSize:      verr.Measured,
+		Limit:             verr.Limit,
+		RetryAfterSeconds: seconds,
+	})
+}
+
+func HandleRejections(tracker *RejectionTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(RejectionsResponse{
+			Status:     "OK",
+			Rejections: tracker.Report(),
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics alert rules can watch.
+const (
+	AlertHitRatio     = "hit_ratio"         // GET hits over hits and misses in the window
+	AlertEvictionRate = "evictions_per_sec" // Capacity evictions per second over the window
+	AlertMemoryBytes  = "memory_bytes"      // Memory in use by the runtime, at evaluation
+)
+
+// Alert rule states.
+const (
+	AlertOK     = "ok"
+	AlertFiring = "firing"
+)
+
+// Webhook delivery limits.
+const (
+	alertWebhookAttempts = 3 // Tries per notification, 1s and then 2s apart
+	alertWebhookTimeout  = 5 * time.Second
+	alertQueueSize       = 64 // Notifications waiting for delivery before new ones are dropped
+)
+
+// AlertRule is one threshold from -alert-rules, written as the metric, < or
+// >, the threshold and, for rates, "/" and the window they are measured
+// over: "hit_ratio<0.8/5m", "evictions_per_sec>100/1m", "memory_bytes>2e9".
+type AlertRule struct {
+	Spec      string
+	Metric    string
+	Below     bool // Fires when the value drops below Threshold, rather than above it
+	Threshold float64
+	Window    time.Duration // Zero for memory_bytes
+}
+
+// parseAlertRules parses the rules of -alert-rules.
+func parseAlertRules(specs []string) ([]AlertRule, error) {
+	rules := make([]AlertRule, 0, len(specs))
+	for _, spec := range specs {
+		rule := AlertRule{Spec: spec}
+		cut := strings.IndexAny(spec, "<>")
+		if cut < 0 {
+			return nil, fmt.Errorf("rule %q: expected metric<threshold or metric>threshold", spec)
+		}
+		rule.Metric, rule.Below = spec[:cut], spec[cut] == '<'
+		threshold, window, hasWindow := strings.Cut(spec[cut+1:], "/")
+		var err error
+		if rule.Threshold, err = strconv.ParseFloat(threshold, 64); err != nil {
+			return nil, fmt.Errorf("rule %q: invalid threshold %q", spec, threshold)
+		}
+		switch rule.Metric {
+		case AlertHitRatio, AlertEvictionRate:
+			if rule.Window, err = time.ParseDuration(window); !hasWindow || err != nil || rule.Window <= 0 {
+				return nil, fmt.Errorf("rule %q: %s needs a window, e.g. /5m", spec, rule.Metric)
+			}
+		case AlertMemoryBytes:
+			if hasWindow {
+				return nil, fmt.Errorf("rule %q: %s takes no window", spec, rule.Metric)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown metric %q, expected %s, %s or %s",
+				spec, rule.Metric, AlertHitRatio, AlertEvictionRate, AlertMemoryBytes)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// AlertRuleStatus is the state of one rule in GET /admin/alerts replies.
+type AlertRuleStatus struct {
+	Rule        string     `json:"rule"`
+	State       string     `json:"state"`
+	Value       *float64   `json:"value"`           // Last evaluated value; null until the window is covered, or with no GETs in it
+	Since       *time.Time `json:"since,omitempty"` // When the rule entered its state; unset while it has always been ok
+	EvaluatedAt *time.Time `json:"evaluated_at,omitempty"`
+}
+
+// AlertNotification is the body POSTed to the webhook when a rule starts
+// firing or resolves.
+type AlertNotification struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"` // "firing" or "resolved"
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	At        time.Time `json:"at"`
+}
+
+// AlertWebhookStats reports webhook deliveries in GET /admin/alerts replies.
+type AlertWebhookStats struct {
+	Delivered uint64 `json:"delivered"`
+	Failures  uint64 `json:"failures"` // Notifications given up on after every attempt failed
+	Dropped   uint64 `json:"dropped"`  // Notifications lost because the queue was full
+}
+
+// AlertsResponse structure for GET /admin/alerts replies
+type AlertsResponse struct {
+	Status     string             `json:"status"`
+	IntervalMs int64              `json:"interval_ms"`
+	Rules      []AlertRuleStatus  `json:"rules"`
+	Webhook    *AlertWebhookStats `json:"webhook,omitempty"` // Only present with -alert-webhook
+}
+
+// alertSample holds the cumulative counters at one evaluation.
+type alertSample struct {
+	at                      time.Time
+	hits, misses, evictions uint64
+}
+
+// AlertEngine evaluates alert rules on a ticker. A rule notifies only when
+// its state changes, from ok to firing or back, so a sustained breach is
+// reported once. Rules whose window is not yet covered, or whose hit ratio
+// has no GETs to go by, keep their state. Notifications are logged and, when
+// a webhook is configured, delivered in order by a single goroutine that
+// retries failures, so a slow or broken endpoint never holds up evaluation.
+type AlertEngine struct {
+	rules    []AlertRule
+	interval time.Duration
+	metrics  *Metrics
+	cache    *ShardedCache
+
+	history []alertSample // Oldest first; only touched by the evaluating goroutine
+	keep    time.Duration // How far back history must reach
+
+	mutex    sync.Mutex
+	statuses []AlertRuleStatus
+
+	webhook   string
+	client    *http.Client
+	queue     chan AlertNotification
+	delivered atomic.Uint64
+	failures  atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// NewAlertEngine creates an engine evaluating rules every interval and
+// posting notifications to webhook, unless it is empty.
+func NewAlertEngine(rules []AlertRule, interval time.Duration, webhook string, m *Metrics, cache *ShardedCache) (*AlertEngine, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("the evaluation interval must be positive")
+	}
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", webhook)
+		}
+	}
+	e := &AlertEngine{
+		rules:    rules,
+		interval: interval,
+		metrics:  m,
+		cache:    cache,
+		statuses: make([]AlertRuleStatus, len(rules)),
+		webhook:  webhook,
+	}
+	for i, rule := range rules {
+		e.statuses[i] = AlertRuleStatus{Rule: rule.Spec, State: AlertOK}
+		e.keep = max(e.keep, rule.Window)
+	}
+	if webhook != "" {
+		e.client = &http.Client{Timeout: alertWebhookTimeout}
+		e.queue = make(chan AlertNotification, alertQueueSize)
+	}
+	return e, nil
+}
+
+// Start evaluates the rules every interval in the background.
+func (e *AlertEngine) Start() {
+	if e.queue != nil {
+		e.cache.workers.Go("alert-webhook", e.deliver)
+	}
+	e.cache.workers.Go("alerts", func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.evaluate(time.Now())
+		}
+	})
+	log.Printf("Evaluating %d alert rules every %s", len(e.rules), e.interval)
+}
+
+// evaluate samples the counters, evaluates every rule and notifies about
+// rules that changed state.
+func (e *AlertEngine) evaluate(now time.Time) {
+	sample := alertSample{
+		at:     now,
+		hits:   e.metrics.requests[OpGet][OutcomeHit].Load(),
+		misses: e.metrics.requests[OpGet][OutcomeMiss].Load(),
+	}
+	for _, n := range e.cache.EvictionsByCost() {
+		sample.evictions += n
+	}
+	e.history = append(e.history, sample)
+	// Keep the newest sample at least keep old, which the longest window
+	// is measured from.
+	drop := 0
+	for drop+1 < len(e.history) && !e.history[drop+1].at.After(now.Add(-e.keep)) {
+		drop++
+	}
+	e.history = e.history[drop:]
+
+	var changed []AlertNotification
+	e.mutex.Lock()
+	for i, rule := range e.rules {
+		status := &e.statuses[i]
+		status.EvaluatedAt = &now
+		value, ok := e.value(rule, sample)
+		if !ok {
+			status.Value = nil
+			continue
+		}
+		status.Value = &value
+		breached := value > rule.Threshold
+		if rule.Below {
+			breached = value < rule.Threshold
+		}
+		if breached == (status.State == AlertFiring) {
+			continue
+		}
+		n := AlertNotification{Rule: rule.Spec, State: AlertFiring, Value: value, Threshold: rule.Threshold, At: now}
+		status.State = AlertFiring
+		if !breached {
+			n.State = "resolved"
+			status.State = AlertOK
+		}
+		status.Since = &now
+		changed = append(changed, n)
+	}
+	e.mutex.Unlock()
+
+	for _, n := range changed {
+		log.Printf("Alert %s: %s (value %g, threshold %g)", n.State, n.Rule, n.Value, n.Threshold)
+		if e.queue == nil {
+			continue
+		}
+		select {
+		case e.queue <- n:
+		default:
+			e.dropped.Add(1)
+			log.Printf("Warning: alert webhook queue full, dropping the %s notification of %s", n.State, n.Rule)
+		}
+	}
+}
+
+// value computes rule's metric at sample, and reports false when there is
+// not enough history or traffic to tell.
+func (e *AlertEngine) value(rule AlertRule, sample alertSample) (float64, bool) {
+	if rule.Metric == AlertMemoryBytes {
+		return float64(memoryInUse()), true
+	}
+	var base *alertSample
+	for i := len(e.history) - 1; i >= 0; i-- {
+		if !e.history[i].at.After(sample.at.Add(-rule.Window)) {
+			base = &e.history[i]
+			break
+		}
+	}
+	if base == nil {
+		return 0, false
+	}
+	switch rule.Metric {
+	case AlertHitRatio:
+		hits, misses := sample.hits-base.hits, sample.misses-base.misses
+		if hits+misses == 0 {
+			return 0, false
+		}
+		return float64(hits) / float64(hits+misses), true
+	default: // AlertEvictionRate
+		return float64(sample.evictions-base.evictions) / sample.at.Sub(base.at).Seconds(), true
+	}
+}
+
+// deliver posts queued notifications to the webhook, in order.
+func (e *AlertEngine) deliver() {
+	for n := range e.queue {
+		body, _ := json.Marshal(n)
+		var err error
+		for attempt := range alertWebhookAttempts {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = e.post(body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			e.failures.Add(1)
+			log.Printf("Warning: alert webhook gave up on the %s notification of %s after %d attempts: %v",
+				n.State, n.Rule, alertWebhookAttempts, err)
+			continue
+		}
+		e.delivered.Add(1)
+	}
+}
+
+// post sends one notification body and treats any non-2xx reply as a failure.
+func (e *AlertEngine) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+// Status returns the state of every rule and the webhook counters.
+func (e *AlertEngine) Status() AlertsResponse {
+	e.mutex.Lock()
+	rules := make([]AlertRuleStatus, len(e.statuses))
+	copy(rules, e.statuses)
+	e.mutex.Unlock()
+	resp := AlertsResponse{Status: "OK", IntervalMs: e.interval.Milliseconds(), Rules: rules}
+	if e.queue != nil {
+		resp.Webhook = &AlertWebhookStats{
+			Delivered: e.delivered.Load(),
+			Failures:  e.failures.Load(),
+			Dropped:   e.dropped.Load(),
+		}
+	}
+	return resp
+}
+
+// HandleAlerts handles GET /admin/alerts.
+func HandleAlerts(e *AlertEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(e.Status())
+	}
+}
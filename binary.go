@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"kv-go-cache/binproto"
+)
+
+// BinaryServer answers the binary protocol (see package binproto). Each
+// connection is served by its own goroutine; pipelined requests are answered
+// in order and flushed once no more are buffered.
+type BinaryServer struct {
+	cache       *ShardedCache
+	drainer     *Drainer
+	maintenance *Maintenance
+	writes      WritePolicy
+
+	mutex   sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	closing bool
+	serving sync.WaitGroup // Open connections
+}
+
+// NewBinaryServer creates a server for the cache that applies writes to PUTs
+// as /put does.
+func NewBinaryServer(cache *ShardedCache, drainer *Drainer, maintenance *Maintenance, writes WritePolicy) *BinaryServer {
+	return &BinaryServer{cache: cache, drainer: drainer, maintenance: maintenance, writes: writes, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on ln until it is closed.
+func (s *BinaryServer) Serve(ln net.Listener) {
+	s.mutex.Lock()
+	s.ln = ln
+	s.mutex.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Binary listener stopped: %v", err)
+			}
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// track registers an accepted connection, unless the server is shutting
+// down.
+func (s *BinaryServer) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.serving.Add(1)
+	return true
+}
+
+func (s *BinaryServer) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+	s.serving.Done()
+}
+
+// Shutdown stops accepting connections and ends the open ones once the
+// requests they have already read are answered: reads are cut short, so a
+// request still arriving is dropped unanswered. It returns ctx.Err(), after
+// closing the connections outright, if they do not finish in time.
+func (s *BinaryServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *BinaryServer) shuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closing
+}
+
+func (s *BinaryServer) serveConn(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	writer := s.writes.Fairness.writerFor("", conn.RemoteAddr().String()) // The protocol carries no token
+	for {
+		req, err := binproto.ReadRequest(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.shuttingDown() {
+				// The stream cannot be resynchronized after a bad frame.
+				binproto.WriteResponse(w, binaryError(err.Error()))
+				w.Flush()
+			}
+			return
+		}
+		if err := binproto.WriteResponse(w, s.handle(req, writer)); err != nil {
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle executes one request of writer (see FairnessGuard) with the same
+// validation as the HTTP API. PUTs go through the server's WritePolicy.
+func (s *BinaryServer) handle(req binproto.Request, writer uint16) binproto.Response {
+	cache := s.cache
+	if st := s.maintenance.state.Load(); st != nil {
+		return binaryError(st.message)
+	}
+	key := cache.NormalizeKey(string(req.Key))
+	if msg := validateKey(key); msg != "" {
+		return binaryError(msg)
+	}
+	if req.Op != binproto.OpGet {
+		if err := s.drainer.writesRefused(); err != nil {
+			return binaryError(errorMessage(err))
+		}
+	}
+	switch req.Op {
+	case binproto.OpGet:
+		item, found, err := cache.GetCtx(context.Background(), key, false)
+		switch {
+		case err != nil:
+			return binaryError(errorMessage(err))
+		case !found:
+			return binproto.Response{Status: binproto.StatusNotFound}
+		case !item.ReadableBy(""): // The protocol carries no token
+			return binaryError(errorMessage(forbidden(key)))
+		}
+		return binproto.Response{Status: binproto.StatusOK, Payload: []byte(item.Value)}
+	case binproto.OpPut:
+		if !utf8.Valid(req.Value) {
+			return binaryError("Value must be UTF-8 text.")
+		}
+		putReq := &PutRequest{Key: key, Value: string(req.Value)}
+		if verr := validatePut(key, putReq); verr != nil {
+			return binaryError(verr.Message)
+		}
+		// Without a token, entries with a read ACL are off limits
+		put, err := s.writes.prepare(key, putReq.Value, putReq.options(EncodingText), writer, "")
+		if err == nil {
+			_, err = cache.PutWithOptionsCtx(context.Background(), key, put.value, put.opts)
+		}
+		if err != nil {
+			return binaryError(errorMessage(err))
+		}
+		return binproto.Response{Status: binproto.StatusOK}
+	default: // binproto.OpDel
+		deleted, err := cache.DeleteAs(key, "")
+		if err != nil {
+			return binaryError(errorMessage(err))
+		}
+		if !deleted {
+			return binproto.Response{Status: binproto.StatusNotFound}
+		}
+		return binproto.Response{Status: binproto.StatusOK}
+	}
+}
+
+func binaryError(msg string) binproto.Response {
+	return binproto.Response{Status: binproto.StatusError, Payload: []byte(msg)}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"kv-go-cache/binproto"
+)
+
+// startBinaryServer serves cache on a loopback port and returns a client.
+func startBinaryServer(t *testing.T, cache *ShardedCache) *binproto.Client {
+	t.Helper()
+	return startBinaryServerWith(t, cache, WritePolicy{})
+}
+
+// startBinaryServerWith is startBinaryServer with PUTs going through writes.
+func startBinaryServerWith(t *testing.T, cache *ShardedCache, writes WritePolicy) *binproto.Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewBinaryServer(cache, NewDrainer(cache, time.Second, nil), NewMaintenance(cache.clock, "Down for maintenance."), writes)
+	go server.Serve(ln)
+	client, err := binproto.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return client
+}
+
+func TestBinaryProtocolRoundTrip(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	client := startBinaryServer(t, cache)
+
+	if err := client.Put("user:1", "Ada Lovelace ✓"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	value, found, err := client.Get("user:1")
+	if err != nil || !found || value != "Ada Lovelace ✓" {
+		t.Fatalf("Get = %q, %v, %v", value, found, err)
+	}
+	if stored, _ := cache.Get("user:1"); stored != value {
+		t.Errorf("the cache holds %q", stored)
+	}
+	if deleted, err := client.Delete("user:1"); err != nil || !deleted {
+		t.Fatalf("Delete = %v, %v", deleted, err)
+	}
+	if _, found, err := client.Get("user:1"); err != nil || found {
+		t.Errorf("Get after Delete = found %v, %v", found, err)
+	}
+	if deleted, err := client.Delete("user:1"); err != nil || deleted {
+		t.Errorf("second Delete = %v, %v", deleted, err)
+	}
+}
+
+func TestBinaryProtocolReportsErrors(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.PutWithOptions("frozen", "v", PutOptions{Immutable: true})
+	client := startBinaryServer(t, cache)
+
+	var serverErr binproto.ServerError
+	if err := client.Put("", "v"); !errors.As(err, &serverErr) {
+		t.Errorf("Put with an empty key = %v, want a ServerError", err)
+	}
+	if err := client.Put("frozen", "changed"); !errors.As(err, &serverErr) {
+		t.Errorf("Put over an immutable key = %v, want a ServerError", err)
+	}
+	// The connection stays usable after an error reply.
+	if value, found, err := client.Get("frozen"); err != nil || !found || value != "v" {
+		t.Errorf("Get after errors = %q, %v, %v", value, found, err)
+	}
+}
+
+func TestBinaryPutAppliesTheWritePolicy(t *testing.T) {
+	rules, err := parseTTLRules([]string{"session:*=1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewShardedCache(4, 100, false)
+	client := startBinaryServerWith(t, cache, WritePolicy{
+		TTL:        TTLPolicy{Max: 30 * time.Minute, Rules: rules},
+		Transforms: loadTestChain(t, "* trim", "secret: reject-pattern [0-9]"),
+	})
+
+	if err := client.Put("session:1", "  token  "); err != nil {
+		t.Fatal(err)
+	}
+	item, found := getItem(cache, "session:1")
+	if !found || item.Value != "token" || !slices.Equal(item.Transforms, []string{"trim"}) {
+		t.Errorf("stored %q with transforms %v, want %q trimmed", item.Value, item.Transforms, "token")
+	}
+	// The rule's hour is clamped to -max-ttl, as it is for /put.
+	if ttl := time.Duration(item.ExpiresAt - item.CreatedAt); ttl != 30*time.Minute {
+		t.Errorf("TTL = %v, want the 30m maximum", ttl)
+	}
+
+	var serverErr binproto.ServerError
+	if err := client.Put("secret:1", "pin 1234"); !errors.As(err, &serverErr) {
+		t.Errorf("Put refused by a transform = %v, want a ServerError", err)
+	}
+	if _, found := getItem(cache, "secret:1"); found {
+		t.Error("a value refused by a transform was stored")
+	}
+}
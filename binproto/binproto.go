@@ -0,0 +1,216 @@
+// Package binproto implements the cache's compact binary protocol, served on
+// the -listen-binary address, and a small client for it.
+//
+// A request frame is a one-byte opcode followed by the uvarint-prefixed key
+// and, for PUT only, the uvarint-prefixed value:
+//
+//	GET/DEL: [op][len(key)][key]
+//	PUT:     [op][len(key)][key][len(value)][value]
+//
+// Every request is answered, in order, by a response frame: a one-byte status
+// and a uvarint-prefixed payload holding the value of a GET hit or the message
+// of an error, and empty otherwise. Requests may be pipelined.
+package binproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Opcodes.
+const (
+	OpGet byte = 1
+	OpPut byte = 2
+	OpDel byte = 3
+)
+
+// Response statuses.
+const (
+	StatusOK       byte = 0
+	StatusNotFound byte = 1
+	StatusError    byte = 2
+)
+
+// MaxFieldSize bounds any key, value or payload on the wire, in bytes.
+const MaxFieldSize = 1 << 20
+
+// Request is one decoded request frame.
+type Request struct {
+	Op    byte
+	Key   []byte
+	Value []byte // PUT only
+}
+
+// Response is one decoded response frame.
+type Response struct {
+	Status  byte
+	Payload []byte
+}
+
+// ServerError is an error reported by the server in a StatusError frame.
+type ServerError string
+
+func (e ServerError) Error() string { return "kvcache: " + string(e) }
+
+// readField reads one uvarint-prefixed byte string.
+func readField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFieldSize {
+		return nil, fmt.Errorf("binproto: field of %d bytes exceeds %d", n, MaxFieldSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeField writes one uvarint-prefixed byte string.
+func writeField(w *bufio.Writer, b []byte) error {
+	var prefix [binary.MaxVarintLen64]byte
+	if _, err := w.Write(prefix[:binary.PutUvarint(prefix[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadRequest decodes the next request frame. It returns io.EOF when the
+// connection ends cleanly between frames.
+func ReadRequest(r *bufio.Reader) (Request, error) {
+	var req Request
+	op, err := r.ReadByte()
+	if err != nil {
+		return req, err
+	}
+	req.Op = op
+	if op != OpGet && op != OpPut && op != OpDel {
+		return req, fmt.Errorf("binproto: unknown opcode %d", op)
+	}
+	if req.Key, err = readField(r); err != nil {
+		return req, noEOF(err)
+	}
+	if op == OpPut {
+		if req.Value, err = readField(r); err != nil {
+			return req, noEOF(err)
+		}
+	}
+	return req, nil
+}
+
+// WriteRequest encodes req; the caller flushes w.
+func WriteRequest(w *bufio.Writer, req Request) error {
+	if err := w.WriteByte(req.Op); err != nil {
+		return err
+	}
+	if err := writeField(w, req.Key); err != nil {
+		return err
+	}
+	if req.Op == OpPut {
+		return writeField(w, req.Value)
+	}
+	return nil
+}
+
+// ReadResponse decodes the next response frame.
+func ReadResponse(r *bufio.Reader) (Response, error) {
+	var resp Response
+	status, err := r.ReadByte()
+	if err != nil {
+		return resp, err
+	}
+	resp.Status = status
+	resp.Payload, err = readField(r)
+	return resp, noEOF(err)
+}
+
+// WriteResponse encodes resp; the caller flushes w.
+func WriteResponse(w *bufio.Writer, resp Response) error {
+	if err := w.WriteByte(resp.Status); err != nil {
+		return err
+	}
+	return writeField(w, resp.Payload)
+}
+
+// noEOF turns an EOF inside a frame into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Client is a connection to a binary listener. It is safe for concurrent use;
+// calls are serialized over the one connection.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Dial connects to a binary listener at addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// do sends req and waits for its response.
+func (c *Client) do(req Request) (Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := WriteRequest(c.w, req); err != nil {
+		return Response{}, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return Response{}, err
+	}
+	resp, err := ReadResponse(c.r)
+	if err != nil {
+		return resp, err
+	}
+	if resp.Status == StatusError {
+		return resp, ServerError(resp.Payload)
+	}
+	return resp, nil
+}
+
+// Get returns the value of key and whether it was found.
+func (c *Client) Get(key string) (string, bool, error) {
+	resp, err := c.do(Request{Op: OpGet, Key: []byte(key)})
+	if err != nil {
+		return "", false, err
+	}
+	return string(resp.Payload), resp.Status == StatusOK, nil
+}
+
+// Put stores value under key.
+func (c *Client) Put(key, value string) error {
+	_, err := c.do(Request{Op: OpPut, Key: []byte(key), Value: []byte(value)})
+	return err
+}
+
+// Delete removes key and reports whether it was present.
+func (c *Client) Delete(key string) (bool, error) {
+	resp, err := c.do(Request{Op: OpDel, Key: []byte(key)})
+	if err != nil {
+		return false, err
+	}
+	return resp.Status == StatusOK, nil
+}
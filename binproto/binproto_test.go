@@ -0,0 +1,88 @@
+package binproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	requests := []Request{
+		{Op: OpGet, Key: []byte("user:1")},
+		{Op: OpPut, Key: []byte("user:1"), Value: []byte("Ada")},
+		{Op: OpPut, Key: []byte("empty"), Value: []byte{}},
+		{Op: OpPut, Key: []byte("big"), Value: bytes.Repeat([]byte("x"), 300)}, // Two-byte length prefix
+		{Op: OpDel, Key: []byte("user:1")},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, req := range requests {
+		if err := WriteRequest(w, req); err != nil {
+			t.Fatalf("WriteRequest(%+v): %v", req, err)
+		}
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&buf)
+	for _, want := range requests {
+		got, err := ReadRequest(r)
+		if err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		if got.Op != want.Op || !bytes.Equal(got.Key, want.Key) || !bytes.Equal(got.Value, want.Value) {
+			t.Errorf("ReadRequest = %+v, want %+v", got, want)
+		}
+	}
+	if _, err := ReadRequest(r); err != io.EOF {
+		t.Errorf("ReadRequest after the last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	responses := []Response{
+		{Status: StatusOK, Payload: []byte("Ada")},
+		{Status: StatusNotFound, Payload: []byte{}},
+		{Status: StatusError, Payload: []byte("Key cannot be empty.")},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, resp := range responses {
+		if err := WriteResponse(w, resp); err != nil {
+			t.Fatalf("WriteResponse: %v", err)
+		}
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&buf)
+	for _, want := range responses {
+		got, err := ReadResponse(r)
+		if err != nil {
+			t.Fatalf("ReadResponse: %v", err)
+		}
+		if got.Status != want.Status || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("ReadResponse = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestReadRequestRejectsMalformedFrames(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		want  string // Part of the error
+	}{
+		{"unknown opcode", []byte{9, 1, 'k'}, "unknown opcode 9"},
+		{"key cut short", []byte{OpGet, 5, 'k', 'e'}, io.ErrUnexpectedEOF.Error()},
+		{"value missing", []byte{OpPut, 1, 'k'}, io.ErrUnexpectedEOF.Error()},
+		{"oversized field", []byte{OpGet, 0x81, 0x80, 0x80, 0x01}, "exceeds"}, // 2MB + 1
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadRequest(bufio.NewReader(bytes.NewReader(tc.frame)))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("ReadRequest = %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
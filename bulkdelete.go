@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBulkDeleteKeys is the default bound on how many keys one POST
+// /bulk/delete may remove, and so how long it holds each shard lock
+// (-max-bulk-delete-keys).
+const maxBulkDeleteKeys = 1000
+
+// BulkDeleteRequest structure for POST /bulk/delete bodies
+type BulkDeleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// BulkDeleteResponse structure for POST /bulk/delete replies
+type BulkDeleteResponse struct {
+	Status    string   `json:"status"`
+	Deleted   int      `json:"deleted"`
+	Missing   []string `json:"missing"`             // Absent or expired keys, in request order
+	Forbidden []string `json:"forbidden,omitempty"` // Keys whose read ACL does not list the request's token
+}
+
+// DeleteMany removes keys on behalf of reader (see requestReader), taking
+// each shard's lock once for all of its keys. Keys that are absent or
+// expired are returned as missing, and keys holding an entry reader may not
+// delete as forbidden; both are in the order of keys and nothing is removed
+// for them. Keys must not repeat.
+func (sc *ShardedCache) DeleteMany(keys []string, reader string) (deleted int, missing, forbidden []string) {
+	type outcome int
+	const (
+		outcomeDeleted outcome = iota
+		outcomeMissing
+		outcomeForbidden
+	)
+	outcomes := make(map[string]outcome, len(keys))
+	now := sc.now()
+	for index, shardKeys := range sc.groupByShard(keys) {
+		if len(shardKeys) == 0 {
+			continue
+		}
+		shard := sc.shards[index]
+		var removed []*entry
+		var live []bool
+		shard.mutex.Lock()
+		for _, key := range shardKeys {
+			elem, hit := shard.lookupLocked(key)
+			if !hit {
+				outcomes[key] = outcomeMissing
+				continue
+			}
+			e := elem.Value.(*entry)
+			alive := shard.live(e, now)
+			if alive && !readableBy(e.readers, reader) {
+				outcomes[key] = outcomeForbidden
+				continue
+			}
+			if alive {
+				outcomes[key] = outcomeDeleted
+			} else {
+				outcomes[key] = outcomeMissing
+			}
+			removed = append(removed, shard.removeElement(elem))
+			live = append(live, alive)
+		}
+		shard.mutex.Unlock()
+
+		for i, e := range removed {
+			if live[i] {
+				shard.notifyEvict(e, EvictionDeleted)
+			} else {
+				shard.notifyEvict(e, EvictionExpired)
+			}
+		}
+		for _, key := range shardKeys {
+			sc.trace.record(traceDelete, key, 0, 0)
+		}
+	}
+
+	missing = []string{}
+	for _, key := range keys {
+		switch outcomes[key] {
+		case outcomeDeleted:
+			deleted++
+		case outcomeMissing:
+			missing = append(missing, key)
+		case outcomeForbidden:
+			forbidden = append(forbidden, key)
+		}
+	}
+	return deleted, missing, forbidden
+}
+
+// HandleBulkDelete handles POST /bulk/delete: remove up to maxKeys keys,
+// locking each shard once. Absent keys are not an error; the reply counts
+// the keys deleted and lists the missing ones. Keys holding an entry the
+// request's token may not delete are kept and reported as forbidden.
+func HandleBulkDelete(cache *ShardedCache, maxKeys int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BulkDeleteRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) == 0 {
+			writeJSONError(w, "Keys cannot be empty.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) > maxKeys {
+			writeCacheError(w, fmt.Errorf("%w: at most %d keys may be deleted at once", errTooManyKeys, maxKeys))
+			return
+		}
+		keys := make([]string, 0, len(req.Keys))
+		seen := make(map[string]bool, len(req.Keys))
+		for _, key := range req.Keys {
+			key = cache.trimKey(key)
+			if msg := validateKey(key); msg != "" {
+				writeJSONError(w, msg, http.StatusBadRequest)
+				return
+			}
+			if !seen[key] { // A repeated key is deleted, and reported, once
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		deleted, missing, forbidden := cache.DeleteMany(keys, requestReader(r))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(BulkDeleteResponse{
+			Status:    "OK",
+			Deleted:   deleted,
+			Missing:   missing,
+			Forbidden: forbidden,
+		})
+	}
+}
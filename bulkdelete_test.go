@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// bulkDelete sends keys to POST /bulk/delete, with token as the bearer
+// token if it is set, and decodes the reply.
+func bulkDelete(t *testing.T, cache *ShardedCache, token string, keys ...string) BulkDeleteResponse {
+	t.Helper()
+	body, _ := json.Marshal(BulkDeleteRequest{Keys: keys})
+	req := httptest.NewRequest(http.MethodPost, "/bulk/delete", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	HandleBulkDelete(cache, 100)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp BulkDeleteResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestBulkDeletePartialPresence(t *testing.T) {
+	cache, clock := newFakeClockCache(4, 100)
+	for _, key := range bulkKeys(10) {
+		cache.Put(key, "v")
+	}
+	cache.PutWithOptions("short", "v", PutOptions{TTL: time.Second})
+	clock.Advance(2 * time.Second)
+
+	resp := bulkDelete(t, cache, "", "key:7", "gone:1", "key:2", "short", " key:7 ", "gone:2", "key:4")
+	if resp.Deleted != 3 {
+		t.Errorf("deleted %d, want 3", resp.Deleted)
+	}
+	if want := []string{"gone:1", "short", "gone:2"}; !slices.Equal(resp.Missing, want) {
+		t.Errorf("missing = %v, want %v in request order", resp.Missing, want)
+	}
+	for _, key := range bulkKeys(10) {
+		deleted := key == "key:2" || key == "key:4" || key == "key:7"
+		if cache.Exists(key) == deleted {
+			t.Errorf("%s exists = %v after the delete", key, !deleted)
+		}
+	}
+	if cache.Len() != 7 {
+		t.Errorf("%d entries left, want 7 with the expired one removed", cache.Len())
+	}
+}
+
+func TestBulkDeleteNothingPresent(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.Put("kept", "v")
+	resp := bulkDelete(t, cache, "", "a", "b")
+	if resp.Deleted != 0 || !slices.Equal(resp.Missing, []string{"a", "b"}) || !cache.Exists("kept") {
+		t.Errorf("%+v", resp)
+	}
+}
+
+func TestBulkDeleteKeepsForbiddenKeys(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	putWithACL(t, cache, "private", "v", "t0k3n")
+	cache.Put("public", "v")
+
+	resp := bulkDelete(t, cache, "", "private", "public", "absent")
+	if resp.Deleted != 1 || !slices.Equal(resp.Missing, []string{"absent"}) || !slices.Equal(resp.Forbidden, []string{"private"}) {
+		t.Errorf("without a token: %+v", resp)
+	}
+	if !cache.Exists("private") {
+		t.Fatal("a forbidden key was deleted")
+	}
+	if resp := bulkDelete(t, cache, "t0k3n", "private"); resp.Deleted != 1 || len(resp.Forbidden) != 0 {
+		t.Errorf("with the token: %+v", resp)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControlRule grants responses for keys starting with prefix a max-age.
+type cacheControlRule struct {
+	prefix string
+	maxAge time.Duration
+}
+
+// CacheControlPolicy decides the caching headers GET responses carry for
+// intermediary proxies. A nil policy sets none.
+type CacheControlPolicy struct {
+	rules   []cacheControlRule // Longest prefix first
+	private []string           // Key prefixes that are never cacheable
+}
+
+// NewCacheControlPolicy parses rules of the form "prefix=duration,..." (an
+// empty prefix matches every key). It returns nil when there are no rules and
+// no private prefixes.
+func NewCacheControlPolicy(rules []string, private []string) (*CacheControlPolicy, error) {
+	if len(rules) == 0 && len(private) == 0 {
+		return nil, nil
+	}
+	p := &CacheControlPolicy{private: private}
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("rule %q is not prefix=duration", rule)
+		}
+		maxAge, err := time.ParseDuration(rule[i+1:])
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("rule %q has an invalid max-age", rule)
+		}
+		p.rules = append(p.rules, cacheControlRule{prefix: rule[:i], maxAge: maxAge})
+	}
+	sort.SliceStable(p.rules, func(i, j int) bool {
+		return len(p.rules[i].prefix) > len(p.rules[j].prefix)
+	})
+	return p, nil
+}
+
+// maxAge returns how long a response for item may be cached at now, or -1
+// if key is private, and false when no rule or private prefix covers key.
+// The max-age never exceeds the entry's remaining TTL, so a proxy cannot
+// outlive the entry.
+func (p *CacheControlPolicy) maxAge(key string, item Item, now int64) (time.Duration, bool) {
+	for _, prefix := range p.private {
+		if strings.HasPrefix(key, prefix) {
+			return -1, true
+		}
+	}
+	for _, rule := range p.rules {
+		if !strings.HasPrefix(key, rule.prefix) {
+			continue
+		}
+		maxAge := rule.maxAge
+		if item.ExpiresAt != 0 {
+			maxAge = max(min(maxAge, time.Duration(item.ExpiresAt-now)), 0)
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
+
+// setHeaders adds Cache-Control, Age and Expires to a GET reply for key at
+// now, the time of the cache's clock; found is false for a miss. Keys no rule
+// covers get no caching headers.
+func (p *CacheControlPolicy) setHeaders(w http.ResponseWriter, key string, item Item, found bool, now time.Time) {
+	if p == nil {
+		return
+	}
+	if !found {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	maxAge, covered := p.maxAge(key, item, now.UnixNano())
+	switch {
+	case !covered:
+		return
+	case maxAge < 0:
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	seconds := int64(maxAge / time.Second) // Round down, never past the TTL
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(seconds, 10))
+	w.Header().Set("Expires", now.Add(time.Duration(seconds)*time.Second).UTC().Format(http.TimeFormat))
+	if item.CreatedAt != 0 {
+		age := max(now.UnixNano()-item.CreatedAt, 0) / int64(time.Second)
+		w.Header().Set("Age", strconv.FormatInt(age, 10))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getWithPolicy sends a /get for key to cache under policy.
+func getWithPolicy(cache *ShardedCache, policy *CacheControlPolicy, key string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	HandleGet(cache, nil, policy)(rec, httptest.NewRequest(http.MethodGet, "/get?key="+key, nil))
+	return rec
+}
+
+func TestCacheControlNeverOutlivesTheEntry(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	policy, err := NewCacheControlPolicy([]string{"flags:=60s"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ttl  time.Duration
+		want string
+	}{
+		{0, "max-age=60"},                        // No TTL: the rule decides
+		{5 * time.Minute, "max-age=60"},          // TTL longer than the rule
+		{10 * time.Second, "max-age=10"},         // 10s left must never advertise 60
+		{10500 * time.Millisecond, "max-age=10"}, // Rounded down
+		{300 * time.Millisecond, "max-age=0"},
+	} {
+		cache.PutWithOptions("flags:web", "on", PutOptions{TTL: tc.ttl})
+		rec := getWithPolicy(cache, policy, "flags:web")
+		if got := rec.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("TTL %s: Cache-Control %q, want %q", tc.ttl, got, tc.want)
+		}
+	}
+
+	// The cap follows the entry as it ages
+	cache.PutWithOptions("flags:web", "on", PutOptions{TTL: 70 * time.Second})
+	clock.Advance(15 * time.Second)
+	rec := getWithPolicy(cache, policy, "flags:web")
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=55" {
+		t.Errorf("after 15s of a 70s TTL: Cache-Control %q, want max-age=55", got)
+	}
+	if got := rec.Header().Get("Age"); got != "15" {
+		t.Errorf("Age %q, want 15", got)
+	}
+	wantExpires := clock.Now().Add(55 * time.Second).UTC().Format(http.TimeFormat)
+	if got := rec.Header().Get("Expires"); got != wantExpires {
+		t.Errorf("Expires %q, want %q", got, wantExpires)
+	}
+}
+
+func TestCacheControlPrefixes(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	policy, err := NewCacheControlPolicy([]string{"=5s", "cdn:=1m", "cdn:images:=1h"}, []string{"cdn:private:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"cdn:images:logo", "cdn:css", "cdn:private:token", "other"} {
+		cache.Put(key, "v")
+	}
+	for key, want := range map[string]string{
+		"cdn:images:logo":   "max-age=3600", // Longest prefix wins
+		"cdn:css":           "max-age=60",
+		"cdn:private:token": "no-store",
+		"other":             "max-age=5", // The empty prefix matches every key
+		"missing":           "no-store",
+	} {
+		rec := getWithPolicy(cache, policy, key)
+		if got := rec.Header().Get("Cache-Control"); got != want {
+			t.Errorf("%s: Cache-Control %q, want %q", key, got, want)
+		}
+		if want == "no-store" && rec.Header().Get("Expires") != "" {
+			t.Errorf("%s: uncacheable reply carries Expires", key)
+		}
+	}
+}
+
+func TestCacheControlLeavesUncoveredKeysAlone(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	cache.Put("other", "v")
+	policy, _ := NewCacheControlPolicy([]string{"cdn:=1m"}, nil)
+	for _, policy := range []*CacheControlPolicy{policy, nil} {
+		rec := getWithPolicy(cache, policy, "other")
+		for _, header := range []string{"Cache-Control", "Expires", "Age"} {
+			if got := rec.Header().Get(header); got != "" {
+				t.Errorf("%s: %q on a key no rule covers", header, got)
+			}
+		}
+	}
+}
+
+func TestNewCacheControlPolicyRejectsBadRules(t *testing.T) {
+	for _, rule := range []string{"cdn:", "cdn:=soon", "cdn:=-1s"} {
+		if _, err := NewCacheControlPolicy([]string{rule}, nil); err == nil {
+			t.Errorf("rule %q accepted", rule)
+		}
+	}
+	if p, err := NewCacheControlPolicy(nil, nil); p != nil || err != nil {
+		t.Errorf("no rules: policy %v, error %v, want neither", p, err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+var errCaptureRunning = errors.New("another capture is still running")
+
+// Limits of POST /admin/capture.
+const (
+	maxCaptureSeconds    = 600
+	maxCaptureEvents     = 10000
+	defaultCaptureEvents = 100
+	captureBodyBytes     = 4096             // Request and response bodies are cut to this size
+	captureRetention     = 15 * time.Minute // How long a finished capture can still be read
+)
+
+// CaptureRequest structure for POST /admin/capture bodies
+type CaptureRequest struct {
+	KeyPrefix       string `json:"key_prefix"`
+	DurationSeconds int    `json:"duration_seconds"`
+	MaxEvents       int    `json:"max_events"`
+}
+
+// CaptureEvent is one recorded request touching a captured key.
+type CaptureEvent struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Keys      []string  `json:"keys"` // The keys that matched the prefix
+	Request   string    `json:"request"`
+	Status    int       `json:"status"`
+	Response  string    `json:"response"`
+	Truncated bool      `json:"truncated,omitempty"` // A body was cut to captureBodyBytes
+}
+
+// CaptureResponse structure for POST /admin/capture and GET
+// /admin/capture/{id} replies
+type CaptureResponse struct {
+	Status    string         `json:"status"`
+	ID        string         `json:"id"`
+	KeyPrefix string         `json:"key_prefix"`
+	Started   time.Time      `json:"started"`
+	Ends      time.Time      `json:"ends"`
+	Active    bool           `json:"active"`
+	MaxEvents int            `json:"max_events"`
+	Events    []CaptureEvent `json:"events"`
+}
+
+// capture is one time-boxed recording.
+type capture struct {
+	id        string
+	keyPrefix string
+	started   time.Time
+	ends      time.Time
+	maxEvents int
+
+	mutex  sync.Mutex
+	events []CaptureEvent
+}
+
+// Capturer records full request and response bodies of operations on keys
+// with a given prefix, for one capture at a time. While no capture runs, a
+// wrapped handler costs a single atomic load.
+//
+// All methods are safe to call on a nil *Capturer, which never records.
+type Capturer struct {
+	active atomic.Pointer[capture]
+
+	mutex    sync.Mutex
+	captures map[string]*capture // Running and recently finished, by id
+}
+
+// NewCapturer creates a capturer with no capture running.
+func NewCapturer() *Capturer {
+	return &Capturer{captures: make(map[string]*capture)}
+}
+
+// Start begins a capture unless one is already running.
+func (c *Capturer) Start(req CaptureRequest) (CaptureResponse, error) {
+	var id [8]byte
+	rand.Read(id[:])
+	now := time.Now()
+	capt := &capture{
+		id:        hex.EncodeToString(id[:]),
+		keyPrefix: req.KeyPrefix,
+		started:   now,
+		ends:      now.Add(time.Duration(req.DurationSeconds) * time.Second),
+		maxEvents: req.MaxEvents,
+	}
+	if !c.active.CompareAndSwap(nil, capt) {
+		return CaptureResponse{}, errCaptureRunning
+	}
+	c.mutex.Lock()
+	c.captures[capt.id] = capt
+	c.mutex.Unlock()
+
+	time.AfterFunc(capt.ends.Sub(now), func() { c.active.CompareAndSwap(capt, nil) })
+	time.AfterFunc(capt.ends.Sub(now)+captureRetention, func() {
+		c.mutex.Lock()
+		delete(c.captures, capt.id)
+		c.mutex.Unlock()
+	})
+	return capt.response(true), nil
+}
+
+// Get returns the capture with id, while it runs and for captureRetention
+// after it ends.
+func (c *Capturer) Get(id string) (CaptureResponse, bool) {
+	c.mutex.Lock()
+	capt, ok := c.captures[id]
+	c.mutex.Unlock()
+	if !ok {
+		return CaptureResponse{}, false
+	}
+	return capt.response(c.active.Load() == capt), true
+}
+
+// response copies the capture for a reply.
+func (capt *capture) response(active bool) CaptureResponse {
+	capt.mutex.Lock()
+	defer capt.mutex.Unlock()
+	return CaptureResponse{
+		Status:    "OK",
+		ID:        capt.id,
+		KeyPrefix: capt.keyPrefix,
+		Started:   capt.started,
+		Ends:      capt.ends,
+		Active:    active,
+		MaxEvents: capt.maxEvents,
+		Events:    append([]CaptureEvent{}, capt.events...),
+	}
+}
+
+// add records ev and reports whether the capture has room for more.
+func (capt *capture) add(ev CaptureEvent) bool {
+	capt.mutex.Lock()
+	defer capt.mutex.Unlock()
+	if len(capt.events) < capt.maxEvents {
+		capt.events = append(capt.events, ev)
+	}
+	return len(capt.events) < capt.maxEvents
+}
+
+// capturedKeys lists the keys a request names in its query or JSON body.
+func capturedKeys(r *http.Request, body []byte) []string {
+	var keys []string
+	queried, _ := queryKeys(r, nil, maxFallbackKeys) // As sent, apart from trimming
+	for _, key := range queried {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	var fields struct {
+		Key    string                     `json:"key"`
+		OldKey string                     `json:"old_key"`
+		NewKey string                     `json:"new_key"`
+		Keys   []string                   `json:"keys"`
+		Pairs  map[string]json.RawMessage `json:"pairs"`
+	}
+	json.Unmarshal(body, &fields) // Best effort; the handler reports bad bodies
+	for _, key := range []string{fields.Key, fields.OldKey, fields.NewKey} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, fields.Keys...)
+	for key := range fields.Pairs {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// clip cuts b to captureBodyBytes, on a rune boundary.
+func clip(b []byte) (string, bool) {
+	if len(b) <= captureBodyBytes {
+		return string(b), false
+	}
+	b = b[:captureBodyBytes]
+	for len(b) > 0 && !utf8.Valid(b) {
+		b = b[:len(b)-1]
+	}
+	return string(b), true
+}
+
+// Wrap records requests to next that touch a key matching the running
+// capture, if any.
+func (c *Capturer) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		capt := c.active.Load()
+		if capt == nil {
+			next(w, r)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, "Request body exceeds limit (1MB).", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var matched []string
+		for _, key := range capturedKeys(r, body) {
+			if strings.HasPrefix(strings.TrimSpace(key), capt.keyPrefix) {
+				matched = append(matched, key)
+			}
+		}
+		if len(matched) == 0 {
+			next(w, r)
+			return
+		}
+
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		ev := CaptureEvent{
+			Time:   time.Now(),
+			Method: r.Method,
+			URL:    r.URL.RequestURI(),
+			Keys:   matched,
+			Status: rec.status,
+		}
+		var cutRequest, cutResponse bool
+		ev.Request, cutRequest = clip(body)
+		ev.Response, cutResponse = clip(rec.body.Bytes())
+		ev.Truncated = cutRequest || cutResponse
+		if !capt.add(ev) {
+			c.active.CompareAndSwap(capt, nil) // Full, stop recording early
+		}
+	}
+}
+
+// requireAdminToken lets a request through only if it carries
+// "Authorization: Bearer <token>".
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, "Admin token required.", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleCaptureStart handles POST /admin/capture.
+func HandleCaptureStart(c *Capturer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CaptureRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		if req.KeyPrefix == "" {
+			writeJSONError(w, "Key prefix cannot be empty.", http.StatusBadRequest)
+			return
+		}
+		if req.DurationSeconds <= 0 || req.DurationSeconds > maxCaptureSeconds {
+			writeJSONError(w, fmt.Sprintf("Duration must be between 1 and %d seconds.", maxCaptureSeconds), http.StatusBadRequest)
+			return
+		}
+		if req.MaxEvents == 0 {
+			req.MaxEvents = defaultCaptureEvents
+		}
+		if req.MaxEvents < 0 || req.MaxEvents > maxCaptureEvents {
+			writeJSONError(w, fmt.Sprintf("Max events must be between 1 and %d.", maxCaptureEvents), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := c.Start(req)
+		if err != nil {
+			writeJSONError(w, fmt.Sprintf("Cannot start a capture: %v.", err), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// HandleCaptureGet handles GET /admin/capture/{id}.
+func HandleCaptureGet(c *Capturer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := c.Get(r.PathValue("id"))
+		if !ok {
+			writeJSONError(w, "Capture not found.", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// ClaimRequest structure for POST /claim bodies
+type ClaimRequest struct {
+	Keys       []string `json:"keys"`
+	Owner      string   `json:"owner"`
+	TTLSeconds int      `json:"ttl_seconds"`
+}
+
+// ClaimResponse structure for POST /claim replies
+type ClaimResponse struct {
+	Status  string            `json:"status"`
+	Claimed []string          `json:"claimed"` // Absent keys now holding the caller as owner
+	Held    map[string]string `json:"held"`    // Keys that were already present, with their value
+
+	Forbidden []string `json:"forbidden,omitempty"` // Present keys whose read ACL does not list the request's token
+}
+
+// ReleaseRequest structure for POST /release bodies
+type ReleaseRequest struct {
+	Keys  []string `json:"keys"`
+	Owner string   `json:"owner"`
+}
+
+// ReleaseResponse structure for POST /release replies
+type ReleaseResponse struct {
+	Status   string   `json:"status"`
+	Released []string `json:"released"`
+
+	Forbidden []string `json:"forbidden,omitempty"` // Present keys whose read ACL does not list the request's token
+}
+
+// Claim returns the current value of every present key that reader (see
+// requestReader) may read, lists the other present keys under denied without
+// their value and, for absent keys, stores owner with the given TTL. Each
+// shard is handled under a single lock acquisition, so two concurrent
+// claimers can never both claim the same key.
+func (sc *ShardedCache) Claim(keys []string, owner string, ttl time.Duration, reader string) (claimed []string, held map[string]string, denied []string) {
+	claimed = []string{}
+	held = make(map[string]string)
+	var items []Item // Claimed values, for waiters
+	for index, shardKeys := range sc.groupByShard(keys) {
+		if len(shardKeys) == 0 {
+			continue
+		}
+		shard := sc.shards[index]
+		var evicted, expired []*entry
+
+		shard.mutex.Lock()
+		for _, key := range shardKeys {
+			item, found, gone, _ := shard.getLocked(key, staleNever)
+			if gone != nil {
+				expired = append(expired, gone)
+			}
+			if found {
+				if item.ReadableBy(reader) {
+					held[key] = item.Value
+				} else {
+					denied = append(denied, key)
+				}
+				continue
+			}
+			if _, e := shard.putLocked(key, owner, PutOptions{TTL: ttl}); e != nil {
+				evicted = append(evicted, e)
+			}
+			claimed = append(claimed, key)
+			items = append(items, shard.items[key].Value.(*entry).item())
+		}
+		shard.mutex.Unlock()
+
+		for _, e := range expired {
+			shard.notifyEvict(e, EvictionExpired)
+		}
+		for _, e := range evicted {
+			shard.notifyEvict(e, EvictionCapacity)
+		}
+	}
+	for i, key := range claimed {
+		sc.waiters.wake(key, items[i])
+	}
+	return claimed, held, denied
+}
+
+// Release deletes each of keys whose current value is still owner and
+// returns the keys it deleted. Live entries reader (see requestReader) may
+// not read are listed under denied, whatever their value, and kept, so the
+// reply never tells whether an unreadable value equals owner.
+func (sc *ShardedCache) Release(keys []string, owner, reader string) (released, denied []string) {
+	released = []string{}
+	for index, shardKeys := range sc.groupByShard(keys) {
+		if len(shardKeys) == 0 {
+			continue
+		}
+		shard := sc.shards[index]
+		var removed []*entry
+		now := sc.now()
+
+		shard.mutex.Lock()
+		for _, key := range shardKeys {
+			elem, hit := shard.lookupLocked(key)
+			if !hit {
+				continue
+			}
+			ent := elem.Value.(*entry)
+			if !shard.live(ent, now) {
+				continue
+			}
+			if !readableBy(ent.readers, reader) {
+				denied = append(denied, key)
+			} else if ent.value == owner {
+				removed = append(removed, shard.removeElement(elem))
+				released = append(released, key)
+			}
+		}
+		shard.mutex.Unlock()
+
+		for _, e := range removed {
+			shard.notifyEvict(e, EvictionDeleted)
+		}
+	}
+	return released, denied
+}
+
+// decodeClaimKeys trims, validates and de-duplicates the keys of a claim or
+// release request, returning an error message on failure.
+func decodeClaimKeys(cache *ShardedCache, raw []string, owner string) ([]string, string) {
+	if len(raw) == 0 {
+		return nil, "Keys cannot be empty."
+	}
+	if owner == "" {
+		return nil, "Owner cannot be empty."
+	}
+	if utf8.RuneCountInString(owner) > MaxValueLength {
+		return nil, "Owner exceeds maximum value length."
+	}
+	seen := make(map[string]bool, len(raw))
+	keys := make([]string, 0, len(raw))
+	for _, key := range raw {
+		key = cache.trimKey(key)
+		if msg := validateKey(key); msg != "" {
+			return nil, msg
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, ""
+}
+
+// HandleClaim handles POST /claim. The TTL of claimed keys is clamped by the
+// bounds of ttl, as for PUT.
+func HandleClaim(cache *ShardedCache, ttl TTLPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ClaimRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		keys, msg := decodeClaimKeys(cache, req.Keys, req.Owner)
+		if msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if req.TTLSeconds <= 0 {
+			writeJSONError(w, "TTL must be positive.", http.StatusBadRequest)
+			return
+		}
+
+		lease, _ := ttl.Clamp(time.Duration(req.TTLSeconds) * time.Second)
+		claimed, held, denied := cache.Claim(keys, req.Owner, lease, requestReader(r))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ClaimResponse{
+			Status:    "OK",
+			Claimed:   claimed,
+			Held:      held,
+			Forbidden: denied,
+		})
+	}
+}
+
+func HandleRelease(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReleaseRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		keys, msg := decodeClaimKeys(cache, req.Keys, req.Owner)
+		if msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		released, denied := cache.Release(keys, req.Owner, requestReader(r))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ReleaseResponse{
+			Status:    "OK",
+			Released:  released,
+			Forbidden: denied,
+		})
+	}
+}
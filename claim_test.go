@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentClaimsClaimEachKeyOnce(t *testing.T) {
+	cache := NewShardedCache(4, 1000, false)
+	const workers, perWorker = 8, 16
+	claimedBy := make([][]string, workers)
+	heldBy := make([]map[string]string, workers)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range workers {
+		// Worker w asks for job:w to job:w+15, so neighbours overlap by 15 keys.
+		keys := make([]string, perWorker)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("job:%d", w+i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			claimedBy[w], heldBy[w], _ = cache.Claim(keys, fmt.Sprintf("worker-%d", w), time.Minute, "")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	owners := make(map[string]string)
+	for w := range workers {
+		for _, key := range claimedBy[w] {
+			if other, ok := owners[key]; ok {
+				t.Errorf("%s claimed by both %s and worker-%d", key, other, w)
+			}
+			owners[key] = fmt.Sprintf("worker-%d", w)
+		}
+	}
+	if want := workers + perWorker - 1; len(owners) != want {
+		t.Errorf("%d keys claimed, want all %d", len(owners), want)
+	}
+	for w := range workers {
+		if got := len(claimedBy[w]) + len(heldBy[w]); got != perWorker {
+			t.Errorf("worker-%d: %d keys claimed or held, want %d", w, got, perWorker)
+		}
+		for key, value := range heldBy[w] {
+			if value != owners[key] {
+				t.Errorf("worker-%d: %s held by %q, but %q claimed it", w, key, value, owners[key])
+			}
+		}
+	}
+}
+
+func TestClaimClampsTTLLikePut(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	handler := HandleClaim(cache, TTLPolicy{Min: time.Minute, Max: time.Hour})
+	for key, tc := range map[string]struct {
+		ttlSeconds int
+		want       time.Duration
+	}{
+		"short": {1, time.Minute},
+		"long":  {86400, time.Hour},
+		"fine":  {600, 10 * time.Minute},
+	} {
+		body := fmt.Sprintf(`{"keys": [%q], "owner": "worker-a", "ttl_seconds": %d}`, key, tc.ttlSeconds)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/claim", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", key, rec.Code, rec.Body)
+		}
+		item, found := getItem(cache, key)
+		if ttl := time.Duration(item.ExpiresAt - item.CreatedAt); !found || ttl != tc.want {
+			t.Errorf("%s: claimed for %v, want %v", key, ttl, tc.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// Clock is where the cache reads the time and gets its background tickers
+// from: entry expiry, recency, age caps, pressure windows and the sweepers all
+// go through it, so tests can move time forward instead of sleeping (see
+// testutil.FakeClock). It only uses standard types, so implementations need
+// not import this package.
+type Clock interface {
+	Now() time.Time
+	// NewTicker delivers the time on the returned channel every d, dropping
+	// ticks for slow receivers like time.Ticker, until stop is called.
+	NewTicker(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// realNow is the real clock's time in UnixNano, as the hot paths read it.
+func realNow() int64 { return time.Now().UnixNano() }
+
+// SetClock makes the cache and its shards read the time from clock. The
+// shards keep a plain function rather than the interface, and for the real
+// clock that function is time.Now itself, so lookups pay no interface call.
+// Must be called before the cache starts serving requests or any background
+// worker is started.
+func (sc *ShardedCache) SetClock(clock Clock) {
+	now := realNow
+	if _, real := clock.(realClock); !real {
+		now = func() int64 { return clock.Now().UnixNano() }
+	}
+	sc.clock, sc.now = clock, now
+	for _, shard := range sc.shards {
+		shard.now = now
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kv-go-cache/testutil"
+)
+
+var _ Clock = (*testutil.FakeClock)(nil)
+
+// newFakeClockCache returns a cache that reads the time from a fake clock.
+func newFakeClockCache(shards, capacity int) (*ShardedCache, *testutil.FakeClock) {
+	clock := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	cache := NewShardedCache(shards, capacity, false)
+	cache.SetClock(clock)
+	return cache, clock
+}
+
+func TestSnapshotterRunsOnClockTicks(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.Put("k", "v")
+	s := NewSnapshotter(cache, filepath.Join(t.TempDir(), "snapshot"), time.Hour)
+	s.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().LastAt == nil && time.Now().Before(deadline) {
+		clock.Advance(time.Hour)
+		time.Sleep(time.Millisecond)
+	}
+	stats := s.Stats()
+	if stats.LastAt == nil || stats.LastEntries != 1 {
+		t.Fatalf("no snapshot after the clock passed the interval: %+v", stats)
+	}
+	if start := time.Unix(1_700_000_000, 0); stats.LastAt.Before(start) || stats.LastAt.After(start.Add(24*time.Hour)) {
+		t.Errorf("last snapshot at %v, want a time of the fake clock", stats.LastAt)
+	}
+}
+
+func TestSweeperRunsOnClockTicks(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.Put("old", "v")
+	cache.SetMaxEntryAge(time.Minute)
+
+	// The sweeper registers its ticker once its goroutine runs, so keep
+	// advancing until a tick reaches it.
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Len() > 0 && time.Now().Before(deadline) {
+		clock.Advance(time.Minute)
+		time.Sleep(time.Millisecond)
+	}
+	if n := cache.Len(); n != 0 {
+		t.Errorf("%d entries left after the max-age sweeper ticked past their age", n)
+	}
+}
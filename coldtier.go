@@ -0,0 +1,378 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// coldRecordHeader is the size of the key/value length prefix of an arena record.
+	coldRecordHeader = 8
+	// coldDemoteBatch bounds how many entries are demoted per shard lock hold.
+	coldDemoteBatch = 512
+	// coldCompactMinBytes is the arena size below which compaction is not worth it.
+	coldCompactMinBytes = 64 * 1024
+)
+
+// coldRef locates a cold entry in the arena and keeps the entry metadata that
+// is not stored in the record itself.
+type coldRef struct {
+	off        int
+	createdAt  int64
+	accessedAt int64
+	expiresAt  int64
+	ttl        time.Duration
+	reads      uint64
+	version    uint64
+	generation uint64
+	cost       int
+	encoding   Encoding
+	writer     uint16
+}
+
+// coldTier holds a shard's idle entries outside the list/map representation:
+// keys and values are copied into one append-only byte arena, in demotion
+// order, and indexed by key hash. Neither the arena nor the index contains
+// pointers, so the garbage collector does not have to scan them, which is the
+// point for shards whose tails hold millions of small strings nobody reads.
+//
+// Records are [key length][value length][key][value]. Removed records become
+// dead bytes until compact copies the live ones into a fresh arena. Cold
+// entries are always older than every hot entry of the shard, so the oldest
+// live record is the next eviction victim.
+//
+// A coldTier is owned by a shard and guarded by the shard mutex. A nil
+// *coldTier is an empty, disabled tier.
+type coldTier struct {
+	arena []byte
+	head  int                // Offset of the oldest record that may still be live
+	index map[uint64]coldRef // fnv64a(key) -> record
+	dead  int                // Bytes of removed records still in the arena
+}
+
+func newColdTier() *coldTier {
+	return &coldTier{index: make(map[uint64]coldRef)}
+}
+
+// len returns the number of cold entries.
+func (t *coldTier) len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.index)
+}
+
+// record returns the key and value stored at off and the record's size.
+func (t *coldTier) record(off int) (key, value []byte, size int) {
+	klen := int(binary.LittleEndian.Uint32(t.arena[off:]))
+	vlen := int(binary.LittleEndian.Uint32(t.arena[off+4:]))
+	start := off + coldRecordHeader
+	return t.arena[start : start+klen], t.arena[start+klen : start+klen+vlen], coldRecordHeader + klen + vlen
+}
+
+// find looks key up, verifying the stored key so hash collisions never match.
+func (t *coldTier) find(key string) (coldRef, uint64, bool) {
+	if t == nil || len(t.index) == 0 {
+		return coldRef{}, 0, false
+	}
+	h := hashKey64(key)
+	ref, ok := t.index[h]
+	if !ok {
+		return coldRef{}, 0, false
+	}
+	if stored, _, _ := t.record(ref.off); string(stored) != key {
+		return coldRef{}, 0, false
+	}
+	return ref, h, true
+}
+
+// add copies e into the arena and reports whether it did. Entries with a
+// refresh source, a stale window or a sliding expiry of their own stay hot, as
+// do locks, pinned and immutable entries, entries with a read ACL or applied
+// write transforms, which coldRef has no pointer-free place for, and any key
+// whose hash is already taken.
+func (t *coldTier) add(e *entry) bool {
+	if e.refresh != nil || e.fence != 0 || e.pinned || e.immutable || e.readers != nil || e.transforms != nil || e.staleFor != 0 || e.idleTTL != 0 {
+		return false
+	}
+	h := hashKey64(e.key)
+	if _, taken := t.index[h]; taken {
+		return false
+	}
+	off := len(t.arena)
+	t.arena = binary.LittleEndian.AppendUint32(t.arena, uint32(len(e.key)))
+	t.arena = binary.LittleEndian.AppendUint32(t.arena, uint32(len(e.value)))
+	t.arena = append(t.arena, e.key...)
+	t.arena = append(t.arena, e.value...)
+	t.index[h] = coldRef{off: off, createdAt: e.createdAt, accessedAt: e.accessedAt, expiresAt: e.expiresAt, ttl: e.ttl, reads: e.reads.Load(), version: e.version, generation: e.generation, cost: e.cost, encoding: e.encoding, writer: e.writer}
+	return true
+}
+
+// entryAt rebuilds the entry stored under ref.
+func (t *coldTier) entryAt(ref coldRef) *entry {
+	key, value, _ := t.record(ref.off)
+	e := &entry{
+		key:        string(key),
+		value:      string(value),
+		createdAt:  ref.createdAt,
+		accessedAt: ref.accessedAt,
+		cost:       ref.cost,
+		expiresAt:  ref.expiresAt,
+		ttl:        ref.ttl,
+		version:    ref.version,
+		generation: ref.generation,
+		encoding:   ref.encoding,
+		writer:     ref.writer,
+	}
+	e.reads.Store(ref.reads)
+	return e
+}
+
+// drop removes the record of hash h from the index and counts its bytes dead.
+func (t *coldTier) drop(h uint64, ref coldRef) {
+	_, _, size := t.record(ref.off)
+	delete(t.index, h)
+	t.dead += size
+}
+
+// take removes key from the tier and returns its entry, or nil if key is not cold.
+func (t *coldTier) take(key string) *entry {
+	ref, h, ok := t.find(key)
+	if !ok {
+		return nil
+	}
+	e := t.entryAt(ref)
+	t.drop(h, ref)
+	return e
+}
+
+// takeOldest removes and returns the least recently demoted entry, or nil if
+// the tier is empty.
+func (t *coldTier) takeOldest() *entry {
+	return t.takeOldestBefore(math.MaxInt64)
+}
+
+// takeOldestBefore removes and returns the least recently demoted entry if
+// it was last used before cutoff (UnixNano), and otherwise returns nil.
+func (t *coldTier) takeOldestBefore(cutoff int64) *entry {
+	for t.len() > 0 && t.head < len(t.arena) {
+		key, _, size := t.record(t.head)
+		h := hashKey64(string(key))
+		if ref, ok := t.index[h]; ok && ref.off == t.head {
+			if ref.accessedAt >= cutoff {
+				return nil
+			}
+			e := t.entryAt(ref)
+			t.drop(h, ref)
+			t.head += size
+			return e
+		}
+		t.head += size // Already removed
+	}
+	return nil
+}
+
+// cheapest returns the lowest-cost of the n least recently demoted entries,
+// the oldest on ties, with the hash it is indexed under and the number of
+// entries compared, which is 0 when the tier is empty.
+func (t *coldTier) cheapest(n int) (coldRef, uint64, int) {
+	var best coldRef
+	var bestHash uint64
+	seen := 0
+	if t.len() == 0 {
+		return best, bestHash, 0
+	}
+	for off := t.head; off < len(t.arena) && seen < n; {
+		key, _, size := t.record(off)
+		h := hashKey64(string(key))
+		if ref, ok := t.index[h]; ok && ref.off == off {
+			if seen == 0 || ref.cost < best.cost {
+				best, bestHash = ref, h
+			}
+			seen++
+		}
+		off += size
+	}
+	return best, bestHash, seen
+}
+
+// each calls fn with a copy of every cold entry, oldest first.
+func (t *coldTier) each(fn func(e *entry)) {
+	t.walk(func(e *entry) bool {
+		fn(e)
+		return true
+	})
+}
+
+// walk calls fn with a copy of each cold entry, oldest first, until fn
+// returns false.
+func (t *coldTier) walk(fn func(e *entry) bool) {
+	if t.len() == 0 {
+		return
+	}
+	for off := t.head; off < len(t.arena); {
+		key, _, size := t.record(off)
+		if ref, ok := t.index[hashKey64(string(key))]; ok && ref.off == off {
+			if !fn(t.entryAt(ref)) {
+				return
+			}
+		}
+		off += size
+	}
+}
+
+// compact copies the live records into a fresh arena once at least half of
+// the current one is dead, and reports the number of bytes reclaimed.
+func (t *coldTier) compact() int {
+	if len(t.arena) < coldCompactMinBytes || t.dead < len(t.arena)/2 {
+		return 0
+	}
+	before := len(t.arena)
+	arena := make([]byte, 0, len(t.arena)-t.dead)
+	for off := t.head; off < len(t.arena); {
+		key, _, size := t.record(off)
+		h := hashKey64(string(key))
+		if ref, ok := t.index[h]; ok && ref.off == off {
+			ref.off = len(arena)
+			t.index[h] = ref
+			arena = append(arena, t.arena[off:off+size]...)
+		}
+		off += size
+	}
+	t.arena, t.head, t.dead = arena, 0, 0
+	return before - len(arena)
+}
+
+// lookupLocked returns the list element for key, rehydrating the entry from
+// the cold tier if that is where it lives. A rehydrated entry goes to the back
+// of the list; callers that count the lookup as a use move it to the front.
+// MUST be called with the mutex held.
+func (c *LRUCache) lookupLocked(key string) (*list.Element, bool) {
+	if elem, hit := c.items[key]; hit {
+		return elem, true
+	}
+	if e := c.cold.take(key); e != nil {
+		elem := c.evictList.PushBack(e) // Still in the key directory, no need to re-add
+		c.items[key] = elem
+		return elem, true
+	}
+	return nil, false
+}
+
+// forgetCold removes an entry taken out of the cold tier for good from the
+// key directory, the value index and the writer counts, and returns it.
+// MUST be called with the mutex held.
+func (c *LRUCache) forgetCold(e *entry) *entry {
+	c.directory.remove(e.key)
+	c.valueIndex.remove(e.key)
+	c.countWriter(e, -1)
+	return e
+}
+
+// touch marks elem as the most recently used entry.
+// MUST be called with the mutex held.
+func (c *LRUCache) touch(elem *list.Element) {
+	c.evictList.MoveToFront(elem)
+	if c.trackAccess {
+		elem.Value.(*entry).accessedAt = c.now()
+	}
+}
+
+// lenLocked counts hot and cold entries. MUST be called with the mutex held.
+func (c *LRUCache) lenLocked() int {
+	return c.evictList.Len() + c.cold.len()
+}
+
+// demoteIdle moves entries last used before cutoff (UnixNano) from the tail
+// of the LRU list into the cold tier, then compacts the arena if enough of it
+// is dead. It returns the number of entries demoted.
+func (c *LRUCache) demoteIdle(cutoff int64) int {
+	demoted := 0
+	for {
+		c.mutex.Lock()
+		batch := 0
+		elem := c.evictList.Back()
+		for n := 0; elem != nil && n < coldDemoteBatch; n++ {
+			ent := elem.Value.(*entry)
+			if ent.accessedAt >= cutoff {
+				elem = nil // Everything in front of this is more recent
+				break
+			}
+			prev := elem.Prev()
+			if c.cold.add(ent) {
+				c.evictList.Remove(elem)
+				delete(c.items, ent.key)
+				batch++
+			}
+			elem = prev
+		}
+		// Stop when the idle tail is done, or when a whole batch consisted of
+		// entries that must stay hot (they would be rescanned forever).
+		done := elem == nil || batch == 0
+		if done {
+			c.cold.compact()
+		}
+		c.mutex.Unlock()
+		demoted += batch
+		if done {
+			return demoted
+		}
+	}
+}
+
+// ColdTierStats reports cold tier usage in /stats.
+type ColdTierStats struct {
+	AfterMs    int64 `json:"after_ms"`
+	Items      int   `json:"items"`
+	ArenaBytes int   `json:"arena_bytes"`
+	DeadBytes  int   `json:"dead_bytes"`
+}
+
+// EnableColdTier moves entries that have not been used for after into each
+// shard's cold tier, checking every after/2. Reads and writes of cold keys
+// behave exactly as for hot ones. Must be called before the cache starts
+// serving requests.
+func (sc *ShardedCache) EnableColdTier(after time.Duration) {
+	if after <= 0 {
+		return
+	}
+	now := sc.now()
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		shard.cold = newColdTier()
+		shard.startTrackingAccess(now)
+		shard.mutex.Unlock()
+	}
+	sc.coldAfter = after
+	sc.workers.Go("cold-tier", func() {
+		ticks, stop := sc.clock.NewTicker(max(after/2, time.Second))
+		defer stop()
+		for range ticks {
+			cutoff := sc.now() - int64(after)
+			for _, shard := range sc.shards {
+				shard.demoteIdle(cutoff)
+			}
+		}
+	})
+	log.Printf("Cold tier enabled for entries idle longer than %s", after)
+}
+
+// ColdTierStats sums cold tier usage over all shards, or returns nil when the
+// tier is disabled.
+func (sc *ShardedCache) ColdTierStats() *ColdTierStats {
+	if sc.coldAfter <= 0 {
+		return nil
+	}
+	stats := &ColdTierStats{AfterMs: sc.coldAfter.Milliseconds()}
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		stats.Items += shard.cold.len()
+		stats.ArenaBytes += len(shard.cold.arena)
+		stats.DeadBytes += shard.cold.dead
+		shard.mutex.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// demoteAll moves every idle entry of cache into its cold tier.
+func demoteAll(cache *ShardedCache) int {
+	n := 0
+	for _, shard := range cache.shards {
+		n += shard.demoteIdle(cache.now() + int64(time.Second))
+	}
+	return n
+}
+
+func TestColdTierKeepsEntryMetadata(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	cache.EnableColdTier(time.Hour)
+	cache.EnableReadCounting()
+	cache.PutWithOptions("ttl", "v", PutOptions{TTL: time.Hour})
+	cache.PutWithOptions("transformed", "v", PutOptions{Transforms: []string{"trim"}})
+	cache.GetCtx(t.Context(), "ttl", false)
+	cache.GetCtx(t.Context(), "ttl", false)
+
+	if n := demoteAll(cache); n != 1 {
+		t.Fatalf("demoted %d entries, want 1 (transformed entries stay hot)", n)
+	}
+	shard := cache.shards[0]
+	shard.mutex.Lock()
+	ref, _, cold := shard.cold.find("ttl")
+	_, _, transformedCold := shard.cold.find("transformed")
+	elem, _ := shard.lookupLocked("ttl")
+	ent := elem.Value.(*entry)
+	ttl, reads := ent.ttl, ent.reads.Load()
+	shard.mutex.Unlock()
+
+	if !cold || ref.ttl != time.Hour {
+		t.Errorf("cold ref of ttl = %+v (found %v), want its 1h TTL kept", ref, cold)
+	}
+	if transformedCold {
+		t.Error("entry with transforms was moved to the cold tier")
+	}
+	if ttl != time.Hour || reads != 2 {
+		t.Errorf("rehydrated entry has ttl %v and %d reads, want 1h and 2", ttl, reads)
+	}
+	if item, found, _ := cache.GetCtx(t.Context(), "transformed", false); !found || !slices.Equal(item.Transforms, []string{"trim"}) {
+		t.Errorf("GET transformed = %+v, %v; want its transforms", item, found)
+	}
+}
+
+func TestCostAwareEvictionComparesColdAndHot(t *testing.T) {
+	cache := NewShardedCache(1, 4, false)
+	if err := cache.SetEvictionPolicy(EvictionPolicyCostAware, 4); err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableColdTier(time.Hour)
+	cache.PutWithOptions("cold:costly", "v", PutOptions{Cost: 90})
+	cache.PutWithOptions("cold:mid", "v", PutOptions{Cost: 50})
+	if n := demoteAll(cache); n != 2 {
+		t.Fatalf("demoted %d entries, want 2", n)
+	}
+	cache.PutWithOptions("hot:cheap", "v", PutOptions{Cost: 1})
+	cache.PutWithOptions("hot:mid", "v", PutOptions{Cost: 50})
+
+	cache.PutWithOptions("new", "v", PutOptions{Cost: 50})
+	if cache.Exists("hot:cheap") {
+		t.Error("the cheapest candidate, a hot entry, survived")
+	}
+	for _, key := range []string{"cold:costly", "cold:mid", "hot:mid", "new"} {
+		if !cache.Exists(key) {
+			t.Errorf("%s was evicted instead of hot:cheap", key)
+		}
+	}
+
+	// On ties, the cold entry is older and goes first.
+	cache.PutWithOptions("newer", "v", PutOptions{Cost: 50})
+	if cache.Exists("cold:mid") {
+		t.Error("cold:mid survived a tie with newer hot entries")
+	}
+}
+
+// BenchmarkGCLongTail measures a full collection with a million small,
+// long-lived entries, all hot or all in the cold tier, as a long-tail
+// workload leaves them.
+func BenchmarkGCLongTail(b *testing.B) {
+	for _, cold := range []bool{false, true} {
+		name := "hot"
+		if cold {
+			name = "cold"
+		}
+		b.Run(name, func(b *testing.B) {
+			cache := NewShardedCache(64, 16384, false)
+			if cold {
+				cache.EnableColdTier(time.Hour)
+			}
+			for i := range 64 * 16384 {
+				cache.Put("key:"+strconv.Itoa(i), "value:"+strconv.Itoa(i))
+			}
+			if cold {
+				demoteAll(cache)
+			}
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for range b.N {
+				runtime.GC()
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "pause-ns/op")
+			runtime.KeepAlive(cache)
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime options that can be set from the command line.
+type Config struct {
+	// ListenAddrs must all bind or startup fails. OptionalListenAddrs are bound
+	// when possible and skipped with a log line otherwise.
+	ListenAddrs         []string
+	OptionalListenAddrs []string
+
+	// BinaryListenAddr serves the binary protocol (package binproto) in
+	// addition to HTTP. Empty disables it.
+	BinaryListenAddr string
+
+	// ShardHash is the hash keys are sharded by: "fnv32a" or "fnv64a".
+	// ShardSalt mixes a random per-process salt into it.
+	ShardHash string
+	ShardSalt bool
+
+	// KeyNormalization brings every key to a Unicode normalization form
+	// before it is stored or looked up: "nfc", or empty to keep keys as sent.
+	KeyNormalization string
+
+	// ReadSnapshotInterval enables weakly consistent GETs served from a lock-free
+	// per-shard snapshot rebuilt at this interval. Zero keeps reads fully consistent.
+	ReadSnapshotInterval time.Duration
+
+	// ShardLockTimeout bounds how long GET /get and PUT /put wait for a busy
+	// shard before failing with 503. Zero waits as long as the request lives.
+	ShardLockTimeout time.Duration
+
+	// WriteBufferSize stages up to this many PUTs per shard, applied in
+	// batches every WriteBufferInterval. Zero applies every PUT at once.
+	WriteBufferSize     int
+	WriteBufferInterval time.Duration
+
+	// EvictionLogSize is how many recent removals GET /debug/evictions keeps.
+	// Zero disables the log and the endpoint.
+	EvictionLogSize int
+
+	// EvictionPolicy is "lru" or "cost-aware"; EvictionCandidates is how many of
+	// the least recently used entries cost-aware eviction compares.
+	EvictionPolicy     string
+	EvictionCandidates int
+
+	// KeyDirectory maintains a global key -> shard index for lock-free
+	// existence checks and key counts.
+	KeyDirectory bool
+
+	// TouchOnWrite makes updates of existing keys refresh their LRU position.
+	TouchOnWrite bool
+
+	// SkipUnchangedPuts leaves entries alone when a PUT would store the
+	// value they already hold with a TTL within UnchangedTTLTolerance of
+	// theirs, so their version is not bumped.
+	SkipUnchangedPuts     bool
+	UnchangedTTLTolerance time.Duration
+
+	// LazyShards starts every shard's key map empty instead of sized for a
+	// full shard, lowering baseline memory at the cost of map growth later.
+	LazyShards bool
+
+	// AllowValueCapture permits POST /admin/capture to record raw keys and
+	// values; it requires AdminToken, which the capture endpoints check.
+	AllowValueCapture bool
+	AdminToken        string
+
+	// IdempotencyMaxKeys and IdempotencyTTL bound the replies kept for writes
+	// sent with an Idempotency-Key header. 0 keys disables the header.
+	IdempotencyMaxKeys int
+	IdempotencyTTL     time.Duration
+
+	// StaleWindow is how long past their TTL entries stay readable with
+	// GET ?stale=allow; entries stored with swr_seconds use their own window.
+	StaleWindow time.Duration
+
+	// PinMaxFraction is the share of each shard's capacity that may be pinned.
+	PinMaxFraction float64
+
+	// ImmutablePrefixes lists key prefixes whose entries refuse overwrites,
+	// as if written with "immutable": true.
+	ImmutablePrefixes []string
+
+	// FetchAllowedHosts lists the origin hosts (host or host:port) POST /fetch
+	// may contact. Empty disables the endpoint.
+	FetchAllowedHosts []string
+
+	// RefreshAheadWorkers re-fetch /fetch entries flagged refresh_ahead when
+	// they are read within the last RefreshAheadFraction of their TTL.
+	RefreshAheadWorkers  int
+	RefreshAheadFraction float64
+
+	// RejectionThreshold is how many oversized PUTs of one key are answered
+	// with 400 within RejectionWindow before switching to 413. Zero disables
+	// the tracking and GET /admin/rejections.
+	RejectionThreshold int
+	RejectionWindow    time.Duration
+
+	// Pressure holds the eviction pressure levels behind X-Cache-Pressure and
+	// the write throttling applied under high pressure.
+	Pressure PressurePolicy
+
+	// TTL clamps the TTLs requested on PUT; zero bounds are disabled.
+	// TTLRules ("pattern=ttl") give PUTs without a TTL a default by key.
+	TTL      TTLPolicy
+	TTLRules []string
+
+	// WriteTransforms names a file of transforms applied to PUT values
+	// before they are stored (see LoadTransformChain).
+	WriteTransforms string
+
+	// ColdAfter moves entries idle for this long into a per-shard byte arena
+	// the garbage collector does not scan. Zero disables the cold tier.
+	ColdAfter time.Duration
+
+	// MaxIdle removes entries not used for this long, whether or not their
+	// shard is full. Zero keeps them until evicted or expired.
+	MaxIdle time.Duration
+
+	// Rebalance moves capacity between shards by their eviction pressure
+	// (see Rebalancer); a zero interval disables it.
+	Rebalance RebalancePolicy
+
+	// FairnessWriter counts PUT entries per writer, identified by "ip" or
+	// "token"; empty disables it. A writer holding more than FairnessLimit of
+	// a full shard evicts its own entries first (0 = only count).
+	FairnessWriter string
+	FairnessLimit  float64
+
+	// MaxWaiters bounds how many GET ?wait= requests may block at once. Zero
+	// disables waiting.
+	MaxWaiters int
+
+	// DrainBudget is how long POST /admin/drain may spend handing entries to
+	// its target.
+	DrainBudget time.Duration
+
+	// DrainTargets lists the peers (host:port) POST /admin/drain may hand
+	// entries to. Empty disables the endpoint; it requires AdminToken.
+	DrainTargets []string
+
+	// MaintenanceMessage is what requests refused during maintenance are
+	// told, unless POST /admin/maintenance gives its own.
+	MaintenanceMessage string
+
+	// ValueIndexPrefix enables GET /search by indexing the first this many
+	// characters of every value; ValueIndexMaxKeys bounds the indexed keys.
+	ValueIndexPrefix  int
+	ValueIndexMaxKeys int
+
+	// MissLogSize is how many recent GET misses GET /admin/misses aggregates
+	// over (0 disables it); MissLogKeys is how much of each key is kept:
+	// "hash", "prefix" or "full".
+	MissLogSize int
+	MissLogKeys string
+
+	// TTLReportSample is how many entries of each shard GET /admin/ttl-report
+	// examines (0 = all of them).
+	TTLReportSample int
+
+	// ErrorWindow is how far back GET /stats/errors looks; ErrorLogSample
+	// logs one in that many 4xx replies with the request redacted (0 = none).
+	ErrorWindow    time.Duration
+	ErrorLogSample int
+
+	// SnapshotPath and SnapshotInterval enable periodic snapshots of the cache
+	// as a Redis SET line dump (loadable with -import-redis).
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// ACLExport is what snapshots and drains do with entries that have a
+	// read ACL: "include" them with it, or "skip" them.
+	ACLExport string
+
+	// TracePath records the shape of GET, PUT and delete traffic for
+	// `kvcache replay`, for TraceSample of keys, hashed with TraceKeySecret.
+	TracePath      string
+	TraceSample    float64
+	TraceKeySecret string
+
+	// StatsDAddr, when set, pushes counters and gauges over UDP every
+	// StatsDInterval, named under StatsDPrefix in the StatsDFormat line format
+	// ("statsd" or "dogstatsd", which also sends StatsDTags).
+	StatsDAddr     string
+	StatsDInterval time.Duration
+	StatsDPrefix   string
+	StatsDFormat   string
+	StatsDTags     []string
+
+	// AlertRules are thresholds over internal metrics, evaluated every
+	// AlertInterval; state changes are logged and posted to AlertWebhook.
+	AlertRules    []string
+	AlertInterval time.Duration
+	AlertWebhook  string
+
+	// CacheControl maps key prefixes to the max-age GET responses advertise to
+	// proxies ("prefix=duration"); keys under CacheControlPrivate are always
+	// sent with no-store.
+	CacheControl        []string
+	CacheControlPrivate []string
+
+	// HotKeys counts GET hits per key for GET /admin/hotkeys.
+	HotKeys bool
+
+	// UI serves an HTML page for inspecting the cache at GET /ui. It requires
+	// AdminToken, which the page itself is checked against.
+	UI bool
+
+	// Most keys one request may name on each bulk endpoint.
+	MaxBulkGetKeys    int // POST /get/bulk
+	MaxBulkAddKeys    int // POST /add/bulk
+	MaxFallbackKeys   int // GET /get/fallback
+	MaxBulkDeleteKeys int // POST /bulk/delete
+
+	// HealthWeights weigh the signals behind GET /health/score, which counts
+	// HealthMaxInFlight requests in flight and a recent p99 latency of
+	// HealthLatencyTarget as saturated.
+	HealthWeights       string
+	HealthMaxInFlight   int
+	HealthLatencyTarget time.Duration
+
+	// ReadyMinHitRatio fails /health with 503 DEGRADED while the GET hit
+	// ratio over ReadyHitRatioWindow is below it; 0 disables the check. The
+	// ratio is reported in the /health body either way.
+	ReadyMinHitRatio    float64
+	ReadyHitRatioWindow time.Duration
+
+	// PutStrictFields rejects PUT bodies with fields PutRequest does not
+	// define; PutNullValue is "reject" or "empty" for "value": null.
+	PutStrictFields bool
+	PutNullValue    string
+
+	// PutReportEvictedKey adds the key an insert evicted to PUT replies. It
+	// reveals other clients' keys, so it is meant for debugging.
+	PutReportEvictedKey bool
+
+	// ImportRedisPath is a Redis-style SET line dump loaded before serving.
+	ImportRedisPath string
+}
+
+// parseFlags reads the command-line flags into a Config.
+func parseFlags() *Config {
+	cfg := &Config{}
+	flag.DurationVar(&cfg.ReadSnapshotInterval, "read-snapshot-interval", 0,
+		"Serve GETs from a lock-free snapshot rebuilt at this interval, e.g. 100ms (0 = disabled)")
+	flag.DurationVar(&cfg.ShardLockTimeout, "shard-lock-timeout", 0,
+		"Fail GET and PUT with 503 after waiting this long for a busy shard, e.g. 50ms (0 = wait as long as the request lives)")
+	flag.IntVar(&cfg.WriteBufferSize, "write-buffer", 0,
+		"Stage up to this many PUTs per shard and apply them in batches (0 = apply each PUT at once)")
+	flag.DurationVar(&cfg.WriteBufferInterval, "write-buffer-interval", 2*time.Millisecond,
+		"How often staged PUTs are applied with -write-buffer")
+	flag.IntVar(&cfg.EvictionLogSize, "eviction-log-size", 0,
+		"Keep this many recent evictions, with their reason, for GET /debug/evictions (0 = disabled)")
+	flag.StringVar(&cfg.EvictionPolicy, "eviction", EvictionPolicyLRU,
+		"Eviction policy when a shard is full: lru or cost-aware")
+	flag.IntVar(&cfg.EvictionCandidates, "eviction-candidates", 8,
+		"Number of least recently used entries cost-aware eviction chooses from")
+	flag.IntVar(&cfg.RefreshAheadWorkers, "refresh-ahead-workers", 4,
+		"Background workers refreshing refresh_ahead entries from their origin (0 = disabled)")
+	flag.Float64Var(&cfg.RefreshAheadFraction, "refresh-ahead-fraction", 0.2,
+		"Refresh an entry when it is read within this final fraction of its TTL")
+	flag.IntVar(&cfg.RejectionThreshold, "rejection-threshold", 3,
+		"Oversized PUTs of the same key allowed per -rejection-window before replying 413 (0 = disabled)")
+	flag.DurationVar(&cfg.RejectionWindow, "rejection-window", time.Minute,
+		"Window over which repeated oversized PUTs are counted")
+	var listen, listenOptional string
+	flag.StringVar(&listen, "listen", "0.0.0.0:7171",
+		"Comma-separated addresses to serve on, e.g. 0.0.0.0:7171,[::1]:7171; all must bind")
+	flag.StringVar(&listenOptional, "listen-optional", "",
+		"Comma-separated extra addresses to serve on if they can be bound (e.g. a localhost debug listener)")
+	flag.StringVar(&cfg.BinaryListenAddr, "listen-binary", "",
+		"Address to serve the compact binary protocol on, e.g. 0.0.0.0:7172 (empty = disabled)")
+	flag.StringVar(&cfg.ShardHash, "shard-hash", ShardHashFNV32a,
+		"Hash used to pick a key's shard: fnv32a or fnv64a (fewer collisions at large shard counts)")
+	flag.BoolVar(&cfg.ShardSalt, "shard-salt", false,
+		"Salt the shard hash with a random value chosen at startup, so keys cannot be crafted to land on one shard. The salt changes on every restart, so snapshots then load sequentially")
+	flag.StringVar(&cfg.KeyNormalization, "key-normalization", "",
+		"Normalize keys to this Unicode form before storing or looking them up: nfc, or empty to keep them as sent. Only enable it on an empty cache")
+	var immutablePrefixes string
+	flag.StringVar(&immutablePrefixes, "immutable-prefixes", "",
+		"Comma-separated key prefixes whose entries cannot be overwritten once written")
+	var fetchAllow string
+	flag.StringVar(&fetchAllow, "fetch-allow-hosts", "",
+		"Comma-separated origin hosts (host or host:port) POST /fetch may contact; empty disables /fetch")
+	flag.Float64Var(&cfg.Pressure.ShedFraction, "pressure-shed-fraction", 0,
+		"Fraction (0-1) of writes to a high-pressure shard rejected with 429 (0 = never shed)")
+	flag.DurationVar(&cfg.Pressure.MaxBackoff, "pressure-max-backoff", time.Second,
+		"Backoff suggested to writers at the maximum pressure ratio of 1; scales linearly")
+	flag.BoolVar(&cfg.KeyDirectory, "key-directory", false,
+		"Maintain a global key directory for lock-free existence checks and counts (costs one extra map entry per key)")
+	flag.BoolVar(&cfg.TouchOnWrite, "touch-on-write", true,
+		"Move a key to the front of the LRU list when it is updated; false means only reads refresh recency")
+	flag.BoolVar(&cfg.SkipUnchangedPuts, "skip-unchanged-puts", false,
+		"Leave an entry's version alone when a PUT stores the value it already holds; the PUT reply says \"unchanged\": true")
+	flag.DurationVar(&cfg.UnchangedTTLTolerance, "unchanged-ttl-tolerance", 0,
+		"How far a PUT's TTL may differ from the entry's and still count as unchanged with -skip-unchanged-puts")
+	flag.BoolVar(&cfg.LazyShards, "lazy-shards", false,
+		"Let shard maps start empty and grow with their keys instead of pre-allocating room for a full shard")
+	flag.BoolVar(&cfg.AllowValueCapture, "allow-value-capture", false,
+		"Serve POST /admin/capture, which records full request and response bodies for matching keys")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "",
+		"Bearer token required by the capture, drain, restore and generation bump endpoints, which are not served without it")
+	flag.IntVar(&cfg.IdempotencyMaxKeys, "idempotency-max-keys", 10000,
+		"Most Idempotency-Key replies kept for retried writes; 0 ignores the header")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", 10*time.Minute,
+		"How long the reply to a write sent with an Idempotency-Key is kept")
+	flag.DurationVar(&cfg.TTL.Min, "min-ttl", 0,
+		"Raise TTLs requested on PUT below this, in whole seconds (0 = no minimum)")
+	flag.DurationVar(&cfg.TTL.Max, "max-ttl", 0,
+		"Lower TTLs requested on PUT above this, in whole seconds (0 = no maximum)")
+	var ttlRules string
+	flag.StringVar(&ttlRules, "ttl-rules", "",
+		"Comma-separated pattern=ttl rules giving PUTs without a TTL a default, first match wins, e.g. session:*=30m,config:*=never")
+	flag.StringVar(&cfg.WriteTransforms, "write-transforms", "",
+		"File of '<key prefix> <transform> [argument]' lines applied in order to PUT values: trim, reject-pattern, redact-pattern or truncate")
+	flag.DurationVar(&cfg.TTL.MaxAge, "max-entry-age", 0,
+		"Never serve an entry longer than this after it was written, whatever its TTL, in whole seconds (0 = no cap)")
+	flag.DurationVar(&cfg.StaleWindow, "stale-window", 0,
+		"How long past their TTL entries can still be read with GET ?stale=allow (0 = off)")
+	flag.Float64Var(&cfg.PinMaxFraction, "pin-max-fraction", 0.5,
+		"Share of each shard's capacity (0-1, exclusive) that POST /pin may exempt from eviction")
+	flag.Float64Var(&cfg.Pressure.Medium, "pressure-medium", 0.1,
+		"Evictions per put (0-1) at which X-Cache-Pressure reports medium")
+	flag.Float64Var(&cfg.Pressure.High, "pressure-high", 0.5,
+		"Evictions per put (0-1) at which X-Cache-Pressure reports high")
+	flag.DurationVar(&cfg.ColdAfter, "cold-after", 0,
+		"Move entries not used for this long into a compact per-shard cold tier to cut GC work, e.g. 10m (0 = disabled)")
+	flag.DurationVar(&cfg.MaxIdle, "max-idle", 0,
+		"Remove entries that have not been read or written for this long, even when their shard has room (0 = disabled)")
+	flag.DurationVar(&cfg.Rebalance.Interval, "rebalance-interval", 0,
+		"Move capacity from idle shards to evicting ones at this interval, keeping the total, e.g. 1m (0 = disabled)")
+	flag.IntVar(&cfg.Rebalance.MinCapacity, "rebalance-min-capacity", MaxCapacityPerShard/4,
+		"Smallest capacity rebalancing leaves a shard")
+	flag.IntVar(&cfg.Rebalance.MaxCapacity, "rebalance-max-capacity", MaxCapacityPerShard*4,
+		"Largest capacity rebalancing gives a shard")
+	flag.Float64Var(&cfg.Rebalance.Damping, "rebalance-damping", 0.5,
+		"Share (0-1] of the capacity a rebalance round could move that it actually moves")
+	flag.StringVar(&cfg.FairnessWriter, "fairness-writer", "",
+		"Count PUT entries per writer, identified by ip or token (Authorization header), and list the top writers in /stats (empty = disabled)")
+	flag.Float64Var(&cfg.FairnessLimit, "fairness-limit", 0,
+		"Share of a shard's capacity above which a writer's inserts evict its own least recently used entries first (0 = only count)")
+	flag.IntVar(&cfg.MaxWaiters, "max-waiters", 1024,
+		"Maximum GET ?wait= requests blocked waiting for a key at once (0 = disabled)")
+	flag.DurationVar(&cfg.DrainBudget, "drain-budget", 30*time.Second,
+		"Time POST /admin/drain may spend streaming entries to its target before stopping")
+	var drainTargets string
+	flag.StringVar(&drainTargets, "drain-targets", "",
+		"Comma-separated host:port peers POST /admin/drain may send entries to (empty = disabled); requires -admin-token")
+	flag.StringVar(&cfg.MaintenanceMessage, "maintenance-message", "The cache is down for maintenance.",
+		"Message of the 503 replies sent while POST /admin/maintenance has the node in maintenance")
+	flag.IntVar(&cfg.ValueIndexPrefix, "value-index-prefix", 0,
+		"Index the first N characters of every value for GET /search?value-prefix= (0 = disabled)")
+	flag.IntVar(&cfg.ValueIndexMaxKeys, "value-index-max-keys", 100000,
+		"Maximum number of keys held in the value prefix index")
+	flag.IntVar(&cfg.MissLogSize, "miss-log-size", 0,
+		"Remember this many recent GET misses for GET /admin/misses (0 = disabled)")
+	flag.StringVar(&cfg.MissLogKeys, "miss-log-keys", MissKeysHash,
+		"What the miss log keeps of each key: hash, prefix (up to the first ':') or full")
+	flag.IntVar(&cfg.TTLReportSample, "ttl-report-sample", defaultTTLReportSample,
+		"Most entries per shard GET /admin/ttl-report examines, which bounds how long it holds each shard lock (0 = all)")
+	flag.DurationVar(&cfg.ErrorWindow, "error-window", defaultErrorWindow,
+		"Window GET /stats/errors counts error replies over, at least 1m")
+	flag.IntVar(&cfg.ErrorLogSample, "error-log-sample", 0,
+		"Log one in N 4xx replies with the request's values redacted (0 = disabled)")
+	flag.StringVar(&cfg.SnapshotPath, "snapshot-path", "",
+		"File to write periodic snapshots to; load it at startup with -import-redis")
+	flag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", 0,
+		"Write a snapshot to -snapshot-path at this interval and on shutdown, e.g. 5m (0 = disabled)")
+	flag.StringVar(&cfg.ACLExport, "acl-export", ACLExportInclude,
+		"What snapshots and drains do with entries that have a read ACL: include them with it, or skip them")
+	flag.StringVar(&cfg.TracePath, "trace-path", "",
+		"Record operation, keyed key hash, sizes and timing of cache traffic to this file for `kvcache replay` (empty = disabled)")
+	flag.Float64Var(&cfg.TraceSample, "trace-sample", 0.1,
+		"Fraction of keys whose operations -trace-path records, chosen by key hash")
+	flag.StringVar(&cfg.TraceKeySecret, "trace-key-secret", "",
+		"Secret keying the key hash in traces; required with -trace-path")
+	flag.StringVar(&cfg.StatsDAddr, "statsd-addr", "",
+		"UDP host:port of a StatsD or DogStatsD server to push metrics to (empty = disabled)")
+	flag.DurationVar(&cfg.StatsDInterval, "statsd-interval", 10*time.Second,
+		"How often metrics are pushed to -statsd-addr")
+	flag.StringVar(&cfg.StatsDPrefix, "statsd-prefix", "kvcache",
+		"Prefix of pushed metric names")
+	flag.StringVar(&cfg.StatsDFormat, "statsd-format", StatsDFormatPlain,
+		"Line format of pushed metrics: statsd, or dogstatsd (tags the operation instead of naming it)")
+	var statsdTags string
+	flag.StringVar(&statsdTags, "statsd-tags", "",
+		"Comma-separated DogStatsD tags added to every pushed metric, e.g. env:prod,node:a")
+	var alertRules string
+	flag.StringVar(&alertRules, "alert-rules", "",
+		"Comma-separated alert rules such as hit_ratio<0.8/5m,evictions_per_sec>100/1m,memory_bytes>2e9 (empty = disabled)")
+	flag.DurationVar(&cfg.AlertInterval, "alert-interval", 15*time.Second,
+		"How often alert rules are evaluated")
+	flag.StringVar(&cfg.AlertWebhook, "alert-webhook", "",
+		"URL to POST a JSON notification to when an alert rule starts firing or resolves")
+	flag.BoolVar(&cfg.HotKeys, "hot-keys", false,
+		"Count GET hits per key and serve the most read keys at GET /admin/hotkeys")
+	flag.BoolVar(&cfg.UI, "ui", false,
+		"Serve a page for getting, putting and deleting keys and watching /stats at GET /ui; requires -admin-token")
+	flag.IntVar(&cfg.MaxBulkGetKeys, "max-bulk-get-keys", maxBulkGetKeys,
+		"Most keys one POST /get/bulk may read")
+	flag.IntVar(&cfg.MaxBulkAddKeys, "max-bulk-add-keys", maxBulkAddKeys,
+		"Most pairs one POST /add/bulk may insert, which bounds how long it holds shard locks")
+	flag.IntVar(&cfg.MaxFallbackKeys, "max-fallback-keys", maxFallbackKeys,
+		"Most keys one GET /get/fallback may try")
+	flag.IntVar(&cfg.MaxBulkDeleteKeys, "max-bulk-delete-keys", maxBulkDeleteKeys,
+		"Most keys one POST /bulk/delete may remove, which bounds how long it holds each shard lock")
+	flag.StringVar(&cfg.HealthWeights, "health-weights", "inflight=0.4,latency=0.3,memory=0.15,eviction=0.15",
+		"Weights of the load signals behind GET /health/score")
+	flag.IntVar(&cfg.HealthMaxInFlight, "health-max-inflight", 256,
+		"Requests in flight at which the health score's inflight signal is saturated")
+	flag.DurationVar(&cfg.HealthLatencyTarget, "health-latency-target", 50*time.Millisecond,
+		"Recent p99 latency at which the health score's latency signal is saturated")
+	flag.Float64Var(&cfg.ReadyMinHitRatio, "ready-min-hit-ratio", 0,
+		"GET hit ratio below which /health reports 503 DEGRADED (0 = never)")
+	flag.DurationVar(&cfg.ReadyHitRatioWindow, "ready-hit-ratio-window", time.Minute,
+		"Window of the hit ratio reported and checked by /health")
+	flag.BoolVar(&cfg.PutStrictFields, "put-strict-fields", false,
+		"Reject PUT bodies containing unknown fields")
+	flag.StringVar(&cfg.PutNullValue, "put-null-value", NullValueEmpty,
+		"How PUT treats \"value\": null: reject, or empty (store an empty string)")
+	flag.BoolVar(&cfg.PutReportEvictedKey, "put-report-evicted-key", false,
+		"Debug: include the key an insert evicted as evicted_key in PUT replies (reveals other clients' keys)")
+	var cacheControl, cacheControlPrivate string
+	flag.StringVar(&cacheControl, "cache-control", "",
+		"Comma-separated prefix=max-age rules for GET Cache-Control headers, e.g. static:=1h,cfg:=30s (max-age is capped at the entry's TTL)")
+	flag.StringVar(&cacheControlPrivate, "cache-control-private", "",
+		"Comma-separated key prefixes whose GET responses are sent with Cache-Control: no-store")
+	flag.StringVar(&cfg.ImportRedisPath, "import-redis", "",
+		"Load a Redis SET line dump (e.g. redis-cli output) from this file before serving")
+	flag.Parse()
+
+	cfg.ListenAddrs = splitList(listen)
+	cfg.OptionalListenAddrs = splitList(listenOptional)
+	cfg.FetchAllowedHosts = splitList(fetchAllow)
+	cfg.DrainTargets = splitList(drainTargets)
+	cfg.ImmutablePrefixes = splitList(immutablePrefixes)
+	cfg.CacheControl = splitList(cacheControl)
+	cfg.CacheControlPrivate = splitList(cacheControlPrivate)
+	cfg.StatsDTags = splitList(statsdTags)
+	cfg.AlertRules = splitList(alertRules)
+	cfg.TTLRules = splitList(ttlRules)
+	return cfg
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
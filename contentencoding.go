@@ -0,0 +1,47 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gzipBody closes both the decompressor and the wire body under it.
+type gzipBody struct {
+	*gzip.Reader
+	wire io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.wire.Close()
+}
+
+// acceptEncodedBody lets next read bodies sent with "Content-Encoding: gzip"
+// as if they had been sent plain. The handler's own body limit then applies
+// to the decompressed bytes, so a small compressed body cannot expand past
+// it. Encodings other than gzip and identity get 415 with code
+// unsupported_encoding, and a body that is not gzip at all gets 400 with
+// code bad_encoding.
+func acceptEncodedBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeJSONErrorCode(w, "Request body is not valid gzip.", "bad_encoding", http.StatusBadRequest)
+				return
+			}
+			r.Body = gzipBody{Reader: gz, wire: r.Body}
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			writeJSONErrorCode(w, "Unsupported Content-Encoding '"+encoding+"', use gzip or none.", "unsupported_encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestGzipBodiesCannotInflatePastTheLimit(t *testing.T) {
+	// 64MB of JSON, over the 1MB limit of both handlers, in about 64KB.
+	var compressed bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	io.WriteString(gz, `{"key": "bomb", "value": "`)
+	chunk := strings.Repeat("x", 1<<20)
+	for range 64 {
+		io.WriteString(gz, chunk)
+	}
+	io.WriteString(gz, `"}`)
+	gz.Close()
+
+	decoder, err := NewPutDecoder(NewMetrics(), false, NullValueReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		target  string
+		handler func(c *ShardedCache) http.HandlerFunc
+	}{
+		{"/put", func(c *ShardedCache) http.HandlerFunc {
+			return HandlePut(c, decoder, WritePolicy{}, PressurePolicy{}, nil, false)
+		}},
+		{"/import/ndjson", func(c *ShardedCache) http.HandlerFunc {
+			return HandleImportNDJSON(c, NewDrainer(c, time.Second, nil), WritePolicy{})
+		}},
+	} {
+		cache := NewShardedCache(1, 10, false)
+		wire := &countingReader{r: bytes.NewReader(compressed.Bytes())}
+		req := httptest.NewRequest(http.MethodPost, tc.target, wire)
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		acceptEncodedBody(tc.handler(cache))(rec, req)
+
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status %d, want 413: %s", tc.target, rec.Code, rec.Body)
+		}
+		if cache.Exists("bomb") {
+			t.Errorf("%s: the oversized value was stored", tc.target)
+		}
+		// Reading stops at the limit, long before the end of the body.
+		if wire.n > compressed.Len()/4 {
+			t.Errorf("%s: read %d of %d compressed bytes", tc.target, wire.n, compressed.Len())
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DeleteResponse structure for POST /delete replies
+type DeleteResponse struct {
+	Status string `json:"status"`
+	Key    string `json:"key"`
+}
+
+// HandleDelete handles POST /delete?key=, removing one key. An absent or
+// expired key is answered with 404.
+func HandleDelete(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := queryKey(r, cache)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		deleted, err := cache.DeleteAs(key, requestReader(r))
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !deleted {
+			writeCacheError(w, fmt.Errorf("%w: %s", ErrNotFound, key))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(DeleteResponse{Status: "OK", Key: key})
+	}
+}
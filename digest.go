@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+// DigestResponse structure for GET /digest replies
+type DigestResponse struct {
+	Status  string   `json:"status"`
+	Shards  int      `json:"shards"`
+	Digest  string   `json:"digest"`  // XOR of every shard digest
+	Digests []string `json:"digests"` // Per shard, in shard order
+	Items   []int    `json:"items"`   // Entries hashed per shard
+}
+
+// entryDigest hashes one entry's key, value and encoding.
+func entryDigest(key, value string, encoding Encoding) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(value))
+	hasher.Write([]byte{0, byte(encoding)})
+	return hasher.Sum64()
+}
+
+// Digest returns an order-independent digest of the shard's unexpired
+// entries and how many went into it. Two shards holding the same keys,
+// values and encodings have the same digest, whatever order the entries were
+// written in; TTLs and versions are left out since they differ between
+// nodes. Entry fields are only copied under the mutex and hashed after it is
+// released.
+func (c *LRUCache) Digest() (uint64, int) {
+	type triple struct {
+		key, value string
+		encoding   Encoding
+	}
+	now := c.now()
+	c.mutex.Lock()
+	entries := make([]triple, 0, c.lenLocked())
+	add := func(e *entry) {
+		if c.live(e, now) {
+			entries = append(entries, triple{e.key, e.value, e.encoding})
+		}
+	}
+	for _, elem := range c.items {
+		add(elem.Value.(*entry))
+	}
+	c.cold.each(add)
+	c.mutex.Unlock()
+
+	var digest uint64
+	for _, t := range entries {
+		digest ^= entryDigest(t.key, t.value, t.encoding)
+	}
+	return digest, len(entries)
+}
+
+func HandleDigest(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := DigestResponse{
+			Status:  "OK",
+			Shards:  len(cache.shards),
+			Digests: make([]string, len(cache.shards)),
+			Items:   make([]int, len(cache.shards)),
+		}
+		var total uint64
+		for i, shard := range cache.shards {
+			digest, n := shard.Digest()
+			total ^= digest
+			resp.Digests[i] = fmt.Sprintf("%016x", digest)
+			resp.Items[i] = n
+		}
+		resp.Digest = fmt.Sprintf("%016x", total)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyDirectory is an optional global index of key -> shard index kept next to
+// the shard maps. It answers "is this key anywhere?" and "how many keys are
+// there?" without taking any shard lock, at the cost of a second map entry per
+// key. It is updated under the owning shard's lock, so it is exact for each
+// key; expired entries stay listed until a lookup or flush removes them.
+//
+// All methods are safe to call on a nil *KeyDirectory, which behaves as a
+// directory that knows nothing.
+type KeyDirectory struct {
+	shards sync.Map // string -> int
+	count  atomic.Int64
+}
+
+// add records that key now lives in the given shard.
+func (d *KeyDirectory) add(key string, shard int) {
+	if d == nil {
+		return
+	}
+	if _, loaded := d.shards.Swap(key, shard); !loaded {
+		d.count.Add(1)
+	}
+}
+
+// remove forgets key.
+func (d *KeyDirectory) remove(key string) {
+	if d == nil {
+		return
+	}
+	if _, loaded := d.shards.LoadAndDelete(key); loaded {
+		d.count.Add(-1)
+	}
+}
+
+// mayContain reports false only when key is known to be absent. A nil
+// directory always answers true so callers fall back to the shard.
+func (d *KeyDirectory) mayContain(key string) bool {
+	if d == nil {
+		return true
+	}
+	_, ok := d.shards.Load(key)
+	return ok
+}
+
+// Len returns the number of keys in the directory.
+func (d *KeyDirectory) Len() int {
+	if d == nil {
+		return 0
+	}
+	return int(d.count.Load())
+}
+
+// EnableKeyDirectory builds the global key directory from the current
+// contents and keeps it updated from then on. Must be called before the cache
+// starts serving requests.
+func (sc *ShardedCache) EnableKeyDirectory() {
+	dir := &KeyDirectory{}
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		for key := range shard.items {
+			dir.add(key, shard.index)
+		}
+		shard.directory = dir
+		shard.mutex.Unlock()
+	}
+	sc.directory = dir
+	log.Printf("Global key directory enabled")
+}
+
+// Contains reports whether key is present, unexpired and not outdated,
+// without updating LRU order.
+func (c *LRUCache) Contains(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, hit := c.items[key]; hit {
+		return c.live(elem.Value.(*entry), c.now())
+	}
+	ref, _, cold := c.cold.find(key)
+	return cold && (ref.expiresAt == 0 || c.now() < ref.expiresAt) && ref.generation >= c.generation.Load()
+}
+
+// Exists reports whether key is present and unexpired. With the key directory
+// enabled, absent keys are answered without locking or hashing.
+func (sc *ShardedCache) Exists(key string) bool {
+	if !sc.directory.mayContain(key) {
+		return false
+	}
+	return sc.shards[sc.getShardIndex(key)].Contains(key)
+}
+
+// ExistsResponse structure for GET /exists replies
+type ExistsResponse struct {
+	Status string `json:"status"`
+	Key    string `json:"key"`
+	Exists bool   `json:"exists"`
+}
+
+func HandleExists(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := queryKey(r, cache)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ExistsResponse{
+			Status: "OK",
+			Key:    key,
+			Exists: cache.Exists(key),
+		})
+	}
+}
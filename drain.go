@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainBatchSize is how many entries are sent to the target per import request.
+const drainBatchSize = 1000
+
+// Drain states reported by GET /admin/drain/status.
+const (
+	DrainIdle     = "idle"
+	DrainRunning  = "running"
+	DrainDone     = "done"
+	DrainTimedOut = "timed_out" // Time budget ran out before every entry was sent
+	DrainFailed   = "failed"
+	DrainCanceled = "canceled" // Stopped by POST /admin/drain/cancel
+)
+
+// DrainStatus describes the progress of a drain.
+type DrainStatus struct {
+	State      string     `json:"state"`
+	Target     string     `json:"target,omitempty"`
+	Total      int        `json:"total"`    // Entries selected for handoff
+	Sent       int        `json:"sent"`     // Entries delivered to the target so far
+	Imported   int        `json:"imported"` // Entries the target accepted
+	Rejected   int        `json:"rejected"` // Entries the target refused
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// DrainStatusResponse structure for POST /admin/drain and GET /admin/drain/status replies
+type DrainStatusResponse struct {
+	Status   string      `json:"status"`
+	ReadOnly bool        `json:"read_only"`
+	Drain    DrainStatus `json:"drain"`
+}
+
+// Drainer hands a node's entries to a peer before a restart. Starting a drain
+// makes the node read-only and unready; the entries are then streamed, most
+// recently used first, to the target's POST /import/redis until all are sent,
+// the time budget runs out or the drain is canceled.
+type Drainer struct {
+	cache   *ShardedCache
+	budget  time.Duration
+	targets []string // host:port peers a drain may be sent to
+	client  *http.Client
+
+	readOnly  atomic.Bool
+	restoring atomic.Int32 // Restores in progress (see BeginRestore)
+	restored  atomic.Int64 // Entries loaded by the restores in progress
+
+	mutex  sync.Mutex
+	status DrainStatus
+	cancel context.CancelFunc // Stops the running drain; nil when none runs
+}
+
+// NewDrainer creates a drainer that spends at most budget on a handoff to one
+// of targets.
+func NewDrainer(cache *ShardedCache, budget time.Duration, targets []string) *Drainer {
+	return &Drainer{
+		cache:   cache,
+		budget:  budget,
+		targets: targets,
+		client:  &http.Client{},
+		status:  DrainStatus{State: DrainIdle},
+	}
+}
+
+// allowed reports whether target is one of the configured drain targets.
+func (d *Drainer) allowed(target string) bool {
+	return slices.Contains(d.targets, target)
+}
+
+// ReadOnly reports whether writes are currently refused.
+func (d *Drainer) ReadOnly() bool {
+	return d.readOnly.Load()
+}
+
+// Status returns a copy of the current drain progress.
+func (d *Drainer) Status() DrainStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.status
+}
+
+// Start flips the node to read-only and begins handing entries to target in
+// the background. It fails if a drain is already running. The caller checks
+// that target is allowed.
+func (d *Drainer) Start(target string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.status.State == DrainRunning {
+		return errors.New("a drain is already running")
+	}
+	if d.Restoring() {
+		return errRestoreRunning
+	}
+	now := time.Now()
+	d.status = DrainStatus{State: DrainRunning, Target: target, StartedAt: &now}
+	d.readOnly.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), d.budget)
+	d.cancel = cancel
+	go d.run(ctx, target)
+	return nil
+}
+
+// Cancel stops a running drain and makes the node writable and ready again,
+// also after a drain that has already finished. Entries already sent stay on
+// the target.
+func (d *Drainer) Cancel() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.cancel != nil {
+		d.cancel()
+		d.cancel = nil
+	}
+	d.readOnly.Store(false)
+}
+
+// run performs the handoff and records the outcome.
+func (d *Drainer) run(ctx context.Context, target string) {
+	entries := d.cache.entriesByRecency()
+	d.update(func(s *DrainStatus) { s.Total = len(entries) })
+	log.Printf("Draining %d entries to %s", len(entries), target)
+
+	var err error
+	for start := 0; start < len(entries) && err == nil; start += drainBatchSize {
+		batch := entries[start:min(start+drainBatchSize, len(entries))]
+		var stats ImportStats
+		if stats, err = d.send(ctx, target, batch); err == nil {
+			d.update(func(s *DrainStatus) {
+				s.Sent += len(batch)
+				s.Imported += stats.Imported
+				s.Rejected += stats.Rejected
+			})
+		}
+	}
+
+	d.update(func(s *DrainStatus) {
+		now := time.Now()
+		s.FinishedAt = &now
+		switch {
+		case err == nil:
+			s.State = DrainDone
+		case errors.Is(err, context.DeadlineExceeded):
+			s.State = DrainTimedOut
+		case errors.Is(err, context.Canceled):
+			s.State = DrainCanceled
+		default:
+			s.State = DrainFailed
+			s.Error = err.Error()
+		}
+	})
+	status := d.Status()
+	log.Printf("Drain to %s %s: %d of %d entries sent", target, status.State, status.Sent, status.Total)
+}
+
+func (d *Drainer) update(fn func(s *DrainStatus)) {
+	d.mutex.Lock()
+	fn(&d.status)
+	if d.status.FinishedAt != nil && d.cancel != nil {
+		d.cancel() // Release the timer
+		d.cancel = nil
+	}
+	d.mutex.Unlock()
+}
+
+// send delivers one batch to the target as a Redis SET line dump.
+func (d *Drainer) send(ctx context.Context, target string, batch []dumpEntry) (ImportStats, error) {
+	var body []byte
+	for _, e := range batch {
+		body = appendRedisSet(body, e)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+target+"/import/redis", bytes.NewReader(body))
+	if err != nil {
+		return ImportStats{}, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return ImportStats{}, fmt.Errorf("target replied %s", resp.Status)
+	}
+	var reply ImportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return ImportStats{}, fmt.Errorf("decode target reply: %w", err)
+	}
+	return reply.ImportStats, nil
+}
+
+// entriesByRecencyLocked copies the shard's unexpired entries, most recently used
+// first, leaving out those that are not exported (see SetACLExport).
+// MUST be called with the mutex held.
+func (c *LRUCache) entriesByRecencyLocked(now int64) []dumpEntry {
+	out := make([]dumpEntry, 0, c.lenLocked())
+	add := func(e *entry) {
+		if !c.exported(e, now) {
+			return
+		}
+		var ttl time.Duration
+		if e.expiresAt != 0 {
+			ttl = time.Duration(e.expiresAt - now)
+		}
+		out = append(out, dumpEntry{key: e.key, value: e.value, ttl: ttl, cost: e.cost, encoding: e.encoding, immutable: e.immutable, readers: e.readers, createdAt: e.createdAt})
+	}
+	for elem := c.evictList.Front(); elem != nil; elem = elem.Next() {
+		add(elem.Value.(*entry))
+	}
+	// Cold entries come after every hot one; each walks them oldest first.
+	hot := len(out)
+	c.cold.each(add)
+	for i, j := hot, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// entriesByRecency returns every unexpired entry, approximately most recently
+// used first: shards keep no shared clock, so their recency lists are
+// interleaved rank by rank.
+func (sc *ShardedCache) entriesByRecency() []dumpEntry {
+	perShard := sc.entriesPerShard()
+	total := 0
+	for _, entries := range perShard {
+		total += len(entries)
+	}
+	out := make([]dumpEntry, 0, total)
+	for rank := 0; len(out) < total; rank++ {
+		for _, entries := range perShard {
+			if rank < len(entries) {
+				out = append(out, entries[rank])
+			}
+		}
+	}
+	return out
+}
+
+// entriesPerShard returns every unexpired entry of each shard, most recently
+// used first, locking one shard at a time.
+func (sc *ShardedCache) entriesPerShard() [][]dumpEntry {
+	perShard := make([][]dumpEntry, len(sc.shards))
+	for i, shard := range sc.shards {
+		now := sc.now()
+		shard.mutex.Lock()
+		perShard[i] = shard.entriesByRecencyLocked(now)
+		shard.mutex.Unlock()
+	}
+	return perShard
+}
+
+// writesRefused returns why writes are currently refused, wrapping
+// ErrReadOnly, or nil if they are accepted.
+func (d *Drainer) writesRefused() error {
+	switch {
+	case d.ReadOnly():
+		return errNodeDraining
+	case d.Restoring():
+		return fmt.Errorf("%w: a restore is in progress", ErrReadOnly)
+	}
+	return nil
+}
+
+// GuardWrites refuses next with 503 while the node is draining or restoring.
+func (d *Drainer) GuardWrites(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := d.writesRefused(); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (d *Drainer) writeStatus(w http.ResponseWriter, statusCode int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(DrainStatusResponse{
+		Status:   "OK",
+		ReadOnly: d.ReadOnly(),
+		Drain:    d.Status(),
+	})
+}
+
+// HandleDrain starts a drain to the host:port given in ?target=, which must be
+// one of the drainer's targets.
+func HandleDrain(d *Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := strings.TrimSpace(r.URL.Query().Get("target"))
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			writeJSONError(w, "Invalid 'target' parameter, expected host:port.", http.StatusBadRequest)
+			return
+		}
+		if !d.allowed(target) {
+			writeJSONError(w, "Target is not in -drain-targets.", http.StatusForbidden)
+			return
+		}
+		if err := d.Start(target); err != nil {
+			writeJSONError(w, fmt.Sprintf("Cannot drain: %v.", err), http.StatusConflict)
+			return
+		}
+		d.writeStatus(w, http.StatusAccepted)
+	}
+}
+
+// HandleDrainCancel handles POST /admin/drain/cancel, stopping a running drain
+// and making the node writable again.
+func HandleDrainCancel(d *Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d.Cancel()
+		d.writeStatus(w, http.StatusOK)
+	}
+}
+
+func HandleDrainStatus(d *Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d.writeStatus(w, http.StatusOK)
+	}
+}
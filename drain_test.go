@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drainTarget serves POST /import/redis for cache, like a peer node does.
+func drainTarget(t *testing.T, cache *ShardedCache) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /import/redis", HandleImportRedis(cache, nil))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func waitForDrain(t *testing.T, d *Drainer) DrainStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := d.Status(); status.State != DrainRunning {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("drain did not finish")
+	return DrainStatus{}
+}
+
+func TestDrainHandsEntriesToTarget(t *testing.T) {
+	source := NewShardedCache(4, 100, false)
+	target := NewShardedCache(4, 100, false)
+	for i := range 50 {
+		source.Put(fmt.Sprintf("only-on-source:%d", i), fmt.Sprintf("value %d", i))
+	}
+	addr := strings.TrimPrefix(drainTarget(t, target).URL, "http://")
+
+	d := NewDrainer(source, 5*time.Second, []string{addr})
+	if err := d.Start(addr); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if !d.ReadOnly() {
+		t.Error("node is writable while draining")
+	}
+	status := waitForDrain(t, d)
+	if status.State != DrainDone || status.Sent != 50 || status.Imported != 50 {
+		t.Fatalf("status = %+v, want done with 50 sent and imported", status)
+	}
+	for i := range 50 {
+		key := fmt.Sprintf("only-on-source:%d", i)
+		if value, ok := target.Get(key); !ok || value != fmt.Sprintf("value %d", i) {
+			t.Errorf("target Get(%q) = %q, %v", key, value, ok)
+		}
+	}
+	if !d.ReadOnly() {
+		t.Error("node became writable after the drain finished")
+	}
+}
+
+func TestDrainRefusesTargetsNotListed(t *testing.T) {
+	source := NewShardedCache(1, 10, false)
+	d := NewDrainer(source, time.Second, []string{"10.0.0.12:7171"})
+	handler := requireAdminToken("secret", HandleDrain(d))
+
+	for _, tc := range []struct {
+		name, token, target string
+		want                int
+	}{
+		{"no token", "", "10.0.0.12:7171", http.StatusUnauthorized},
+		{"wrong token", "guess", "10.0.0.12:7171", http.StatusUnauthorized},
+		{"target not listed", "secret", "10.0.0.13:7171", http.StatusForbidden},
+		{"not host:port", "secret", "10.0.0.12", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/drain?target="+url.QueryEscape(tc.target), nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+			if d.ReadOnly() {
+				t.Error("refused drain made the node read-only")
+			}
+		})
+	}
+}
+
+func TestDrainCancelMakesNodeWritable(t *testing.T) {
+	source := NewShardedCache(1, 10, false)
+	source.Put("k", "v")
+	blocked := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	t.Cleanup(peer.Close)
+	t.Cleanup(func() { close(blocked) })
+	addr := strings.TrimPrefix(peer.URL, "http://")
+
+	d := NewDrainer(source, time.Minute, []string{addr})
+	if err := d.Start(addr); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	d.Cancel()
+	if d.ReadOnly() {
+		t.Error("node is still read-only after Cancel")
+	}
+	if status := waitForDrain(t, d); status.State != DrainCanceled {
+		t.Errorf("state = %q, want %q", status.State, DrainCanceled)
+	}
+	if err := d.Start(addr); err != nil {
+		t.Errorf("Start after cancel: %v", err)
+	}
+	d.Cancel()
+}
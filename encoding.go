@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Encoding is the declared content type of a stored value.
+type Encoding uint8
+
+const (
+	EncodingText   Encoding = iota // Any string; the default
+	EncodingJSON                   // A valid JSON document
+	EncodingBase64                 // Standard, padded base64 (binary payloads)
+)
+
+var encodingNames = [...]string{"text", "json", "base64"}
+
+func (e Encoding) String() string {
+	if int(e) < len(encodingNames) {
+		return encodingNames[e]
+	}
+	return "unknown"
+}
+
+// parseEncoding maps a request's encoding field to an Encoding; an empty
+// name means text.
+func parseEncoding(name string) (Encoding, bool) {
+	if name == "" {
+		return EncodingText, true
+	}
+	for i, n := range encodingNames {
+		if n == name {
+			return Encoding(i), true
+		}
+	}
+	return 0, false
+}
+
+// valid reports whether value is well-formed for the encoding.
+func (e Encoding) valid(value string) bool {
+	switch e {
+	case EncodingJSON:
+		return json.Valid([]byte(value))
+	case EncodingBase64:
+		_, err := base64.StdEncoding.DecodeString(value)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// Item is a value as returned by lookups, together with its encoding and
+// timestamps.
+type Item struct {
+	Value     string
+	Encoding  Encoding
+	CreatedAt int64 // UnixNano when the value was stored; 0 if unknown
+	ExpiresAt int64 // UnixNano after which the entry is gone; 0 = never
+	Stale     bool  // Past ExpiresAt, returned within a stale-while-revalidate window
+	Immutable bool  // Writes to the key are refused while this value lives
+
+	Generation uint64 // Cache generation the value was written under (see BumpGeneration)
+
+	Transforms []string // Write transforms that changed the value (see TransformChain)
+
+	Readers []string // Hashed tokens that may read the value (see ACLRequest); nil = anyone
+
+	reads *atomic.Uint64 // The entry's hit counter; nil unless from a lookup
+
+	viaLock bool // In a read snapshot: look the key up under the lock instead (see rebuildSnapshot)
+}
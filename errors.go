@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Errors returned by cache operations. Operations wrap them with the details
+// of the failure, so callers should test for them with errors.Is.
+var (
+	ErrNotFound          = errors.New("key not found")
+	ErrKeyTooLong        = errors.New("key too long")
+	ErrValueTooLong      = errors.New("value too long")
+	ErrTypeMismatch      = errors.New("wrong value type")
+	ErrVersionConflict   = errors.New("version conflict")
+	ErrReadOnly          = errors.New("writes are disabled")
+	ErrCapacityExhausted = errors.New("capacity exhausted")
+	ErrImmutable         = errors.New("key is immutable")
+	ErrLockTimeout       = errors.New("timed out waiting for the shard lock")
+	ErrEntryForbidden    = errors.New("entry is not readable with this token")
+)
+
+// errorReply is how writeCacheError answers an error. Message, if set,
+// replaces the error's own text.
+type errorReply struct {
+	err     error
+	status  int
+	code    string
+	message string
+}
+
+// errorReplies is checked in order, so errors that wrap a sentinel but need
+// a reply of their own come before it.
+var errorReplies = []errorReply{
+	{err: errLeaseExpired, status: http.StatusGone, code: "lease_expired"},
+	{err: errLockHeld, status: http.StatusConflict, code: "lock_held"},
+	{err: errNotJSONObject, status: http.StatusUnprocessableEntity, code: "not_json_object"},
+	{err: errKeyEncoding, status: http.StatusBadRequest, code: "key_encoding"},
+	{err: errTooManyWaiters, status: http.StatusServiceUnavailable, code: "too_many_waiters"},
+	{err: errTooManyKeys, status: http.StatusBadRequest, code: "too_many_keys"},
+	{err: errTransformRejected, status: http.StatusUnprocessableEntity, code: "transform_rejected"},
+	{err: ErrNotFound, status: http.StatusNotFound, code: "not_found"},
+	{err: ErrKeyTooLong, status: http.StatusBadRequest, code: "key_too_long"},
+	{err: ErrValueTooLong, status: http.StatusBadRequest, code: "value_too_long"},
+	{err: ErrTypeMismatch, status: http.StatusConflict, code: "type_mismatch"},
+	{err: ErrVersionConflict, status: http.StatusConflict, code: "version_conflict"},
+	{err: ErrReadOnly, status: http.StatusServiceUnavailable, code: "read_only"},
+	{err: ErrCapacityExhausted, status: http.StatusConflict, code: "capacity_exhausted"},
+	{err: ErrImmutable, status: http.StatusConflict, code: "immutable_key"},
+	{err: ErrEntryForbidden, status: http.StatusForbidden, code: "entry_forbidden"},
+	{err: ErrLockTimeout, status: http.StatusServiceUnavailable, code: "lock_timeout", message: "Timed out waiting for a busy shard."},
+	{err: context.DeadlineExceeded, status: http.StatusServiceUnavailable, code: "timeout", message: "Timed out waiting for the cache."},
+	{err: context.Canceled, status: http.StatusServiceUnavailable, code: "timeout", message: "Timed out waiting for the cache."},
+}
+
+// lookupErrorReply finds the reply for err, if it is one the cache returns.
+func lookupErrorReply(err error) (errorReply, bool) {
+	for _, reply := range errorReplies {
+		if errors.Is(err, reply.err) {
+			return reply, true
+		}
+	}
+	return errorReply{}, false
+}
+
+// isCacheError reports whether writeCacheError has a reply of its own for err.
+func isCacheError(err error) bool {
+	_, ok := lookupErrorReply(err)
+	return ok
+}
+
+// errorMessage turns an error into a sentence for a reply.
+func errorMessage(err error) string {
+	msg := err.Error()
+	first, size := utf8.DecodeRuneInString(msg)
+	return string(unicode.ToUpper(first)) + msg[size:] + "."
+}
+
+// writeCacheError sends the reply for an error returned by a cache
+// operation, with its status and error code. Errors the cache does not
+// define are answered with 500.
+func writeCacheError(w http.ResponseWriter, err error) {
+	reply, ok := lookupErrorReply(err)
+	if !ok {
+		reply = errorReply{status: http.StatusInternalServerError, code: "internal"}
+	}
+	msg := reply.message
+	if msg == "" {
+		msg = errorMessage(err)
+	}
+	writeJSONErrorCode(w, msg, reply.code, reply.status)
+}
+
+// checkLengths fails with ErrKeyTooLong or ErrValueTooLong when key or value
+// is over its limit.
+func checkLengths(key, value string) error {
+	if n := utf8.RuneCountInString(key); n > MaxKeyLength {
+		return fmt.Errorf("%w: %d characters, at most %d", ErrKeyTooLong, n, MaxKeyLength)
+	}
+	if n := utf8.RuneCountInString(value); n > MaxValueLength {
+		return fmt.Errorf("%w: %d characters, at most %d", ErrValueTooLong, n, MaxValueLength)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheErrorsWrapSentinels(t *testing.T) {
+	cache := NewShardedCache(1, 8, false)
+	if err := cache.SetPinLimit(0.125); err != nil { // One pinned key
+		t.Fatal(err)
+	}
+	cache.PutWithOptions("immutable", "v", PutOptions{Immutable: true})
+	cache.Put("text", "not json")
+	cache.Put("pinned", "v")
+	if err := cache.Pin("pinned", true); err != nil {
+		t.Fatal(err)
+	}
+	putWithACL(t, cache, "guarded", "v", "t0k3n")
+	token, _, err := cache.AcquireLock("lock", "owner", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainer := NewDrainer(cache, time.Minute, nil)
+	drainer.BeginRestore()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		sentinel error
+		status   int
+		code     string
+	}{
+		{"key too long", func() error {
+			_, err := cache.PutWithOptionsCtx(ctx, strings.Repeat("k", MaxKeyLength+1), "v", PutOptions{})
+			return err
+		}(), ErrKeyTooLong, http.StatusBadRequest, "key_too_long"},
+		{"value too long", func() error {
+			_, err := cache.PutWithOptionsCtx(ctx, "k", strings.Repeat("v", MaxValueLength+1), PutOptions{})
+			return err
+		}(), ErrValueTooLong, http.StatusBadRequest, "value_too_long"},
+		{"put over immutable", func() error {
+			_, err := cache.PutWithOptionsCtx(ctx, "immutable", "w", PutOptions{})
+			return err
+		}(), ErrImmutable, http.StatusConflict, "immutable_key"},
+		{"update absent", func() error {
+			_, _, err := cache.Update("absent", "", nil, func(old string) (string, error) { return old, nil })
+			return err
+		}(), ErrNotFound, http.StatusNotFound, "not_found"},
+		{"update unreadable", func() error {
+			_, _, err := cache.Update("guarded", "", nil, func(old string) (string, error) { return old, nil })
+			return err
+		}(), ErrEntryForbidden, http.StatusForbidden, "entry_forbidden"},
+		{"merge into text", func() error {
+			_, _, _, err := cache.MergeJSON("text", "", nil, map[string]json.RawMessage{"a": json.RawMessage("1")})
+			return err
+		}(), ErrTypeMismatch, http.StatusUnprocessableEntity, "not_json_object"},
+		{"pin absent", cache.Pin("absent", true), ErrNotFound, http.StatusNotFound, "not_found"},
+		{"pin over limit", cache.Pin("text", true), ErrCapacityExhausted, http.StatusConflict, "capacity_exhausted"},
+		{"pin a lock", cache.Pin("lock", true), ErrTypeMismatch, http.StatusConflict, "type_mismatch"},
+		{"rename absent", cache.Rename("absent", "other", ""), ErrNotFound, http.StatusNotFound, "not_found"},
+		{"rename onto immutable", cache.Rename("text", "immutable", ""), ErrImmutable, http.StatusConflict, "immutable_key"},
+		{"renew with another token", func() error {
+			_, err := cache.RenewLock("lock", token+1, time.Minute)
+			return err
+		}(), ErrVersionConflict, http.StatusConflict, "version_conflict"},
+		{"renew a value", func() error {
+			_, err := cache.RenewLock("text", token, time.Minute)
+			return err
+		}(), ErrTypeMismatch, http.StatusConflict, "type_mismatch"},
+		{"add a group too large", cache.PutAllIfAbsent(map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6", "g": "7", "h": "8"}), ErrCapacityExhausted, http.StatusConflict, "capacity_exhausted"},
+		{"write while restoring", drainer.writesRefused(), ErrReadOnly, http.StatusServiceUnavailable, "read_only"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if !errors.Is(tc.err, tc.sentinel) {
+				t.Fatalf("error %v does not wrap %v", tc.err, tc.sentinel)
+			}
+			rec := httptest.NewRecorder()
+			writeCacheError(rec, tc.err)
+			var reply GenericErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &reply)
+			if rec.Code != tc.status || reply.Code != tc.code {
+				t.Errorf("reply %d %q, want %d %q", rec.Code, reply.Code, tc.status, tc.code)
+			}
+		})
+	}
+}
+
+func TestLockTimeoutErrors(t *testing.T) {
+	cache := NewShardedCache(1, 4, false)
+	cache.SetLockTimeout(time.Millisecond)
+	shard := cache.shards[0]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	_, _, err := cache.GetCtx(context.Background(), "k", false)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("GetCtx behind a held lock: %v, want ErrLockTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.PutWithOptionsCtx(ctx, "k", "v", PutOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("PutWithOptionsCtx with a done context: %v, want context.Canceled", err)
+	}
+	rec := httptest.NewRecorder()
+	writeCacheError(rec, err)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled context answered %d, want 503", rec.Code)
+	}
+}
+
+func TestUnknownErrorsAreInternal(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeCacheError(rec, errors.New("disk on fire"))
+	var reply GenericErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	if rec.Code != http.StatusInternalServerError || reply.Code != "internal" || reply.Message != "Disk on fire." {
+		t.Errorf("reply %d %+v", rec.Code, reply)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errorCodeHeader carries the error code of a reply from writeJSONErrorCode
+// to ErrorStats, which removes it before the reply is sent.
+const errorCodeHeader = "X-KVCache-Internal-Error-Code"
+
+// errorCodeNone labels error replies sent without an error code, such as
+// validation messages and replies from the router itself.
+const errorCodeNone = "none"
+
+const (
+	defaultErrorWindow = 5 * time.Minute
+	errorWindowSlots   = 60   // Buckets the window is split into
+	errorTop           = 10   // Rows of GET /stats/errors
+	maxSampledBody     = 4096 // Request body bytes kept for the sampled log
+)
+
+// errorKey is one series of kvcache_errors_total.
+type errorKey struct {
+	endpoint string // Route pattern, or "unmatched"
+	status   int
+	code     string
+}
+
+// errorSlot counts error replies during one slice of the window.
+type errorSlot struct {
+	index  int64 // Unix time divided by the slot width
+	counts map[errorKey]uint64
+}
+
+// ErrorStats counts replies with a 4xx or 5xx status by endpoint, status and
+// error code: in total for /metrics, and over a sliding window for GET
+// /stats/errors. With sampling on, it also logs one in every N client error
+// replies together with the request, its values redacted, so malformed
+// requests can be seen without logging all of them.
+type ErrorStats struct {
+	mux         *http.ServeMux // Resolves requests to their route pattern
+	window      time.Duration
+	slotWidth   time.Duration
+	sampleEvery uint64 // 0 = never log
+
+	mutex  sync.Mutex
+	totals map[errorKey]uint64
+	slots  [errorWindowSlots]errorSlot
+
+	clientErrors atomic.Uint64 // 4xx replies seen, for sampling
+}
+
+// NewErrorStats creates the error counters for the routes of mux, keeping a
+// window of the given length, and registers them with metrics. sampleEvery
+// is N for the sampled log of 4xx replies; 0 disables it.
+func NewErrorStats(metrics *Metrics, mux *http.ServeMux, window time.Duration, sampleEvery int) *ErrorStats {
+	s := &ErrorStats{
+		mux:         mux,
+		window:      window,
+		slotWidth:   max(window/errorWindowSlots, time.Second),
+		sampleEvery: uint64(sampleEvery),
+		totals:      make(map[errorKey]uint64),
+	}
+	metrics.errors = s
+	if sampleEvery > 0 {
+		log.Printf("Logging one in %d client error replies, with values redacted", sampleEvery)
+	}
+	return s
+}
+
+// errorRecorder passes a reply through, noting its status and taking the
+// error code marker off it.
+type errorRecorder struct {
+	http.ResponseWriter
+	status int
+	code   string
+}
+
+func (e *errorRecorder) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+		e.code = e.Header().Get(errorCodeHeader)
+	}
+	e.Header().Del(errorCodeHeader)
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorRecorder) Write(p []byte) (int, error) {
+	if e.status == 0 {
+		e.WriteHeader(http.StatusOK)
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+func (e *errorRecorder) Unwrap() http.ResponseWriter { return e.ResponseWriter }
+
+// bodySample keeps the first maxSampledBody bytes a handler reads from a
+// request body.
+type bodySample struct {
+	io.ReadCloser
+	kept []byte
+	read int
+}
+
+func (b *bodySample) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += n
+	if room := maxSampledBody - len(b.kept); room > 0 {
+		b.kept = append(b.kept, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// Wrap counts the error replies of next. It must be the outermost handler,
+// so that it sees every reply and no client sees the error code marker.
+func (s *ErrorStats) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body *bodySample
+		if s.sampleEvery > 0 && r.Body != nil && r.Body != http.NoBody {
+			body = &bodySample{ReadCloser: r.Body}
+			r.Body = body
+		}
+		rec := &errorRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status >= 400 {
+			s.observe(r, rec.status, rec.code, body)
+		}
+	})
+}
+
+// observe counts one error reply to r and decides whether to log it.
+func (s *ErrorStats) observe(r *http.Request, status int, code string, body *bodySample) {
+	if code == "" {
+		code = errorCodeNone
+	}
+	endpoint := "unmatched"
+	if _, pattern := s.mux.Handler(r); pattern != "" {
+		endpoint = pattern
+	}
+	key := errorKey{endpoint: endpoint, status: status, code: code}
+
+	index := time.Now().UnixNano() / int64(s.slotWidth)
+	s.mutex.Lock()
+	s.totals[key]++
+	slot := &s.slots[index%errorWindowSlots]
+	if slot.index != index || slot.counts == nil {
+		*slot = errorSlot{index: index, counts: make(map[errorKey]uint64)}
+	}
+	slot.counts[key]++
+	s.mutex.Unlock()
+
+	if status < 500 && s.sampleEvery > 0 && (s.clientErrors.Add(1)-1)%s.sampleEvery == 0 {
+		log.Printf("Sampled %d reply (code %s) to %s %s: %s", status, code, r.Method, redactedURL(r), describeBody(body, r.Header.Get("Content-Encoding")))
+	}
+}
+
+// redactedURL returns the request's path and query with the query values
+// replaced, since they hold keys and values.
+func redactedURL(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return r.URL.Path
+	}
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	for i, pair := range pairs {
+		if name, _, ok := strings.Cut(pair, "="); ok {
+			pairs[i] = name + "=<redacted>"
+		}
+	}
+	return r.URL.Path + "?" + strings.Join(pairs, "&")
+}
+
+// describeBody shows what a handler read of a request body with every value
+// replaced by its JSON type, keeping the structure and field names. Bodies
+// that are not JSON, compressed or too large to show are described instead.
+func describeBody(body *bodySample, encoding string) string {
+	switch {
+	case body == nil || body.read == 0:
+		return "no body read"
+	case encoding != "" && encoding != "identity":
+		return fmt.Sprintf("%d bytes, %s-encoded", body.read, encoding)
+	case body.read > len(body.kept):
+		return fmt.Sprintf("%d bytes, over the %d byte sample", body.read, maxSampledBody)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body.kept))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	if err == nil && dec.More() {
+		err = errors.New("data after the JSON value")
+	}
+	if err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			return fmt.Sprintf("%d bytes, not valid JSON at offset %d: %v", body.read, syntax.Offset, err)
+		}
+		return fmt.Sprintf("%d bytes, not valid JSON: %v", body.read, err)
+	}
+	var redacted strings.Builder
+	enc := json.NewEncoder(&redacted)
+	enc.SetEscapeHTML(false) // Keep the <type> placeholders readable
+	enc.Encode(redactJSON(v))
+	return strings.TrimSuffix(redacted.String(), "\n")
+}
+
+// redactJSON replaces the values in a decoded JSON document with their type.
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for name, field := range v {
+			v[name] = redactJSON(field)
+		}
+		return v
+	case []any:
+		for i, elem := range v {
+			v[i] = redactJSON(elem)
+		}
+		return v
+	case string:
+		return "<string>"
+	case json.Number:
+		return "<number>"
+	case bool:
+		return "<bool>"
+	default:
+		return nil
+	}
+}
+
+// ErrorCodeCount is one row of GET /stats/errors.
+type ErrorCodeCount struct {
+	Code   string `json:"code"` // "none" for replies without an error code
+	Status int    `json:"status"`
+	Count  uint64 `json:"count"`
+}
+
+// ErrorStatsResponse structure for GET /stats/errors replies
+type ErrorStatsResponse struct {
+	Status       string           `json:"status"`
+	WindowMs     int64            `json:"window_ms"`
+	ClientErrors uint64           `json:"client_errors"` // 4xx replies in the window
+	ServerErrors uint64           `json:"server_errors"` // 5xx replies in the window
+	Top          []ErrorCodeCount `json:"top"`           // Most frequent codes in the window
+}
+
+// Recent sums the error replies of the window by code and status.
+func (s *ErrorStats) Recent() ErrorStatsResponse {
+	resp := ErrorStatsResponse{Status: "OK", WindowMs: s.window.Milliseconds(), Top: []ErrorCodeCount{}}
+	type codeStatus struct {
+		code   string
+		status int
+	}
+	counts := make(map[codeStatus]uint64)
+	oldest := time.Now().Add(-s.window).UnixNano() / int64(s.slotWidth)
+	s.mutex.Lock()
+	for _, slot := range s.slots {
+		if slot.index <= oldest {
+			continue
+		}
+		for key, n := range slot.counts {
+			counts[codeStatus{key.code, key.status}] += n
+			if key.status >= 500 {
+				resp.ServerErrors += n
+			} else {
+				resp.ClientErrors += n
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	for key, n := range counts {
+		resp.Top = append(resp.Top, ErrorCodeCount{Code: key.code, Status: key.status, Count: n})
+	}
+	slices.SortFunc(resp.Top, func(a, b ErrorCodeCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Code, b.Code), cmp.Compare(a.Status, b.Status))
+	})
+	if len(resp.Top) > errorTop {
+		resp.Top = resp.Top[:errorTop]
+	}
+	return resp
+}
+
+// writeMetrics writes kvcache_errors_total in the Prometheus text format.
+func (s *ErrorStats) writeMetrics(w io.Writer) {
+	s.mutex.Lock()
+	keys := make([]errorKey, 0, len(s.totals))
+	for key := range s.totals {
+		keys = append(keys, key)
+	}
+	totals := make([]uint64, len(keys))
+	slices.SortFunc(keys, func(a, b errorKey) int {
+		return cmp.Or(cmp.Compare(a.endpoint, b.endpoint), cmp.Compare(a.status, b.status), cmp.Compare(a.code, b.code))
+	})
+	for i, key := range keys {
+		totals[i] = s.totals[key]
+	}
+	s.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP kvcache_errors_total Replies with a 4xx or 5xx status, by endpoint, status and error code.")
+	fmt.Fprintln(w, "# TYPE kvcache_errors_total counter")
+	for i, key := range keys {
+		fmt.Fprintf(w, "kvcache_errors_total{endpoint=%q,status=\"%d\",code=%q} %d\n", key.endpoint, key.status, key.code, totals[i])
+	}
+}
+
+// HandleErrorStats handles GET /stats/errors: the most frequent error codes
+// replied with over the window, and the number of 4xx and 5xx replies.
+func HandleErrorStats(stats *ErrorStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(stats.Recent())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorStatsCountAndSampleErrorReplies(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(io.Discard)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /get", func(w http.ResponseWriter, r *http.Request) {
+		writeCacheError(w, fmt.Errorf("%w: %s", ErrNotFound, r.URL.Query().Get("key")))
+	})
+	mux.HandleFunc("PUT /put", func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		writeJSONError(w, "Key cannot be empty.", http.StatusBadRequest)
+	})
+	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONErrorCode(w, "Timed out.", "timeout", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	stats := NewErrorStats(NewMetrics(), mux, time.Minute, 2)
+	handler := stats.Wrap(mux)
+
+	// Client errors in order, so that the 1st and 3rd are sampled.
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/put", strings.NewReader(`{"key": "", "value": "hunter2", "ttl_seconds": 5}`)),
+		httptest.NewRequest(http.MethodGet, "/get?key=user:1", nil),
+		httptest.NewRequest(http.MethodGet, "/get?key=user:2", nil),
+		httptest.NewRequest(http.MethodGet, "/nowhere", nil),
+		httptest.NewRequest(http.MethodGet, "/slow", nil),
+		httptest.NewRequest(http.MethodGet, "/health", nil),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Header().Get(errorCodeHeader) != "" {
+			t.Errorf("%s: the error code marker reached the client", req.URL)
+		}
+	}
+
+	for key, want := range map[errorKey]uint64{
+		{"PUT /put", http.StatusBadRequest, errorCodeNone}:      1,
+		{"GET /get", http.StatusNotFound, "not_found"}:          2,
+		{"unmatched", http.StatusNotFound, errorCodeNone}:       1,
+		{"GET /slow", http.StatusServiceUnavailable, "timeout"}: 1,
+	} {
+		if got := stats.totals[key]; got != want {
+			t.Errorf("%+v counted %d times, want %d", key, got, want)
+		}
+	}
+	if len(stats.totals) != 4 {
+		t.Errorf("counted %d series, want 4: %v", len(stats.totals), stats.totals)
+	}
+	var metrics strings.Builder
+	stats.writeMetrics(&metrics)
+	if want := `kvcache_errors_total{endpoint="GET /get",status="404",code="not_found"} 2`; !strings.Contains(metrics.String(), want) {
+		t.Errorf("metrics lack %s:\n%s", want, metrics.String())
+	}
+	if recent := stats.Recent(); recent.ClientErrors != 4 || recent.ServerErrors != 1 || recent.Top[0].Code != "not_found" {
+		t.Errorf("recent errors %+v", recent)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	var sampled []string
+	for _, line := range lines {
+		if strings.Contains(line, "Sampled") {
+			sampled = append(sampled, line)
+		}
+	}
+	if len(sampled) != 2 {
+		t.Fatalf("sampled %d replies, want the 1st and 3rd of 4 client errors:\n%s", len(sampled), logged.String())
+	}
+	if want := `PUT /put: {"key":"<string>","ttl_seconds":"<number>","value":"<string>"}`; !strings.Contains(sampled[0], want) {
+		t.Errorf("first sample %q, want the body redacted as %s", sampled[0], want)
+	}
+	if want := "GET /get?key=<redacted>"; !strings.Contains(sampled[1], want) {
+		t.Errorf("second sample %q, want the query redacted as %s", sampled[1], want)
+	}
+	if strings.Contains(logged.String(), "hunter2") || strings.Contains(logged.String(), "user:") {
+		t.Errorf("the log shows request values:\n%s", logged.String())
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EvictionReason describes why an entry left the cache.
+type EvictionReason int
+
+const (
+	EvictionCapacity EvictionReason = iota // Pushed out as least recently used by a full shard
+	EvictionFlushed                        // Removed by POST /flush
+	EvictionExpired                        // TTL elapsed, removed when next looked up
+	EvictionRenamed                        // Moved to another key by POST /rename
+	EvictionDeleted                        // Explicitly deleted, e.g. by POST /release
+	EvictionIdle                           // Unused for longer than the idle limit (see EnableIdleReaping)
+)
+
+// String returns the name used for the reason in logs and JSON.
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionCapacity:
+		return "capacity"
+	case EvictionFlushed:
+		return "flushed"
+	case EvictionExpired:
+		return "expired"
+	case EvictionRenamed:
+		return "renamed"
+	case EvictionDeleted:
+		return "deleted"
+	case EvictionIdle:
+		return "idle"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON encodes the reason by name.
+func (r EvictionReason) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// Eviction policy names accepted by SetEvictionPolicy.
+const (
+	EvictionPolicyLRU       = "lru"
+	EvictionPolicyCostAware = "cost-aware"
+)
+
+// SetEvictionPolicy selects how a full shard picks its victim. "lru" evicts the
+// least recently used entry; "cost-aware" evicts the lowest-cost entry among the
+// candidates least recently used ones (oldest first on ties). Must be called
+// before the cache starts serving requests.
+func (sc *ShardedCache) SetEvictionPolicy(policy string, candidates int) error {
+	var costAware bool
+	switch policy {
+	case EvictionPolicyLRU:
+	case EvictionPolicyCostAware:
+		if candidates < 1 {
+			return fmt.Errorf("cost-aware eviction needs at least 1 candidate, got %d", candidates)
+		}
+		costAware = true
+	default:
+		return fmt.Errorf("unknown eviction policy %q", policy)
+	}
+	for _, shard := range sc.shards {
+		shard.costAware = costAware
+		shard.evictionCandidates = candidates
+	}
+	return nil
+}
+
+// EvictionPolicy returns the name of the active eviction policy.
+func (sc *ShardedCache) EvictionPolicy() string {
+	if len(sc.shards) > 0 && sc.shards[0].costAware {
+		return EvictionPolicyCostAware
+	}
+	return EvictionPolicyLRU
+}
+
+// Cost buckets used to break capacity evictions down in /stats.
+const numCostBuckets = 4
+
+var costBucketNames = [numCostBuckets]string{"1", "2-10", "11-50", "51-100"}
+
+// costBucket maps an entry cost to its index in costBucketNames.
+func costBucket(cost int) int {
+	switch {
+	case cost <= 1:
+		return 0
+	case cost <= 10:
+		return 1
+	case cost <= 50:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// EvictionsByCost sums capacity evictions per cost bucket across all shards.
+func (sc *ShardedCache) EvictionsByCost() map[string]uint64 {
+	var totals [numCostBuckets]uint64
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		for i, n := range shard.evictionsByCost {
+			totals[i] += n
+		}
+		shard.mutex.Unlock()
+	}
+	out := make(map[string]uint64, numCostBuckets)
+	for i, name := range costBucketNames {
+		out[name] = totals[i]
+	}
+	return out
+}
+
+// EvictionCallback is invoked for every entry removed from the cache. It runs
+// on the goroutine that caused the removal, after the shard lock is released,
+// so it must be cheap and safe for concurrent use.
+type EvictionCallback func(key, value string, reason EvictionReason)
+
+// OnEvict registers fn to be told about removals from every shard. Callbacks
+// must be registered before the cache starts serving requests.
+func (sc *ShardedCache) OnEvict(fn EvictionCallback) {
+	sc.evictCallbacks = append(sc.evictCallbacks, fn)
+	if len(sc.evictCallbacks) == 1 {
+		for _, shard := range sc.shards {
+			shard.onEvict = sc.notifyEvict
+		}
+	}
+}
+
+// notifyEvict fans a removal out to all registered callbacks.
+func (sc *ShardedCache) notifyEvict(key, value string, reason EvictionReason) {
+	for _, fn := range sc.evictCallbacks {
+		fn(key, value, reason)
+	}
+}
+
+// --- Eviction debug log ---
+
+// EvictionEvent is one entry in the eviction debug log.
+type EvictionEvent struct {
+	Key    string         `json:"key"`
+	Reason EvictionReason `json:"reason"`
+	Time   time.Time      `json:"time"`
+}
+
+// EvictionLogResponse structure for GET /debug/evictions replies
+type EvictionLogResponse struct {
+	Status string          `json:"status"`
+	Events []EvictionEvent `json:"events"` // Oldest first
+}
+
+// EvictionLog keeps the most recent removals in a fixed-size ring buffer.
+type EvictionLog struct {
+	mutex  sync.Mutex
+	events []EvictionEvent
+	next   int  // Slot the next event is written to
+	full   bool // Whether the ring has wrapped at least once
+}
+
+// NewEvictionLog creates a log holding up to size events.
+func NewEvictionLog(size int) *EvictionLog {
+	return &EvictionLog{events: make([]EvictionEvent, size)}
+}
+
+// Record is an EvictionCallback that appends the removal to the ring.
+func (l *EvictionLog) Record(key, _ string, reason EvictionReason) {
+	l.mutex.Lock()
+	l.events[l.next] = EvictionEvent{Key: key, Reason: reason, Time: time.Now()}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mutex.Unlock()
+}
+
+// Events returns a copy of the logged events, oldest first.
+func (l *EvictionLog) Events() []EvictionEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.full {
+		return append([]EvictionEvent(nil), l.events[:l.next]...)
+	}
+	out := make([]EvictionEvent, 0, len(l.events))
+	out = append(out, l.events[l.next:]...)
+	return append(out, l.events[:l.next]...)
+}
+
+func HandleEvictionLog(evictionLog *EvictionLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(EvictionLogResponse{
+			Status: "OK",
+			Events: evictionLog.Events(),
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCostAwareEvictionKeepsExpensiveEntries(t *testing.T) {
+	for _, tc := range []struct {
+		policy      string
+		wantSurvive bool
+	}{
+		{EvictionPolicyLRU, false},
+		{EvictionPolicyCostAware, true},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			cache := NewShardedCache(1, 8, false)
+			if err := cache.SetEvictionPolicy(tc.policy, 8); err != nil {
+				t.Fatal(err)
+			}
+			cache.PutWithOptions("report.pdf", "rendered", PutOptions{Cost: 100})
+			for i := range 40 { // Five times the capacity in cheap writes
+				cache.Put(fmt.Sprintf("flag:%d", i), "on")
+			}
+			if got := cache.Exists("report.pdf"); got != tc.wantSurvive {
+				t.Errorf("expensive entry present = %v, want %v", got, tc.wantSurvive)
+			}
+			if n := cache.Len(); n != 8 {
+				t.Errorf("%d entries, want the capacity of 8", n)
+			}
+
+			byCost := cache.EvictionsByCost()
+			wantCostly := uint64(1)
+			if tc.wantSurvive {
+				wantCostly = 0
+			}
+			if byCost["51-100"] != wantCostly || byCost["1"] != 33-wantCostly {
+				t.Errorf("evictions by cost = %v, want %d costly and %d cheap", byCost, wantCostly, 33-wantCostly)
+			}
+		})
+	}
+}
+
+func TestCostAwareEvictionDefaultsToLRU(t *testing.T) {
+	cache := NewShardedCache(1, 3, false)
+	if err := cache.SetEvictionPolicy(EvictionPolicyCostAware, 3); err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("a", "v")
+	cache.Put("b", "v")
+	cache.Put("c", "v")
+	cache.Get("a") // b is now the least recently used
+	cache.Put("d", "v")
+	if cache.Exists("b") {
+		t.Error("with equal costs the least recently used entry should go")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if !cache.Exists(key) {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestCostAwareEvictionOnlyLooksAtCandidates(t *testing.T) {
+	cache := NewShardedCache(1, 4, false)
+	if err := cache.SetEvictionPolicy(EvictionPolicyCostAware, 2); err != nil {
+		t.Fatal(err)
+	}
+	cache.PutWithOptions("old", "v", PutOptions{Cost: 60})
+	cache.PutWithOptions("older-cheap", "v", PutOptions{Cost: 40})
+	cache.PutWithOptions("recent-cheap", "v", PutOptions{Cost: 1})
+	cache.PutWithOptions("recent", "v", PutOptions{Cost: 60})
+	cache.Put("new", "v")
+	if cache.Exists("older-cheap") {
+		t.Error("the cheaper of the two oldest entries survived")
+	}
+	if !cache.Exists("recent-cheap") {
+		t.Error("an entry outside the candidate window was evicted")
+	}
+}
+
+func TestSetEvictionPolicyValidates(t *testing.T) {
+	cache := NewShardedCache(1, 4, false)
+	if err := cache.SetEvictionPolicy(EvictionPolicyCostAware, 0); err == nil {
+		t.Error("cost-aware eviction accepted 0 candidates")
+	}
+	if err := cache.SetEvictionPolicy("lfu", 4); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	if got := cache.EvictionPolicy(); got != EvictionPolicyLRU {
+		t.Errorf("policy after failed changes = %s, want %s", got, EvictionPolicyLRU)
+	}
+}
+
+func TestPutRejectsCostOutOfRange(t *testing.T) {
+	cache := NewShardedCache(1, 4, false)
+	for cost, want := range map[int]int{-1: http.StatusBadRequest, 0: http.StatusOK, 100: http.StatusOK, 101: http.StatusBadRequest} {
+		if rec := doPut(t, cache, PutRequest{Key: "k", Value: "v", Cost: cost}); rec.Code != want {
+			t.Errorf("cost %d: status %d, want %d", cost, rec.Code, want)
+		}
+	}
+}
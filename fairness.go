@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+)
+
+// Writer identities the fairness guard can account by.
+const (
+	FairnessWriterIP    = "ip"    // The client address of the connection
+	FairnessWriterToken = "token" // The Authorization header, or the client address without one
+)
+
+const (
+	// fairnessBuckets is how many writer counters each shard keeps. Writers
+	// are hashed into them, so memory does not grow with the number of
+	// writers; writers sharing a bucket are counted, and capped, together.
+	fairnessBuckets = 1024
+	// fairnessScanLimit bounds how many entries an insert inspects looking
+	// for the writer's own least recently used one.
+	fairnessScanLimit = 4096
+	// fairnessTopWriters is how many writers /stats lists.
+	fairnessTopWriters = 10
+)
+
+// writerCounts holds a shard's resident entries per writer bucket. Guarded
+// by the shard mutex.
+type writerCounts [fairnessBuckets]int32
+
+// countWriter adds delta to the count of e's writer, if entries are
+// accounted. MUST be called with the mutex held.
+func (c *LRUCache) countWriter(e *entry, delta int32) {
+	if c.writers != nil && e.writer != 0 {
+		c.writers[e.writer-1] += delta
+	}
+}
+
+// evictOwnLocked makes room for an insert by writer by removing that
+// writer's least recently used unpinned entry, when the writer holds more
+// than its fair share of the shard. It returns nil when the writer is within
+// its share or none of its entries is found among the fairnessScanLimit
+// least recently used ones; cold entries are not searched.
+// MUST be called with the mutex held.
+func (c *LRUCache) evictOwnLocked(writer uint16) *entry {
+	if c.fairShare <= 0 || writer == 0 || int(c.writers[writer-1]) < c.fairShare {
+		return nil
+	}
+	elem := c.evictList.Back()
+	for n := 0; elem != nil && n < fairnessScanLimit; n++ {
+		if ent := elem.Value.(*entry); ent.writer == writer && !ent.pinned {
+			removed := c.removeElement(elem)
+			c.evictionsByCost[costBucket(removed.cost)]++
+			c.selfEvictions.Add(1)
+			return removed
+		}
+		elem = elem.Prev()
+	}
+	return nil
+}
+
+// FairnessGuard identifies the writer of each PUT, so that shards can count
+// their entries per writer and, with a cap, make a writer over its share
+// evict its own entries instead of everyone else's. A nil *FairnessGuard
+// identifies nobody.
+type FairnessGuard struct {
+	basis  string
+	labels [fairnessBuckets]atomic.Pointer[string] // Last writer seen in each bucket, for /stats
+}
+
+// NewFairnessGuard creates a guard identifying writers by basis, "ip" or
+// "token".
+func NewFairnessGuard(basis string) (*FairnessGuard, error) {
+	if basis != FairnessWriterIP && basis != FairnessWriterToken {
+		return nil, fmt.Errorf("unknown writer identity %q, expected %s or %s", basis, FairnessWriterIP, FairnessWriterToken)
+	}
+	return &FairnessGuard{basis: basis}, nil
+}
+
+// writer returns the bucket of the writer of r, plus one, or 0 for nil g.
+// Tokens are only ever shown as a prefix of their SHA-256.
+func (g *FairnessGuard) writer(r *http.Request) uint16 {
+	return g.writerFor(r.Header.Get("Authorization"), r.RemoteAddr)
+}
+
+// writerFor is writer for a request sent from addr with the Authorization
+// header token, which may be empty.
+func (g *FairnessGuard) writerFor(token, addr string) uint16 {
+	if g == nil {
+		return 0
+	}
+	var label string
+	if g.basis == FairnessWriterToken && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		label = "token:" + hex.EncodeToString(sum[:6])
+	} else {
+		label, _, _ = net.SplitHostPort(addr)
+		if label == "" {
+			label = addr
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	bucket := h.Sum32() % fairnessBuckets
+	if last := g.labels[bucket].Load(); last == nil || *last != label {
+		g.labels[bucket].Store(&label)
+	}
+	return uint16(bucket) + 1
+}
+
+// label names bucket (0-based) in /stats.
+func (g *FairnessGuard) label(bucket int) string {
+	if last := g.labels[bucket].Load(); last != nil {
+		return *last
+	}
+	return fmt.Sprintf("bucket:%d", bucket)
+}
+
+// EnableWriterFairness makes every shard count its entries per writer. With
+// a positive limit, a writer holding more than limit of a full shard's
+// capacity evicts its own least recently used entry to insert, instead of
+// the shard's. Must be called before the cache starts serving requests.
+func (sc *ShardedCache) EnableWriterFairness(g *FairnessGuard, limit float64) {
+	for _, shard := range sc.shards {
+		shard.writers = new(writerCounts)
+		if limit > 0 {
+			shard.fairLimit = limit
+			shard.fairShare = max(1, int(limit*float64(shard.capacity)))
+		}
+	}
+	sc.fairness, sc.fairnessLimit = g, limit
+	if limit > 0 {
+		log.Printf("Writers holding more than %.4g%% of a shard evict their own entries first (by %s)", limit*100, g.basis)
+	} else {
+		log.Printf("Counting entries per writer (by %s)", g.basis)
+	}
+}
+
+// WriterStats is one writer in FairnessStats.
+type WriterStats struct {
+	Writer        string  `json:"writer"` // Client address or token hash last seen in the writer's bucket
+	Entries       int     `json:"entries"`
+	MaxShardShare float64 `json:"max_shard_share"` // Largest fraction of one shard's capacity held
+}
+
+// FairnessStats reports writer accounting in /stats.
+type FairnessStats struct {
+	WriterBasis   string        `json:"writer_basis"`
+	Limit         float64       `json:"limit"`          // Share of a shard above which a writer evicts its own entries; 0 = only counting
+	SelfEvictions uint64        `json:"self_evictions"` // Inserts that evicted their writer's own entry
+	TopWriters    []WriterStats `json:"top_writers"`    // By resident entries
+}
+
+// FairnessStats lists the writers with the most resident entries, or
+// returns nil when writers are not accounted.
+func (sc *ShardedCache) FairnessStats() *FairnessStats {
+	if sc.fairness == nil {
+		return nil
+	}
+	stats := &FairnessStats{WriterBasis: sc.fairness.basis, Limit: sc.fairnessLimit, TopWriters: []WriterStats{}}
+	var totals [fairnessBuckets]int
+	var shares [fairnessBuckets]float64
+	var counts writerCounts
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		counts = *shard.writers
+		capacity := shard.capacity
+		shard.mutex.Unlock()
+		for i, n := range counts {
+			totals[i] += int(n)
+			shares[i] = max(shares[i], float64(n)/float64(capacity))
+		}
+		stats.SelfEvictions += shard.selfEvictions.Load()
+	}
+	for i, n := range totals {
+		if n > 0 {
+			stats.TopWriters = append(stats.TopWriters, WriterStats{Writer: sc.fairness.label(i), Entries: n, MaxShardShare: shares[i]})
+		}
+	}
+	slices.SortFunc(stats.TopWriters, func(a, b WriterStats) int { return b.Entries - a.Entries })
+	if len(stats.TopWriters) > fairnessTopWriters {
+		stats.TopWriters = stats.TopWriters[:fairnessTopWriters]
+	}
+	return stats
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultFetchTimeout = 2 * time.Second
+	maxFetchTimeout     = 30 * time.Second
+)
+
+// FetchRequest structure for POST /fetch bodies
+type FetchRequest struct {
+	Key        string `json:"key"`
+	OriginURL  string `json:"origin_url"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"` // 0 = no expiry
+	TimeoutMs  int    `json:"timeout_ms,omitempty"`  // 0 = defaultFetchTimeout
+
+	// RefreshAhead re-fetches the value in the background when it is read
+	// close to expiry (needs ttl_seconds and refresh-ahead workers).
+	RefreshAhead bool `json:"refresh_ahead,omitempty"`
+
+	// SWRSeconds keeps serving the value this long past its TTL while it is
+	// re-fetched in the background (needs ttl_seconds).
+	SWRSeconds int `json:"swr_seconds,omitempty"`
+}
+
+// FetchResponse structure for POST /fetch replies. Source is "hit" (served from
+// the cache), "filled" (fetched from the origin and stored) or "origin_error".
+type FetchResponse struct {
+	Status       string `json:"status"`
+	Source       string `json:"source"`
+	Key          string `json:"key"`
+	Value        string `json:"value,omitempty"`
+	OriginStatus int    `json:"origin_status,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// originError is returned by Fetcher when the origin could not supply a value.
+type originError struct {
+	status int // HTTP status from the origin, 0 if it never answered
+	msg    string
+}
+
+func (e *originError) Error() string { return e.msg }
+
+// fetchCall is an in-flight origin fetch that concurrent callers wait on.
+type fetchCall struct {
+	wg    sync.WaitGroup
+	value string
+	err   error
+}
+
+// Fetcher fills cache misses from allowlisted origin URLs, collapsing
+// concurrent fetches of the same key into one origin request.
+type Fetcher struct {
+	cache        *ShardedCache
+	allowedHosts map[string]bool // Lower-cased host[:port] values origins may use
+	transforms   *TransformChain // Applied to fetched values before they are stored
+	client       *http.Client
+
+	mutex    sync.Mutex
+	inflight map[string]*fetchCall
+}
+
+// NewFetcher creates a Fetcher that only contacts the given hosts (host or
+// host:port, matched exactly against the origin URL) and stores what they
+// return through transforms. Redirects are followed only when they stay
+// within the allowlist.
+func NewFetcher(cache *ShardedCache, allowedHosts []string, transforms *TransformChain) *Fetcher {
+	f := &Fetcher{
+		cache:        cache,
+		allowedHosts: make(map[string]bool, len(allowedHosts)),
+		transforms:   transforms,
+		inflight:     make(map[string]*fetchCall),
+	}
+	for _, host := range allowedHosts {
+		f.allowedHosts[strings.ToLower(host)] = true
+	}
+	f.client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !f.allowed(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowlisted", req.URL.Host)
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// allowed reports whether u is an http(s) URL on an allowlisted host.
+func (f *Fetcher) allowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return f.allowedHosts[strings.ToLower(u.Host)]
+}
+
+// fill fetches key from origin and stores it, sharing the result with any
+// concurrent fill of the same key. The first caller's origin and options win.
+// It fails with ErrImmutable if the key holds an immutable entry and with
+// errTransformRejected if a write transform refuses the value, and waiters
+// are released even if the fetch panics.
+func (f *Fetcher) fill(key string, origin *url.URL, opts PutOptions, timeout time.Duration) (string, error) {
+	f.mutex.Lock()
+	if call, ok := f.inflight[key]; ok {
+		f.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := &fetchCall{err: &originError{msg: "Origin fetch did not complete."}} // Kept if fetching panics
+	call.wg.Add(1)
+	f.inflight[key] = call
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		delete(f.inflight, key)
+		f.mutex.Unlock()
+		call.wg.Done()
+	}()
+
+	value, err := f.fetchOrigin(origin, timeout)
+	if err == nil {
+		value, opts.Transforms, err = f.transforms.Apply(key, value)
+	}
+	if err == nil && f.cache.PutWithOptions(key, value, opts).Refused {
+		value, err = "", fmt.Errorf("%w: %s", ErrImmutable, key)
+	}
+	call.value, call.err = value, err
+	return call.value, call.err
+}
+
+// fetchOrigin performs the GET against the origin and validates the body.
+func (f *Fetcher) fetchOrigin(origin *url.URL, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin.String(), nil)
+	if err != nil {
+		return "", &originError{msg: "Invalid origin request."}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", &originError{msg: fmt.Sprintf("Origin request failed: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &originError{status: resp.StatusCode, msg: "Origin returned a non-200 status."}
+	}
+	// A UTF-8 rune is at most 4 bytes, so this is enough to detect overflow.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxValueLength*utf8.UTFMax+1))
+	if err != nil {
+		return "", &originError{status: resp.StatusCode, msg: "Failed to read origin response."}
+	}
+	if utf8.RuneCount(body) > MaxValueLength {
+		return "", &originError{
+			status: resp.StatusCode,
+			msg:    fmt.Sprintf("Origin response exceeds maximum value length (%d characters).", MaxValueLength),
+		}
+	}
+	return string(body), nil
+}
+
+// HandleFetch serves POST /fetch: return the cached value for key, or on a
+// miss fetch it from origin_url, store it with ttl_seconds resolved by ttl as
+// for /put, and return it.
+func HandleFetch(fetcher *Fetcher, ttl TTLPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req FetchRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+
+		key := fetcher.cache.trimKey(req.Key)
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+		origin, err := url.Parse(req.OriginURL)
+		if err != nil || !fetcher.allowed(origin) {
+			writeJSONError(w, "Origin URL is not allowlisted.", http.StatusForbidden)
+			return
+		}
+		if req.TTLSeconds < 0 {
+			writeJSONError(w, "TTL cannot be negative.", http.StatusBadRequest)
+			return
+		}
+		if req.RefreshAhead && req.TTLSeconds == 0 {
+			writeJSONError(w, "Refresh-ahead requires a TTL.", http.StatusBadRequest)
+			return
+		}
+		if req.SWRSeconds < 0 || (req.SWRSeconds > 0 && req.TTLSeconds == 0) {
+			writeJSONError(w, "A stale window requires a TTL and cannot be negative.", http.StatusBadRequest)
+			return
+		}
+		timeout := defaultFetchTimeout
+		if req.TimeoutMs < 0 {
+			writeJSONError(w, "Timeout cannot be negative.", http.StatusBadRequest)
+			return
+		} else if req.TimeoutMs > 0 {
+			timeout = min(time.Duration(req.TimeoutMs)*time.Millisecond, maxFetchTimeout)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		item, found, err := fetcher.cache.GetCtx(r.Context(), key, false)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if found && !item.ReadableBy(requestReader(r)) {
+			writeCacheError(w, forbidden(key))
+			return
+		}
+		if found {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(FetchResponse{Status: "OK", Source: "hit", Key: key, Value: item.Value})
+			return
+		}
+
+		opts := PutOptions{
+			TTL:      time.Duration(req.TTLSeconds) * time.Second,
+			StaleFor: time.Duration(req.SWRSeconds) * time.Second,
+		}
+		opts.TTL, _, _ = ttl.Resolve(key, opts.TTL)
+		if req.RefreshAhead || req.SWRSeconds > 0 {
+			opts.Refresh = &RefreshSource{Origin: origin, TTL: opts.TTL, StaleFor: opts.StaleFor, Timeout: timeout, Ahead: req.RefreshAhead}
+		}
+		value, err := fetcher.fill(key, origin, opts, timeout)
+		if errors.Is(err, ErrImmutable) || errors.Is(err, errTransformRejected) {
+			writeCacheError(w, err)
+			return
+		}
+		if err != nil {
+			resp := FetchResponse{Status: "ERROR", Source: "origin_error", Key: key, Message: err.Error()}
+			var oerr *originError
+			if errors.As(err, &oerr) {
+				resp.OriginStatus = oerr.status
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(FetchResponse{Status: "OK", Source: "filled", Key: key, Value: value})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fetchOriginServer serves body at /value and counts the requests.
+func fetchOriginServer(t *testing.T, body string, delay time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(delay)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func postFetch(t *testing.T, handler http.HandlerFunc, req FetchRequest) (*httptest.ResponseRecorder, FetchResponse) {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/fetch", bytes.NewReader(body)))
+	var resp FetchResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec, resp
+}
+
+func TestFetchClampsTTLLikePut(t *testing.T) {
+	origin, _ := fetchOriginServer(t, "from origin", 0)
+	u, _ := url.Parse(origin.URL)
+	cache := NewShardedCache(1, 10, false)
+	handler := HandleFetch(NewFetcher(cache, []string{u.Host}, nil), TTLPolicy{Max: time.Minute})
+
+	rec, resp := postFetch(t, handler, FetchRequest{Key: "k", OriginURL: origin.URL + "/value", TTLSeconds: 3600})
+	if rec.Code != http.StatusOK || resp.Source != "filled" {
+		t.Fatalf("status %d, reply %+v", rec.Code, resp)
+	}
+	item, ok := cache.shards[0].GetItem("k")
+	if !ok {
+		t.Fatal("filled value was not stored")
+	}
+	if left := time.Duration(item.ExpiresAt - time.Now().UnixNano()); left > time.Minute {
+		t.Errorf("TTL left %s, want at most the 1m maximum", left)
+	}
+}
+
+func TestFetchReportsImmutableKey(t *testing.T) {
+	origin, _ := fetchOriginServer(t, "from origin", 0)
+	u, _ := url.Parse(origin.URL)
+	cache := NewShardedCache(1, 10, false)
+	fetcher := NewFetcher(cache, []string{u.Host}, nil)
+
+	// A concurrent writer stores an immutable value between the miss and the fill.
+	if _, err := fetcher.fill("k", mustParseURL(t, origin.URL), PutOptions{}, time.Second); err != nil {
+		t.Fatalf("first fill: %v", err)
+	}
+	cache.Delete("k")
+	cache.PutWithOptions("k", "pinned down", PutOptions{Immutable: true})
+	if _, err := fetcher.fill("k", mustParseURL(t, origin.URL), PutOptions{}, time.Second); !errors.Is(err, ErrImmutable) {
+		t.Errorf("fill over an immutable key = %v, want ErrImmutable", err)
+	}
+	if value, _ := cache.Get("k"); value != "pinned down" {
+		t.Errorf("immutable value replaced by %q", value)
+	}
+}
+
+func TestFetchDeduplicatesConcurrentMisses(t *testing.T) {
+	origin, hits := fetchOriginServer(t, "slow value", 50*time.Millisecond)
+	u, _ := url.Parse(origin.URL)
+	cache := NewShardedCache(1, 10, false)
+	fetcher := NewFetcher(cache, []string{u.Host}, nil)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := fetcher.fill("k", mustParseURL(t, origin.URL), PutOptions{}, time.Second); err != nil || value != "slow value" {
+				t.Errorf("fill = %q, %v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := hits.Load(); n != 1 {
+		t.Errorf("origin was asked %d times, want 1", n)
+	}
+	if len(fetcher.inflight) != 0 {
+		t.Errorf("%d fills left in flight", len(fetcher.inflight))
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
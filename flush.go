@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// flushBatchSize bounds how many entries are removed per shard lock acquisition.
+const flushBatchSize = 512
+
+// FlushResponse structure for POST /flush replies
+type FlushResponse struct {
+	Status  string `json:"status"`
+	Removed int    `json:"removed"`
+}
+
+// RemoveMatching deletes every entry for which match returns true and reports
+// how many were removed. Candidates are collected under one lock hold and then
+// removed in batches of flushBatchSize, re-checking each entry so that values
+// rewritten in between are left alone.
+func (c *LRUCache) RemoveMatching(match func(e *entry) bool) int {
+	return c.removeMatching(match, EvictionFlushed)
+}
+
+// removeMatching is RemoveMatching, reporting removals with reason.
+func (c *LRUCache) removeMatching(match func(e *entry) bool, reason EvictionReason) int {
+	c.mutex.Lock()
+	var candidates []string
+	for key, elem := range c.items {
+		if match(elem.Value.(*entry)) {
+			candidates = append(candidates, key)
+		}
+	}
+	c.cold.each(func(e *entry) {
+		if match(e) {
+			candidates = append(candidates, e.key)
+		}
+	})
+	c.mutex.Unlock()
+
+	removed := 0
+	batch := make([]*entry, 0, min(flushBatchSize, len(candidates)))
+	for start := 0; start < len(candidates); start += flushBatchSize {
+		end := min(start+flushBatchSize, len(candidates))
+		batch = batch[:0]
+		c.mutex.Lock()
+		for _, key := range candidates[start:end] {
+			elem, hit := c.lookupLocked(key)
+			if !hit || !match(elem.Value.(*entry)) {
+				continue
+			}
+			batch = append(batch, c.removeElement(elem))
+		}
+		c.mutex.Unlock()
+
+		for _, e := range batch {
+			c.notifyEvict(e, reason)
+		}
+		removed += len(batch)
+	}
+	return removed
+}
+
+// RemoveMatching applies the filter to every shard, one shard at a time.
+func (sc *ShardedCache) RemoveMatching(match func(e *entry) bool) int {
+	removed := 0
+	for _, shard := range sc.shards {
+		removed += shard.RemoveMatching(match)
+	}
+	return removed
+}
+
+// HandleFlush removes entries selected by optional filters:
+//   - older_than=<duration>: stored more than this long ago
+//   - newer_than=<duration>: stored less than this long ago
+//   - prefix=<string>: key starts with this prefix
+//
+// Filters combine with AND; with none given, every entry is removed. Entries
+// without a recorded timestamp count as infinitely old.
+func HandleFlush(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		now := cache.clock.Now()
+
+		var olderThan, newerThan int64 // UnixNano cut-offs; 0 = no bound
+		if raw := query.Get("older_than"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < 0 {
+				writeJSONError(w, "Invalid 'older_than' duration.", http.StatusBadRequest)
+				return
+			}
+			olderThan = now.Add(-d).UnixNano()
+		}
+		if raw := query.Get("newer_than"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < 0 {
+				writeJSONError(w, "Invalid 'newer_than' duration.", http.StatusBadRequest)
+				return
+			}
+			newerThan = now.Add(-d).UnixNano()
+		}
+		prefix := query.Get("prefix")
+
+		removed := cache.RemoveMatching(func(e *entry) bool {
+			if olderThan != 0 && e.createdAt >= olderThan {
+				return false
+			}
+			if newerThan != 0 && e.createdAt <= newerThan {
+				return false
+			}
+			return strings.HasPrefix(e.key, prefix)
+		})
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(FlushResponse{
+			Status:  "OK",
+			Removed: removed,
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// generationSweepInterval is how often the sweeper looks for a bump to
+// clean up after.
+const generationSweepInterval = 10 * time.Second
+
+// GenerationResponse structure for POST /admin/generation/bump replies
+type GenerationResponse struct {
+	Status     string `json:"status"`
+	Generation uint64 `json:"generation"`
+	Persisted  bool   `json:"persisted"` // Recorded in the snapshot file before this reply
+}
+
+// outdated reports whether e was written under an older generation than the
+// shard's current one, which makes it absent to readers. Lock entries are
+// leases rather than cached data and belong to every generation.
+func (c *LRUCache) outdated(e *entry) bool {
+	return e.generation < c.generation.Load() && e.fence == 0
+}
+
+// live reports whether e is present to readers at now (UnixNano): neither
+// expired nor outdated.
+func (c *LRUCache) live(e *entry, now int64) bool {
+	return !e.expired(now) && !c.outdated(e)
+}
+
+// Generation returns the cache generation that writes are recorded under.
+// It starts at 1.
+func (sc *ShardedCache) Generation() uint64 {
+	return sc.shards[0].generation.Load()
+}
+
+// BumpGeneration invalidates every entry written so far without removing
+// anything: lookups treat entries of older generations as misses and remove
+// them as they find them, and a sweeper clears the rest in the background.
+// Removals are reported as expired. It returns the new generation.
+func (sc *ShardedCache) BumpGeneration() uint64 {
+	sc.generationMutex.Lock()
+	defer sc.generationMutex.Unlock()
+	next := sc.Generation() + 1
+	sc.setGeneration(next)
+	log.Printf("Bumped the cache generation to %d", next)
+	return next
+}
+
+// adoptGeneration raises the generation to g, the one a snapshot was written
+// under, and reports whether entries of g are still current. A snapshot
+// older than the running generation holds only outdated entries.
+func (sc *ShardedCache) adoptGeneration(g uint64) bool {
+	sc.generationMutex.Lock()
+	defer sc.generationMutex.Unlock()
+	if g < sc.Generation() {
+		return false
+	}
+	if g > sc.Generation() {
+		sc.setGeneration(g)
+	}
+	return true
+}
+
+// setGeneration makes g current on every shard and starts the sweeper the
+// first time. MUST be called with generationMutex held.
+func (sc *ShardedCache) setGeneration(g uint64) {
+	for _, shard := range sc.shards {
+		shard.generation.Store(g)
+	}
+	if !sc.generationSweeping {
+		sc.generationSweeping = true
+		sc.workers.Go("generation-sweeper", sc.sweepGenerations)
+	}
+}
+
+// sweepGenerations removes outdated entries after each bump, one shard at a
+// time. They are misses already, so this only frees their memory.
+func (sc *ShardedCache) sweepGenerations() {
+	var swept uint64
+	ticks, stop := sc.clock.NewTicker(generationSweepInterval)
+	defer stop()
+	for range ticks {
+		g := sc.Generation()
+		if g == swept {
+			continue
+		}
+		removed := 0
+		for _, shard := range sc.shards {
+			removed += shard.removeMatching(shard.outdated, EvictionExpired)
+		}
+		swept = g
+		if removed > 0 {
+			log.Printf("Removed %d entries older than generation %d", removed, g)
+		}
+	}
+}
+
+// HandleGenerationBump handles POST /admin/generation/bump. With snapshots
+// configured the new generation is written to the snapshot file before the
+// reply, so a restart cannot bring the invalidated entries back.
+func HandleGenerationBump(cache *ShardedCache, snapshotter *Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := GenerationResponse{Status: "OK", Generation: cache.BumpGeneration()}
+		if snapshotter != nil {
+			if err := snapshotter.Save(); err != nil {
+				log.Printf("Warning: generation %d is not persisted yet: %v", resp.Generation, err)
+			} else {
+				resp.Persisted = true
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxBulkGetKeys is the default bound on how many keys one POST /get/bulk
+// may read (-max-bulk-get-keys).
+const maxBulkGetKeys = 1000
+
+// errTooManyKeys fails a bulk request that names more keys than its
+// endpoint allows, before any of them is looked at.
+var errTooManyKeys = errors.New("too many keys")
+
+// Reply shapes of POST /get/bulk, selected with ?format=.
+const (
+	BulkGetFormatLists = "lists" // Default: found values by key plus a missing list
+	BulkGetFormatList  = "list"  // One result per requested key, in request order
+)
+
+// GetBulkRequest structure for POST /get/bulk bodies
+type GetBulkRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// GetBulkResponse structure for POST /get/bulk replies in the lists format
+type GetBulkResponse struct {
+	Status    string            `json:"status"`
+	Found     map[string]string `json:"found"`
+	Missing   []string          `json:"missing"`
+	Forbidden []string          `json:"forbidden,omitempty"` // Keys whose read ACL does not list the request's token
+}
+
+// Read modes of POST /get/bulk, selected with ?consistency=.
+const (
+	BulkGetConsistencyKey   = "key"   // Default: every key is read on its own
+	BulkGetConsistencyShard = "shard" // The keys of a shard are read under one lock hold
+)
+
+// GetShardConsistentCtx looks up keys like GetCtx without stale values, but
+// reads all the keys of a shard under a single hold of its lock, so the
+// values from one shard all come from the same moment. Shards are read one
+// after another, so keys on different shards may not. Results are in the
+// order of keys. Read snapshots are bypassed, since they lag behind.
+func (sc *ShardedCache) GetShardConsistentCtx(ctx context.Context, keys []string) ([]Item, []bool, error) {
+	positions := make([][]int, len(sc.shards))
+	for i, key := range keys {
+		index := sc.getShardIndex(key)
+		positions[index] = append(positions[index], i)
+	}
+
+	items := make([]Item, len(keys))
+	found := make([]bool, len(keys))
+	expired := make([]*entry, len(keys))
+	refreshDue := make([]*RefreshSource, len(keys))
+	for index, shardPositions := range positions {
+		if len(shardPositions) == 0 {
+			continue
+		}
+		shard := sc.shards[index]
+		if err := shard.lockCtx(ctx); err != nil {
+			return nil, nil, err
+		}
+		for _, i := range shardPositions {
+			items[i], found[i], expired[i], refreshDue[i] = shard.getLocked(keys[i], staleOwnWindow)
+		}
+		shard.mutex.Unlock()
+
+		for _, i := range shardPositions {
+			shard.afterGet(keys[i], expired[i], refreshDue[i])
+			sc.countRead(items[i], found[i])
+			sc.trace.record(traceGet, keys[i], len(items[i].Value), 0)
+		}
+	}
+	return items, found, nil
+}
+
+// BulkGetResult is one key of a POST /get/bulk?format=list reply.
+type BulkGetResult struct {
+	Key       string  `json:"key"`
+	Found     bool    `json:"found"`
+	Value     *string `json:"value"`               // null when not found or forbidden
+	Forbidden bool    `json:"forbidden,omitempty"` // The key's read ACL does not list the request's token
+}
+
+// GetBulkListResponse structure for POST /get/bulk?format=list replies
+type GetBulkListResponse struct {
+	Status  string          `json:"status"`
+	Results []BulkGetResult `json:"results"`
+}
+
+// HandleGetBulk handles POST /get/bulk: read up to maxKeys keys, each looked
+// up on its own like GET /get. Misses are not an error. The default
+// reply splits the keys into found and missing; ?format=list returns one
+// {key, found, value} object per requested key, in request order. With
+// ?consistency=shard the keys of each shard are read at one moment (see
+// GetShardConsistentCtx). Keys holding an entry the request's token may not
+// read are reported as forbidden, without their value.
+func HandleGetBulk(cache *ShardedCache, misses *MissLog, maxKeys int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req GetBulkRequest
+
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "":
+			format = BulkGetFormatLists
+		case BulkGetFormatLists, BulkGetFormatList:
+		default:
+			writeJSONError(w, fmt.Sprintf("Unknown format %q, expected %q or %q.", format, BulkGetFormatLists, BulkGetFormatList), http.StatusBadRequest)
+			return
+		}
+		consistency := r.URL.Query().Get("consistency")
+		switch consistency {
+		case "":
+			consistency = BulkGetConsistencyKey
+		case BulkGetConsistencyKey, BulkGetConsistencyShard:
+		default:
+			writeJSONError(w, fmt.Sprintf("Unknown consistency %q, expected %q or %q.", consistency, BulkGetConsistencyKey, BulkGetConsistencyShard), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) == 0 {
+			writeJSONError(w, "Keys cannot be empty.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) > maxKeys {
+			writeCacheError(w, fmt.Errorf("%w: at most %d keys may be read at once", errTooManyKeys, maxKeys))
+			return
+		}
+		keys := make([]string, len(req.Keys))
+		for i, key := range req.Keys {
+			keys[i] = cache.trimKey(key)
+			if msg := validateKey(keys[i]); msg != "" {
+				writeJSONError(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
+
+		items := make([]Item, len(keys))
+		found := make([]bool, len(keys))
+		if consistency == BulkGetConsistencyShard {
+			var err error
+			if items, found, err = cache.GetShardConsistentCtx(r.Context(), keys); err != nil {
+				writeCacheError(w, err)
+				return
+			}
+		} else {
+			for i, key := range keys {
+				var err error
+				if items[i], found[i], err = cache.GetCtx(r.Context(), key, false); err != nil {
+					writeCacheError(w, err)
+					return
+				}
+			}
+		}
+
+		reader := requestReader(r)
+		results := make([]BulkGetResult, len(keys))
+		for i, key := range keys {
+			results[i] = BulkGetResult{Key: key, Found: found[i]}
+			if found[i] && !items[i].ReadableBy(reader) {
+				results[i].Found, results[i].Forbidden = false, true
+			} else if found[i] {
+				results[i].Value = &items[i].Value
+			} else {
+				misses.Record(key)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if format == BulkGetFormatList {
+			json.NewEncoder(w).Encode(GetBulkListResponse{Status: "OK", Results: results})
+			return
+		}
+		resp := GetBulkResponse{Status: "OK", Found: make(map[string]string), Missing: []string{}}
+		for _, res := range results {
+			if res.Found {
+				resp.Found[res.Key] = *res.Value
+			} else if res.Forbidden {
+				resp.Forbidden = append(resp.Forbidden, res.Key)
+			} else {
+				resp.Missing = append(resp.Missing, res.Key)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// bulkKeys returns n keys named key:0 to key:n-1.
+func bulkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	return keys
+}
+
+func TestBulkEndpointsCapTheKeyCount(t *testing.T) {
+	const limit = 50
+	for _, tc := range []struct {
+		name    string
+		handler func(cache *ShardedCache) http.HandlerFunc
+		request func(keys []string) *http.Request
+	}{
+		{"get/bulk", func(c *ShardedCache) http.HandlerFunc { return HandleGetBulk(c, nil, limit) },
+			func(keys []string) *http.Request {
+				body, _ := json.Marshal(GetBulkRequest{Keys: keys})
+				return httptest.NewRequest(http.MethodPost, "/get/bulk", bytes.NewReader(body))
+			}},
+		{"get/fallback", func(c *ShardedCache) http.HandlerFunc { return HandleGetFallback(c, nil, limit) },
+			func(keys []string) *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/get/fallback?key="+strings.Join(keys, "&key="), nil)
+			}},
+		{"add/bulk", func(c *ShardedCache) http.HandlerFunc { return HandleAddBulk(c, limit, nil) },
+			func(keys []string) *http.Request {
+				pairs := make(map[string]string, len(keys))
+				for _, key := range keys {
+					pairs["new:"+key] = "v"
+				}
+				body, _ := json.Marshal(AddBulkRequest{Pairs: pairs})
+				return httptest.NewRequest(http.MethodPost, "/add/bulk", bytes.NewReader(body))
+			}},
+		{"bulk/delete", func(c *ShardedCache) http.HandlerFunc { return HandleBulkDelete(c, limit) },
+			func(keys []string) *http.Request {
+				body, _ := json.Marshal(BulkDeleteRequest{Keys: keys})
+				return httptest.NewRequest(http.MethodPost, "/bulk/delete", bytes.NewReader(body))
+			}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, n := range []int{limit, limit + 1} {
+				cache := NewShardedCache(4, 1000, false)
+				for _, key := range bulkKeys(limit + 1) {
+					cache.Put(key, "v")
+				}
+				rec := httptest.NewRecorder()
+				tc.handler(cache)(rec, tc.request(bulkKeys(n)))
+
+				if n == limit {
+					if rec.Code != http.StatusOK {
+						t.Errorf("%d keys, at the limit: status %d: %s", n, rec.Code, rec.Body)
+					}
+					continue
+				}
+				var reply GenericErrorResponse
+				json.Unmarshal(rec.Body.Bytes(), &reply)
+				if rec.Code != http.StatusBadRequest || reply.Code != "too_many_keys" || !strings.Contains(reply.Message, "at most 50") {
+					t.Errorf("%d keys, over the limit: status %d, %+v", n, rec.Code, reply)
+				}
+				if got := cache.Len(); got != limit+1 {
+					t.Errorf("%d entries after the refused request, want it to do nothing", got)
+				}
+			}
+		})
+	}
+}
+
+// TestShardConsistentBulkGet rewrites a group of keys on one shard in order,
+// key 0 first, while reading them with ?consistency=shard. A read from one
+// moment sees the versions never rise along the group and span at most one
+// write pass; a read interleaved with the writer could see a later key ahead.
+func TestShardConsistentBulkGet(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4)) // Lets the writer run mid-read
+	cache := NewShardedCache(4, 1000, false)
+	var group []string
+	for _, key := range bulkKeys(1000) {
+		if cache.getShardIndex(key) == 0 && len(group) < 16 {
+			group = append(group, key)
+		}
+	}
+	for _, key := range group {
+		cache.Put(key, "0")
+	}
+	body, _ := json.Marshal(GetBulkRequest{Keys: group})
+	handler := HandleGetBulk(cache, nil, 100)
+
+	done := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for version := 1; ; version++ {
+			for _, key := range group {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				cache.Put(key, strconv.Itoa(version))
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-writerDone
+	}()
+
+	for read := 0; read < 2000; read++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/get/bulk?format=list&consistency=shard", bytes.NewReader(body)))
+		var reply GetBulkListResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		versions := make([]int, len(reply.Results))
+		for i, result := range reply.Results {
+			if !result.Found || result.Value == nil {
+				t.Fatalf("%s missing", result.Key)
+			}
+			versions[i], _ = strconv.Atoi(*result.Value)
+		}
+		for i := 1; i < len(versions); i++ {
+			if versions[i] > versions[i-1] || versions[0]-versions[i] > 1 {
+				t.Fatalf("read %d saw versions %v, not one moment of the shard", read, versions)
+			}
+		}
+	}
+}
+
+func TestBulkGetRejectsUnknownConsistency(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	body, _ := json.Marshal(GetBulkRequest{Keys: []string{"a"}})
+	rec := httptest.NewRecorder()
+	HandleGetBulk(cache, nil, 100)(rec, httptest.NewRequest(http.MethodPost, "/get/bulk?consistency=global", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "consistency") {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxFallbackKeys is the default bound on how many keys one GET
+// /get/fallback may try (-max-fallback-keys).
+const maxFallbackKeys = 32
+
+// GetFallbackResponse structure for GET /get/fallback replies
+type GetFallbackResponse struct {
+	Status    string `json:"status"`
+	Key       string `json:"key"`   // The key that hit
+	Index     int    `json:"index"` // Its position among the requested keys, from 0
+	Value     string `json:"value"`
+	Encoding  string `json:"encoding"`
+	Immutable bool   `json:"immutable,omitempty"`
+}
+
+// HandleGetFallback handles GET /get/fallback?key=a&key=b...: return the
+// first of the keys, in request order, that holds a value. Keys are read one
+// by one like GET /get and the lookup stops at the first hit, so only that
+// key counts as used for LRU purposes and keys after it are not read. The
+// keys tried before it are recorded as misses. 404 only if every key misses,
+// and 403 if the first hit has a read ACL that does not list the request's
+// token.
+func HandleGetFallback(cache *ShardedCache, misses *MissLog, maxKeys int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := queryKeys(r, cache, maxKeys+1)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if len(keys) == 0 {
+			writeJSONError(w, "Missing 'key' query parameter.", http.StatusBadRequest)
+			return
+		}
+		if len(keys) > maxKeys {
+			writeCacheError(w, fmt.Errorf("%w: at most %d keys may be tried at once", errTooManyKeys, maxKeys))
+			return
+		}
+		for _, key := range keys {
+			if msg := validateKey(key); msg != "" {
+				writeJSONError(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
+
+		reader := requestReader(r)
+		for i, key := range keys {
+			item, found, err := cache.GetCtx(r.Context(), key, false)
+			if err != nil {
+				writeCacheError(w, err)
+				return
+			}
+			if !found {
+				misses.Record(key)
+				continue
+			}
+			if !item.ReadableBy(reader) {
+				writeCacheError(w, forbidden(key))
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(GetFallbackResponse{
+				Status:    "OK",
+				Key:       key,
+				Index:     i,
+				Value:     item.Value,
+				Encoding:  item.Encoding.String(),
+				Immutable: item.Immutable,
+			})
+			return
+		}
+		writeJSONError(w, "None of the keys were found.", http.StatusNotFound)
+	}
+}
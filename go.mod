@@ -1,3 +1,5 @@
 module kv-go-cache
 
 go 1.24.1
+
+require golang.org/x/text v0.30.0
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// healthWindow is how many one-second latency samples the recent p99 covers.
+const healthWindow = 10
+
+// readyMinGets is how many GETs the hit ratio window must hold before the
+// ratio is reported, or can fail readiness.
+const readyMinGets = 100
+
+// HealthWeights weigh the load signals behind the health score.
+type HealthWeights struct {
+	InFlight float64 `json:"inflight"`
+	Latency  float64 `json:"latency"`
+	Memory   float64 `json:"memory"`
+	Eviction float64 `json:"eviction"`
+}
+
+// parseHealthWeights reads weights given as "inflight=0.4,latency=0.3,...".
+// Signals that are not named get a weight of 0.
+func parseHealthWeights(spec string) (HealthWeights, error) {
+	var w HealthWeights
+	fields := map[string]*float64{
+		"inflight": &w.InFlight,
+		"latency":  &w.Latency,
+		"memory":   &w.Memory,
+		"eviction": &w.Eviction,
+	}
+	for _, item := range splitList(spec) {
+		name, raw, _ := strings.Cut(item, "=")
+		field, ok := fields[strings.TrimSpace(name)]
+		if !ok {
+			return w, fmt.Errorf("unknown signal %q, expected inflight, latency, memory or eviction", name)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || v < 0 {
+			return w, fmt.Errorf("invalid weight %q", item)
+		}
+		*field = v
+	}
+	if w.InFlight+w.Latency+w.Memory+w.Eviction == 0 {
+		return w, fmt.Errorf("at least one weight must be positive")
+	}
+	return w, nil
+}
+
+// HealthLoads are the load signals, each scaled to 0 (idle) .. 1 (saturated).
+type HealthLoads struct {
+	InFlight float64 `json:"inflight"`
+	Latency  float64 `json:"latency"`
+	Memory   float64 `json:"memory"`
+	Eviction float64 `json:"eviction"`
+}
+
+// HealthScoreResponse structure for GET /health/score replies
+type HealthScoreResponse struct {
+	Status   string        `json:"status"`
+	Score    int           `json:"score"` // 100 = idle, 0 = saturated
+	Loads    HealthLoads   `json:"loads"`
+	Weights  HealthWeights `json:"weights"`
+	InFlight int64         `json:"inflight"`
+	P99Ms    float64       `json:"p99_ms"` // Over the last 10 seconds
+}
+
+// HealthScorer turns load signals into a 0-100 score load balancers can
+// weigh nodes by. Everything but the in-flight count is sampled once a second
+// by a background goroutine, so reading the score costs a few atomic loads
+// even while the node is overloaded.
+type HealthScorer struct {
+	metrics       *Metrics
+	cache         *ShardedCache
+	weights       HealthWeights
+	maxInFlight   int
+	latencyTarget time.Duration
+
+	// Latest samples, as math.Float64bits.
+	p99      atomic.Uint64 // Seconds
+	memory   atomic.Uint64
+	eviction atomic.Uint64
+
+	// Cumulative latency bucket counts of the last healthWindow seconds,
+	// only touched by the sampling goroutine.
+	history [healthWindow][len(latencyBuckets) + 1]uint64
+	next    int
+
+	// GET hit ratio over hitWindow, which fails readiness below minHitRatio
+	// when that is positive. hits holds the cumulative GET hits and misses
+	// of the last hitWindow seconds and is only touched by the sampling
+	// goroutine.
+	minHitRatio float64
+	hitWindow   time.Duration
+	hits        [][2]uint64
+	hitNext     int
+	hitRatio    atomic.Uint64 // math.Float64bits, NaN below readyMinGets GETs
+	hitGets     atomic.Uint64 // GETs in the window
+}
+
+// HitRatio is the recent GET hit ratio reported by /health.
+type HitRatio struct {
+	Ratio  float64 // NaN when the window holds fewer than readyMinGets GETs
+	Gets   uint64
+	Window time.Duration
+}
+
+// Known reports whether enough GETs were seen to tell the ratio.
+func (r HitRatio) Known() bool { return !math.IsNaN(r.Ratio) }
+
+func (r HitRatio) String() string {
+	if !r.Known() {
+		return fmt.Sprintf("hit_ratio=unknown gets=%d window=%s", r.Gets, r.Window)
+	}
+	return fmt.Sprintf("hit_ratio=%.4f gets=%d window=%s", r.Ratio, r.Gets, r.Window)
+}
+
+// NewHealthScorer creates a scorer and starts sampling. The GET hit ratio is
+// measured over hitWindow, rounded to whole seconds, and fails Ready below
+// minHitRatio; a minHitRatio of 0 only reports it.
+func NewHealthScorer(m *Metrics, cache *ShardedCache, weights HealthWeights, maxInFlight int, latencyTarget time.Duration,
+	minHitRatio float64, hitWindow time.Duration) *HealthScorer {
+	hitWindow = max(hitWindow.Round(time.Second), time.Second)
+	h := &HealthScorer{
+		metrics:       m,
+		cache:         cache,
+		weights:       weights,
+		maxInFlight:   max(maxInFlight, 1),
+		latencyTarget: max(latencyTarget, time.Millisecond),
+		minHitRatio:   minHitRatio,
+		hitWindow:     hitWindow,
+		hits:          make([][2]uint64, int(hitWindow/time.Second)),
+	}
+	h.hitRatio.Store(math.Float64bits(math.NaN()))
+	cache.workers.Go("health-sampler", func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.sample()
+		}
+	})
+	return h
+}
+
+// sample refreshes the cached latency, memory and eviction signals.
+func (h *HealthScorer) sample() {
+	// Recent p99: the bucket holding the 99th percentile of the requests
+	// completed since the oldest sample in the window.
+	var now [len(latencyBuckets) + 1]uint64
+	for op := range numOps {
+		for i := range now {
+			now[i] += h.metrics.latency[op].buckets[i].Load()
+		}
+	}
+	oldest := h.history[h.next]
+	h.history[h.next] = now
+	h.next = (h.next + 1) % healthWindow
+	var total uint64
+	for i := range now {
+		total += now[i] - oldest[i]
+	}
+	var p99 float64
+	if total > 0 {
+		var seen uint64
+		for i := range now {
+			seen += now[i] - oldest[i]
+			if float64(seen) >= 0.99*float64(total) {
+				if i < len(latencyBuckets) {
+					p99 = latencyBuckets[i]
+				} else {
+					p99 = 2 * latencyBuckets[len(latencyBuckets)-1] // Beyond the last bucket
+				}
+				break
+			}
+		}
+	}
+	h.p99.Store(math.Float64bits(p99))
+
+	// Memory: bytes mapped by the runtime against GOMEMLIMIT, when set.
+	var memory float64
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 && limit > 0 {
+		memory = float64(memoryInUse()) / float64(limit)
+	}
+	h.memory.Store(math.Float64bits(memory))
+
+	var eviction float64
+	for _, ratio := range h.cache.ShardPressure() {
+		eviction = max(eviction, ratio)
+	}
+	h.eviction.Store(math.Float64bits(eviction))
+
+	// Hit ratio: GETs completed since the oldest sample in its window. Until
+	// the window has filled, the oldest sample is the zero the counters
+	// started from.
+	gets := [2]uint64{h.metrics.requests[OpGet][OutcomeHit].Load(), h.metrics.requests[OpGet][OutcomeMiss].Load()}
+	since := h.hits[h.hitNext]
+	h.hits[h.hitNext] = gets
+	h.hitNext = (h.hitNext + 1) % len(h.hits)
+	hits, total := gets[0]-since[0], gets[0]+gets[1]-since[0]-since[1]
+	ratio := math.NaN()
+	if total >= readyMinGets {
+		ratio = float64(hits) / float64(total)
+	}
+	h.hitRatio.Store(math.Float64bits(ratio))
+	h.hitGets.Store(total)
+}
+
+// HitRatio returns the GET hit ratio of the last sampled window.
+func (h *HealthScorer) HitRatio() HitRatio {
+	return HitRatio{Ratio: math.Float64frombits(h.hitRatio.Load()), Gets: h.hitGets.Load(), Window: h.hitWindow}
+}
+
+// Ready reports false when the hit ratio check is enabled and the recent
+// ratio is known and below the threshold.
+func (h *HealthScorer) Ready(ratio HitRatio) bool {
+	return h.minHitRatio <= 0 || !ratio.Known() || ratio.Ratio >= h.minHitRatio
+}
+
+// memoryInUse returns the bytes mapped by the Go runtime, less heap memory
+// released back to the operating system.
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// Score returns the current score with the signals it was computed from.
+func (h *HealthScorer) Score() HealthScoreResponse {
+	inFlight := h.metrics.inFlight.Load()
+	p99 := math.Float64frombits(h.p99.Load())
+	clamp := func(v float64) float64 { return min(max(v, 0), 1) }
+	loads := HealthLoads{
+		InFlight: clamp(float64(inFlight) / float64(h.maxInFlight)),
+		Latency:  clamp(p99 / h.latencyTarget.Seconds()),
+		Memory:   clamp(math.Float64frombits(h.memory.Load())),
+		Eviction: clamp(math.Float64frombits(h.eviction.Load())),
+	}
+	w := h.weights
+	load := (w.InFlight*loads.InFlight + w.Latency*loads.Latency + w.Memory*loads.Memory + w.Eviction*loads.Eviction) /
+		(w.InFlight + w.Latency + w.Memory + w.Eviction)
+	return HealthScoreResponse{
+		Status:   "OK",
+		Score:    int(math.Round(100 * (1 - load))),
+		Loads:    loads,
+		Weights:  w,
+		InFlight: inFlight,
+		P99Ms:    p99 * 1000,
+	}
+}
+
+func HandleHealthScore(h *HealthScorer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.Score())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHealthScoreDegradesMonotonically(t *testing.T) {
+	h := &HealthScorer{
+		metrics:       NewMetrics(),
+		weights:       HealthWeights{InFlight: 0.4, Latency: 0.3, Memory: 0.15, Eviction: 0.15},
+		maxInFlight:   100,
+		latencyTarget: 100 * time.Millisecond,
+	}
+	signals := []struct {
+		name  string
+		raise func(level float64)
+	}{
+		{"inflight", func(level float64) { h.metrics.inFlight.Store(int64(level * 100)) }},
+		{"latency", func(level float64) { h.p99.Store(math.Float64bits(level * 0.1)) }},
+		{"memory", func(level float64) { h.memory.Store(math.Float64bits(level)) }},
+		{"eviction", func(level float64) { h.eviction.Store(math.Float64bits(level)) }},
+	}
+
+	last := h.Score().Score
+	if last != 100 {
+		t.Fatalf("idle score = %d, want 100", last)
+	}
+	for _, signal := range signals {
+		for _, level := range []float64{0.25, 0.5, 0.75, 1, 2} {
+			signal.raise(level)
+			score := h.Score().Score
+			if score > last {
+				t.Fatalf("score rose from %d to %d as %s went to %v", last, score, signal.name, level)
+			}
+			last = score
+		}
+	}
+	if last != 0 {
+		t.Errorf("score with every signal saturated = %d, want 0", last)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	defaultHotKeysTop = 20
+	maxHotKeysTop     = 1000
+)
+
+// HotKey is one entry of a GET /admin/hotkeys reply.
+type HotKey struct {
+	Key   string `json:"key"`
+	Reads uint64 `json:"reads"`
+}
+
+// HotKeysResponse structure for GET /admin/hotkeys replies
+type HotKeysResponse struct {
+	Status string   `json:"status"`
+	Keys   []HotKey `json:"keys"`
+}
+
+// EnableReadCounting makes GETs count hits per key, for HotKeys. Each entry
+// carries its own atomic counter, so counting adds no lock and readers of
+// different keys never touch the same counter. Must be called before the
+// cache starts serving requests.
+func (sc *ShardedCache) EnableReadCounting() {
+	sc.countReads = true
+}
+
+// countRead records a GET hit on item when read counting is enabled.
+func (sc *ShardedCache) countRead(item Item, found bool) {
+	if sc.countReads && found && item.reads != nil {
+		item.reads.Add(1)
+	}
+}
+
+// hotKeysLocked returns up to top of the shard's hot entries with the most
+// reads, most read first. Cold entries are idle by definition and skipped.
+// MUST be called with the mutex held.
+func (c *LRUCache) hotKeysLocked(top int) []HotKey {
+	var out []HotKey
+	for key, elem := range c.items {
+		if reads := elem.Value.(*entry).reads.Load(); reads > 0 {
+			out = append(out, HotKey{Key: key, Reads: reads})
+		}
+	}
+	sortHotKeys(out)
+	return out[:min(top, len(out))]
+}
+
+// HotKeys returns up to top keys with the most GET hits across all shards.
+// Counts live on the entries: they survive updates of a key but start over
+// once it is removed, evicted or moved to the cold tier.
+func (sc *ShardedCache) HotKeys(top int) []HotKey {
+	out := []HotKey{}
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		out = append(out, shard.hotKeysLocked(top)...)
+		shard.mutex.Unlock()
+	}
+	sortHotKeys(out)
+	return out[:min(top, len(out))]
+}
+
+// sortHotKeys orders keys by reads, descending, then by key.
+func sortHotKeys(keys []HotKey) {
+	slices.SortFunc(keys, func(a, b HotKey) int {
+		if c := cmp.Compare(b.Reads, a.Reads); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+}
+
+func HandleHotKeys(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		top := defaultHotKeysTop
+		if raw := r.URL.Query().Get("top"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 || n > maxHotKeysTop {
+				writeJSONError(w, "Invalid 'top' parameter, expected a number between 1 and 1000.", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(HotKeysResponse{
+			Status: "OK",
+			Keys:   cache.HotKeys(top),
+		})
+	}
+}
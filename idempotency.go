@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeyLength caps the Idempotency-Key header, in bytes.
+const maxIdempotencyKeyLength = 255
+
+// idempotentResponse is a stored reply to a write sent with an
+// Idempotency-Key. Until done is set the original request is still running.
+type idempotentResponse struct {
+	key         string
+	fingerprint [sha256.Size]byte // Method, URL and body of the original request
+	storedAt    int64             // UnixNano
+	done        bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// IdempotencyStore remembers the replies to recent writes sent with an
+// Idempotency-Key header, so that a retried write is answered with the
+// original reply instead of being applied twice. It holds at most max keys,
+// each for ttl; the oldest are dropped first. A key whose request never
+// finished is also released after ttl.
+//
+// All methods are safe to call on a nil *IdempotencyStore, which stores
+// nothing.
+type IdempotencyStore struct {
+	max int
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Oldest first
+}
+
+// NewIdempotencyStore creates a store, or returns nil if max or ttl is not
+// positive.
+func NewIdempotencyStore(max int, ttl time.Duration) *IdempotencyStore {
+	if max <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &IdempotencyStore{max: max, ttl: ttl, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// begin looks key up. It returns the stored reply of a finished request with
+// replay set, or reserves key for a new request and returns the reservation
+// to pass to finish. It reports conflict if key is in use by a running
+// request or by one with a different fingerprint.
+func (s *IdempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (resp *idempotentResponse, replay bool, conflict string) {
+	now := time.Now().UnixNano()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Drop expired keys from the old end.
+	for elem := s.order.Front(); elem != nil; elem = s.order.Front() {
+		resp := elem.Value.(*idempotentResponse)
+		if now-resp.storedAt < int64(s.ttl) {
+			break
+		}
+		s.order.Remove(elem)
+		delete(s.entries, resp.key)
+	}
+
+	if elem, ok := s.entries[key]; ok {
+		resp := elem.Value.(*idempotentResponse)
+		switch {
+		case resp.fingerprint != fingerprint:
+			return nil, false, "Idempotency-Key was already used for a different request."
+		case !resp.done:
+			return nil, false, "A request with this Idempotency-Key is still in progress."
+		}
+		return resp, true, ""
+	}
+
+	if s.order.Len() >= s.max {
+		if oldest := s.order.Front(); oldest != nil {
+			s.order.Remove(oldest)
+			delete(s.entries, oldest.Value.(*idempotentResponse).key)
+		}
+	}
+	resp = &idempotentResponse{key: key, fingerprint: fingerprint, storedAt: now}
+	s.entries[key] = s.order.PushBack(resp)
+	return resp, false, ""
+}
+
+// finish stores the reply for a reservation made by begin. Replies that may
+// succeed on a retry (server errors and 429) are not kept, which frees the
+// key.
+func (s *IdempotencyStore) finish(resp *idempotentResponse, status int, header http.Header, body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.entries[resp.key]
+	if !ok || elem.Value != resp {
+		return // Dropped for age or room in the meantime
+	}
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		s.order.Remove(elem)
+		delete(s.entries, resp.key)
+		return
+	}
+	resp.done, resp.status, resp.header, resp.body = true, status, header, body
+}
+
+// responseCapture passes a reply through while keeping a copy of it.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// Wrap makes next idempotent for requests with an Idempotency-Key header. A
+// repeated key is answered with the stored reply and Idempotent-Replayed:
+// true; a key still in flight, or reused with another method, URL or body,
+// gets 409. Requests without the header pass straight through.
+func (s *IdempotencyStore) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if s == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, "Idempotency-Key exceeds maximum length (255 bytes).", http.StatusBadRequest)
+			return
+		}
+
+		// Hash the body the handler will see; it still applies its own limit.
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, "Request body exceeds limit (1MB).", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h := sha256.New()
+		io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+		h.Write(body)
+		var fingerprint [sha256.Size]byte
+		h.Sum(fingerprint[:0])
+
+		resp, replay, conflict := s.begin(key, fingerprint)
+		if conflict != "" {
+			writeJSONError(w, conflict, http.StatusConflict)
+			return
+		}
+		if replay {
+			for name, values := range resp.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		next(capture, r)
+		s.finish(resp, capture.status, w.Header().Clone(), capture.body.Bytes())
+	}
+}
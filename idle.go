@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// idleReapBatch bounds how many entries are reaped per shard lock hold.
+const idleReapBatch = 512
+
+// IdleStats reports idle reaping in /stats.
+type IdleStats struct {
+	MaxIdleMs int64  `json:"max_idle_ms"`
+	Reaped    uint64 `json:"reaped"` // Entries removed for being idle
+}
+
+// startTrackingAccess makes the shard maintain entry.accessedAt, treating
+// every entry already stored as used at now. MUST be called with the mutex
+// held.
+func (c *LRUCache) startTrackingAccess(now int64) {
+	if c.trackAccess {
+		return
+	}
+	c.trackAccess = true
+	for elem := c.evictList.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*entry).accessedAt = now
+	}
+}
+
+// reapIdle removes the unpinned entries last used before cutoff (UnixNano),
+// cold ones first, and returns how many it removed. Entries are taken from
+// the least recently used end, which holds the idle ones, so the walk stops
+// at the first entry used since cutoff.
+func (c *LRUCache) reapIdle(cutoff int64) int {
+	reaped := 0
+	for {
+		c.mutex.Lock()
+		batch := make([]*entry, 0, 16)
+		for len(batch) < idleReapBatch {
+			e := c.cold.takeOldestBefore(cutoff)
+			if e == nil {
+				break
+			}
+			batch = append(batch, c.forgetCold(e))
+		}
+		for elem := c.evictList.Back(); elem != nil && len(batch) < idleReapBatch; {
+			ent := elem.Value.(*entry)
+			if ent.accessedAt >= cutoff {
+				break
+			}
+			prev := elem.Prev()
+			if !ent.pinned {
+				batch = append(batch, c.removeElement(elem))
+			}
+			elem = prev
+		}
+		c.idleReaped.Add(uint64(len(batch)))
+		c.mutex.Unlock()
+
+		for _, e := range batch {
+			c.notifyEvict(e, EvictionIdle)
+		}
+		reaped += len(batch)
+		if len(batch) < idleReapBatch {
+			return reaped
+		}
+	}
+}
+
+// EnableIdleReaping removes entries that have not been read or written for
+// maxIdle, whether or not their shard is full, checking every quarter of
+// maxIdle (at least once a second). Pinned entries are kept. Unlike a
+// sliding expiry it applies to every entry alike. Must be called before the
+// cache starts serving requests.
+func (sc *ShardedCache) EnableIdleReaping(maxIdle time.Duration) {
+	if maxIdle <= 0 {
+		return
+	}
+	now := sc.now()
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		shard.startTrackingAccess(now)
+		shard.mutex.Unlock()
+	}
+	sc.maxIdle = maxIdle
+	sc.workers.Go("idle-reaper", func() {
+		ticks, stop := sc.clock.NewTicker(max(maxIdle/4, time.Second))
+		defer stop()
+		for range ticks {
+			cutoff := sc.now() - int64(maxIdle)
+			for _, shard := range sc.shards {
+				shard.reapIdle(cutoff)
+			}
+		}
+	})
+	log.Printf("Removing entries idle longer than %s", maxIdle)
+}
+
+// IdleStats sums idle reaping over all shards, or returns nil when it is
+// disabled.
+func (sc *ShardedCache) IdleStats() *IdleStats {
+	if sc.maxIdle <= 0 {
+		return nil
+	}
+	stats := &IdleStats{MaxIdleMs: sc.maxIdle.Milliseconds()}
+	for _, shard := range sc.shards {
+		stats.Reaped += shard.idleReaped.Load()
+	}
+	return stats
+}
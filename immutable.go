@@ -0,0 +1,22 @@
+package main
+
+import "strings"
+
+// SetImmutablePrefixes makes every key starting with one of prefixes
+// immutable when it is written, as if the write had asked for it. Must be
+// called before the cache starts serving requests.
+func (sc *ShardedCache) SetImmutablePrefixes(prefixes []string) {
+	for _, shard := range sc.shards {
+		shard.immutablePrefixes = prefixes
+	}
+}
+
+// immutablePrefix reports whether key falls under an immutable prefix.
+func (c *LRUCache) immutablePrefix(key string) bool {
+	for _, prefix := range c.immutablePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImmutablePutIsRefused(t *testing.T) {
+	cache := NewShardedCache(1, 3, false)
+	if rec := doPut(t, cache, PutRequest{Key: "blob:1", Value: "v1", Immutable: true}); rec.Code != http.StatusOK {
+		t.Fatalf("first PUT: status %d", rec.Code)
+	}
+	cache.Put("a", "v")
+	cache.Put("b", "v")
+
+	rec := doPut(t, cache, PutRequest{Key: "blob:1", Value: "v2"})
+	var reply GenericErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	if rec.Code != http.StatusConflict || reply.Code != "immutable_key" {
+		t.Errorf("overwrite: status %d, code %q, want 409 immutable_key", rec.Code, reply.Code)
+	}
+
+	// The refused write left blob:1 the least recently used entry
+	cache.Put("c", "v")
+	if cache.Exists("blob:1") {
+		t.Error("the refused write moved the entry to the front")
+	}
+
+	doPut(t, cache, PutRequest{Key: "blob:2", Value: "v1", Immutable: true})
+	doPut(t, cache, PutRequest{Key: "blob:2", Value: "v2"})
+	if rec, resp := doGet(t, cache, "key=blob:2"); rec.Code != http.StatusOK || resp.Value != "v1" || !resp.Immutable {
+		t.Errorf("GET after a refused write: status %d, %+v", rec.Code, resp)
+	}
+}
+
+func TestImmutablePrefixes(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.SetImmutablePrefixes([]string{"sha256:"})
+	cache.Put("sha256:abc", "v1")
+	if res := cache.PutWithOptions("sha256:abc", "v2", PutOptions{}); !res.Refused {
+		t.Error("overwrite under an immutable prefix was applied")
+	}
+	cache.Put("other", "v1")
+	if res := cache.PutWithOptions("other", "v2", PutOptions{}); res.Refused {
+		t.Error("key outside the prefixes was refused")
+	}
+}
+
+func TestImmutableKeysCanBeDeleted(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	cache.PutWithOptions("blob:1", "v1", PutOptions{Immutable: true})
+	rec := httptest.NewRecorder()
+	HandleDelete(cache)(rec, httptest.NewRequest(http.MethodPost, "/delete?key=blob:1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: status %d", rec.Code)
+	}
+	if res := cache.PutWithOptions("blob:1", "v2", PutOptions{}); res.Refused {
+		t.Error("key could not be written again after its deletion")
+	}
+}
+
+func TestImmutableRefusesConditionalWrites(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.PutWithOptions("blob:1", "v1", PutOptions{Immutable: true})
+	cache.Put("plain", "v")
+
+	if err := cache.PutAllIfAbsent(map[string]string{"blob:1": "v2", "new": "v"}); !errors.Is(err, errKeysPresent) {
+		t.Errorf("PutAllIfAbsent: %v, want errKeysPresent", err)
+	}
+	if claimed, held, _ := cache.Claim([]string{"blob:1"}, "worker", time.Minute, ""); len(claimed) != 0 || held["blob:1"] != "v1" {
+		t.Errorf("Claim: claimed %v, held %v", claimed, held)
+	}
+	if _, _, err := cache.AcquireLock("blob:1", "owner", time.Minute); err == nil {
+		t.Error("AcquireLock took over an immutable key")
+	}
+	if _, _, err := cache.Update("blob:1", "", nil, func(old string) (string, error) { return "v2", nil }); !errors.Is(err, ErrImmutable) {
+		t.Errorf("Update: %v, want ErrImmutable", err)
+	}
+	if _, _, _, err := cache.MergeJSON("blob:1", "", nil, map[string]json.RawMessage{"a": json.RawMessage("1")}); !errors.Is(err, ErrImmutable) {
+		t.Errorf("MergeJSON: %v, want ErrImmutable", err)
+	}
+	if err := cache.Rename("plain", "blob:1", ""); !errors.Is(err, ErrImmutable) {
+		t.Errorf("Rename onto it: %v, want ErrImmutable", err)
+	}
+	if err := cache.Rename("blob:1", "moved", ""); !errors.Is(err, ErrImmutable) {
+		t.Errorf("Rename away: %v, want ErrImmutable", err)
+	}
+	if value, _ := cache.Get("blob:1"); value != "v1" {
+		t.Errorf("value %q after the refused writes, want v1", value)
+	}
+}
+
+func TestImportHonorsImmutablePerLine(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.PutWithOptions("blob:1", "v1", PutOptions{Immutable: true})
+	stats, err := ImportRedisLines(cache, strings.NewReader("SET blob:1 v2\nSET blob:2 v1 IMMUTABLE\nSET blob:2 v2\nSET plain v\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 2 || stats.Rejected != 2 {
+		t.Errorf("imported %d, rejected %d, want 2 and 2", stats.Imported, stats.Rejected)
+	}
+	for key, want := range map[string]string{"blob:1": "v1", "blob:2": "v1", "plain": "v"} {
+		if value, _ := cache.Get(key); value != want {
+			t.Errorf("%s = %q, want %q", key, value, want)
+		}
+	}
+}
+
+func TestImmutableSurvivesSnapshots(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	cache.PutWithOptions("blob:1", "v1", PutOptions{Immutable: true})
+	cache.Put("plain", "v")
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := NewSnapshotter(cache, path, time.Hour).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewShardedCache(4, 100, false)
+	if _, err := loadSnapshot(restored, path); err != nil {
+		t.Fatal(err)
+	}
+	if res := restored.PutWithOptions("blob:1", "v2", PutOptions{}); !res.Refused {
+		t.Error("restored entry accepted an overwrite")
+	}
+	if res := restored.PutWithOptions("plain", "w", PutOptions{}); res.Refused {
+		t.Error("restored plain entry refused an overwrite")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// importMaxBodyBytes bounds the size of a POST /import/redis body.
+const importMaxBodyBytes = 64 << 20
+
+// ImportStats summarises one Redis dump import.
+type ImportStats struct {
+	Imported int            `json:"imported"`
+	Rejected int            `json:"rejected"` // Malformed SET lines or keys/values over the limits
+	Skipped  map[string]int `json:"skipped"`  // Unsupported commands, by lowercased name
+}
+
+// ImportResponse structure for POST /import/redis replies
+type ImportResponse struct {
+	Status string `json:"status"`
+	ImportStats
+}
+
+// ImportRedisLines loads a Redis-style line dump, one command per line as
+// redis-cli accepts it (e.g. `SET "user:1" "Ada" EX 60`), into the cache.
+// Only SET with optional EX/PX (and this cache's COST/ENCODING extensions) is
+// supported; other commands are counted in Skipped rather than failing the
+// import. Blank lines and lines starting with '#' are ignored. Writes to
+// immutable keys are counted as rejected. An error is returned only if
+// reading r fails, in which case the lines before the failure have already
+// been imported.
+func ImportRedisLines(cache *ShardedCache, r io.Reader) (ImportStats, error) {
+	return scanRedisLines(r, func(e dumpEntry) bool { return e.store(cache) })
+}
+
+// ImportRedisLinesAs is ImportRedisLines on behalf of reader (see
+// requestReader), with values passed through transforms: a line whose key
+// holds a live entry with a read ACL reader is not on, or whose value a
+// transform refuses, counts as rejected, and the entry is left as it is.
+func ImportRedisLinesAs(cache *ShardedCache, r io.Reader, reader string, transforms *TransformChain) (ImportStats, error) {
+	return scanRedisLines(r, func(e dumpEntry) bool {
+		key, opts := cache.NormalizeKey(e.key), e.options()
+		value, changed, err := transforms.applyEncoded(key, e.value, e.encoding)
+		if err != nil {
+			return false
+		}
+		opts.Transforms = changed
+		opts.CheckACL, opts.Reader = true, reader
+		return !cache.PutWithOptions(key, value, opts).Refused
+	})
+}
+
+// store writes e to cache and reports whether it was accepted.
+func (e dumpEntry) store(cache *ShardedCache) bool {
+	return !cache.PutWithOptions(cache.NormalizeKey(e.key), e.value, e.options()).Refused
+}
+
+// options returns the PutOptions that store e as it was dumped.
+func (e dumpEntry) options() PutOptions {
+	return PutOptions{TTL: e.ttl, Cost: e.cost, Encoding: e.encoding, Immutable: e.immutable, Readers: e.readers, CreatedAt: e.createdAt}
+}
+
+// scanRedisLines parses a Redis-style line dump and calls fn for every valid
+// SET, counting what it imported, rejected and skipped. Entries fn refuses
+// count as rejected.
+func scanRedisLines(r io.Reader, fn func(e dumpEntry) bool) (ImportStats, error) {
+	stats := ImportStats{Skipped: make(map[string]int)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitRedisArgs(line)
+		if err != nil || len(args) == 0 {
+			stats.Rejected++
+			continue
+		}
+		if cmd := strings.ToLower(args[0]); cmd != "set" {
+			stats.Skipped[cmd]++
+			continue
+		}
+		e, ok := parseRedisSet(args[1:])
+		req := &PutRequest{Key: e.key, Value: e.value, Cost: e.cost, Encoding: e.encoding.String()}
+		if !ok || validatePut(e.key, req) != nil || !fn(e) {
+			stats.Rejected++
+			continue
+		}
+		stats.Imported++
+	}
+	return stats, scanner.Err()
+}
+
+// parseRedisSet parses the arguments of
+// `SET key value [EX seconds|PX milliseconds] [COST n] [ENCODING name] [IMMUTABLE] [ACL hash,...] [CREATED unix-ms]`.
+func parseRedisSet(args []string) (e dumpEntry, ok bool) {
+	if len(args) < 2 {
+		return dumpEntry{}, false
+	}
+	e.key, e.value = args[0], args[1]
+	for i := 2; i < len(args); i += 2 {
+		if strings.EqualFold(args[i], "immutable") {
+			e.immutable = true
+			i-- // A flag, without a value
+			continue
+		}
+		if i+1 == len(args) {
+			return dumpEntry{}, false
+		}
+		if strings.EqualFold(args[i], "encoding") {
+			if e.encoding, ok = parseEncoding(strings.ToLower(args[i+1])); !ok {
+				return dumpEntry{}, false
+			}
+			continue
+		}
+		if strings.EqualFold(args[i], "acl") {
+			if e.readers = strings.Split(args[i+1], ","); len(e.readers) > MaxACLTokens {
+				return dumpEntry{}, false
+			}
+			for _, h := range e.readers {
+				if !validACLHash(h) {
+					return dumpEntry{}, false
+				}
+			}
+			continue
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			return dumpEntry{}, false
+		}
+		switch strings.ToLower(args[i]) {
+		case "ex":
+			e.ttl = time.Duration(n) * time.Second
+		case "px":
+			e.ttl = time.Duration(n) * time.Millisecond
+		case "cost":
+			e.cost = int(min(n, MaxCost+1)) // Out of range values fail validation
+		case "created":
+			e.createdAt = int64(time.Duration(n) * time.Millisecond)
+		default:
+			return dumpEntry{}, false
+		}
+	}
+	return e, true
+}
+
+// splitRedisArgs splits a line into arguments the way redis-cli does:
+// arguments are separated by spaces and may be "double quoted" (with \n, \r,
+// \t, \b, \a, \\, \" and \xHH escapes) or 'single quoted' (with \' only).
+func splitRedisArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, errors.New("unterminated double quote")
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					case 'x':
+						if i+2 < len(line) {
+							if b, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+								c = byte(b)
+								i += 2
+								break
+							}
+						}
+						c = 'x'
+					default:
+						c = line[i]
+					}
+				}
+				arg.WriteByte(c)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, errors.New("unterminated single quote")
+				}
+				if line[i] == '\'' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg.WriteByte(line[i])
+				i++
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg.WriteByte(line[i])
+				i++
+			}
+			args = append(args, arg.String())
+			continue
+		}
+		// A closing quote must be followed by a separator or the end of line.
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// dumpEntry is one entry written out as a Redis SET line.
+type dumpEntry struct {
+	key, value string
+	ttl        time.Duration // Remaining time to live; 0 = none
+	cost       int           // Eviction weight; 0 = MinCost
+	encoding   Encoding
+	immutable  bool
+	readers    []string // Hashed read tokens (see ACLRequest); nil = no ACL
+	createdAt  int64    // UnixNano when the value was stored; 0 = unknown
+}
+
+// appendRedisSet appends e to b as a `SET key value [PX ms] [COST n] [ENCODING name] [IMMUTABLE] [ACL hash,...] [CREATED ms]`
+// line that ImportRedisLines reads back unchanged, but for the creation time,
+// which is kept to the millisecond.
+func appendRedisSet(b []byte, e dumpEntry) []byte {
+	b = append(b, "SET "...)
+	b = append(b, quoteRedisArg(e.key)...)
+	b = append(b, ' ')
+	b = append(b, quoteRedisArg(e.value)...)
+	if e.ttl > 0 {
+		b = append(b, " PX "...)
+		b = strconv.AppendInt(b, max(e.ttl.Milliseconds(), 1), 10)
+	}
+	if e.cost > MinCost {
+		b = append(b, " COST "...)
+		b = strconv.AppendInt(b, int64(e.cost), 10)
+	}
+	if e.encoding != EncodingText {
+		b = append(b, " ENCODING "...)
+		b = append(b, e.encoding.String()...)
+	}
+	if e.immutable {
+		b = append(b, " IMMUTABLE"...)
+	}
+	if len(e.readers) > 0 {
+		b = append(b, " ACL "...)
+		b = append(b, strings.Join(e.readers, ",")...)
+	}
+	if e.createdAt > 0 {
+		b = append(b, " CREATED "...)
+		b = strconv.AppendInt(b, max(time.Duration(e.createdAt).Milliseconds(), 1), 10)
+	}
+	return append(b, '\n')
+}
+
+// quoteRedisArg double-quotes s so that splitRedisArgs reads it back unchanged.
+func quoteRedisArg(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// importRedisFile imports the dump or snapshot at path at startup and logs
+// a summary. Snapshot files of any supported format version are accepted;
+// current ones are loaded in parallel (see loadSnapshot).
+func importRedisFile(cache *ShardedCache, path string, loaded *atomic.Int64) (ImportStats, error) {
+	load, err := loadSnapshotCounting(cache, path, loaded)
+	stats := load.Stats
+	if err != nil {
+		return stats, fmt.Errorf("read %s after %d entries: %w", path, stats.Imported, err)
+	}
+	log.Printf("Imported %d entries from %s in %s (format version %d, %d rejected, entries per worker %v)",
+		stats.Imported, path, load.Duration.Round(time.Millisecond), load.Info.Version, stats.Rejected, load.Workers)
+	for cmd, n := range stats.Skipped {
+		log.Printf("Warning: skipped %d unsupported %q commands in %s", n, cmd, path)
+	}
+	return stats, nil
+}
+
+func HandleImportRedis(cache *ShardedCache, transforms *TransformChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, importMaxBodyBytes)
+		stats, err := ImportRedisLinesAs(cache, r.Body, requestReader(r), transforms)
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeJSONError(w, fmt.Sprintf("Import stopped after %d entries: %v", stats.Imported, err), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ImportResponse{
+			Status:      "OK",
+			ImportStats: stats,
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Safeguards of POST /import/ndjson, which has no overall size limit.
+const (
+	ndjsonMaxObjectBytes = 1024 * 1024      // Largest single object
+	ndjsonMaxErrors      = 100              // Per-line errors listed in the reply
+	ndjsonIdleTimeout    = 30 * time.Second // Longest wait for the next object
+)
+
+var errObjectTooLarge = fmt.Errorf("object exceeds limit (%d bytes)", ndjsonMaxObjectBytes)
+
+// ImportLineError is one rejected object of a streaming import.
+type ImportLineError struct {
+	Line    int    `json:"line"` // 1-based position of the object in the stream
+	Message string `json:"message"`
+}
+
+// StreamImportResponse structure for POST /import/ndjson replies
+type StreamImportResponse struct {
+	Status        string            `json:"status"`
+	Message       string            `json:"message,omitempty"` // Why the import stopped early
+	Imported      int               `json:"imported"`
+	Rejected      int               `json:"rejected"`
+	Errors        []ImportLineError `json:"errors"`                   // The first ndjsonMaxErrors rejections
+	ErrorsOmitted int               `json:"errors_omitted,omitempty"` // Rejections beyond those
+}
+
+// objectLimitReader fails once the decoder reading from it needs more than
+// ndjsonMaxObjectBytes past the end of the last object it decoded.
+type objectLimitReader struct {
+	r    io.Reader
+	dec  *json.Decoder
+	read int64
+}
+
+func (l *objectLimitReader) Read(p []byte) (int, error) {
+	room := ndjsonMaxObjectBytes - (l.read - l.dec.InputOffset())
+	if room <= 0 {
+		return 0, errObjectTooLarge
+	}
+	if int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// HandleImportNDJSON handles POST /import/ndjson: a stream of PutRequest
+// objects, normally one per line, stored as they are decoded so memory use
+// does not grow with the size of the body. Objects that fail validation or
+// have fields of the wrong type are rejected and listed; malformed JSON, an
+// oversized object, a stalled client or the node starting to refuse writes
+// stops the import, keeping what was stored so far. Values are transformed
+// and TTLs resolved by writes as for PUT; imports are not counted for writer
+// fairness.
+func HandleImportNDJSON(cache *ShardedCache, drainer *Drainer, writes WritePolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := StreamImportResponse{Status: "OK", Errors: []ImportLineError{}}
+		limited := &objectLimitReader{r: r.Body}
+		dec := json.NewDecoder(limited)
+		limited.dec = dec
+		control := http.NewResponseController(w)
+
+		reject := func(line int, msg string) {
+			resp.Rejected++
+			if len(resp.Errors) < ndjsonMaxErrors {
+				resp.Errors = append(resp.Errors, ImportLineError{Line: line, Message: msg})
+			} else {
+				resp.ErrorsOmitted++
+			}
+		}
+
+		status := http.StatusOK
+		for line := 1; ; line++ {
+			control.SetReadDeadline(time.Now().Add(ndjsonIdleTimeout)) // Best effort
+			var req PutRequest
+			err := dec.Decode(&req)
+			if err == io.EOF {
+				break
+			}
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				// The decoder has skipped the whole object, so the stream goes on.
+				reject(line, fmt.Sprintf("Field '%s' must be %s, not %s.", typeErr.Field, jsonKind(typeErr.Type), typeErr.Value))
+				continue
+			}
+			if err != nil {
+				status = http.StatusBadRequest
+				if errors.Is(err, errObjectTooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				resp.Message = fmt.Sprintf("Import stopped at line %d: %v", line, err)
+				break
+			}
+			if err := drainer.writesRefused(); err != nil {
+				status = http.StatusServiceUnavailable
+				resp.Message = fmt.Sprintf("Import stopped at line %d: %v", line, err)
+				break
+			}
+
+			key := cache.trimKey(req.Key)
+			if verr := validatePut(key, &req); verr != nil {
+				reject(line, verr.Message)
+				continue
+			}
+			encoding, _ := parseEncoding(req.Encoding) // Checked by validatePut
+			put, err := writes.prepare(key, req.Value, req.options(encoding), 0, requestReader(r))
+			if err != nil {
+				reject(line, errorMessage(err))
+				continue
+			}
+			if result := cache.PutWithOptions(key, put.value, put.opts); result.Forbidden {
+				reject(line, fmt.Sprintf("Key '%s' holds an entry this token may not overwrite.", key))
+				continue
+			} else if result.Refused {
+				reject(line, fmt.Sprintf("Key '%s' is immutable.", key))
+				continue
+			}
+			resp.Imported++
+		}
+		control.SetReadDeadline(time.Time{})
+
+		if status != http.StatusOK {
+			resp.Status = "ERROR"
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Key normalization forms, selected with SetKeyNormalization.
+const (
+	KeyNormalizationNone = ""    // Keys are stored as sent, after trimming
+	KeyNormalizationNFC  = "nfc" // Unicode canonical composition
+)
+
+// SetKeyNormalization makes NormalizeKey bring every key to form, so keys
+// that only differ in how their characters are encoded, such as "é" as one
+// code point or as "e" plus a combining accent, name the same entry. Keys
+// already stored are not rewritten, so entries stored under another form
+// become unreachable: switch it on for an empty cache only. Must be called
+// before the cache starts serving requests.
+func (sc *ShardedCache) SetKeyNormalization(form string) error {
+	switch form {
+	case KeyNormalizationNone:
+		sc.nfcKeys = false
+		return nil
+	case KeyNormalizationNFC:
+		sc.nfcKeys = true
+		log.Printf("Normalizing keys to Unicode NFC")
+		return nil
+	}
+	return fmt.Errorf("unknown key normalization %q, expected %s or an empty string", form, KeyNormalizationNFC)
+}
+
+// NormalizeKey returns key in the form keys are stored in. Every key a
+// request names goes through it after trimming and before validation, so
+// writes and reads agree on the entry. A nil cache leaves key as it is.
+func (sc *ShardedCache) NormalizeKey(key string) string {
+	if sc == nil || !sc.nfcKeys {
+		return key
+	}
+	return norm.NFC.String(key)
+}
+
+// trimKey trims a key from a request and normalizes it.
+func (sc *ShardedCache) trimKey(key string) string {
+	return sc.NormalizeKey(strings.TrimSpace(key))
+}
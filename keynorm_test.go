@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNFCUnifiesCombiningCharacters(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		composed, decomposed string
+	}{
+		{"acute accent", "caf\u00e9", "cafe\u0301"},
+		{"ring above", "\u00c5ngstr\u00f6m", "A\u030angstro\u0308m"},
+		{"hangul syllable", "\ud55c", "\u1112\u1161\u11ab"},
+		{"two marks", "\u1ec7", "e\u0302\u0323"}, // Marks out of canonical order
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := NewShardedCache(8, 100, false)
+			if err := cache.SetKeyNormalization(KeyNormalizationNFC); err != nil {
+				t.Fatal(err)
+			}
+			if rec := doPut(t, cache, PutRequest{Key: "  " + tc.decomposed + " ", Value: "v1"}); rec.Code != http.StatusOK {
+				t.Fatalf("PUT status %d: %s", rec.Code, rec.Body)
+			}
+			for _, key := range []string{tc.composed, tc.decomposed} {
+				rec, resp := doGet(t, cache, "key="+url.QueryEscape(key))
+				if rec.Code != http.StatusOK || resp.Value != "v1" {
+					t.Errorf("GET %+q: status %d, value %q", key, rec.Code, resp.Value)
+				}
+				if resp.Key != tc.composed {
+					t.Errorf("GET %+q replied key %+q, want the NFC form %+q", key, resp.Key, tc.composed)
+				}
+			}
+
+			// A write through the other form updates the same entry
+			doPut(t, cache, PutRequest{Key: tc.composed, Value: "v2"})
+			if n := cache.Len(); n != 1 {
+				t.Errorf("%d entries after writing both forms, want 1", n)
+			}
+			if value, ok := cache.Get(cache.NormalizeKey(tc.decomposed)); !ok || value != "v2" {
+				t.Errorf("Get = %q, %v, want v2", value, ok)
+			}
+		})
+	}
+}
+
+func TestKeysKeptAsSentByDefault(t *testing.T) {
+	cache := NewShardedCache(8, 100, false)
+	doPut(t, cache, PutRequest{Key: "café", Value: "decomposed"})
+	doPut(t, cache, PutRequest{Key: "café", Value: "composed"})
+	if n := cache.Len(); n != 2 {
+		t.Errorf("%d entries, want the two forms kept apart", n)
+	}
+	if _, resp := doGet(t, cache, "key="+url.QueryEscape("café")); resp.Value != "decomposed" {
+		t.Errorf("decomposed key read %q", resp.Value)
+	}
+}
+
+func TestSetKeyNormalizationRejectsUnknownForms(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	if err := cache.SetKeyNormalization("nfd"); err == nil {
+		t.Error("SetKeyNormalization(nfd) succeeded")
+	}
+	if got := (*ShardedCache)(nil).NormalizeKey("café"); got != "café" {
+		t.Errorf("nil cache normalized the key to %+q", got)
+	}
+}
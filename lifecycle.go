@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// component is one part of the server that has to be stopped at shutdown.
+type component struct {
+	name      string
+	dependsOn []string // Components this one uses while running
+	timeout   time.Duration
+	stop      func(ctx context.Context) error
+}
+
+// Lifecycle stops the server's components at shutdown in dependency order:
+// a component is stopped only once every component depending on it has
+// stopped, so nothing is closed while something still feeds it. Among the
+// components that are ready, the one registered last goes first.
+type Lifecycle struct {
+	components []*component
+}
+
+// Register adds a component. stop gets a context that ends after timeout;
+// a stop that overruns it is logged and left running while shutdown moves
+// on. dependsOn names the components it uses, which are stopped after it.
+func (l *Lifecycle) Register(name string, timeout time.Duration, stop func(ctx context.Context) error, dependsOn ...string) {
+	l.components = append(l.components, &component{name: name, dependsOn: dependsOn, timeout: timeout, stop: stop})
+}
+
+// Order returns the names of the components in the order Shutdown stops
+// them, or an error if a dependency is unknown or the dependencies form a
+// cycle.
+func (l *Lifecycle) Order() ([]string, error) {
+	sorted, err := l.sorted()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(sorted))
+	for i, c := range sorted {
+		names[i] = c.name
+	}
+	return names, nil
+}
+
+// sorted is Order, returning the components themselves.
+func (l *Lifecycle) sorted() ([]*component, error) {
+	index := make(map[string]int, len(l.components))
+	for i, c := range l.components {
+		if _, dup := index[c.name]; dup {
+			return nil, fmt.Errorf("component %s is registered twice", c.name)
+		}
+		index[c.name] = i
+	}
+	dependents := make([]int, len(l.components)) // Not yet stopped
+	for _, c := range l.components {
+		for _, dep := range c.dependsOn {
+			i, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("component %s depends on unknown component %s", c.name, dep)
+			}
+			dependents[i]++
+		}
+	}
+
+	order := make([]*component, 0, len(l.components))
+	stopped := make([]bool, len(l.components))
+	for len(order) < len(l.components) {
+		next := -1
+		for i := len(l.components) - 1; i >= 0; i-- {
+			if !stopped[i] && dependents[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var left []string
+			for i, c := range l.components {
+				if !stopped[i] {
+					left = append(left, c.name)
+				}
+			}
+			return nil, fmt.Errorf("components %v depend on each other", left)
+		}
+		stopped[next] = true
+		order = append(order, l.components[next])
+		for _, dep := range l.components[next].dependsOn {
+			dependents[index[dep]]--
+		}
+	}
+	return order, nil
+}
+
+// newServerLifecycle registers the server's components. The listeners stop
+// accepting and their requests drain, then whatever those requests fed is
+// flushed, and the final snapshot comes last, so it holds every acknowledged
+// write. binaryServer, snapshotter and statsd may be nil.
+func newServerLifecycle(cache *ShardedCache, server *http.Server, binaryServer *BinaryServer, snapshotter *Snapshotter, statsd *StatsDEmitter) *Lifecycle {
+	lifecycle := &Lifecycle{}
+	lifecycle.Register("cache", time.Minute, func(context.Context) error {
+		if snapshotter != nil {
+			snapshotter.Final()
+		}
+		return nil
+	})
+	lifecycle.Register("write-buffer", 10*time.Second, func(context.Context) error {
+		cache.FlushWriteBuffers()
+		return nil
+	}, "cache")
+	lifecycle.Register("trace", 10*time.Second, func(context.Context) error {
+		cache.trace.Close()
+		return nil
+	})
+	lifecycle.Register("statsd", 5*time.Second, func(context.Context) error {
+		if statsd != nil {
+			statsd.Final()
+		}
+		return nil
+	})
+	lifecycle.Register("http", 10*time.Second, server.Shutdown, "cache", "write-buffer", "trace", "statsd")
+	if binaryServer != nil {
+		lifecycle.Register("binary", 10*time.Second, binaryServer.Shutdown, "cache", "statsd")
+	}
+	return lifecycle
+}
+
+// Shutdown stops every component in Order, logging each one. Order must
+// have succeeded.
+func (l *Lifecycle) Shutdown() {
+	order, err := l.sorted()
+	if err != nil {
+		log.Printf("Cannot order shutdown: %v", err)
+		return
+	}
+	for _, c := range order {
+		c.shutdown()
+	}
+}
+
+// shutdown runs the component's stop function within its timeout.
+func (c *component) shutdown() {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.stop(ctx) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("Stopping %s failed after %s: %v", c.name, time.Since(start).Round(time.Millisecond), err)
+			return
+		}
+		log.Printf("Stopped %s in %s", c.name, time.Since(start).Round(time.Millisecond))
+	case <-ctx.Done():
+		log.Printf("Stopping %s did not finish within %s, moving on", c.name, c.timeout)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerShutdownOrder(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	order, err := newServerLifecycle(cache, &http.Server{}, &BinaryServer{}, nil, nil).Order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(name string) int { return slices.Index(order, name) }
+	for _, listener := range []string{"http", "binary"} {
+		for _, consumer := range []string{"write-buffer", "trace", "statsd", "cache"} {
+			if at(listener) > at(consumer) {
+				t.Errorf("%s stops before %s in %v", consumer, listener, order)
+			}
+		}
+	}
+	if order[len(order)-1] != "cache" {
+		t.Errorf("the final snapshot is not taken last: %v", order)
+	}
+}
+
+func TestLifecycleRejectsBadGraphs(t *testing.T) {
+	noop := func(context.Context) error { return nil }
+	for name, register := range map[string]func(l *Lifecycle){
+		"cycle": func(l *Lifecycle) {
+			l.Register("a", time.Second, noop, "b")
+			l.Register("b", time.Second, noop, "a")
+		},
+		"unknown dependency": func(l *Lifecycle) {
+			l.Register("a", time.Second, noop, "missing")
+		},
+		"duplicate": func(l *Lifecycle) {
+			l.Register("a", time.Second, noop)
+			l.Register("a", time.Second, noop)
+		},
+	} {
+		var l Lifecycle
+		register(&l)
+		if order, err := l.Order(); err == nil {
+			t.Errorf("%s: ordered as %v", name, order)
+		}
+	}
+}
+
+func TestLifecycleMovesOnAfterATimeout(t *testing.T) {
+	var l Lifecycle
+	var stopped []string
+	l.Register("slow-dependency", time.Second, func(context.Context) error {
+		stopped = append(stopped, "slow-dependency")
+		return nil
+	})
+	l.Register("stuck", 10*time.Millisecond, func(context.Context) error {
+		select {} // Never returns
+	}, "slow-dependency")
+	done := make(chan struct{})
+	go func() {
+		l.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waited for a stop function past its timeout")
+	}
+	if !slices.Equal(stopped, []string{"slow-dependency"}) {
+		t.Errorf("stopped %v after the stuck component", stopped)
+	}
+}
+
+// TestShutdownKeepsAcknowledgedWrites writes through a real listener, with
+// the write buffer on, while the server shuts down, and checks that the
+// final snapshot holds every write that got a 200.
+func TestShutdownKeepsAcknowledgedWrites(t *testing.T) {
+	cache := NewShardedCache(4, 100_000, false)
+	cache.EnableWriteBuffer(256, time.Hour) // Only the shutdown flush applies the writes
+	path := filepath.Join(t.TempDir(), "snapshot")
+	snapshotter := NewSnapshotter(cache, path, time.Hour)
+	decoder, _ := NewPutDecoder(NewMetrics(), false, NullValueReject)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", HandlePut(cache, decoder, WritePolicy{}, PressurePolicy{}, nil, false))
+	server := &http.Server{Handler: mux}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/put"
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		acked = map[string]string{}
+	)
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key, value := fmt.Sprintf("w%d:%d", w, i%500), fmt.Sprintf("v%d", i)
+				body, _ := json.Marshal(PutRequest{Key: key, Value: value})
+				resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+				if err != nil {
+					return // The listener is closed
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					mutex.Lock()
+					acked[key] = value
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	newServerLifecycle(cache, server, nil, snapshotter, nil).Shutdown()
+	wg.Wait()
+
+	if len(acked) == 0 {
+		t.Fatal("no write was acknowledged before the shutdown")
+	}
+	restored := NewShardedCache(4, 100_000, false)
+	if _, err := loadSnapshot(restored, path); err != nil {
+		t.Fatal(err)
+	}
+	lost := 0
+	for key, want := range acked {
+		if got, ok := restored.Get(key); !ok || got != want {
+			lost++
+			if lost <= 5 {
+				t.Errorf("%s = %q, %v in the final snapshot, acknowledged as %q", key, got, ok, want)
+			}
+		}
+	}
+	if lost > 0 {
+		t.Errorf("%d of %d acknowledged writes missing from the final snapshot", lost, len(acked))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// ListenerStats reports connection counts for one listen address in /stats.
+type ListenerStats struct {
+	Addr     string `json:"addr"`
+	Accepted uint64 `json:"accepted"`
+}
+
+// countingListener wraps a net.Listener and counts accepted connections.
+type countingListener struct {
+	net.Listener
+	addr     string // Address as configured, e.g. "[::1]:7171"
+	accepted atomic.Uint64
+}
+
+// Accept waits for the next connection and counts it.
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// openListeners binds every required and optional address. A failure on a
+// required address fails the whole call (closing what was already opened); a
+// failure on an optional one is logged and skipped. At least one listener
+// must come up.
+func openListeners(required, optional []string) ([]*countingListener, error) {
+	var listeners []*countingListener
+	var errs []error
+	for _, addr := range required {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listen on %s: %w", addr, err))
+			continue
+		}
+		listeners = append(listeners, &countingListener{Listener: ln, addr: addr})
+	}
+	for _, addr := range optional {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Printf("Skipping optional listener %s: %v", addr, err)
+			continue
+		}
+		listeners = append(listeners, &countingListener{Listener: ln, addr: addr})
+	}
+	if len(errs) == 0 && len(listeners) == 0 {
+		errs = append(errs, errors.New("no listen address could be bound"))
+	}
+	if len(errs) > 0 {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, errors.Join(errs...)
+	}
+	return listeners, nil
+}
+
+// listenerStats snapshots the accepted-connection counts of each listener.
+func listenerStats(listeners []*countingListener) []ListenerStats {
+	out := make([]ListenerStats, len(listeners))
+	for i, ln := range listeners {
+		out[i] = ListenerStats{Addr: ln.addr, Accepted: ln.accepted.Load()}
+	}
+	return out
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errLockHeld     = errors.New("lock is held")
+	errNotALock     = fmt.Errorf("%w: key holds a regular value", ErrTypeMismatch)
+	errLeaseExpired = errors.New("lease expired")
+	errLeaseStolen  = fmt.Errorf("%w: lease is held by another token", ErrVersionConflict)
+)
+
+// LockAcquireRequest structure for POST /lock/acquire bodies
+type LockAcquireRequest struct {
+	Key        string `json:"key"`
+	TTLSeconds int    `json:"ttl_seconds"`
+	Owner      string `json:"owner,omitempty"` // Stored as the key's value; defaults to the token
+}
+
+// LockRequest structure for POST /lock/renew and /lock/release bodies
+type LockRequest struct {
+	Key        string `json:"key"`
+	Token      uint64 `json:"token"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"` // New lease length, renew only
+}
+
+// LockResponse structure for /lock/* replies
+type LockResponse struct {
+	Status           string `json:"status"`
+	Key              string `json:"key"`
+	Token            uint64 `json:"token,omitempty"`
+	Owner            string `json:"owner,omitempty"`
+	ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
+}
+
+// AcquireLock takes a lease on key for ttl, capped by the maximum entry age,
+// and returns its fencing token and the lease granted. An absent key, or one
+// whose entry is no longer live, is taken over; a live lease fails with
+// errLockHeld and a live regular value with errNotALock.
+//
+// The token is counted on the lock entry: taking over an expired lease hands
+// out the previous token plus one. A key without a lock entry, because it was
+// never locked or its lock was released, evicted or overwritten, starts above
+// every token its shard has retired and above the clock in microseconds, so
+// tokens never repeat for a key, across restarts included. Microseconds keep
+// them exact as JSON numbers (below 2^53).
+func (sc *ShardedCache) AcquireLock(key, owner string, ttl time.Duration) (uint64, time.Duration, error) {
+	shard := sc.shards[sc.getShardIndex(key)]
+	now := sc.now()
+
+	shard.mutex.Lock()
+	token := max(shard.retiredFence+1, uint64(now/int64(time.Microsecond)))
+	if elem, hit := shard.lookupLocked(key); hit {
+		ent := elem.Value.(*entry)
+		switch {
+		case ent.fence == 0 && shard.live(ent, now):
+			shard.mutex.Unlock()
+			return 0, 0, errNotALock
+		case shard.live(ent, now):
+			shard.mutex.Unlock()
+			return 0, 0, errLockHeld
+		case ent.fence != 0:
+			token = ent.fence + 1
+		}
+	}
+	if owner == "" {
+		owner = strconv.FormatUint(token, 10)
+	}
+	// putLocked reuses an expired entry in place, so its version keeps counting.
+	_, evicted := shard.putLocked(key, owner, PutOptions{TTL: ttl})
+	elem := shard.items[key]
+	shard.setPinnedLocked(elem, false) // An outdated pinned value taken over; a lease has to be able to run out
+	ent := elem.Value.(*entry)
+	ent.fence = token
+	item := ent.item()
+	shard.mutex.Unlock()
+
+	if evicted != nil {
+		shard.notifyEvict(evicted, EvictionCapacity)
+	}
+	sc.waiters.wake(key, item)
+	return token, shard.cappedTTL(ttl), nil
+}
+
+// leaseLocked returns the lock entry of key if token holds its lease.
+// MUST be called with the mutex held.
+func (c *LRUCache) leaseLocked(key string, token uint64, now int64) (*entry, error) {
+	elem, hit := c.lookupLocked(key)
+	if !hit {
+		return nil, errLeaseExpired
+	}
+	ent := elem.Value.(*entry)
+	switch {
+	case ent.fence == 0:
+		if !c.live(ent, now) {
+			return nil, errLeaseExpired
+		}
+		return nil, errNotALock
+	case ent.fence != token:
+		if !c.live(ent, now) {
+			return nil, errLeaseExpired
+		}
+		return nil, errLeaseStolen
+	case !c.live(ent, now):
+		return nil, errLeaseExpired
+	}
+	return ent, nil
+}
+
+// RenewLock extends the lease held by token on key to ttl from now and
+// returns the lease granted. With a maximum entry age the lease ends no later
+// than that age after the lock was acquired, as for any entry after its write.
+func (sc *ShardedCache) RenewLock(key string, token uint64, ttl time.Duration) (time.Duration, error) {
+	shard := sc.shards[sc.getShardIndex(key)]
+	now := sc.now()
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	ent, err := shard.leaseLocked(key, token, now)
+	if err != nil {
+		return 0, err
+	}
+	lease := shard.cappedTTL(ttl)
+	if shard.maxAge > 0 {
+		lease = min(lease, time.Duration(ent.createdAt+int64(shard.maxAge)-now))
+	}
+	ent.expiresAt = now + int64(lease)
+	return lease, nil
+}
+
+// ReleaseLock deletes key if token still holds its lease.
+func (sc *ShardedCache) ReleaseLock(key string, token uint64) error {
+	shard := sc.shards[sc.getShardIndex(key)]
+	now := sc.now()
+
+	shard.mutex.Lock()
+	if _, err := shard.leaseLocked(key, token, now); err != nil {
+		shard.mutex.Unlock()
+		return err
+	}
+	removed := shard.removeElement(shard.items[key])
+	shard.mutex.Unlock()
+
+	shard.notifyEvict(removed, EvictionDeleted)
+	return nil
+}
+
+// leaseSeconds rounds a granted lease up to whole seconds for replies.
+func leaseSeconds(lease time.Duration) int {
+	return int((lease + time.Second - 1) / time.Second)
+}
+
+func writeLockResponse(w http.ResponseWriter, resp LockResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func HandleLockAcquire(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LockAcquireRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		key := cache.trimKey(req.Key)
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if req.TTLSeconds <= 0 {
+			writeJSONError(w, "TTL must be positive.", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Owner) > MaxValueLength {
+			writeJSONError(w, "Owner exceeds maximum value length.", http.StatusBadRequest)
+			return
+		}
+
+		token, lease, err := cache.AcquireLock(key, req.Owner, time.Duration(req.TTLSeconds)*time.Second)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		owner := req.Owner
+		if owner == "" {
+			owner = strconv.FormatUint(token, 10)
+		}
+		writeLockResponse(w, LockResponse{
+			Status:           "OK",
+			Key:              key,
+			Token:            token,
+			Owner:            owner,
+			ExpiresInSeconds: leaseSeconds(lease),
+		})
+	}
+}
+
+// decodeLockRequest reads a renew or release body, writing the error reply
+// and returning false when it is invalid.
+func decodeLockRequest(w http.ResponseWriter, r *http.Request, cache *ShardedCache) (LockRequest, bool) {
+	var req LockRequest
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+		return req, false
+	}
+	req.Key = cache.trimKey(req.Key)
+	if msg := validateKey(req.Key); msg != "" {
+		writeJSONError(w, msg, http.StatusBadRequest)
+		return req, false
+	}
+	if req.Token == 0 {
+		writeJSONError(w, "Token cannot be empty.", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func HandleLockRenew(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeLockRequest(w, r, cache)
+		if !ok {
+			return
+		}
+		if req.TTLSeconds <= 0 {
+			writeJSONError(w, "TTL must be positive.", http.StatusBadRequest)
+			return
+		}
+		lease, err := cache.RenewLock(req.Key, req.Token, time.Duration(req.TTLSeconds)*time.Second)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		writeLockResponse(w, LockResponse{
+			Status:           "OK",
+			Key:              req.Key,
+			Token:            req.Token,
+			ExpiresInSeconds: leaseSeconds(lease),
+		})
+	}
+}
+
+func HandleLockRelease(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeLockRequest(w, r, cache)
+		if !ok {
+			return
+		}
+		if err := cache.ReleaseLock(req.Key, req.Token); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		writeLockResponse(w, LockResponse{Status: "OK", Key: req.Key})
+	}
+}
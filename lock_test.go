@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockMutualExclusion(t *testing.T) {
+	cache := NewShardedCache(4, 100, false)
+	var (
+		holders atomic.Int32
+		mu      sync.Mutex
+		tokens  []uint64 // In the order the lock was held
+		wg      sync.WaitGroup
+	)
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for acquired := 0; acquired < 50; {
+				token, _, err := cache.AcquireLock("lock:job", "", time.Minute)
+				if errors.Is(err, errLockHeld) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("AcquireLock: %v", err)
+					return
+				}
+				if n := holders.Add(1); n != 1 {
+					t.Errorf("%d holders at once", n)
+				}
+				mu.Lock()
+				tokens = append(tokens, token)
+				mu.Unlock()
+				holders.Add(-1)
+				if err := cache.ReleaseLock("lock:job", token); err != nil {
+					t.Errorf("ReleaseLock(%d): %v", token, err)
+				}
+				acquired++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(tokens) != 16*50 {
+		t.Fatalf("lock held %d times, want %d", len(tokens), 16*50)
+	}
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i] <= tokens[i-1] {
+			t.Fatalf("token %d is %d after %d", i, tokens[i], tokens[i-1])
+		}
+	}
+}
+
+func TestLockTakeover(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	first, _, err := cache.AcquireLock("lock:a", "worker-a", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.AcquireLock("lock:a", "worker-b", time.Minute); !errors.Is(err, errLockHeld) {
+		t.Fatalf("AcquireLock on a live lease = %v, want errLockHeld", err)
+	}
+	clock.Advance(20 * time.Millisecond)
+	if err := cache.ReleaseLock("lock:a", first); !errors.Is(err, errLeaseExpired) {
+		t.Errorf("ReleaseLock of an expired lease = %v, want errLeaseExpired", err)
+	}
+
+	second, _, err := cache.AcquireLock("lock:a", "worker-b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first+1 {
+		t.Errorf("takeover token = %d, want %d", second, first+1)
+	}
+	if _, err := cache.RenewLock("lock:a", first, time.Minute); !errors.Is(err, errLeaseStolen) {
+		t.Errorf("RenewLock with the old token = %v, want errLeaseStolen", err)
+	}
+	if err := cache.ReleaseLock("lock:a", second); err != nil {
+		t.Errorf("ReleaseLock: %v", err)
+	}
+
+	// Overwriting a lock with a plain write must not let its token come back.
+	third, _, err := cache.AcquireLock("lock:a", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("lock:a", "plain")
+	cache.Delete("lock:a")
+	fourth, _, err := cache.AcquireLock("lock:a", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third <= second || fourth <= third {
+		t.Errorf("tokens %d, %d, %d do not increase", second, third, fourth)
+	}
+}
+
+func TestLockNotALock(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	cache.Put("k", "v")
+	if _, _, err := cache.AcquireLock("k", "", time.Minute); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("AcquireLock on a regular value = %v, want ErrTypeMismatch", err)
+	}
+	if err := cache.ReleaseLock("k", 1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("ReleaseLock on a regular value = %v, want ErrTypeMismatch", err)
+	}
+}
+
+func TestLockRenewCappedByMaxAge(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.SetMaxEntryAge(time.Second)
+	token, lease, err := cache.AcquireLock("lock:a", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease != time.Second {
+		t.Errorf("acquired lease = %v, want 1s", lease)
+	}
+	clock.Advance(100 * time.Millisecond)
+	lease, err = cache.RenewLock("lock:a", token, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease != 900*time.Millisecond {
+		t.Errorf("renewed lease = %v, want the 900ms left of the 1s age cap", lease)
+	}
+}
+
+func TestLockTakesOverOutdatedPinnedValue(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	if err := cache.SetPinLimit(0.5); err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("k", "v")
+	if err := cache.Pin("k", true); err != nil {
+		t.Fatal(err)
+	}
+	cache.BumpGeneration()
+
+	if _, _, err := cache.AcquireLock("k", "", time.Minute); err != nil {
+		t.Fatalf("AcquireLock over an outdated value: %v", err)
+	}
+	shard := cache.shards[0]
+	shard.mutex.Lock()
+	pinned, count := shard.items["k"].Value.(*entry).pinned, shard.pinned
+	shard.mutex.Unlock()
+	if pinned || count != 0 {
+		t.Errorf("lock entry pinned=%v, shard pinned count %d; want unpinned", pinned, count)
+	}
+	if err := cache.Pin("k", true); !errors.Is(err, errPinningLock) {
+		t.Errorf("Pin on a lock = %v, want errPinningLock", err)
+	}
+}
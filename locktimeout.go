@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// LockTimeoutStats reports bounded shard lock waits in /stats.
+type LockTimeoutStats struct {
+	TimeoutMs  int64    `json:"timeout_ms"`
+	Rejections uint64   `json:"rejections"`           // Requests failed after waiting the full timeout
+	PerShard   []uint64 `json:"per_shard_rejections"` // The same, by shard index
+}
+
+// SetLockTimeout makes GETs and PUTs that go through the context-aware paths
+// give up with ErrLockTimeout after waiting timeout for a shard's mutex,
+// instead of queueing behind a long operation for as long as the request
+// lives. Zero restores unbounded waits. Must be called before the cache
+// starts serving requests.
+func (sc *ShardedCache) SetLockTimeout(timeout time.Duration) {
+	for _, shard := range sc.shards {
+		shard.lockTimeout = timeout
+	}
+	if timeout > 0 {
+		log.Printf("Failing GETs and PUTs that wait more than %s for a shard lock", timeout)
+	}
+}
+
+// LockTimeoutStats sums lock timeout rejections over all shards, or returns
+// nil when waits are unbounded.
+func (sc *ShardedCache) LockTimeoutStats() *LockTimeoutStats {
+	if len(sc.shards) == 0 || sc.shards[0].lockTimeout <= 0 {
+		return nil
+	}
+	stats := &LockTimeoutStats{
+		TimeoutMs: sc.shards[0].lockTimeout.Milliseconds(),
+		PerShard:  make([]uint64, len(sc.shards)),
+	}
+	for i, shard := range sc.shards {
+		n := shard.lockTimeouts.Load()
+		stats.PerShard[i] = n
+		stats.Rejections += n
+	}
+	return stats
+}
@@ -2,13 +2,23 @@ package main
 
 import (
 	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings" // Needed for TrimSpace
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unicode/utf8" // Needed for correct character count
 )
 
@@ -19,6 +29,8 @@ const (
 	TotalCapacity       = NumShards * MaxCapacityPerShard
 	MaxKeyLength        = 256
 	MaxValueLength      = 256
+	MinCost             = 1   // Default eviction weight of an entry
+	MaxCost             = 100 // Highest eviction weight a client may set
 )
 
 // --- Request & Response Models (Updated for new spec) ---
@@ -27,25 +39,109 @@ const (
 type PutRequest struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	Cost  int    `json:"cost,omitempty"` // Optional eviction weight (1-100), used by cost-aware eviction
+
+	Encoding string `json:"encoding,omitempty"` // Optional: text (default), json or base64
+
+	TTLSeconds int `json:"ttl_seconds,omitempty"` // Optional time to live; 0 = never expires
+	SWRSeconds int `json:"swr_seconds,omitempty"` // Optional stale-while-revalidate window after the TTL
+
+	IdleTTLSeconds int `json:"idle_ttl_seconds,omitempty"` // Optional sliding expiry, extended by reads and capped by ttl_seconds
+
+	Immutable bool `json:"immutable,omitempty"` // Refuse later writes to the key while this value lives
+
+	Force bool `json:"force,omitempty"` // Write even when the key already holds this value (see -skip-unchanged-puts)
+
+	ACL *ACLRequest `json:"acl,omitempty"` // Optional: only these bearer tokens may read or delete the entry
 }
 
 // GenericErrorResponse structure for standard error replies
 type GenericErrorResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"` // Set for errors returned by the cache, see writeCacheError
 }
 
 // PutSuccessResponse structure for PUT success replies
 type PutSuccessResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status         string   `json:"status"`
+	Message        string   `json:"message"`
+	EvictedToAdmit bool     `json:"evicted_to_admit,omitempty"` // This insert pushed another entry out
+	TTLSeconds     int      `json:"ttl_seconds,omitempty"`      // The TTL applied, when one was requested or set by a rule
+	TTLAdjusted    bool     `json:"ttl_adjusted,omitempty"`     // The requested TTL was clamped to the server's bounds
+	Buffered       bool     `json:"buffered,omitempty"`         // Staged in the write buffer, applied within its interval
+	EvictedKey     string   `json:"evicted_key,omitempty"`      // The key this insert pushed out; only with -put-report-evicted-key
+	TTLRule        string   `json:"ttl_rule,omitempty"`         // Pattern of the -ttl-rules rule that chose the TTL
+	Unchanged      bool     `json:"unchanged,omitempty"`        // The key already held this value, so nothing was written
+	Transforms     []string `json:"transforms,omitempty"`       // Write transforms that changed the value, in order
+	Generation     uint64   `json:"generation,omitempty"`       // Cache generation the entry was written under; not known for buffered puts
 }
 
 // GetSuccessResponse structure for GET success replies
 type GetSuccessResponse struct {
-	Status string `json:"status"`
-	Key    string `json:"key"`
-	Value  string `json:"value"`
+	Status     string       `json:"status"`
+	Key        string       `json:"key"`
+	Value      string       `json:"value"`
+	Encoding   string       `json:"encoding"`
+	Immutable  bool         `json:"immutable,omitempty"`
+	Transforms []string     `json:"transforms,omitempty"` // Write transforms that changed the value when it was stored
+	ACL        *ACLResponse `json:"acl,omitempty"`        // The entry's read ACL, shown to the readers on it
+}
+
+// StatsResponse structure for GET /stats replies
+type StatsResponse struct {
+	Status   string `json:"status"`
+	Shards   int    `json:"shards"`
+	Capacity int    `json:"capacity"`
+	Items    int    `json:"items"`
+
+	EvictionPolicy  string            `json:"eviction_policy"`
+	EvictionsByCost map[string]uint64 `json:"evictions_by_cost"` // Capacity evictions per cost bucket
+	// Evictions per put over the last pressureWindowSeconds, per shard.
+	EvictionPressure []float64 `json:"eviction_pressure"`
+	PinnedKeys       int       `json:"pinned_keys"`
+
+	Listeners []ListenerStats `json:"listeners"`
+
+	// Only present when refresh-ahead is enabled.
+	RefreshAhead *RefreshStats `json:"refresh_ahead,omitempty"`
+
+	// Only present when automatic snapshots are enabled.
+	Snapshot *SnapshotStats `json:"snapshot,omitempty"`
+
+	// Only present when the global key directory is enabled.
+	DirectoryKeys *int `json:"directory_keys,omitempty"`
+
+	// Only present when the cold tier is enabled.
+	ColdTier *ColdTierStats `json:"cold_tier,omitempty"`
+
+	// Only present when GETs are served from read snapshots.
+	ReadSnapshotIntervalMs int64 `json:"read_snapshot_interval_ms,omitempty"`
+	ReadSnapshotAgeMs      int64 `json:"read_snapshot_age_ms,omitempty"`
+
+	// Only present when PUTs go through the write buffer.
+	WriteBuffer *WriteBufferStats `json:"write_buffer,omitempty"`
+
+	// Only present while a traffic trace is recorded.
+	Trace *TraceStats `json:"trace,omitempty"`
+
+	// Only present when idle entries are reaped.
+	Idle *IdleStats `json:"idle,omitempty"`
+
+	// Only present when entries are counted per writer.
+	Fairness *FairnessStats `json:"fairness,omitempty"`
+
+	// Only present when shard lock waits are bounded.
+	LockTimeout *LockTimeoutStats `json:"lock_timeout,omitempty"`
+
+	// Background workers and their restarts (see Supervisor).
+	Workers []WorkerStats `json:"workers"`
+
+	// Only present when unchanged puts are skipped.
+	UnchangedPuts *UnchangedPutStats `json:"unchanged_puts,omitempty"`
+
+	// Cache generation new writes are recorded under (see BumpGeneration).
+	Generation uint64 `json:"generation"`
 }
 
 
@@ -53,16 +149,212 @@ type GetSuccessResponse struct {
 
 // entry represents a key-value pair in the LRU cache's linked list.
 type entry struct {
-	key   string
-	value string
+	key       string
+	value     string
+	createdAt int64         // UnixNano when the current value was stored; 0 if unknown
+	cost      int           // Eviction weight, higher survives longer under cost-aware eviction
+	expiresAt int64         // UnixNano after which the entry is treated as absent; 0 = never
+	ttl       time.Duration // TTL asked for by the last write; 0 = none
+	version   uint64        // 1 when the key is created, incremented by every write
+	encoding  Encoding
+
+	refresh *RefreshSource // Where to re-fetch the value ahead of expiry; nil = never
+	fence   uint64         // Fencing token of the lease held on a lock entry; 0 = a regular value
+	pinned  bool           // Exempt from capacity eviction and TTL expiry (see Pin)
+
+	immutable bool // Writes are refused until the entry is removed (see SetImmutablePrefixes)
+
+	generation uint64 // Cache generation the value was written under (see BumpGeneration)
+
+	staleFor time.Duration // How long past expiresAt the entry is served as stale; 0 = not at all
+
+	// Sliding expiry (see PutOptions.IdleTTL): every read moves expiresAt to
+	// idleTTL from then, but never past hardExpiresAt (0 = no cap).
+	idleTTL       time.Duration
+	hardExpiresAt int64
+
+	accessedAt int64 // UnixNano of the last use; only maintained while the shard tracks access
+
+	writer uint16 // Writer bucket plus one (see FairnessGuard); 0 = not accounted
+
+	transforms []string // Write transforms that changed the value, for debugging
+
+	readers []string // Hashes of the tokens that may read the entry (see ACLRequest); nil = anyone
+
+	reads atomic.Uint64 // GET hits, counted with EnableReadCounting
+}
+
+// expired reports whether the entry's TTL has elapsed at now (UnixNano).
+// Pinned entries never expire.
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt != 0 && now >= e.expiresAt && !e.pinned
+}
+
+// slideExpiry moves a sliding entry's expiry to idleTTL from now, capped by
+// its hard expiry.
+func (e *entry) slideExpiry(now int64) {
+	e.expiresAt = now + int64(e.idleTTL)
+	if e.hardExpiresAt != 0 && e.hardExpiresAt < e.expiresAt {
+		e.expiresAt = e.hardExpiresAt
+	}
+}
+
+// item copies the entry's value and metadata for a reader.
+func (e *entry) item() Item {
+	return Item{Value: e.value, Encoding: e.encoding, CreatedAt: e.createdAt, ExpiresAt: e.expiresAt, Immutable: e.immutable, Generation: e.generation, Transforms: e.transforms, Readers: e.readers, reads: &e.reads}
+}
+
+// PutOptions carries optional per-entry settings for a write.
+type PutOptions struct {
+	Cost     int           // Eviction weight (MinCost-MaxCost); 0 means MinCost
+	TTL      time.Duration // Time to live; 0 means the entry never expires
+	Encoding Encoding      // Declared content type of the value
+	StaleFor time.Duration // Stale-while-revalidate window after the TTL; 0 = none
+
+	// IdleTTL makes the expiry slide: the entry expires IdleTTL after its
+	// last write or read, but never later than TTL after the write when TTL
+	// is set. 0 = expiry does not move.
+	IdleTTL time.Duration
+
+	Immutable bool // Refuse later writes to the key while this value lives
+
+	Writer uint16 // Who wrote the entry, for writer fairness (see FairnessGuard); 0 = unknown
+
+	Refresh *RefreshSource // Where to refresh the entry from (requires TTL)
+
+	// Coalesce lets the write be skipped when it would leave the entry as it
+	// is (see SkipUnchangedPuts).
+	Coalesce bool
+
+	// Transform rewrites the value before it is stored. PutWithOptionsCtx
+	// and PutBuffered fail with errTransformRejected when it returns an
+	// error; PutWithOptions then writes nothing and reports Refused.
+	Transform Transform
+
+	Transforms []string // Names of the write transforms that changed the value, kept with the entry
+
+	Readers []string // Hashed tokens that may read the entry (see ACLRequest); nil = anyone
+
+	// CreatedAt is when the value was first stored (UnixNano), for entries
+	// restored from a snapshot or dump, so that they keep their age. 0, or a
+	// time after now, means now.
+	CreatedAt int64
+
+	// CheckACL makes the write refuse to overwrite a live entry whose read
+	// ACL does not list Reader (see requestReader), as DeleteAs refuses to
+	// remove one. Requests set it; library writes, like Delete, skip it.
+	CheckACL bool
+	Reader   string
+}
+
+// PutResult reports what a write did to its shard.
+type PutResult struct {
+	Refused    bool    // Nothing was written: the key holds an immutable or forbidden entry, or Transform failed
+	Forbidden  bool    // With Refused: the entry's read ACL does not list PutOptions.Reader
+	Unchanged  bool    // Nothing was written: the key already held this value (see SkipUnchangedPuts)
+	Evicted    bool    // Another entry was evicted to make room
+	EvictedKey string  // Key of that entry, when Evicted
+	Pressure   float64 // Shard evictions per put over the recent window
+	Generation uint64  // Cache generation the entry holds, when it was written or left unchanged
 }
 
 // LRUCache holds the data for a single cache shard with LRU eviction.
 type LRUCache struct {
 	mutex    sync.Mutex // Use Mutex as writes require exclusive access to list+map
-	capacity int
+	capacity int        // Guarded by mutex; changed by Resize
 	items    map[string]*list.Element // Map key to list element for O(1) access
 	evictList *list.List              // Doubly linked list for O(1) add/remove/move
+
+	// readSnapshot is an immutable copy of the shard's contents that readers can
+	// consult without the mutex. Nil unless read snapshots are enabled.
+	readSnapshot atomic.Pointer[map[string]Item]
+
+	// onEvict is told about every entry that leaves the shard. Always invoked
+	// after the mutex has been released. Nil when nobody is listening.
+	onEvict EvictionCallback
+
+	// Cost-aware eviction (see SetEvictionPolicy). When enabled, the victim is
+	// the cheapest of the evictionCandidates least recently used entries.
+	costAware          bool
+	evictionCandidates int
+	evictionsByCost    [numCostBuckets]uint64 // Guarded by mutex
+
+	// Pinned entries are skipped by eviction (see Pin). At most maxPinned
+	// entries may be pinned, so a full shard always has a victim.
+	pinned      int // Guarded by mutex
+	maxPinned   int
+	pinFraction float64 // Share of the capacity maxPinned follows on Resize
+
+	pressure pressureWindow // Recent put/eviction counts, guarded by mutex
+
+	// retiredFence is the highest fencing token of a lock entry that left
+	// the shard or was overwritten by a plain write, so that a new lock on
+	// its key starts above it (see AcquireLock). Guarded by mutex.
+	retiredFence uint64
+
+	index     int           // Position of this shard in its ShardedCache
+	directory *KeyDirectory // Optional global key directory, nil when disabled
+
+	// Refresh-ahead (see OnRefreshDue): a read within the last refreshFraction
+	// of an entry's TTL reports the entry to onRefreshDue.
+	refreshFraction float64
+	onRefreshDue    func(key string, src *RefreshSource)
+
+	// touchOnWrite makes updating an existing key count as a use for LRU
+	// purposes. When false only reads refresh recency.
+	touchOnWrite bool
+
+	// staleWindow is how long past their TTL entries without a window of
+	// their own stay available to readers that accept stale values.
+	staleWindow time.Duration
+
+	// Puts asking for it leave an entry alone when they would store the same
+	// value with a TTL within unchangedTolerance of its own (see
+	// SkipUnchangedPuts).
+	skipUnchanged      bool
+	unchangedTolerance time.Duration
+	unchangedPuts      atomic.Uint64 // Puts skipped that way
+
+	// maxAge is the longest an entry may be served after it was written,
+	// whatever its TTL, pin or stale window (see SetMaxEntryAge); 0 = no cap.
+	maxAge time.Duration
+
+	// generation is the current cache generation, the same on every shard;
+	// entries written under an older one are outdated (see BumpGeneration).
+	generation atomic.Uint64
+
+	immutablePrefixes []string // Keys written under these become immutable
+
+	skipACLEntries bool // Leave entries with a read ACL out of snapshots and drains (see SetACLExport)
+
+	// cold holds entries idle for longer than the configured period (see
+	// EnableColdTier). Nil when the cold tier is disabled.
+	cold *coldTier
+
+	// trackAccess keeps entry.accessedAt up to date, for the cold tier and
+	// idle reaping (see EnableIdleReaping).
+	trackAccess bool
+	idleReaped  atomic.Uint64 // Entries removed by reapIdle
+
+	// Writer fairness (see EnableWriterFairness): resident entries per
+	// writer, nil when not accounted, and the count above which a writer
+	// evicts its own entries to insert (0 = never).
+	writers       *writerCounts
+	fairShare     int
+	fairLimit     float64 // Share of the capacity fairShare follows on Resize
+	selfEvictions atomic.Uint64
+
+	waiters    *WaitList   // GETs waiting for a key to be written; nil = none allowed
+	valueIndex *ValueIndex // Optional value prefix index, nil when disabled
+
+	writes *writeBuffer // Staged puts (see EnableWriteBuffer); nil when disabled
+
+	// lockTimeout bounds how long lockCtx waits for the mutex (see
+	// SetLockTimeout); 0 waits as long as the caller's context allows.
+	lockTimeout  time.Duration
+	lockTimeouts atomic.Uint64 // Acquisitions given up after lockTimeout
+
+	now func() int64 // Current time in UnixNano (see SetClock)
 }
 
 // NewLRUCache initializes a new LRU cache shard.
@@ -71,117 +363,913 @@ func NewLRUCache(capacity int) *LRUCache {
 		// Default or minimum capacity if needed, but better to configure properly.
 		capacity = MaxCapacityPerShard
 	}
-	return &LRUCache{
-		capacity:  capacity,
-		items:     make(map[string]*list.Element, capacity), // Pre-allocate map hint
-		evictList: list.New(),
+	return newLRUCache(capacity, capacity) // Pre-allocate map hint
+}
+
+// NewLazyLRUCache initializes a shard whose key map starts empty and grows as
+// keys arrive, instead of being sized for a full shard up front.
+func NewLazyLRUCache(capacity int) *LRUCache {
+	if capacity <= 0 {
+		capacity = MaxCapacityPerShard
+	}
+	return newLRUCache(capacity, 0)
+}
+
+func newLRUCache(capacity, sizeHint int) *LRUCache {
+	c := &LRUCache{
+		capacity:     capacity,
+		items:        make(map[string]*list.Element, sizeHint),
+		evictList:    list.New(),
+		touchOnWrite: true,
+		now:          realNow,
 	}
+	c.generation.Store(1)
+	return c
 }
 
 // Get retrieves a value, moving the item to the front (most recently used).
+// Expired entries are removed lazily here and reported as a miss.
 func (c *LRUCache) Get(key string) (string, bool) {
+	item, found := c.GetItem(key)
+	return item.Value, found
+}
+
+// GetItem is Get, also returning the value's encoding.
+func (c *LRUCache) GetItem(key string) (Item, bool) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	item, found, expired, refreshDue := c.getLocked(key, staleOwnWindow)
+	c.mutex.Unlock()
+
+	c.afterGet(key, expired, refreshDue)
+	return item, found
+}
+
+// GetCtx is GetItem with a choice of stale reads, but gives up with ctx.Err()
+// if ctx is done before the shard lock can be acquired.
+func (c *LRUCache) GetCtx(ctx context.Context, key string, stale staleReads) (Item, bool, error) {
+	if err := c.lockCtx(ctx); err != nil {
+		return Item{}, false, err
+	}
+	item, found, expired, refreshDue := c.getLocked(key, stale)
+	c.mutex.Unlock()
+
+	c.afterGet(key, expired, refreshDue)
+	return item, found, nil
+}
+
+// staleReads says which expired entries a lookup may return.
+type staleReads int
+
+const (
+	staleNever     staleReads = iota // Expired entries are absent and removed, as writers need
+	staleOwnWindow                   // Entries within their own swr_seconds window are returned
+	staleAllowed                     // So are other entries within the shard's staleWindow
+)
+
+// getLocked implements Get. If the entry had expired it is removed and
+// returned; if it is due for refresh its source is returned. Both are for the
+// caller to act on once the mutex is released. Unless stale is staleNever,
+// an expired entry within its stale window is kept, and returned with Stale
+// set and its refresh source due if stale accepts it.
+// MUST be called with the mutex held.
+func (c *LRUCache) getLocked(key string, stale staleReads) (item Item, found bool, expired *entry, refreshDue *RefreshSource) {
+	if elem, hit := c.lookupLocked(key); hit {
+		ent := elem.Value.(*entry) // Type assertion needed as list stores interface{}
+		// The age cap and generations come before pins, stale windows and refresh-ahead.
+		if (c.maxAge > 0 && c.tooOld(ent, c.now())) || c.outdated(ent) {
+			return Item{}, false, c.removeElement(elem), nil
+		}
+		// Only read the clock for entries that have a TTL.
+		if ent.expiresAt != 0 {
+			now := c.now()
+			if ent.expired(now) {
+				window := ent.staleFor
+				if window == 0 {
+					window = c.staleWindow
+				}
+				switch {
+				case stale == staleNever || now >= ent.expiresAt+int64(window):
+					return Item{}, false, c.removeElement(elem), nil
+				case ent.staleFor == 0 && stale != staleAllowed:
+					return Item{}, false, nil, nil // Kept for readers that accept stale values
+				}
+				c.touch(elem)
+				item = ent.item()
+				item.Stale = true
+				return item, true, nil, ent.refresh
+			}
+			if ent.refresh != nil && ent.refresh.Ahead && c.refreshFraction > 0 &&
+				now >= ent.expiresAt-int64(c.refreshFraction*float64(c.cappedTTL(ent.refresh.TTL))) {
+				refreshDue = ent.refresh
+			}
+			if ent.idleTTL > 0 {
+				ent.slideExpiry(now)
+			}
+		}
+		c.touch(elem) // Mark as recently used
+		return ent.item(), true, nil, refreshDue
+	}
+	return Item{}, false, nil, nil
+}
 
-	if elem, hit := c.items[key]; hit {
-		c.evictList.MoveToFront(elem) // Mark as recently used
-		// Type assertion needed as list stores interface{}
-		return elem.Value.(*entry).value, true
+// afterGet reports what a lookup found once the mutex has been released.
+func (c *LRUCache) afterGet(key string, expired *entry, refreshDue *RefreshSource) {
+	if expired != nil {
+		c.notifyEvict(expired, EvictionExpired)
+	}
+	if refreshDue != nil && c.onRefreshDue != nil {
+		c.onRefreshDue(key, refreshDue)
 	}
-	return "", false
 }
 
 // Put inserts or updates a value, moving/adding it to the front. Evicts if needed.
 func (c *LRUCache) Put(key, value string) {
+	c.PutWithOptions(key, value, PutOptions{})
+}
+
+// PutWithOptions is Put with per-entry settings.
+func (c *LRUCache) PutWithOptions(key, value string, opts PutOptions) PutResult {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	result, evicted := c.putLocked(key, value, opts)
+	item := c.items[key].Value.(*entry).item()
+	c.mutex.Unlock()
 
-	// Check if key exists - Update value and move to front
-	if elem, hit := c.items[key]; hit {
-		c.evictList.MoveToFront(elem)
-		elem.Value.(*entry).value = value // Update the value
-		return
+	if result.Refused {
+		return result
+	}
+	if evicted != nil {
+		c.notifyEvict(evicted, EvictionCapacity)
+	}
+	c.waiters.wake(key, item)
+	return result
+}
+
+// PutWithOptionsCtx is PutWithOptions, but gives up with ctx.Err() if ctx is
+// done before the shard lock can be acquired, and fails with ErrImmutable if
+// the key holds an immutable entry, or ErrEntryForbidden if opts.CheckACL
+// refuses the write. Nothing is written in any of these cases.
+func (c *LRUCache) PutWithOptionsCtx(ctx context.Context, key, value string, opts PutOptions) (PutResult, error) {
+	if err := c.lockCtx(ctx); err != nil {
+		return PutResult{}, err
+	}
+	result, evicted := c.putLocked(key, value, opts)
+	item := c.items[key].Value.(*entry).item()
+	c.mutex.Unlock()
+
+	if result.Refused {
+		return result, refusal(key, result)
+	}
+	if evicted != nil {
+		c.notifyEvict(evicted, EvictionCapacity)
+	}
+	c.waiters.wake(key, item)
+	return result, nil
+}
+
+// refusal returns the error for a put of key that result reports Refused.
+func refusal(key string, result PutResult) error {
+	if result.Forbidden {
+		return forbidden(key)
+	}
+	return fmt.Errorf("%w: %s", ErrImmutable, key)
+}
+
+// putLocked implements PutWithOptions and returns the entry evicted to make
+// room, if any, so the caller can report it once the mutex is released. A live
+// immutable entry, or one opts.CheckACL forbids overwriting, is left as it
+// is, recency included, and Refused is set.
+// MUST be called with the mutex held.
+func (c *LRUCache) putLocked(key, value string, opts PutOptions) (PutResult, *entry) {
+	cost := opts.Cost
+	if cost <= 0 {
+		cost = MinCost
+	}
+
+	now := c.now()
+	createdAt := now
+	if opts.CreatedAt > 0 && opts.CreatedAt < now {
+		createdAt = opts.CreatedAt
+	}
+	var expiresAt int64
+	if opts.TTL > 0 {
+		expiresAt = now + int64(opts.TTL)
+	}
+	if c.maxAge > 0 && (expiresAt == 0 || expiresAt > createdAt+int64(c.maxAge)) {
+		expiresAt = createdAt + int64(c.maxAge)
+	}
+
+	immutable := opts.Immutable || c.immutablePrefix(key)
+
+	// Check if key exists - Update value and move to front (unless disabled)
+	if elem, hit := c.lookupLocked(key); hit {
+		ent := elem.Value.(*entry)
+		if opts.CheckACL && !readableBy(ent.readers, opts.Reader) && c.live(ent, now) {
+			return PutResult{Refused: true, Forbidden: true, Pressure: c.pressure.ratio(now)}, nil
+		}
+		if ent.immutable && c.live(ent, now) {
+			return PutResult{Refused: true, Pressure: c.pressure.ratio(now)}, nil
+		}
+		if opts.Coalesce && c.skipUnchanged && c.unchangedLocked(ent, value, opts, immutable, now) {
+			return c.coalesceLocked(elem, opts.TTL, expiresAt, now), nil
+		}
+		if c.touchOnWrite {
+			c.touch(elem)
+		}
+		ent.value = value // Update the value
+		ent.version++
+		c.valueIndex.set(key, value)
+		ent.createdAt = createdAt
+		ent.cost = cost
+		ent.expiresAt = expiresAt
+		ent.ttl = opts.TTL
+		ent.encoding = opts.Encoding
+		ent.refresh = opts.Refresh
+		ent.staleFor = opts.StaleFor
+		c.retiredFence = max(c.retiredFence, ent.fence)
+		ent.fence = 0 // A plain write turns a lock back into a regular value
+		ent.immutable = immutable
+		ent.generation = c.generation.Load()
+		ent.transforms = opts.Transforms
+		ent.readers = opts.Readers
+		ent.idleTTL, ent.hardExpiresAt = opts.IdleTTL, 0
+		if ent.idleTTL > 0 {
+			ent.hardExpiresAt = expiresAt
+			ent.slideExpiry(now)
+		}
+		if ent.writer != opts.Writer {
+			c.countWriter(ent, -1)
+			ent.writer = opts.Writer
+			c.countWriter(ent, 1)
+		}
+		c.pressure.record(now, false)
+		return PutResult{Pressure: c.pressure.ratio(now), Generation: ent.generation}, nil
 	}
 
 	// Key doesn't exist - Add new entry
 
 	// Check for capacity and evict LRU item if full
-	if c.evictList.Len() >= c.capacity {
-		c.removeOldest()
+	var evicted *entry
+	if c.lenLocked() >= c.capacity {
+		if evicted = c.evictOwnLocked(opts.Writer); evicted == nil {
+			evicted = c.evictOne()
+		}
 	}
 
 	// Add the new item
-	newEntry := &entry{key, value}
-	element := c.evictList.PushFront(newEntry)
-	c.items[key] = element
+	ent := &entry{key: key, value: value, createdAt: createdAt, cost: cost, expiresAt: expiresAt, ttl: opts.TTL, version: 1, encoding: opts.Encoding, refresh: opts.Refresh, staleFor: opts.StaleFor, immutable: immutable, generation: c.generation.Load(), writer: opts.Writer, transforms: opts.Transforms, readers: opts.Readers}
+	if opts.IdleTTL > 0 {
+		ent.idleTTL, ent.hardExpiresAt = opts.IdleTTL, expiresAt
+		ent.slideExpiry(now)
+	}
+	c.insertFront(ent)
+
+	c.pressure.record(now, evicted != nil)
+	result := PutResult{Evicted: evicted != nil, Pressure: c.pressure.ratio(now), Generation: ent.generation}
+	if evicted != nil {
+		result.EvictedKey = evicted.key
+	}
+	return result, evicted
 }
 
-// removeOldest removes the least recently used item from the cache.
-// MUST be called with the mutex held.
-func (c *LRUCache) removeOldest() {
-	elem := c.evictList.Back() // Get the last element (LRU)
+// lockCtx acquires the mutex, polling with TryLock once it is contended so
+// that it can give up with ctx.Err() when ctx is done, or with
+// ErrLockTimeout after the shard's lock timeout. The uncontended case costs
+// a single TryLock.
+func (c *LRUCache) lockCtx(ctx context.Context) error {
+	if c.mutex.TryLock() {
+		return nil
+	}
+	if ctx.Done() == nil && c.lockTimeout <= 0 {
+		c.mutex.Lock() // Context can never be cancelled, just block
+		return nil
+	}
+	var deadline time.Time
+	if c.lockTimeout > 0 {
+		deadline = time.Now().Add(c.lockTimeout)
+	}
+	backoff := time.Microsecond
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if c.mutex.TryLock() {
+			return nil
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			c.lockTimeouts.Add(1)
+			return fmt.Errorf("%w: shard %d after %s", ErrLockTimeout, c.index, c.lockTimeout)
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Millisecond)
+	}
+}
+
+// removeOldest removes the least recently used unpinned item from the cache
+// and returns it (nil if there is none). MUST be called with the mutex held.
+func (c *LRUCache) removeOldest() *entry {
+	elem := c.unpinnedBack() // Get the last element (LRU)
 	if elem != nil {
-		entryToRemove := c.evictList.Remove(elem).(*entry) // Remove from list
-		delete(c.items, entryToRemove.key)                 // Remove from map
+		return c.removeElement(elem)
+	}
+	return nil
+}
+
+// removeElement unlinks elem from the list, the map and the key directory and
+// returns its entry. MUST be called with the mutex held.
+func (c *LRUCache) removeElement(elem *list.Element) *entry {
+	entryToRemove := c.evictList.Remove(elem).(*entry) // Remove from list
+	delete(c.items, entryToRemove.key)                 // Remove from map
+	c.directory.remove(entryToRemove.key)
+	c.valueIndex.remove(entryToRemove.key)
+	c.countWriter(entryToRemove, -1)
+	if entryToRemove.pinned {
+		c.pinned--
+	}
+	c.retiredFence = max(c.retiredFence, entryToRemove.fence)
+	return entryToRemove
+}
+
+// insertFront adds a new entry as the most recently used one.
+// MUST be called with the mutex held, and only for keys not in the shard.
+func (c *LRUCache) insertFront(e *entry) {
+	if c.trackAccess {
+		e.accessedAt = c.now()
+	}
+	c.items[e.key] = c.evictList.PushFront(e)
+	c.directory.add(e.key, c.index)
+	c.valueIndex.set(e.key, e.value)
+	c.countWriter(e, 1)
+	if e.pinned {
+		c.pinned++ // Renamed in from another key
+	}
+}
+
+// removeCheapest removes the lowest-cost entry among the evictionCandidates
+// least recently used unpinned ones and returns it (nil if there is none).
+// Cold entries are the least recently used of the shard, so the candidates
+// start with them and continue with the tail of the list.
+// MUST be called with the mutex held.
+func (c *LRUCache) removeCheapest() *entry {
+	ref, h, cold := c.cold.cheapest(c.evictionCandidates)
+	var victim *list.Element
+	if cold < c.evictionCandidates {
+		victim = c.unpinnedBack()
+	}
+	if victim != nil {
+		// Scan towards the front; strict < keeps the older entry on ties.
+		elem := victim.Prev()
+		for i := cold + 1; i < c.evictionCandidates && elem != nil; elem = elem.Prev() {
+			if ent := elem.Value.(*entry); !ent.pinned {
+				if ent.cost < victim.Value.(*entry).cost {
+					victim = elem
+				}
+				i++
+			}
+		}
+	}
+	if cold > 0 && (victim == nil || ref.cost <= victim.Value.(*entry).cost) {
+		e := c.cold.entryAt(ref) // Older than every hot candidate, so it wins ties
+		c.cold.drop(h, ref)
+		return c.forgetCold(e)
+	}
+	if victim == nil {
+		return nil
+	}
+	return c.removeElement(victim)
+}
+
+// evictOne makes room for a new entry according to the eviction policy and
+// returns the removed entry. Cold entries are the least recently used of the
+// shard, so LRU takes them first and cost-aware eviction compares them first.
+// MUST be called with the mutex held.
+func (c *LRUCache) evictOne() *entry {
+	var removed *entry
+	if c.costAware {
+		removed = c.removeCheapest()
+	} else if removed = c.cold.takeOldest(); removed != nil {
+		c.forgetCold(removed)
+	} else {
+		removed = c.removeOldest()
+	}
+	if removed != nil {
+		c.evictionsByCost[costBucket(removed.cost)]++
+	}
+	return removed
+}
+
+// notifyEvict reports a removed entry to the eviction callback, if any.
+// MUST be called without the mutex held.
+func (c *LRUCache) notifyEvict(e *entry, reason EvictionReason) {
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value, reason)
 	}
 }
 
+// Capacity returns the number of entries the shard holds before it evicts.
+func (c *LRUCache) Capacity() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.capacity
+}
+
+// Len returns the number of items currently stored in the shard.
+func (c *LRUCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lenLocked()
+}
+
+// GetSnapshot looks the key up in the last published read snapshot without
+// taking the mutex. The result may be stale and does not update LRU order,
+// but entries whose TTL has run out since the snapshot was built are misses.
+// Falls back to Get if no snapshot has been published yet, and for the
+// entries the snapshot leaves to the locked path.
+func (c *LRUCache) GetSnapshot(key string) (Item, bool) {
+	snap := c.readSnapshot.Load()
+	if snap == nil {
+		return c.GetItem(key)
+	}
+	item, ok := (*snap)[key]
+	if ok && item.viaLock {
+		return c.GetItem(key)
+	}
+	now := c.now()
+	if ok && item.ExpiresAt != 0 && now >= item.ExpiresAt {
+		return Item{}, false // Expired since the snapshot was built
+	}
+	if ok && c.maxAge > 0 && item.CreatedAt <= now-int64(c.maxAge) {
+		return Item{}, false // Left for the sweeper (see SetMaxEntryAge)
+	}
+	if ok && item.Generation < c.generation.Load() {
+		return Item{}, false // Bumped since the snapshot was built (see BumpGeneration)
+	}
+	return item, ok
+}
+
+// rebuildSnapshot copies the shard's contents into a new map and swaps it in
+// for lock-free readers. The mutex is only held for the copy. Entries whose
+// expiry a snapshot read cannot judge, because reads slide it or a pin
+// suspends it, are only marked, so GetSnapshot reads them under the lock.
+func (c *LRUCache) rebuildSnapshot() {
+	now := c.now()
+	c.mutex.Lock()
+	snap := make(map[string]Item, c.lenLocked())
+	for key, elem := range c.items {
+		ent := elem.Value.(*entry)
+		switch {
+		case ent.idleTTL > 0 || ent.pinned:
+			snap[key] = Item{viaLock: true}
+		case c.live(ent, now):
+			snap[key] = ent.item()
+		}
+	}
+	c.cold.each(func(ent *entry) { // Never sliding or pinned
+		if c.live(ent, now) {
+			snap[ent.key] = ent.item()
+		}
+	})
+	c.mutex.Unlock()
+	c.readSnapshot.Store(&snap)
+}
+
 // --- Sharded Cache Implementation ---
 
 // ShardedCache manages multiple LRUCache shards.
 type ShardedCache struct {
 	shards []*LRUCache
+
+	// Weakly consistent read mode (see EnableReadSnapshots).
+	snapshotInterval time.Duration
+	lastSnapshot     atomic.Int64 // UnixNano of the last completed snapshot rebuild
+
+	evictCallbacks []EvictionCallback // Registered via OnEvict
+
+	directory *KeyDirectory // Optional global key index (see EnableKeyDirectory)
+	coldAfter time.Duration // Idle time before entries move to the cold tier; 0 = disabled
+	maxIdle   time.Duration // Idle time before entries are removed; 0 = disabled
+	maxAge    time.Duration // Age past which entries are removed; 0 = disabled
+	waiters   *WaitList     // Blocked GET ?wait= requests (see EnableWaiters)
+
+	fairness      *FairnessGuard // Identifies writers when entries are counted per writer; nil = not counted
+	fairnessLimit float64        // Share of a shard above which a writer evicts its own entries
+
+	valueIndex *ValueIndex // Optional value prefix index (see EnableValueIndex)
+	countReads bool        // Count GET hits per key (see EnableReadCounting)
+	hash64     bool        // Shard by fnv64a instead of fnv32a (see SetShardHash)
+	nfcKeys    bool        // Normalize keys to Unicode NFC (see SetKeyNormalization)
+	salt       []byte      // Mixed into keys before sharding (see SetShardSalt); nil = unsalted
+
+	generationMutex    sync.Mutex // Serializes generation changes
+	generationSweeping bool       // The generation sweeper is running
+
+	writeBufferInterval time.Duration // Flush interval of staged puts; 0 = not buffered
+
+	trace *TraceRecorder // Optional traffic trace (see EnableTrace)
+
+	workers *Supervisor // Runs the background workers of the cache and its components
+
+	clock Clock        // Source of time and tickers (see SetClock)
+	now   func() int64 // clock.Now in UnixNano, shared with the shards
 }
 
 // NewShardedCache creates and initializes all cache shards.
-func NewShardedCache(numShards, capacityPerShard int) *ShardedCache {
+func NewShardedCache(numShards, capacityPerShard int, lazy bool) *ShardedCache {
 	if numShards <= 0 {
 		numShards = NumShards // Default
 	}
 	shards := make([]*LRUCache, numShards)
 	for i := 0; i < numShards; i++ {
-		shards[i] = NewLRUCache(capacityPerShard)
+		if lazy {
+			shards[i] = NewLazyLRUCache(capacityPerShard)
+		} else {
+			shards[i] = NewLRUCache(capacityPerShard)
+		}
+		shards[i].index = i
 	}
 	log.Printf("Initialized sharded cache with %d shards, %d capacity per shard (Total Capacity: %d)",
 		numShards, capacityPerShard, numShards*capacityPerShard)
-	return &ShardedCache{shards: shards}
+	return &ShardedCache{shards: shards, workers: NewSupervisor(), clock: realClock{}, now: realNow}
+}
+
+// Shard hash functions, selected with SetShardHash.
+const (
+	ShardHashFNV32a = "fnv32a" // Default
+	ShardHashFNV64a = "fnv64a" // Less clustering at large shard counts
+)
+
+// SetShardHash selects the hash keys are sharded by. Switching it moves most
+// keys to another shard, so it must be called before the cache holds any.
+func (sc *ShardedCache) SetShardHash(name string) error {
+	switch name {
+	case ShardHashFNV32a:
+		sc.hash64 = false
+	case ShardHashFNV64a:
+		sc.hash64 = true
+	default:
+		return fmt.Errorf("unknown shard hash %q, expected %s or %s", name, ShardHashFNV32a, ShardHashFNV64a)
+	}
+	return nil
+}
+
+// ShardHash returns the name of the hash keys are sharded by. A salted hash
+// is named after its salt too, such as "fnv32a+salt:1f2e3d4c", so layouts
+// only compare equal when keys land on the same shards.
+func (sc *ShardedCache) ShardHash() string {
+	name := ShardHashFNV32a
+	if sc.hash64 {
+		name = ShardHashFNV64a
+	}
+	if sc.salt != nil {
+		name += "+salt:" + shardSaltID(sc.salt)
+	}
+	return name
 }
 
 // getShardIndex calculates the shard index for a given key.
 func (sc *ShardedCache) getShardIndex(key string) int {
+	return shardIndexFor(key, len(sc.shards), sc.hash64, sc.salt)
+}
+
+// shardIndexFor maps key to one of numShards shards, by the low bits of its
+// fnv64a hash when hash64 is set and by its fnv32a hash otherwise. With a
+// salt, the hash covers the salt followed by the key (see saltedKeyHash).
+func shardIndexFor(key string, numShards int, hash64 bool, salt []byte) int {
+	if salt != nil {
+		return int(saltedKeyHash(key, hash64, salt) % uint64(numShards))
+	}
+	if hash64 {
+		return int(hashKey64(key) % uint64(numShards))
+	}
 	hasher := fnv.New32a()
 	hasher.Write([]byte(key))
 	// Use modulo. If NumShards is a power of 2, `hash & (NumShards - 1)` is faster.
-	return int(hasher.Sum32()) % len(sc.shards)
-	// Example for power of 2: return int(hasher.Sum32() & (uint32(len(sc.shards)) - 1))
+	return int(hasher.Sum32()) % numShards
+	// Example for power of 2: return int(hasher.Sum32() & (uint32(numShards) - 1))
+}
+
+// groupByShard buckets keys by shard index, preserving their relative order.
+// The result has one (possibly empty) slice per shard.
+func (sc *ShardedCache) groupByShard(keys []string) [][]string {
+	groups := make([][]string, len(sc.shards))
+	for _, key := range keys {
+		index := sc.getShardIndex(key)
+		groups[index] = append(groups[index], key)
+	}
+	return groups
 }
 
 // Get retrieves a value from the appropriate shard.
 func (sc *ShardedCache) Get(key string) (string, bool) {
 	shardIndex := sc.getShardIndex(key)
 	shard := sc.shards[shardIndex]
-	return shard.Get(key) // Delegate to the specific shard's Get method
+	if sc.snapshotInterval > 0 {
+		item, found := shard.GetSnapshot(key) // Lock-free, possibly stale read
+		sc.countRead(item, found)
+		sc.trace.record(traceGet, key, len(item.Value), 0)
+		return item.Value, found
+	}
+	item, found := shard.GetItem(key) // Delegate to the specific shard's Get method
+	sc.countRead(item, found)
+	sc.trace.record(traceGet, key, len(item.Value), 0)
+	return item.Value, found
+}
+
+// EnableReadSnapshots switches Get to the lock-free snapshot path and starts a
+// background goroutine that rebuilds every shard's snapshot each interval.
+// Writes become visible to readers on the next rebuild. Must be called before
+// the cache starts serving requests.
+func (sc *ShardedCache) EnableReadSnapshots(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	sc.rebuildSnapshots() // Publish an initial snapshot so readers never fall back
+	sc.snapshotInterval = interval
+	sc.workers.Go("read-snapshots", func() {
+		ticks, stop := sc.clock.NewTicker(interval)
+		defer stop()
+		for range ticks {
+			sc.rebuildSnapshots()
+		}
+	})
+	log.Printf("Serving GETs from lock-free read snapshots rebuilt every %s", interval)
+}
+
+// rebuildSnapshots refreshes the read snapshot of each shard in turn.
+func (sc *ShardedCache) rebuildSnapshots() {
+	for _, shard := range sc.shards {
+		shard.rebuildSnapshot()
+	}
+	sc.lastSnapshot.Store(sc.now())
+}
+
+// SetTouchOnWrite controls whether updating an existing key moves it to the
+// front of its shard's LRU list (the default). Must be called before the cache
+// starts serving requests.
+func (sc *ShardedCache) SetTouchOnWrite(touch bool) {
+	for _, shard := range sc.shards {
+		shard.touchOnWrite = touch
+	}
+}
+
+// SetStaleWindow lets entries without a stale-while-revalidate window of
+// their own be read for window past their TTL by readers that accept stale
+// values (GetCtx with allowStale). Such entries are kept until the window
+// ends. Must be called before the cache starts serving requests.
+func (sc *ShardedCache) SetStaleWindow(window time.Duration) {
+	for _, shard := range sc.shards {
+		shard.staleWindow = window
+	}
+}
+
+// Len returns the total number of items across all shards.
+func (sc *ShardedCache) Len() int {
+	total := 0
+	for _, shard := range sc.shards {
+		total += shard.Len()
+	}
+	return total
+}
+
+// Capacity returns the combined capacity of all shards.
+func (sc *ShardedCache) Capacity() int {
+	total := 0
+	for _, shard := range sc.shards {
+		total += shard.Capacity()
+	}
+	return total
+}
+
+// GetCtx is Get bounded by ctx: it returns ctx.Err() instead of waiting for a
+// contended shard lock past the caller's deadline. Snapshot reads never wait.
+// With allowStale, entries within the cache's stale window are returned after
+// their TTL too, with Item.Stale set; see SetStaleWindow.
+func (sc *ShardedCache) GetCtx(ctx context.Context, key string, allowStale bool) (Item, bool, error) {
+	shard := sc.shards[sc.getShardIndex(key)]
+	if sc.snapshotInterval > 0 {
+		item, found := shard.GetSnapshot(key)
+		sc.countRead(item, found)
+		sc.trace.record(traceGet, key, len(item.Value), 0)
+		return item, found, nil
+	}
+	stale := staleOwnWindow
+	if allowStale {
+		stale = staleAllowed
+	}
+	item, found, err := shard.GetCtx(ctx, key, stale)
+	sc.countRead(item, found)
+	if err == nil {
+		sc.trace.record(traceGet, key, len(item.Value), 0)
+	}
+	return item, found, err
+}
+
+// PutCtx is Put bounded by ctx; see PutWithOptionsCtx.
+func (sc *ShardedCache) PutCtx(ctx context.Context, key, value string) error {
+	_, err := sc.PutWithOptionsCtx(ctx, key, value, PutOptions{})
+	return err
+}
+
+// PutWithOptionsCtx is PutWithOptions bounded by ctx: it returns ctx.Err(),
+// without writing, instead of waiting for a contended shard lock past the
+// caller's deadline. Keys and values over their length limits fail with
+// ErrKeyTooLong and ErrValueTooLong.
+func (sc *ShardedCache) PutWithOptionsCtx(ctx context.Context, key, value string, opts PutOptions) (PutResult, error) {
+	value, err := opts.transformValue(key, value)
+	if err != nil {
+		return PutResult{}, err
+	}
+	if err := checkLengths(key, value); err != nil {
+		return PutResult{}, err
+	}
+	sc.trace.record(tracePut, key, len(value), opts.Cost)
+	shard := sc.shards[sc.getShardIndex(key)]
+	return shard.PutWithOptionsCtx(ctx, key, value, opts)
 }
 
 // Put inserts/updates a value into the appropriate shard.
 func (sc *ShardedCache) Put(key, value string) {
+	sc.trace.record(tracePut, key, len(value), 0)
 	shardIndex := sc.getShardIndex(key)
 	shard := sc.shards[shardIndex]
 	shard.Put(key, value) // Delegate to the specific shard's Put method
 }
 
+// PutWithOptions inserts/updates a value with per-entry settings.
+func (sc *ShardedCache) PutWithOptions(key, value string, opts PutOptions) PutResult {
+	value, err := opts.transformValue(key, value)
+	if err != nil {
+		return PutResult{Refused: true}
+	}
+	sc.trace.record(tracePut, key, len(value), opts.Cost)
+	shard := sc.shards[sc.getShardIndex(key)]
+	return shard.PutWithOptions(key, value, opts)
+}
+
+// Delete removes key and reports whether it was present and unexpired.
+func (sc *ShardedCache) Delete(key string) bool {
+	deleted, _ := sc.remove(key, nil)
+	return deleted
+}
+
+// remove implements Delete. If check is set it is asked about a live entry
+// first, under the shard lock, and an error it returns is passed on with
+// nothing removed.
+func (sc *ShardedCache) remove(key string, check func(e *entry) error) (bool, error) {
+	sc.trace.record(traceDelete, key, 0, 0)
+	shard := sc.shards[sc.getShardIndex(key)]
+	now := sc.now()
+	shard.mutex.Lock()
+	elem, hit := shard.lookupLocked(key)
+	if !hit {
+		shard.mutex.Unlock()
+		return false, nil
+	}
+	live := shard.live(elem.Value.(*entry), now)
+	if live && check != nil {
+		if err := check(elem.Value.(*entry)); err != nil {
+			shard.mutex.Unlock()
+			return false, err
+		}
+	}
+	removed := shard.removeElement(elem)
+	shard.mutex.Unlock()
+
+	if live {
+		shard.notifyEvict(removed, EvictionDeleted)
+	} else {
+		shard.notifyEvict(removed, EvictionExpired)
+	}
+	return live, nil
+}
+
 // writeJSONError sends a standardized JSON error response.
 func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
+	writeJSONErrorCode(w, message, "", statusCode)
+}
+
+// writeJSONErrorCode sends a standardized JSON error response carrying a
+// machine-readable error code.
+func writeJSONErrorCode(w http.ResponseWriter, message, code string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if code != "" {
+		w.Header().Set(errorCodeHeader, code) // For ErrorStats, which removes it
+	}
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(GenericErrorResponse{
 		Status:  "ERROR",
 		Message: message,
+		Code:    code,
 	})
 }
 
+// validateKey checks an already trimmed key and returns the error message to
+// send back, or "" if the key is acceptable.
+func validateKey(key string) string {
+	if key == "" {
+		return "Key cannot be empty."
+	}
+	if utf8.RuneCountInString(key) > MaxKeyLength {
+		return fmt.Sprintf("Key exceeds maximum length (%d characters).", MaxKeyLength)
+	}
+	return ""
+}
+
+// Names of the PUT validation rules, as reported by validatePut.
+const (
+	RuleKeyEmpty     = "key_empty"
+	RuleKeyTooLong   = "key_too_long"
+	RuleValueTooLong = "value_too_long"
+	RuleCostRange    = "cost_range"
+	RuleEncoding     = "encoding"
+	RuleTTL          = "ttl"
+)
+
+// validationError describes which rule a PUT request broke. For length rules
+// Measured and Limit hold the observed and maximum size in characters.
+type validationError struct {
+	Rule     string
+	Message  string
+	Measured int
+	Limit    int
+}
+
+// options converts the optional settings of a validated PUT request.
+func (req *PutRequest) options(encoding Encoding) PutOptions {
+	return PutOptions{
+		Cost:     req.Cost,
+		Encoding: encoding,
+		TTL:      time.Duration(req.TTLSeconds) * time.Second,
+		StaleFor: time.Duration(req.SWRSeconds) * time.Second,
+		IdleTTL:  time.Duration(req.IdleTTLSeconds) * time.Second,
+
+		Immutable: req.Immutable,
+
+		Coalesce: !req.Force,
+
+		Readers: req.ACL.readers(),
+	}
+}
+
+// validatePut checks a PUT request whose key has already been trimmed and
+// returns the first rule it breaks, or nil.
+func validatePut(key string, req *PutRequest) *validationError {
+	// Validate Key (must exist and check length using rune count for UTF-8)
+	if key == "" {
+		return &validationError{Rule: RuleKeyEmpty, Message: "Key cannot be empty."}
+	}
+	if n := utf8.RuneCountInString(key); n > MaxKeyLength {
+		return &validationError{
+			Rule:     RuleKeyTooLong,
+			Message:  fmt.Sprintf("Key exceeds maximum length (%d characters).", MaxKeyLength),
+			Measured: n,
+			Limit:    MaxKeyLength,
+		}
+	}
+
+	// Validate Value (check length using rune count for UTF-8)
+	// Assuming value can be empty, but not exceed max length. Adjust if empty value is disallowed.
+	if n := utf8.RuneCountInString(req.Value); n > MaxValueLength {
+		return &validationError{
+			Rule:     RuleValueTooLong,
+			Message:  fmt.Sprintf("Value exceeds maximum length (%d characters).", MaxValueLength),
+			Measured: n,
+			Limit:    MaxValueLength,
+		}
+	}
+
+	// Validate Cost (optional, 0 means default)
+	if req.Cost < 0 || req.Cost > MaxCost {
+		return &validationError{Rule: RuleCostRange, Message: fmt.Sprintf("Cost must be between %d and %d.", MinCost, MaxCost)}
+	}
+
+	// Validate Encoding (optional, empty means text) and the value against it
+	encoding, ok := parseEncoding(req.Encoding)
+	if !ok {
+		return &validationError{Rule: RuleEncoding, Message: "Encoding must be one of text, json or base64."}
+	}
+	if !encoding.valid(req.Value) {
+		return &validationError{Rule: RuleEncoding, Message: fmt.Sprintf("Value is not valid %s.", encoding)}
+	}
+
+	// Validate TTL, idle TTL and stale window (optional, 0 means none)
+	if req.TTLSeconds < 0 || req.SWRSeconds < 0 || req.IdleTTLSeconds < 0 {
+		return &validationError{Rule: RuleTTL, Message: "TTL, idle TTL and stale window cannot be negative."}
+	}
+	if req.SWRSeconds > 0 && req.TTLSeconds == 0 && req.IdleTTLSeconds == 0 {
+		return &validationError{Rule: RuleTTL, Message: "A stale window requires a TTL."}
+	}
+
+	// Validate the read ACL (optional)
+	if req.ACL != nil {
+		if msg := req.ACL.validate(); msg != "" {
+			return &validationError{Rule: RuleACL, Message: msg}
+		}
+	}
+	return nil
+}
+
 // --- HTTP Handlers --- (Updated to use ShardedCache)
-func HandlePut(cache *ShardedCache) http.HandlerFunc {
+func HandlePut(cache *ShardedCache, decoder *PutDecoder, writes WritePolicy, pressure PressurePolicy, rejections *RejectionTracker, reportEvictedKey bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req PutRequest
 
@@ -189,50 +1277,81 @@ func HandlePut(cache *ShardedCache) http.HandlerFunc {
 		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
 
 		// Decode request body
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			msg := "Invalid JSON format."
-			if strings.Contains(err.Error(), "http: request body too large") {
-				msg = "Request body exceeds limit (1MB)."
-			}
-			writeJSONError(w, msg, http.StatusBadRequest)
+		if derr := decoder.Decode(r.Body, &req); derr != nil {
+			writeJSONErrorCode(w, derr.message, decodeFailureNames[derr.failure], derr.status())
 			return
 		}
 
-		// Validate Key (must exist and check length using rune count for UTF-8)
-		key := strings.TrimSpace(req.Key)
-		if key == "" {
-			writeJSONError(w, "Key cannot be empty.", http.StatusBadRequest)
+		// Validate the request (key is trimmed first)
+		key := cache.trimKey(req.Key)
+		if verr := validatePut(key, &req); verr != nil {
+			// Clients that keep retrying the same oversized value get a 413 with advice.
+			if verr.Rule == RuleValueTooLong && rejections != nil {
+				if retryAfter, repeated := rejections.Record(key, verr.Measured); repeated {
+					writeOversizedError(w, verr, retryAfter)
+					return
+				}
+			}
+			writeJSONError(w, verr.Message, http.StatusBadRequest)
 			return
 		}
-		if utf8.RuneCountInString(key) > MaxKeyLength {
-			writeJSONError(w, fmt.Sprintf("Key exceeds maximum length (%d characters).", MaxKeyLength), http.StatusBadRequest)
-			return
+
+		// Shed some writes while the target shard is thrashing
+		if pressure.ShedFraction > 0 {
+			if ratio := cache.PressureFor(key); pressure.ShouldShed(ratio) {
+				writeShedError(w, pressure, ratio)
+				return
+			}
 		}
 
-		// Validate Value (check length using rune count for UTF-8)
-		// Assuming value can be empty, but not exceed max length. Adjust if empty value is disallowed.
-		if utf8.RuneCountInString(req.Value) > MaxValueLength {
-			writeJSONError(w, fmt.Sprintf("Value exceeds maximum length (%d characters).", MaxValueLength), http.StatusBadRequest)
+		// Normalize the value with the configured write transforms, and
+		// resolve its TTL
+		encoding, _ := parseEncoding(req.Encoding) // Checked by validatePut
+		put, err := writes.prepare(key, req.Value, req.options(encoding), writes.Fairness.writer(r), requestReader(r))
+		if err != nil {
+			writeCacheError(w, err)
 			return
 		}
 
 		// Store the key-value pair
-		cache.Put(key, req.Value) // Use the trimmed key
+		buffered, result, err := cache.PutBuffered(r.Context(), key, put.value, put.opts) // Use the trimmed key
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
 
 		// Send success response
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !buffered { // A staged put has not measured the shard's pressure
+			setBackoffHeaders(w, pressure, result.Pressure)
+		}
+		resp := PutSuccessResponse{
+			Status:         "OK",
+			Message:        "Key inserted/updated successfully.",
+			EvictedToAdmit: result.Evicted,
+			TTLSeconds:     put.ttlSeconds(),
+			TTLAdjusted:    put.ttlAdjusted,
+			Buffered:       buffered,
+			TTLRule:        put.ttlRule,
+			Unchanged:      result.Unchanged,
+			Transforms:     put.opts.Transforms,
+			Generation:     result.Generation,
+		}
+		if reportEvictedKey {
+			resp.EvictedKey = result.EvictedKey
+		}
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(PutSuccessResponse{
-			Status:  "OK",
-			Message: "Key inserted/updated successfully.",
-		})
+		json.NewEncoder(w).Encode(resp)
 	}
 }
 
-func HandleGet(cache *ShardedCache) http.HandlerFunc {
+func HandleGet(cache *ShardedCache, misses *MissLog, caching *CacheControlPolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		key = strings.TrimSpace(key) // Trim whitespace
+		key, err := queryKey(r, cache)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
 
 		// Validate key presence
 		if key == "" {
@@ -246,11 +1365,59 @@ func HandleGet(cache *ShardedCache) http.HandlerFunc {
 			return
 		}
 
+		// Optional long poll: on a miss, wait up to this long for the key to be written
+		var wait time.Duration
+		if raw := r.URL.Query().Get("wait"); raw != "" {
+			seconds, err := strconv.ParseFloat(raw, 64)
+			if err != nil || seconds <= 0 || seconds > maxWaitSeconds {
+				writeJSONError(w, fmt.Sprintf("Invalid 'wait' parameter, expected seconds between 0 and %d.", maxWaitSeconds), http.StatusBadRequest)
+				return
+			}
+			wait = time.Duration(seconds * float64(time.Second))
+		}
+
+		// Optional stale-while-revalidate: accept values past their TTL within the stale window
+		var allowStale bool
+		switch r.URL.Query().Get("stale") {
+		case "":
+		case "allow":
+			allowStale = true
+		default:
+			writeJSONError(w, "Invalid 'stale' parameter, expected allow.", http.StatusBadRequest)
+			return
+		}
+
 		// Attempt to retrieve the value
-		value, found := cache.Get(key)
+		item, found, err := cache.GetCtx(r.Context(), key, allowStale)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+
+		if !found && wait > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			item, found, err = cache.WaitFor(ctx, key)
+			cancel()
+			if err != nil {
+				writeCacheError(w, err)
+				return
+			}
+		}
+
+		// Entries with a read ACL are only served to the tokens on it
+		if found && !item.ReadableBy(requestReader(r)) {
+			writeCacheError(w, forbidden(key))
+			return
+		}
+
+		caching.setHeaders(w, key, item, found, cache.clock.Now())
+		if item.Stale {
+			w.Header().Set("X-Cache", "STALE")
+		}
 
 		// Handle Key Not Found
 		if !found {
+			misses.Record(key)
 			writeJSONError(w, "Key not found.", http.StatusNotFound)
 			return
 		}
@@ -259,39 +1426,471 @@ func HandleGet(cache *ShardedCache) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(GetSuccessResponse{
-			Status: "OK",
-			Key:    key,
-			Value:  value,
+			Status:     "OK",
+			Key:        key,
+			Value:      item.Value,
+			Encoding:   item.Encoding.String(),
+			Immutable:  item.Immutable,
+			Transforms: item.Transforms,
+			ACL:        aclResponse(item.Readers),
 		})
 	}
 }
 
+func HandleStats(cache *ShardedCache, listeners []*countingListener, refresher *Refresher, snapshotter *Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := StatsResponse{
+			Status:   "OK",
+			Shards:   len(cache.shards),
+			Capacity: cache.Capacity(),
+			Items:    cache.Len(),
+
+			EvictionPolicy:  cache.EvictionPolicy(),
+			EvictionsByCost: cache.EvictionsByCost(),
+
+			EvictionPressure: cache.ShardPressure(),
+			PinnedKeys:       cache.PinnedKeys(),
+
+			Listeners: listenerStats(listeners),
+		}
+		if refresher != nil {
+			resp.RefreshAhead = refresher.Stats()
+		}
+		if snapshotter != nil {
+			resp.Snapshot = snapshotter.Stats()
+		}
+		if cache.directory != nil {
+			keys := cache.directory.Len()
+			resp.DirectoryKeys = &keys
+		}
+		resp.ColdTier = cache.ColdTierStats()
+		resp.WriteBuffer = cache.WriteBufferStats()
+		resp.Trace = cache.trace.Stats()
+		resp.LockTimeout = cache.LockTimeoutStats()
+		resp.UnchangedPuts = cache.UnchangedPutStats()
+		resp.Generation = cache.Generation()
+		resp.Idle = cache.IdleStats()
+		resp.Fairness = cache.FairnessStats()
+		resp.Workers = cache.workers.Stats()
+		if cache.snapshotInterval > 0 {
+			resp.ReadSnapshotIntervalMs = cache.snapshotInterval.Milliseconds()
+			resp.ReadSnapshotAgeMs = time.Duration(cache.now() - cache.lastSnapshot.Load()).Milliseconds()
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
 
 // --- Main Function ---
 func main() {
+	// Offline snapshot tools: kvcache migrate-snapshot / inspect-snapshot
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-snapshot":
+			os.Exit(runMigrateSnapshot(os.Args[2:]))
+		case "inspect-snapshot":
+			os.Exit(runInspectSnapshot(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "schema":
+			os.Exit(runSchema(os.Args[2:]))
+		}
+	}
+
+	cfg := parseFlags()
+
 	// Initialize the sharded cache
-	kvCache := NewShardedCache(NumShards, MaxCapacityPerShard)
+	kvCache := NewShardedCache(NumShards, MaxCapacityPerShard, cfg.LazyShards)
 	if kvCache == nil {
 		log.Fatal("Failed to initialize sharded cache")
 	}
+	kvCache.EnableReadSnapshots(cfg.ReadSnapshotInterval)
+	if cfg.WriteBufferSize > 0 && cfg.WriteBufferInterval <= 0 {
+		log.Fatalf("Invalid -write-buffer-interval: must be positive with -write-buffer")
+	}
+	kvCache.EnableWriteBuffer(cfg.WriteBufferSize, cfg.WriteBufferInterval)
+	if cfg.TracePath != "" {
+		trace, err := NewTraceRecorder(cfg.TracePath, []byte(cfg.TraceKeySecret), cfg.TraceSample)
+		if err != nil {
+			log.Fatalf("Invalid -trace-path: %v", err)
+		}
+		kvCache.EnableTrace(trace)
+	}
+	if cfg.ShardLockTimeout < 0 {
+		log.Fatalf("Invalid -shard-lock-timeout: cannot be negative")
+	}
+	kvCache.SetLockTimeout(cfg.ShardLockTimeout)
+	kvCache.SetTouchOnWrite(cfg.TouchOnWrite)
+	if cfg.UnchangedTTLTolerance < 0 {
+		log.Fatalf("Invalid -unchanged-ttl-tolerance: cannot be negative")
+	}
+	if cfg.SkipUnchangedPuts {
+		kvCache.SkipUnchangedPuts(cfg.UnchangedTTLTolerance)
+	}
+	kvCache.SetStaleWindow(cfg.StaleWindow)
+	kvCache.SetImmutablePrefixes(cfg.ImmutablePrefixes)
+	if err := kvCache.SetPinLimit(cfg.PinMaxFraction); err != nil {
+		log.Fatalf("Invalid -pin-max-fraction: %v", err)
+	}
+	kvCache.EnableColdTier(cfg.ColdAfter)
+	if cfg.MaxIdle < 0 {
+		log.Fatalf("Invalid -max-idle: cannot be negative")
+	}
+	kvCache.EnableIdleReaping(cfg.MaxIdle)
+	if cfg.TTL.MaxAge < 0 || cfg.TTL.MaxAge%time.Second != 0 {
+		log.Fatalf("Invalid -max-entry-age: must be a whole number of seconds")
+	}
+	kvCache.SetMaxEntryAge(cfg.TTL.MaxAge)
+	var fairness *FairnessGuard
+	if cfg.FairnessLimit < 0 || cfg.FairnessLimit >= 1 {
+		log.Fatalf("Invalid -fairness-limit: must be at least 0 and below 1")
+	}
+	if cfg.FairnessWriter != "" {
+		var err error
+		if fairness, err = NewFairnessGuard(cfg.FairnessWriter); err != nil {
+			log.Fatalf("Invalid -fairness-writer: %v", err)
+		}
+		kvCache.EnableWriterFairness(fairness, cfg.FairnessLimit)
+	} else if cfg.FairnessLimit > 0 {
+		log.Fatalf("Invalid -fairness-limit: it needs -fairness-writer")
+	}
+	kvCache.EnableWaiters(cfg.MaxWaiters)
+	kvCache.EnableValueIndex(cfg.ValueIndexPrefix, cfg.ValueIndexMaxKeys)
+	if cfg.KeyDirectory {
+		kvCache.EnableKeyDirectory()
+	}
+	if cfg.HotKeys {
+		kvCache.EnableReadCounting()
+	}
+	if err := kvCache.SetShardHash(cfg.ShardHash); err != nil {
+		log.Fatalf("Invalid -shard-hash: %v", err)
+	}
+	if err := kvCache.SetKeyNormalization(cfg.KeyNormalization); err != nil {
+		log.Fatalf("Invalid -key-normalization: %v", err)
+	}
+	if err := kvCache.SetACLExport(cfg.ACLExport); err != nil {
+		log.Fatalf("Invalid -acl-export: %v", err)
+	}
+	if cfg.ShardSalt {
+		salt, err := newShardSalt()
+		if err != nil {
+			log.Fatalf("Failed to generate a shard salt: %v", err)
+		}
+		kvCache.SetShardSalt(salt)
+	}
+	if err := kvCache.SetEvictionPolicy(cfg.EvictionPolicy, cfg.EvictionCandidates); err != nil {
+		log.Fatalf("Invalid eviction settings: %v", err)
+	}
+
+	var evictionLog *EvictionLog
+	if cfg.EvictionLogSize > 0 {
+		evictionLog = NewEvictionLog(cfg.EvictionLogSize)
+		kvCache.OnEvict(evictionLog.Record)
+	}
+
+	listeners, err := openListeners(cfg.ListenAddrs, cfg.OptionalListenAddrs)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	var binaryListener net.Listener
+	if cfg.BinaryListenAddr != "" {
+		if binaryListener, err = net.Listen("tcp", cfg.BinaryListenAddr); err != nil {
+			log.Fatalf("Failed to start binary listener: %v", err)
+		}
+	}
+
+	metrics := NewMetrics()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/put", HandlePut(kvCache))
-	mux.HandleFunc("/get", HandleGet(kvCache))
+	if cfg.ErrorWindow < time.Minute {
+		log.Fatalf("Invalid -error-window: must be at least 1m")
+	}
+	if cfg.ErrorLogSample < 0 {
+		log.Fatalf("Invalid -error-log-sample: must not be negative")
+	}
+	errorStats := NewErrorStats(metrics, mux, cfg.ErrorWindow, cfg.ErrorLogSample)
+	idempotency := NewIdempotencyStore(cfg.IdempotencyMaxKeys, cfg.IdempotencyTTL)
+	var capturer *Capturer // Nil unless raw value capture is allowed
+	if cfg.AllowValueCapture {
+		if cfg.AdminToken == "" {
+			log.Fatal("-allow-value-capture requires -admin-token")
+		}
+		capturer = NewCapturer()
+		mux.HandleFunc("POST /admin/capture", requireAdminToken(cfg.AdminToken, HandleCaptureStart(capturer)))
+		mux.HandleFunc("GET /admin/capture/{id}", requireAdminToken(cfg.AdminToken, HandleCaptureGet(capturer)))
+	}
+	var rejections *RejectionTracker
+	if cfg.RejectionThreshold > 0 {
+		rejections = NewRejectionTracker(cfg.RejectionThreshold, cfg.RejectionWindow, rejectionTrackerSize)
+		mux.HandleFunc("/admin/rejections", HandleRejections(rejections))
+	}
+	drainer := NewDrainer(kvCache, cfg.DrainBudget, cfg.DrainTargets)
+	if len(cfg.DrainTargets) > 0 {
+		if cfg.AdminToken == "" {
+			log.Fatal("-drain-targets requires -admin-token")
+		}
+		mux.HandleFunc("POST /admin/drain", requireAdminToken(cfg.AdminToken, HandleDrain(drainer)))
+		mux.HandleFunc("POST /admin/drain/cancel", requireAdminToken(cfg.AdminToken, HandleDrainCancel(drainer)))
+	}
+	mux.HandleFunc("/admin/drain/status", HandleDrainStatus(drainer))
+	if strings.TrimSpace(cfg.MaintenanceMessage) == "" {
+		log.Fatalf("Invalid -maintenance-message: cannot be empty")
+	}
+	maintenance := NewMaintenance(kvCache.clock, strings.TrimSpace(cfg.MaintenanceMessage))
+	mux.HandleFunc("GET /admin/maintenance", HandleMaintenance(maintenance))
+	if cfg.AdminToken != "" {
+		mux.HandleFunc("POST /admin/maintenance", requireAdminToken(cfg.AdminToken, HandleMaintenance(maintenance)))
+	}
+	if cfg.ImportRedisPath != "" {
+		// Reads are served while the dump loads; writes get 503 until it is done.
+		drainer.BeginRestore()
+		go func() {
+			defer drainer.EndRestore()
+			_, err := importRedisFile(kvCache, cfg.ImportRedisPath, &drainer.restored)
+			switch {
+			case errors.Is(err, fs.ErrNotExist) && cfg.ImportRedisPath == cfg.SnapshotPath:
+				log.Printf("No snapshot at %s yet, starting empty", cfg.SnapshotPath) // First start
+			case err != nil:
+				log.Fatalf("Failed to import Redis dump: %v", err)
+			}
+		}()
+	}
+	if err := cfg.TTL.Validate(); err != nil {
+		log.Fatalf("Invalid -min-ttl/-max-ttl: %v", err)
+	}
+	if cfg.TTL.Rules, err = parseTTLRules(cfg.TTLRules); err != nil {
+		log.Fatalf("Invalid -ttl-rules: %v", err)
+	}
+	if cfg.MaxBulkGetKeys < 1 || cfg.MaxBulkAddKeys < 1 || cfg.MaxFallbackKeys < 1 || cfg.MaxBulkDeleteKeys < 1 {
+		log.Fatalf("Invalid -max-bulk-get-keys/-max-bulk-add-keys/-max-fallback-keys/-max-bulk-delete-keys: must be at least 1")
+	}
+	var transforms *TransformChain
+	if cfg.WriteTransforms != "" {
+		if transforms, err = LoadTransformChain(cfg.WriteTransforms); err != nil {
+			log.Fatalf("Invalid -write-transforms: %v", err)
+		}
+		log.Printf("Applying %d write transforms from %s", len(transforms.steps), cfg.WriteTransforms)
+	}
+	writes := WritePolicy{TTL: cfg.TTL, Transforms: transforms, Fairness: fairness}
+	putDecoder, err := NewPutDecoder(metrics, cfg.PutStrictFields, cfg.PutNullValue)
+	if err != nil {
+		log.Fatalf("Invalid -put-null-value: %v", err)
+	}
+	mux.HandleFunc("/put", metrics.Instrument(OpPut, acceptEncodedBody(capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandlePut(kvCache, putDecoder, writes, cfg.Pressure, rejections, cfg.PutReportEvictedKey)))))))
+	var misses *MissLog
+	if cfg.MissLogSize > 0 {
+		if misses, err = NewMissLog(cfg.MissLogSize, cfg.MissLogKeys); err != nil {
+			log.Fatalf("Invalid miss log settings: %v", err)
+		}
+		mux.HandleFunc("/admin/misses", HandleMisses(misses))
+	}
+	if cfg.TTLReportSample < 0 {
+		log.Fatalf("Invalid -ttl-report-sample: must not be negative")
+	}
+	mux.HandleFunc("GET /admin/ttl-report", HandleTTLReport(kvCache, cfg.TTLReportSample))
+	caching, err := NewCacheControlPolicy(cfg.CacheControl, cfg.CacheControlPrivate)
+	if err != nil {
+		log.Fatalf("Invalid -cache-control: %v", err)
+	}
+	mux.HandleFunc("/get", metrics.Instrument(OpGet, capturer.Wrap(HandleGet(kvCache, misses, caching))))
+	mux.HandleFunc("POST /get/bulk", metrics.Instrument(OpGet, capturer.Wrap(HandleGetBulk(kvCache, misses, cfg.MaxBulkGetKeys))))
+	mux.HandleFunc("GET /get/fallback", metrics.Instrument(OpGet, capturer.Wrap(HandleGetFallback(kvCache, misses, cfg.MaxFallbackKeys))))
+	mux.HandleFunc("/exists", HandleExists(kvCache))
+	mux.HandleFunc("/digest", HandleDigest(kvCache))
+	if cfg.HotKeys {
+		mux.HandleFunc("/admin/hotkeys", HandleHotKeys(kvCache))
+	}
+	if cfg.UI {
+		if cfg.AdminToken == "" {
+			log.Fatal("-ui requires -admin-token")
+		}
+		mux.HandleFunc("GET /ui", requireAdminToken(cfg.AdminToken, HandleUI()))
+	}
+	if kvCache.valueIndex != nil {
+		mux.HandleFunc("/search", HandleSearch(kvCache))
+	}
+	var fetcher *Fetcher
+	var refresher *Refresher
+	if len(cfg.FetchAllowedHosts) > 0 {
+		fetcher = NewFetcher(kvCache, cfg.FetchAllowedHosts, transforms)
+		if cfg.RefreshAheadWorkers > 0 {
+			refresher = NewRefresher(fetcher, cfg.RefreshAheadWorkers)
+			kvCache.OnRefreshDue(cfg.RefreshAheadFraction, refresher.Schedule)
+		}
+	}
+
+	var snapshotter *Snapshotter
+	if cfg.SnapshotPath != "" && cfg.SnapshotInterval > 0 {
+		snapshotter = NewSnapshotter(kvCache, cfg.SnapshotPath, cfg.SnapshotInterval)
+		snapshotter.SkipWhile(drainer.Restoring) // Never overwrite the file with a partial restore
+		snapshotter.Start()
+	}
+	if cfg.AdminToken != "" {
+		mux.HandleFunc("POST /admin/generation/bump", requireAdminToken(cfg.AdminToken, drainer.GuardWrites(HandleGenerationBump(kvCache, snapshotter))))
+	}
+
+	var rebalancer *Rebalancer
+	if cfg.Rebalance.Interval > 0 {
+		if cfg.Rebalance.Interval < pressureWindowSeconds*time.Second {
+			log.Fatalf("Invalid -rebalance-interval: must be at least %ds, the window eviction pressure is measured over", pressureWindowSeconds)
+		}
+		if cfg.Rebalance.MinCapacity < 1 || cfg.Rebalance.MinCapacity > MaxCapacityPerShard {
+			log.Fatalf("Invalid -rebalance-min-capacity: must be between 1 and the shard capacity (%d)", MaxCapacityPerShard)
+		}
+		if cfg.Rebalance.MaxCapacity < MaxCapacityPerShard {
+			log.Fatalf("Invalid -rebalance-max-capacity: must be at least the shard capacity (%d)", MaxCapacityPerShard)
+		}
+		if cfg.Rebalance.Damping <= 0 || cfg.Rebalance.Damping > 1 {
+			log.Fatalf("Invalid -rebalance-damping: must be above 0 and at most 1")
+		}
+		rebalancer = NewRebalancer(kvCache, cfg.Rebalance)
+		rebalancer.Start()
+	}
+	if cfg.SnapshotPath != "" && cfg.AdminToken != "" {
+		mux.HandleFunc("POST /admin/restore", requireAdminToken(cfg.AdminToken, HandleRestore(NewRestorer(kvCache, drainer, cfg.SnapshotPath))))
+	}
+
+	var statsd *StatsDEmitter
+	if cfg.StatsDAddr != "" {
+		if statsd, err = NewStatsDEmitter(cfg.StatsDAddr, cfg.StatsDPrefix, cfg.StatsDFormat, cfg.StatsDTags, cfg.StatsDInterval, metrics, kvCache); err != nil {
+			log.Fatalf("Invalid StatsD settings: %v", err)
+		}
+		statsd.Start()
+	}
+
+	mux.HandleFunc("/stats", HandleStats(kvCache, listeners, refresher, snapshotter))
+	mux.HandleFunc("GET /stats/shards", HandleShardStats(kvCache, rebalancer))
+	mux.HandleFunc("GET /stats/errors", HandleErrorStats(errorStats))
+	mux.HandleFunc("/metrics", HandleMetrics(metrics))
+	mux.HandleFunc("POST /simulate", HandleSimulate(kvCache))
+	mux.HandleFunc("POST /shard-map", HandleShardMap(kvCache))
+	if cfg.TTL.MaxAge > 0 {
+		mux.HandleFunc("POST /admin/enforce-max-age", HandleEnforceMaxAge(kvCache))
+	}
+	mux.HandleFunc("POST /flush", metrics.Instrument(OpFlush, drainer.GuardWrites(idempotency.Wrap(HandleFlush(kvCache)))))
+	mux.HandleFunc("POST /rename", metrics.Instrument(OpRename, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleRename(kvCache))))))
+	mux.HandleFunc("POST /merge", metrics.Instrument(OpMerge, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleMerge(kvCache, transforms))))))
+	mux.HandleFunc("PATCH /merge", metrics.Instrument(OpMerge, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleMergeFields(kvCache, transforms))))))
+	mux.HandleFunc("POST /claim", metrics.Instrument(OpClaim, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleClaim(kvCache, cfg.TTL))))))
+	mux.HandleFunc("POST /release", metrics.Instrument(OpRelease, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleRelease(kvCache))))))
+	mux.HandleFunc("POST /pin", metrics.Instrument(OpPin, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandlePin(kvCache, true))))))
+	mux.HandleFunc("POST /unpin", metrics.Instrument(OpPin, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandlePin(kvCache, false))))))
+	mux.HandleFunc("POST /delete", metrics.Instrument(OpDelete, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleDelete(kvCache))))))
+	mux.HandleFunc("POST /bulk/delete", metrics.Instrument(OpBulk, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleBulkDelete(kvCache, cfg.MaxBulkDeleteKeys))))))
+	mux.HandleFunc("POST /add/bulk", metrics.Instrument(OpBulk, acceptEncodedBody(capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleAddBulk(kvCache, cfg.MaxBulkAddKeys, transforms)))))))
+	mux.HandleFunc("POST /lock/acquire", metrics.Instrument(OpLock, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleLockAcquire(kvCache))))))
+	mux.HandleFunc("POST /lock/renew", metrics.Instrument(OpLock, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleLockRenew(kvCache))))))
+	mux.HandleFunc("POST /lock/release", metrics.Instrument(OpLock, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleLockRelease(kvCache))))))
+	mux.HandleFunc("POST /import/redis", metrics.Instrument(OpBulk, acceptEncodedBody(drainer.GuardWrites(HandleImportRedis(kvCache, transforms)))))
+	mux.HandleFunc("POST /import/ndjson", metrics.Instrument(OpBulk, acceptEncodedBody(drainer.GuardWrites(HandleImportNDJSON(kvCache, drainer, writes)))))
+	if evictionLog != nil {
+		mux.HandleFunc("/debug/evictions", HandleEvictionLog(evictionLog))
+	}
+	if fetcher != nil {
+		mux.HandleFunc("POST /fetch", metrics.Instrument(OpFetch, capturer.Wrap(drainer.GuardWrites(idempotency.Wrap(HandleFetch(fetcher, cfg.TTL))))))
+	}
+
+	weights, err := parseHealthWeights(cfg.HealthWeights)
+	if err != nil {
+		log.Fatalf("Invalid -health-weights: %v", err)
+	}
+	if cfg.ReadyMinHitRatio < 0 || cfg.ReadyMinHitRatio > 1 {
+		log.Fatalf("Invalid -ready-min-hit-ratio: must be between 0 and 1")
+	}
+	if cfg.ReadyHitRatioWindow < time.Second {
+		log.Fatalf("Invalid -ready-hit-ratio-window: must be at least 1s")
+	}
+	health := NewHealthScorer(metrics, kvCache, weights, cfg.HealthMaxInFlight, cfg.HealthLatencyTarget,
+		cfg.ReadyMinHitRatio, cfg.ReadyHitRatioWindow)
+	mux.HandleFunc("/health/score", HandleHealthScore(health))
+
+	if len(cfg.AlertRules) > 0 {
+		rules, err := parseAlertRules(cfg.AlertRules)
+		if err != nil {
+			log.Fatalf("Invalid -alert-rules: %v", err)
+		}
+		alerts, err := NewAlertEngine(rules, cfg.AlertInterval, cfg.AlertWebhook, metrics, kvCache)
+		if err != nil {
+			log.Fatalf("Invalid alert settings: %v", err)
+		}
+		alerts.Start()
+		mux.HandleFunc("GET /admin/alerts", HandleAlerts(alerts))
+	} else if cfg.AlertWebhook != "" {
+		log.Fatalf("Invalid -alert-webhook: it needs -alert-rules")
+	}
 
 	// Add a simple health check endpoint (good practice)
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	ready := func(w http.ResponseWriter, r *http.Request) {
+		hitRatio, workers := health.HitRatio(), kvCache.workers.Summary()
+		if maintenance.Enabled() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "MAINTENANCE\n%s\n%s\n", hitRatio, workers)
+			return
+		}
+		if drainer.ReadOnly() {
+			// Not ready: load balancers should stop sending traffic here
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "DRAINING\n%s\n%s\n", hitRatio, workers)
+			return
+		}
+		if drainer.Restoring() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "RESTORING\nloaded %d entries\n%s\n%s\n", drainer.RestoreProgress(), hitRatio, workers)
+			return
+		}
+		if !health.Ready(hitRatio) {
+			// The cache is thrashing and barely saves the backend any work
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "DEGRADED\n%s\n%s\n", hitRatio, workers)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK\n%s\n%s\n", hitRatio, workers)
+	}
+	mux.HandleFunc("/health", ready)
+	// Liveness: the process serves requests, whether or not it takes traffic yet
+	mux.HandleFunc("/health/live", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "OK")
 	})
+	// The same check for load balancers that also weigh nodes by their score
+	mux.HandleFunc("/health/ready", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Health-Score", strconv.Itoa(health.Score().Score))
+		ready(w, r)
+	})
 
+	// One server, shared by every listener. Using default timeouts for simplicity here:
+	server := &http.Server{Handler: errorStats.Wrap(withSchema(maintenance.Wrap(mux)))}
+	serveErrs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		log.Printf("Starting key-value cache server on %s...", ln.addr)
+		go func(ln *countingListener) {
+			serveErrs <- server.Serve(ln)
+		}(ln)
+	}
+	var binaryServer *BinaryServer
+	if binaryListener != nil {
+		log.Printf("Starting binary protocol listener on %s...", cfg.BinaryListenAddr)
+		binaryServer = NewBinaryServer(kvCache, drainer, maintenance, writes)
+		go binaryServer.Serve(binaryListener)
+	}
 
-	serverAddr := "0.0.0.0:7171"
-	log.Printf("Starting key-value cache server on %s...", serverAddr)
-
+	lifecycle := newServerLifecycle(kvCache, server, binaryServer, snapshotter, statsd)
+	if _, err := lifecycle.Order(); err != nil {
+		log.Fatalf("Invalid shutdown order: %v", err)
+	}
 
-    // Using default timeouts for simplicity here:
-	if err := http.ListenAndServe(serverAddr, mux); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	// Shut down gracefully on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down...")
+		lifecycle.Shutdown()
+	case err := <-serveErrs:
+		log.Fatalf("Server stopped: %v", err)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) // Caches and workers log as they start
+	os.Exit(m.Run())
+}
+
+// doPut sends req to the /put handler of cache, with default settings.
+func doPut(t *testing.T, cache *ShardedCache, req PutRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	return doPutWithTTL(t, cache, TTLPolicy{}, req)
+}
+
+// doPutWithTTL is doPut with a TTL policy.
+func doPutWithTTL(t *testing.T, cache *ShardedCache, ttl TTLPolicy, req PutRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	decoder, err := NewPutDecoder(NewMetrics(), false, NullValueReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	HandlePut(cache, decoder, WritePolicy{TTL: ttl}, PressurePolicy{}, nil, false)(rec, httptest.NewRequest(http.MethodPut, "/put", bytes.NewReader(body)))
+	return rec
+}
+
+// doGet sends a /get with the raw, already encoded query to cache and
+// decodes the reply.
+func doGet(t *testing.T, cache *ShardedCache, rawQuery string) (*httptest.ResponseRecorder, GetSuccessResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	HandleGet(cache, nil, nil)(rec, httptest.NewRequest(http.MethodGet, "/get?"+rawQuery, nil))
+	var resp GetSuccessResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec, resp
+}
+
+func TestGetSnapshotMissesExpiredEntries(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	shard := cache.shards[0]
+	cache.PutWithOptions("short", "v", PutOptions{TTL: 20 * time.Millisecond})
+	cache.Put("forever", "v")
+	shard.rebuildSnapshot()
+
+	if _, ok := shard.GetSnapshot("short"); !ok {
+		t.Fatal("short missing from a fresh snapshot")
+	}
+	clock.Advance(30 * time.Millisecond)
+	if item, ok := shard.GetSnapshot("short"); ok {
+		t.Errorf("GetSnapshot(short) = %+v after its TTL, want a miss", item)
+	}
+	if _, ok := shard.GetSnapshot("forever"); !ok {
+		t.Error("GetSnapshot(forever) missed")
+	}
+}
+
+func TestGetSnapshotSlidesIdleEntries(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	shard := cache.shards[0]
+	cache.PutWithOptions("session", "v", PutOptions{IdleTTL: 60 * time.Millisecond})
+	shard.rebuildSnapshot() // Never rebuilt again: the expiry must move all the same
+
+	for range 6 {
+		clock.Advance(20 * time.Millisecond)
+		if _, ok := shard.GetSnapshot("session"); !ok {
+			t.Fatal("sliding entry expired while it was being read")
+		}
+	}
+	clock.Advance(80 * time.Millisecond)
+	if _, ok := shard.GetSnapshot("session"); ok {
+		t.Error("sliding entry still served after sitting idle past its idle TTL")
+	}
+}
+
+func TestGetSnapshotKeepsPinnedEntries(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	if err := cache.SetPinLimit(0.5); err != nil {
+		t.Fatal(err)
+	}
+	shard := cache.shards[0]
+	cache.PutWithOptions("pinned", "v", PutOptions{TTL: 10 * time.Millisecond})
+	if err := cache.Pin("pinned", true); err != nil {
+		t.Fatalf("Pin: %v", err)
+	}
+	shard.rebuildSnapshot()
+	clock.Advance(20 * time.Millisecond)
+	if _, ok := shard.GetSnapshot("pinned"); !ok {
+		t.Error("pinned entry missed after its TTL")
+	}
+}
+
+func TestTouchOnWriteChangesEvictionOrder(t *testing.T) {
+	for _, tc := range []struct {
+		touch       bool
+		wantEvicted string
+	}{
+		{true, "b"},  // Updating a counts as a use, so b is the oldest
+		{false, "a"}, // Only reads count: a keeps its place at the tail
+	} {
+		t.Run(fmt.Sprintf("touch=%v", tc.touch), func(t *testing.T) {
+			cache := NewShardedCache(1, 3, false)
+			cache.SetTouchOnWrite(tc.touch)
+			cache.Put("a", "v1")
+			cache.Put("b", "v1")
+			cache.Put("c", "v1")
+			cache.Put("a", "v2")
+			cache.Put("d", "v1")
+
+			for _, key := range []string{"a", "b", "c", "d"} {
+				if got, want := cache.Exists(key), key != tc.wantEvicted; got != want {
+					t.Errorf("%s present = %v, want %v", key, got, want)
+				}
+			}
+			if value, ok := cache.Get("a"); tc.touch && (!ok || value != "v2") {
+				t.Errorf("Get(a) = %q, %v, want the updated value", value, ok)
+			}
+		})
+	}
+}
+
+func TestNoTouchOnWriteStillCountsReads(t *testing.T) {
+	cache := NewShardedCache(1, 3, false)
+	cache.SetTouchOnWrite(false)
+	cache.Put("a", "v1")
+	cache.Put("b", "v1")
+	cache.Put("c", "v1")
+	cache.Get("a")
+	cache.Put("b", "v2") // Not a use
+	cache.Put("d", "v1")
+	if cache.Exists("b") {
+		t.Error("b was updated but never read, it should be the one evicted")
+	}
+}
+
+func TestHardTTLWinsOverTouches(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.PutWithOptions("session", "v", PutOptions{TTL: time.Minute, IdleTTL: 10 * time.Second})
+
+	// Read every 5s: the idle TTL never runs out, the hard one does
+	for elapsed := 5 * time.Second; elapsed < time.Minute; elapsed += 5 * time.Second {
+		clock.Advance(5 * time.Second)
+		if _, ok := cache.Get("session"); !ok {
+			t.Fatalf("expired %s after the write, while being read", elapsed)
+		}
+	}
+	clock.Advance(5 * time.Second)
+	if _, ok := cache.Get("session"); ok {
+		t.Error("still served a minute after the write, past its hard TTL")
+	}
+}
+
+func TestIdleTTLExpiresUnreadEntries(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.PutWithOptions("capped", "v", PutOptions{TTL: time.Hour, IdleTTL: 10 * time.Second})
+	cache.PutWithOptions("uncapped", "v", PutOptions{IdleTTL: 10 * time.Second})
+
+	clock.Advance(9 * time.Second)
+	if _, ok := cache.Get("uncapped"); !ok {
+		t.Fatal("uncapped expired before its idle TTL")
+	}
+	clock.Advance(2 * time.Second)
+	if _, ok := cache.Get("capped"); ok {
+		t.Error("capped served after 11s without a read")
+	}
+	if _, ok := cache.Get("uncapped"); !ok {
+		t.Error("uncapped expired although the last read was 2s ago")
+	}
+
+	// An entry without a hard TTL lives as long as it keeps being read
+	for range 100 {
+		clock.Advance(9 * time.Second)
+		if _, ok := cache.Get("uncapped"); !ok {
+			t.Fatal("uncapped expired while being read")
+		}
+	}
+}
+
+func TestOverwriteRestartsBothTTLs(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.PutWithOptions("k", "v1", PutOptions{TTL: 20 * time.Second, IdleTTL: 10 * time.Second})
+	clock.Advance(15 * time.Second)
+	cache.PutWithOptions("k", "v2", PutOptions{TTL: 20 * time.Second, IdleTTL: 10 * time.Second})
+	clock.Advance(8 * time.Second)
+	if _, ok := cache.Get("k"); !ok {
+		t.Fatal("the overwrite did not restart the TTLs")
+	}
+	clock.Advance(8 * time.Second)
+	cache.Get("k")
+	clock.Advance(5 * time.Second) // 21s after the overwrite
+	if _, ok := cache.Get("k"); ok {
+		t.Error("served past the hard TTL of the overwrite")
+	}
+
+	// A plain overwrite drops the sliding expiry
+	cache.PutWithOptions("k", "v3", PutOptions{IdleTTL: 10 * time.Second})
+	cache.Put("k", "v4")
+	clock.Advance(time.Hour)
+	if _, ok := cache.Get("k"); !ok {
+		t.Error("a write without TTLs kept the old idle TTL")
+	}
+}
+
+func TestPutValidatesIdleTTL(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	for _, tc := range []struct {
+		req  PutRequest
+		want int
+	}{
+		{PutRequest{Key: "k", Value: "v", IdleTTLSeconds: 10}, http.StatusOK},
+		{PutRequest{Key: "k", Value: "v", IdleTTLSeconds: 10, TTLSeconds: 60}, http.StatusOK},
+		{PutRequest{Key: "k", Value: "v", IdleTTLSeconds: -1}, http.StatusBadRequest},
+		{PutRequest{Key: "k", Value: "v", IdleTTLSeconds: 10, SWRSeconds: 5}, http.StatusOK},
+	} {
+		if rec := doPut(t, cache, tc.req); rec.Code != tc.want {
+			t.Errorf("%+v: status %d, want %d", tc.req, rec.Code, tc.want)
+		}
+	}
+}
+
+// BenchmarkContextVariants compares GetCtx and PutCtx with Get and Put on an
+// uncontended cache, where the context variants take the lock at once and
+// should cost about the same.
+func BenchmarkContextVariants(b *testing.B) {
+	cache := NewShardedCache(16, 1024, false)
+	keys := bulkKeys(4096)
+	for _, key := range keys {
+		cache.Put(key, "value")
+	}
+	ctx := context.Background()
+	b.Run("Get", func(b *testing.B) {
+		for i := range b.N {
+			cache.Get(keys[i%len(keys)])
+		}
+	})
+	b.Run("GetCtx", func(b *testing.B) {
+		for i := range b.N {
+			cache.GetCtx(ctx, keys[i%len(keys)], false)
+		}
+	})
+	b.Run("Put", func(b *testing.B) {
+		for i := range b.N {
+			cache.Put(keys[i%len(keys)], "value")
+		}
+	})
+	b.Run("PutCtx", func(b *testing.B) {
+		for i := range b.N {
+			cache.PutCtx(ctx, keys[i%len(keys)], "value")
+		}
+	})
+}
+
+// BenchmarkNewShardedCache measures the memory a new, empty cache of 64
+// shards of 4096 entries takes up front, with and without -lazy-shards.
+func BenchmarkNewShardedCache(b *testing.B) {
+	for _, lazy := range []bool{false, true} {
+		name := "eager"
+		if lazy {
+			name = "lazy"
+		}
+		b.Run(name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			caches := make([]*ShardedCache, b.N)
+			for i := range b.N {
+				caches[i] = NewShardedCache(64, 4096, lazy)
+			}
+			b.StopTimer()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "heap-bytes/op")
+			runtime.KeepAlive(caches)
+		})
+	}
+}
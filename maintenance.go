@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceRequest structure for POST /admin/maintenance bodies
+type MaintenanceRequest struct {
+	Enabled *bool  `json:"enabled"`
+	Message string `json:"message"` // Replaces -maintenance-message until maintenance ends
+}
+
+// MaintenanceResponse structure for /admin/maintenance replies
+type MaintenanceResponse struct {
+	Status  string     `json:"status"`
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"` // What refused requests are told
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// maintenanceState is a maintenance window in progress.
+type maintenanceState struct {
+	message string
+	since   time.Time
+}
+
+// Maintenance takes the node out of service without stopping it: while it
+// is on, every request other than health checks, metrics, /stats and
+// /admin/ endpoints gets 503 with a fixed message, reads included. This is
+// stronger than a drain, which still serves reads.
+type Maintenance struct {
+	clock   Clock                            // Stamps the start of a window
+	message string                           // Default for windows started without one
+	state   atomic.Pointer[maintenanceState] // nil = serving
+}
+
+// NewMaintenance creates a maintenance switch, off, whose refusals say
+// message unless the window sets its own. Windows are timed with clock.
+func NewMaintenance(clock Clock, message string) *Maintenance {
+	return &Maintenance{clock: clock, message: message}
+}
+
+// Enabled reports whether requests are currently refused.
+func (m *Maintenance) Enabled() bool {
+	return m.state.Load() != nil
+}
+
+// Set turns maintenance on, with message or the default when it is empty,
+// or off. Turning it on while it is on replaces the message but keeps the
+// start time.
+func (m *Maintenance) Set(enabled bool, message string) {
+	if !enabled {
+		if m.state.Swap(nil) != nil {
+			log.Printf("Maintenance ended, serving requests again")
+		}
+		return
+	}
+	if message == "" {
+		message = m.message
+	}
+	next := &maintenanceState{message: message, since: m.clock.Now()}
+	if prev := m.state.Load(); prev != nil {
+		next.since = prev.since
+	}
+	if m.state.Swap(next) == nil {
+		log.Printf("Maintenance started, refusing requests: %s", message)
+	}
+}
+
+// response describes the current state for /admin/maintenance replies.
+func (m *Maintenance) response() MaintenanceResponse {
+	resp := MaintenanceResponse{Status: "OK"}
+	if st := m.state.Load(); st != nil {
+		since := st.since
+		resp.Enabled, resp.Message, resp.Since = true, st.message, &since
+	}
+	return resp
+}
+
+// maintenanceExempt reports whether path is still served during
+// maintenance, so the node can be watched and switched back on.
+func maintenanceExempt(path string) bool {
+	switch path {
+	case "/health", "/health/live", "/health/ready", "/health/score", "/metrics", "/stats", "/stats/shards", "/stats/errors":
+		return true
+	}
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// Wrap refuses requests to next with 503 and code "maintenance" while
+// maintenance is on, except those to exempt paths.
+func (m *Maintenance) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if st := m.state.Load(); st != nil && !maintenanceExempt(r.URL.Path) {
+			writeJSONErrorCode(w, st.message, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleMaintenance handles GET and POST /admin/maintenance. A POST with
+// {"enabled": true} starts refusing requests, optionally with its own
+// "message", and {"enabled": false} ends it. POST must be behind the admin
+// token, since it takes the whole node out of service.
+func HandleMaintenance(m *Maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var req MaintenanceRequest
+
+			r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+				return
+			}
+			if req.Enabled == nil {
+				writeJSONError(w, "Field 'enabled' is required.", http.StatusBadRequest)
+				return
+			}
+			m.Set(*req.Enabled, strings.TrimSpace(req.Message))
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(m.response())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kv-go-cache/testutil"
+)
+
+func TestMaintenanceWindowIsTimedByTheClock(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	m := NewMaintenance(clock, "Down.")
+	m.Set(true, "")
+	clock.Advance(time.Hour)
+	m.Set(true, "Back at 14:00.") // A new message keeps the start
+
+	rec := httptest.NewRecorder()
+	HandleMaintenance(m)(rec, httptest.NewRequest(http.MethodGet, "/admin/maintenance", nil))
+	var resp MaintenanceResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if !resp.Enabled || resp.Message != "Back at 14:00." || resp.Since == nil || !resp.Since.Equal(time.Unix(1_700_000_000, 0)) {
+		t.Errorf("%s", rec.Body)
+	}
+}
+
+func TestMaintenanceRefusesAllButExemptPaths(t *testing.T) {
+	m := NewMaintenance(realClock{}, "Down.")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	m.Set(true, "")
+	for path, exempt := range map[string]bool{
+		"/get":               false,
+		"/put":               false,
+		"/health":            true,
+		"/stats":             true,
+		"/admin/maintenance": true,
+	} {
+		rec := httptest.NewRecorder()
+		m.Wrap(ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if exempt && rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d during maintenance", path, rec.Code)
+		}
+		if !exempt && (rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"maintenance"`)) {
+			t.Errorf("%s: status %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	HandleMaintenance(m)(rec, httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader(`{"enabled": false}`)))
+	if rec.Code != http.StatusOK || m.Enabled() {
+		t.Errorf("status %d, still in maintenance: %v", rec.Code, m.Enabled())
+	}
+}
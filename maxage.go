@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// tooOld reports whether e was written maxAge or longer before now
+// (UnixNano). Entries without a recorded creation time count as too old.
+func (c *LRUCache) tooOld(e *entry, now int64) bool {
+	return e.createdAt <= now-int64(c.maxAge)
+}
+
+// cappedTTL returns ttl, lowered to the shard's maximum entry age if there is
+// one.
+func (c *LRUCache) cappedTTL(ttl time.Duration) time.Duration {
+	if c.maxAge > 0 {
+		return min(ttl, c.maxAge)
+	}
+	return ttl
+}
+
+// SetMaxEntryAge caps how long any entry is served after it was written, by
+// creation time rather than last use. Writes get an expiry no later than
+// maxAge from now, lookups treat older entries as misses even when they are
+// pinned or within a stale window, and a sweeper removes them every tenth of
+// maxAge (at least once a second, at most once a minute). Removals are
+// reported as expired. Must be called before the cache starts serving
+// requests.
+func (sc *ShardedCache) SetMaxEntryAge(maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	for _, shard := range sc.shards {
+		shard.maxAge = maxAge
+	}
+	sc.maxAge = maxAge
+	sc.workers.Go("max-age-sweeper", func() {
+		ticks, stop := sc.clock.NewTicker(min(max(maxAge/10, time.Second), time.Minute))
+		defer stop()
+		for range ticks {
+			sc.EnforceMaxAge()
+		}
+	})
+	log.Printf("Removing entries older than %s", maxAge)
+}
+
+// EnforceMaxAge removes every entry older than the maximum entry age and
+// returns how many it removed; 0 when there is no maximum.
+func (sc *ShardedCache) EnforceMaxAge() int {
+	if sc.maxAge <= 0 {
+		return 0
+	}
+	removed := 0
+	for _, shard := range sc.shards {
+		now := sc.now()
+		removed += shard.removeMatching(func(e *entry) bool {
+			return shard.tooOld(e, now)
+		}, EvictionExpired)
+	}
+	return removed
+}
+
+// HandleEnforceMaxAge handles POST /admin/enforce-max-age, removing the
+// entries older than the maximum entry age without waiting for the sweeper.
+func HandleEnforceMaxAge(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		removed := cache.EnforceMaxAge()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(FlushResponse{
+			Status:  "OK",
+			Removed: removed,
+		})
+	}
+}
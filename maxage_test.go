@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxEntryAgeMissesOldEntries(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	if err := cache.SetPinLimit(0.5); err != nil {
+		t.Fatal(err)
+	}
+	cache.SetMaxEntryAge(time.Hour)
+	cache.Put("forever", "v")
+	cache.Put("pinned", "v")
+	if err := cache.Pin("pinned", true); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(59 * time.Minute)
+	cache.Put("young", "v")
+	for _, key := range []string{"forever", "pinned"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%s missed before the maximum age", key)
+		}
+	}
+	clock.Advance(2 * time.Minute)
+	for _, key := range []string{"forever", "pinned"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("%s served past the maximum age", key)
+		}
+	}
+	if _, ok := cache.Get("young"); !ok {
+		t.Error("young missed: reads must not count from the oldest entry")
+	}
+}
+
+func TestPutReportsTheCappedTTL(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	policy := TTLPolicy{MaxAge: time.Hour}
+	for _, tc := range []struct {
+		requested    int
+		want         int
+		wantAdjusted bool
+	}{
+		{0, 3600, true}, // No TTL still expires at the cap
+		{7200, 3600, true},
+		{60, 60, false},
+	} {
+		rec := doPutWithTTL(t, cache, policy, PutRequest{Key: "k", Value: "v", TTLSeconds: tc.requested})
+		var resp PutSuccessResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || resp.TTLSeconds != tc.want || resp.TTLAdjusted != tc.wantAdjusted {
+			t.Errorf("ttl_seconds %d: status %d, reply ttl %d adjusted %v, want %d %v",
+				tc.requested, rec.Code, resp.TTLSeconds, resp.TTLAdjusted, tc.want, tc.wantAdjusted)
+		}
+	}
+}
+
+func TestEnforceMaxAgeAfterAConfigChange(t *testing.T) {
+	cache, clock := newFakeClockCache(4, 100)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Put(key, "v")
+	}
+	clock.Advance(2 * time.Hour)
+	cache.Put("fresh", "v")
+	cache.SetMaxEntryAge(time.Hour) // As on a restart with a new -max-entry-age
+
+	report := cache.TTLReport(0)
+	if report.OverMaxAge != 3 || report.MaxEntryAgeMs != time.Hour.Milliseconds() {
+		t.Errorf("report flags %d entries over %dms, want 3 over an hour", report.OverMaxAge, report.MaxEntryAgeMs)
+	}
+
+	rec := httptest.NewRecorder()
+	HandleEnforceMaxAge(cache)(rec, httptest.NewRequest(http.MethodPost, "/admin/enforce-max-age", nil))
+	var resp FlushResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Removed != 3 {
+		t.Errorf("enforce-max-age: status %d, removed %d, want 3", rec.Code, resp.Removed)
+	}
+	if n := cache.Len(); n != 1 {
+		t.Errorf("%d entries left, want only fresh", n)
+	}
+	if report := cache.TTLReport(0); report.OverMaxAge != 0 {
+		t.Errorf("%d entries still over the age after enforcing it", report.OverMaxAge)
+	}
+}
+
+func TestMaxEntryAgeWinsOverStaleWindow(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.SetMaxEntryAge(20 * time.Second)
+	cache.PutWithOptions("k", "v", PutOptions{TTL: 10 * time.Second, StaleFor: time.Minute})
+	clock.Advance(25 * time.Second)
+	if item, found := getItem(cache, "k"); found {
+		t.Errorf("GetItem = %+v past the maximum entry age, want a miss", item)
+	}
+}
+
+func TestMaxEntryAgeCapsRefreshAhead(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.SetMaxEntryAge(time.Hour)
+	var mutex sync.Mutex
+	var due []string
+	cache.OnRefreshDue(0.2, func(key string, src *RefreshSource) {
+		mutex.Lock()
+		due = append(due, key)
+		mutex.Unlock()
+	})
+	// A refresh TTL of a day is capped to an hour, so the refresh window is
+	// the last 12 minutes of the hour rather than of the day.
+	src := &RefreshSource{TTL: 24 * time.Hour, Ahead: true}
+	cache.PutWithOptions("k", "v", PutOptions{TTL: src.TTL, Refresh: src})
+
+	clock.Advance(47 * time.Minute)
+	cache.Get("k")
+	clock.Advance(2 * time.Minute)
+	cache.Get("k")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(due) != 1 {
+		t.Errorf("%d refreshes due, want 1 once the read fell into the capped window", len(due))
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Patch formats accepted by POST /merge.
+const (
+	PatchTypeMerge = "merge"      // RFC 7386 JSON Merge Patch
+	PatchTypeJSON  = "json-patch" // RFC 6902 JSON Patch
+)
+
+var errNotJSONObject = fmt.Errorf("%w: stored value is not a JSON object", ErrTypeMismatch)
+
+// patchConflict is returned when a valid JSON Patch does not fit the stored
+// document, e.g. a path is missing or a test operation fails.
+type patchConflict struct{ reason string }
+
+func (e *patchConflict) Error() string { return e.reason }
+
+func conflictf(format string, args ...any) error {
+	return &patchConflict{reason: fmt.Sprintf(format, args...)}
+}
+
+// MergeRequest structure for POST /merge bodies
+type MergeRequest struct {
+	Key            string          `json:"key"`
+	Patch          json.RawMessage `json:"patch"`
+	PatchType      string          `json:"patch_type,omitempty"`      // "merge" (default) or "json-patch"
+	ReturnDocument bool            `json:"return_document,omitempty"` // Include the patched document in the reply
+}
+
+// MergeFieldsRequest structure for PATCH /merge bodies
+type MergeFieldsRequest struct {
+	Key            string                     `json:"key"`
+	Patch          map[string]json.RawMessage `json:"patch"`                     // Top-level fields to set; null removes one
+	ReturnDocument bool                       `json:"return_document,omitempty"` // Include the updated document in the reply
+}
+
+// MergeResponse structure for POST and PATCH /merge replies
+type MergeResponse struct {
+	Status   string          `json:"status"`
+	Key      string          `json:"key"`
+	Version  uint64          `json:"version"`
+	Created  bool            `json:"created,omitempty"` // PATCH created the key
+	Document json.RawMessage `json:"document,omitempty"`
+}
+
+// Update atomically replaces the value of key with fn(old value) under the
+// shard lock, passed through transforms, and returns the entry's new version
+// and value. The entry keeps its TTL and cost. If fn or a transform fails, the
+// entry is left untouched and the error is returned; ErrNotFound is returned
+// for absent or expired keys, ErrImmutable for immutable ones and
+// ErrEntryForbidden, before fn sees the value, for entries whose read ACL does
+// not list reader (see requestReader).
+func (sc *ShardedCache) Update(key, reader string, transforms *TransformChain, fn func(old string) (string, error)) (uint64, string, error) {
+	shard := sc.shards[sc.getShardIndex(key)]
+	shard.mutex.Lock()
+	item, found, expired, _ := shard.getLocked(key, staleNever)
+	if !found {
+		shard.mutex.Unlock()
+		shard.afterGet(key, expired, nil)
+		return 0, "", fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if item.Immutable {
+		shard.mutex.Unlock()
+		return 0, "", fmt.Errorf("%w: %s", ErrImmutable, key)
+	}
+	if !item.ReadableBy(reader) {
+		shard.mutex.Unlock()
+		return 0, "", forbidden(key)
+	}
+	updated, err := fn(item.Value)
+	var changed []string
+	if err == nil {
+		updated, changed, err = transforms.applyEncoded(key, updated, item.Encoding)
+	}
+	if err != nil {
+		shard.mutex.Unlock()
+		return 0, "", err
+	}
+	ent := shard.replaceLocked(key, updated, changed)
+	version, item := ent.version, ent.item()
+	shard.mutex.Unlock()
+
+	sc.waiters.wake(key, item)
+	return version, updated, nil
+}
+
+// MergeJSON atomically sets the top-level fields of the JSON object stored at
+// key to the values in patch; a null value removes the field. An absent key is
+// created holding just the patched fields. The result is passed through
+// transforms. errNotJSONObject is returned when the stored value is not a
+// JSON object, ErrImmutable when the key is immutable, ErrEntryForbidden when
+// its read ACL does not list reader (see requestReader), ErrValueTooLong when
+// the result exceeds the value limit and errTransformRejected when a
+// transform refuses it.
+func (sc *ShardedCache) MergeJSON(key, reader string, transforms *TransformChain, patch map[string]json.RawMessage) (version uint64, document string, created bool, err error) {
+	shard := sc.shards[sc.getShardIndex(key)]
+	shard.mutex.Lock()
+	item, found, expired, _ := shard.getLocked(key, staleNever)
+	fields := map[string]json.RawMessage{}
+	if found && item.Immutable {
+		shard.mutex.Unlock()
+		shard.afterGet(key, expired, nil)
+		return 0, "", false, fmt.Errorf("%w: %s", ErrImmutable, key)
+	}
+	if found && !item.ReadableBy(reader) {
+		shard.mutex.Unlock()
+		shard.afterGet(key, expired, nil)
+		return 0, "", false, forbidden(key)
+	}
+	if found {
+		if !strings.HasPrefix(strings.TrimSpace(item.Value), "{") ||
+			json.Unmarshal([]byte(item.Value), &fields) != nil {
+			shard.mutex.Unlock()
+			shard.afterGet(key, expired, nil)
+			return 0, "", false, errNotJSONObject
+		}
+	}
+	for name, value := range patch {
+		if string(value) == "null" {
+			delete(fields, name)
+		} else {
+			fields[name] = value
+		}
+	}
+	var changed []string
+	if document, err = encodeJSON(fields); err == nil {
+		err = checkDocumentLength(document)
+	}
+	if err == nil {
+		document, changed, err = transforms.applyEncoded(key, document, EncodingJSON)
+	}
+	if err != nil {
+		shard.mutex.Unlock()
+		shard.afterGet(key, expired, nil)
+		return 0, "", false, err
+	}
+
+	var evicted *entry
+	if found {
+		shard.replaceLocked(key, document, changed)
+	} else {
+		_, evicted = shard.putLocked(key, document, PutOptions{Encoding: EncodingJSON, Transforms: changed})
+	}
+	ent := shard.items[key].Value.(*entry)
+	version, item = ent.version, ent.item()
+	shard.mutex.Unlock()
+
+	shard.afterGet(key, expired, nil)
+	if evicted != nil {
+		shard.notifyEvict(evicted, EvictionCapacity)
+	}
+	sc.waiters.wake(key, item)
+	return version, document, !found, nil
+}
+
+// replaceLocked overwrites the value of key's hot entry, keeping its TTL and
+// cost, and returns the entry. transforms names the write transforms that
+// changed value.
+// MUST be called with the mutex held.
+func (c *LRUCache) replaceLocked(key, value string, transforms []string) *entry {
+	ent := c.items[key].Value.(*entry)
+	ent.value = value
+	ent.transforms = transforms
+	ent.createdAt = c.now()
+	ent.version++
+	c.valueIndex.set(key, value)
+	return ent
+}
+
+// decodeJSON decodes one JSON document, keeping numbers exact.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after JSON document")
+	}
+	return v, nil
+}
+
+// encodeJSON encodes v compactly without HTML escaping.
+func encodeJSON(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// applyMergePatch applies an RFC 7386 merge patch to target.
+func applyMergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+		} else {
+			targetObj[name] = applyMergePatch(targetObj[name], value)
+		}
+	}
+	return targetObj
+}
+
+// jsonPatchOp is one RFC 6902 operation.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped tokens.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, tok := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; "-" means one past the end and is
+// only accepted when allowEnd is set.
+func arrayIndex(tok string, length int, allowEnd bool) (int, error) {
+	if tok == "-" && allowEnd {
+		return length, nil
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (tok != "0" && strings.HasPrefix(tok, "0")) {
+		return 0, conflictf("invalid array index %q", tok)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if i > limit {
+		return 0, conflictf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// pointerGet returns the value at tokens within doc.
+func pointerGet(doc any, tokens []string) (any, error) {
+	for _, tok := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			child, ok := node[tok]
+			if !ok {
+				return nil, conflictf("member %q not found", tok)
+			}
+			doc = child
+		case []any:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, conflictf("cannot descend into a scalar at %q", tok)
+		}
+	}
+	return doc, nil
+}
+
+// pointerEdit applies edit to the container holding the last token and
+// returns the (possibly replaced) document. edit receives the parent and the
+// last token, and returns the parent to store back.
+func pointerEdit(doc any, tokens []string, edit func(parent any, tok string) (any, error)) (any, error) {
+	if len(tokens) == 0 {
+		return nil, conflictf("the whole document cannot be edited this way")
+	}
+	if len(tokens) == 1 {
+		return edit(doc, tokens[0])
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := edit(parent, tokens[len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	// Slices may have been reallocated; store the new one in its container.
+	grand, _ := pointerGet(doc, tokens[:len(tokens)-2])
+	switch g := grand.(type) {
+	case map[string]any:
+		g[tokens[len(tokens)-2]] = updated
+	case []any:
+		i, _ := arrayIndex(tokens[len(tokens)-2], len(g), false)
+		g[i] = updated
+	}
+	return doc, nil
+}
+
+func patchAdd(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerEdit(doc, tokens, func(parent any, tok string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[tok] = value
+			return node, nil
+		case []any:
+			i, err := arrayIndex(tok, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, conflictf("cannot add to a scalar")
+		}
+	})
+}
+
+func patchRemove(doc any, tokens []string) (any, any, error) {
+	var removed any
+	doc, err := pointerEdit(doc, tokens, func(parent any, tok string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			child, ok := node[tok]
+			if !ok {
+				return nil, conflictf("member %q not found", tok)
+			}
+			removed = child
+			delete(node, tok)
+			return node, nil
+		case []any:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, conflictf("cannot remove from a scalar")
+		}
+	})
+	return doc, removed, err
+}
+
+// applyJSONPatch applies an RFC 6902 patch to doc.
+func applyJSONPatch(doc any, patch []byte) (any, error) {
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("JSON Patch must be an array of operations: %w", err)
+	}
+	for n, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value any
+		if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d (%s) is missing 'value'", n, op.Op)
+			}
+			if value, err = decodeJSON(op.Value); err != nil {
+				return nil, err
+			}
+		}
+		switch op.Op {
+		case "add":
+			doc, err = patchAdd(doc, path, value)
+		case "remove":
+			doc, _, err = patchRemove(doc, path)
+		case "replace":
+			if _, err = pointerGet(doc, path); err == nil {
+				if len(path) == 0 {
+					doc = value
+				} else if doc, _, err = patchRemove(doc, path); err == nil {
+					doc, err = patchAdd(doc, path, value)
+				}
+			}
+		case "move", "copy":
+			var from []string
+			if from, err = parsePointer(op.From); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, conflictf("cannot move %q into itself", op.From)
+			}
+			var moved any
+			if op.Op == "move" {
+				doc, moved, err = patchRemove(doc, from)
+			} else if moved, err = pointerGet(doc, from); err == nil {
+				moved = deepCopyJSON(moved)
+			}
+			if err == nil {
+				doc, err = patchAdd(doc, path, moved)
+			}
+		case "test":
+			var current any
+			if current, err = pointerGet(doc, path); err == nil && !jsonEqual(current, value) {
+				err = conflictf("test failed at %q", op.Path)
+			}
+		default:
+			return nil, fmt.Errorf("operation %d has unknown op %q", n, op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// deepCopyJSON copies a decoded JSON value so copies do not share containers.
+func deepCopyJSON(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(node))
+		for k, child := range node {
+			out[k] = deepCopyJSON(child)
+		}
+		return out
+	case []any:
+		out := make([]any, len(node))
+		for i, child := range node {
+			out[i] = deepCopyJSON(child)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// jsonEqual compares decoded JSON values, treating numbers by value.
+func jsonEqual(a, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		return errX == nil && errY == nil && fx == fy
+	default:
+		return a == b
+	}
+}
+
+// checkDocumentLength fails with ErrValueTooLong when a patched document
+// exceeds the value limit.
+func checkDocumentLength(document string) error {
+	if n := utf8.RuneCountInString(document); n > MaxValueLength {
+		return fmt.Errorf("%w: patched document has %d characters, at most %d", ErrValueTooLong, n, MaxValueLength)
+	}
+	return nil
+}
+
+// HandleMerge handles POST /merge: apply a merge patch or JSON Patch to the
+// JSON object value of key, and pass the result through transforms.
+func HandleMerge(cache *ShardedCache, transforms *TransformChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req MergeRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		key := cache.trimKey(req.Key)
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if len(req.Patch) == 0 {
+			writeJSONError(w, "Patch cannot be empty.", http.StatusBadRequest)
+			return
+		}
+		patchType := req.PatchType
+		if patchType == "" {
+			patchType = PatchTypeMerge
+		}
+		var mergePatch any
+		switch patchType {
+		case PatchTypeMerge:
+			var err error
+			if mergePatch, err = decodeJSON(req.Patch); err != nil {
+				writeJSONError(w, "Invalid merge patch.", http.StatusBadRequest)
+				return
+			}
+		case PatchTypeJSON:
+		default:
+			writeJSONError(w, fmt.Sprintf("Unknown patch_type %q, expected %q or %q.", patchType, PatchTypeMerge, PatchTypeJSON), http.StatusBadRequest)
+			return
+		}
+
+		version, document, err := cache.Update(key, requestReader(r), transforms, func(old string) (string, error) {
+			doc, err := decodeJSON([]byte(old))
+			if _, isObject := doc.(map[string]any); err != nil || !isObject {
+				return "", errNotJSONObject
+			}
+			if patchType == PatchTypeMerge {
+				doc = applyMergePatch(doc, mergePatch)
+			} else if doc, err = applyJSONPatch(doc, req.Patch); err != nil {
+				return "", err
+			}
+			document, err := encodeJSON(doc)
+			if err != nil {
+				return "", err
+			}
+			return document, checkDocumentLength(document)
+		})
+
+		var conflict *patchConflict
+		switch {
+		case isCacheError(err):
+			writeCacheError(w, err)
+			return
+		case errors.As(err, &conflict):
+			writeJSONError(w, "Patch cannot be applied: "+conflict.reason+".", http.StatusConflict)
+			return
+		case err != nil:
+			writeJSONError(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := MergeResponse{
+			Status:  "OK",
+			Key:     key,
+			Version: version,
+		}
+		if req.ReturnDocument {
+			resp.Document = json.RawMessage(document)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// HandleMergeFields handles PATCH /merge: set some top-level fields of a JSON
+// object value in one step, creating the key if it does not exist. The result
+// is passed through transforms.
+func HandleMergeFields(cache *ShardedCache, transforms *TransformChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req MergeFieldsRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		key := cache.trimKey(req.Key)
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if len(req.Patch) == 0 {
+			writeJSONError(w, "Patch must set at least one field.", http.StatusBadRequest)
+			return
+		}
+
+		version, document, created, err := cache.MergeJSON(key, requestReader(r), transforms, req.Patch)
+		switch {
+		case isCacheError(err):
+			writeCacheError(w, err)
+			return
+		case err != nil:
+			writeJSONError(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := MergeResponse{
+			Status:  "OK",
+			Key:     key,
+			Version: version,
+			Created: created,
+		}
+		if req.ReturnDocument {
+			resp.Document = json.RawMessage(document)
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
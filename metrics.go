@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Op identifies an instrumented API operation. The set is fixed so the number
+// of exported series stays bounded.
+type Op int
+
+const (
+	OpGet Op = iota
+	OpPut
+	OpRename
+	OpFlush
+	OpFetch
+	OpClaim
+	OpRelease
+	OpMerge
+	OpLock
+	OpDelete
+	OpPin
+	OpBulk // Multi-key writes: /add/bulk, /bulk/delete and the imports
+	numOps
+)
+
+var opNames = [numOps]string{"get", "put", "rename", "flush", "fetch", "claim", "release", "merge", "lock", "delete", "pin", "bulk"}
+
+// Outcome classifies how an operation ended.
+type Outcome int
+
+const (
+	OutcomeHit   Outcome = iota // GET found the key
+	OutcomeMiss                 // Key not found
+	OutcomeOK                   // Any other success
+	OutcomeError                // Rejected or failed request
+	numOutcomes
+)
+
+var outcomeNames = [numOutcomes]string{"hit", "miss", "ok", "error"}
+
+// latencyBuckets are the histogram upper bounds, in seconds.
+var latencyBuckets = [...]float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+
+// latencyHistogram is a fixed-bucket histogram updated with atomics only.
+type latencyHistogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64 // Last bucket is +Inf
+	sumNs   atomic.Uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && seconds > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sumNs.Add(uint64(d))
+}
+
+// Metrics is a small labeled registry: request counters by operation and
+// outcome, a latency histogram per operation, the requests in flight,
+// rejected PUT bodies by reason and error replies by endpoint, status and
+// code.
+type Metrics struct {
+	requests       [numOps][numOutcomes]atomic.Uint64
+	latency        [numOps]latencyHistogram
+	inFlight       atomic.Int64
+	decodeFailures [numDecodeFailures]atomic.Uint64
+	errors         *ErrorStats // Set by NewErrorStats
+}
+
+// NewMetrics creates an empty registry.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Observe records one completed operation.
+func (m *Metrics) Observe(op Op, outcome Outcome, d time.Duration) {
+	m.requests[op][outcome].Add(1)
+	m.latency[op].observe(d)
+}
+
+// ObserveDecodeFailure counts one PUT body rejected for failure.
+func (m *Metrics) ObserveDecodeFailure(failure PutDecodeFailure) {
+	m.decodeFailures[failure].Add(1)
+}
+
+// outcomeFor derives the outcome of op from the HTTP status it replied with.
+func outcomeFor(op Op, status int) Outcome {
+	switch {
+	case status == http.StatusNotFound:
+		return OutcomeMiss
+	case status >= 400:
+		return OutcomeError
+	case op == OpGet:
+		return OutcomeHit
+	default:
+		return OutcomeOK
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument wraps next so every request is counted and timed as op.
+func (m *Metrics) Instrument(op Op, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		m.Observe(op, outcomeFor(op, rec.status), time.Since(start))
+	}
+}
+
+// HandleMetrics serves the registry in the Prometheus text exposition format.
+func HandleMetrics(m *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		fmt.Fprintln(w, "# HELP kvcache_requests_total Requests handled, by operation and outcome.")
+		fmt.Fprintln(w, "# TYPE kvcache_requests_total counter")
+		for op := range numOps {
+			for outcome := range numOutcomes {
+				fmt.Fprintf(w, "kvcache_requests_total{op=%q,outcome=%q} %d\n",
+					opNames[op], outcomeNames[outcome], m.requests[op][outcome].Load())
+			}
+		}
+
+		fmt.Fprintln(w, "# HELP kvcache_request_duration_seconds Request latency, by operation.")
+		fmt.Fprintln(w, "# TYPE kvcache_request_duration_seconds histogram")
+		for op := range numOps {
+			h := &m.latency[op]
+			var cumulative uint64
+			for i := range h.buckets {
+				cumulative += h.buckets[i].Load()
+				le := "+Inf"
+				if i < len(latencyBuckets) {
+					le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+				}
+				fmt.Fprintf(w, "kvcache_request_duration_seconds_bucket{op=%q,le=%q} %d\n", opNames[op], le, cumulative)
+			}
+			fmt.Fprintf(w, "kvcache_request_duration_seconds_sum{op=%q} %g\n", opNames[op], time.Duration(h.sumNs.Load()).Seconds())
+			fmt.Fprintf(w, "kvcache_request_duration_seconds_count{op=%q} %d\n", opNames[op], cumulative)
+		}
+
+		fmt.Fprintln(w, "# HELP kvcache_put_decode_failures_total PUT bodies rejected before validation, by reason.")
+		fmt.Fprintln(w, "# TYPE kvcache_put_decode_failures_total counter")
+		for failure := range numDecodeFailures {
+			fmt.Fprintf(w, "kvcache_put_decode_failures_total{reason=%q} %d\n", decodeFailureNames[failure], m.decodeFailures[failure].Load())
+		}
+
+		if m.errors != nil {
+			m.errors.writeMetrics(w)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentCountsDeletesByOutcome(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	cache.Put("k", "v")
+	metrics := NewMetrics()
+	handler := metrics.Instrument(OpDelete, HandleDelete(cache))
+	for range 2 {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/delete?key=k", nil))
+	}
+
+	rec := httptest.NewRecorder()
+	HandleMetrics(metrics)(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`kvcache_requests_total{op="delete",outcome="ok"} 1`,
+		`kvcache_requests_total{op="delete",outcome="miss"} 1`,
+		`kvcache_request_duration_seconds_count{op="delete"} 2`,
+		`kvcache_requests_total{op="bulk",outcome="ok"} 0`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("/metrics lacks %q", want)
+		}
+	}
+}
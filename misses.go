@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Key retention modes of the miss log (-miss-log-keys).
+const (
+	MissKeysHash   = "hash"   // fnv64a of the key only
+	MissKeysPrefix = "prefix" // Key up to and including the first ':'
+	MissKeysFull   = "full"   // The whole key
+)
+
+const (
+	defaultMissTop    = 50
+	defaultMissWindow = 5 * time.Minute
+)
+
+// MissCount is one aggregated row of GET /admin/misses.
+type MissCount struct {
+	Key   string `json:"key"` // Hash, prefix or full key depending on -miss-log-keys
+	Count int    `json:"count"`
+}
+
+// MissesResponse structure for GET /admin/misses replies
+type MissesResponse struct {
+	Status    string      `json:"status"`
+	KeyMode   string      `json:"key_mode"`
+	WindowMs  int64       `json:"window_ms"`
+	Total     int         `json:"total"`     // Misses recorded in the window
+	Truncated bool        `json:"truncated"` // The ring wrapped inside the window, so older misses are lost
+	Top       []MissCount `json:"top"`
+}
+
+// missSlot is one ring entry. Fields are written with atomics so recording
+// never locks; a reader racing a writer may see a mix of two misses, which
+// the aggregation tolerates.
+type missSlot struct {
+	at    atomic.Int64 // UnixNano; 0 = never written
+	hash  atomic.Uint64
+	label atomic.Pointer[string] // Prefix or key; nil in hash mode
+}
+
+// MissLog is a fixed-size lock-free ring of recent GET misses. Recording is a
+// single atomic increment plus a few stores; all aggregation happens when
+// GET /admin/misses is queried.
+//
+// All methods are safe to call on a nil *MissLog, which records nothing.
+type MissLog struct {
+	mode  string
+	slots []missSlot
+	next  atomic.Uint64
+}
+
+// NewMissLog creates a log remembering the last size misses, retaining keys
+// according to mode.
+func NewMissLog(size int, mode string) (*MissLog, error) {
+	switch mode {
+	case MissKeysHash, MissKeysPrefix, MissKeysFull:
+	default:
+		return nil, fmt.Errorf("unknown miss log key mode %q (want %s, %s or %s)", mode, MissKeysHash, MissKeysPrefix, MissKeysFull)
+	}
+	return &MissLog{mode: mode, slots: make([]missSlot, size)}, nil
+}
+
+// Record notes a miss of key.
+func (l *MissLog) Record(key string) {
+	if l == nil {
+		return
+	}
+	slot := &l.slots[(l.next.Add(1)-1)%uint64(len(l.slots))]
+	slot.at.Store(0) // Mark as in progress
+	slot.hash.Store(hashKey64(key))
+	switch l.mode {
+	case MissKeysFull:
+		slot.label.Store(&key)
+	case MissKeysPrefix:
+		prefix := key
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			prefix = key[:i+1]
+		}
+		slot.label.Store(&prefix)
+	}
+	slot.at.Store(time.Now().UnixNano())
+}
+
+// Top aggregates the misses recorded within window and returns the top most
+// frequent keys, the number of misses in the window, and whether the ring had
+// already overwritten misses from inside the window.
+func (l *MissLog) Top(top int, window time.Duration) ([]MissCount, int, bool) {
+	now := time.Now().UnixNano()
+	since := now - int64(window)
+	counts := make(map[string]int)
+	total := 0
+	oldest := now
+	written := l.next.Load()
+	for i := range l.slots {
+		slot := &l.slots[i]
+		at := slot.at.Load()
+		if at == 0 {
+			continue
+		}
+		oldest = min(oldest, at)
+		if at < since {
+			continue
+		}
+		var key string
+		if label := slot.label.Load(); l.mode != MissKeysHash && label != nil {
+			key = *label
+		} else {
+			key = fmt.Sprintf("%016x", slot.hash.Load())
+		}
+		counts[key]++
+		total++
+	}
+
+	out := make([]MissCount, 0, len(counts))
+	for key, n := range counts {
+		out = append(out, MissCount{Key: key, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > top {
+		out = out[:top]
+	}
+	truncated := written > uint64(len(l.slots)) && oldest >= since
+	return out, total, truncated
+}
+
+func HandleMisses(l *MissLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		top := defaultMissTop
+		if raw := query.Get("top"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				writeJSONError(w, "Invalid 'top' parameter, expected a positive number.", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+		window := defaultMissWindow
+		if raw := query.Get("window"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				writeJSONError(w, "Invalid 'window' parameter, expected a duration like 5m.", http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+
+		counts, total, truncated := l.Top(top, window)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(MissesResponse{
+			Status:    "OK",
+			KeyMode:   l.mode,
+			WindowMs:  window.Milliseconds(),
+			Total:     total,
+			Truncated: truncated,
+			Top:       counts,
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+var (
+	errPinLimit    = fmt.Errorf("%w: the key's shard already holds the maximum number of pinned keys", ErrCapacityExhausted)
+	errPinningLock = fmt.Errorf("%w: the key holds a lock, which must be able to expire", ErrTypeMismatch)
+)
+
+// PinResponse structure for POST /pin and /unpin replies
+type PinResponse struct {
+	Status string `json:"status"`
+	Key    string `json:"key"`
+	Pinned bool   `json:"pinned"`
+}
+
+// SetPinLimit allows each shard to pin at most fraction of its capacity, so
+// that a full shard always has entries it can evict. Must be called before
+// the cache starts serving requests.
+func (sc *ShardedCache) SetPinLimit(fraction float64) error {
+	if fraction < 0 || fraction >= 1 {
+		return fmt.Errorf("pin fraction must be in [0, 1), got %v", fraction)
+	}
+	for _, shard := range sc.shards {
+		shard.pinFraction = fraction
+		shard.maxPinned = int(fraction * float64(shard.capacity))
+	}
+	return nil
+}
+
+// Pin sets whether key is exempt from capacity eviction and TTL expiry. A
+// pinned entry still goes away when it is deleted, flushed or overwritten
+// by a rename. Pinning fails with ErrNotFound for absent keys, with
+// errPinningLock for lock entries and with errPinLimit once the key's shard
+// holds its maximum number of pinned keys.
+func (sc *ShardedCache) Pin(key string, pinned bool) error {
+	shard := sc.shards[sc.getShardIndex(key)]
+	now := sc.now()
+
+	shard.mutex.Lock()
+	elem, hit := shard.lookupLocked(key)
+	if !hit {
+		shard.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if ent := elem.Value.(*entry); ent.expired(now) {
+		expired := shard.removeElement(elem)
+		shard.mutex.Unlock()
+		shard.notifyEvict(expired, EvictionExpired)
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	defer shard.mutex.Unlock()
+	return shard.setPinnedLocked(elem, pinned)
+}
+
+// setPinnedLocked implements Pin for a live entry.
+// MUST be called with the mutex held.
+func (c *LRUCache) setPinnedLocked(elem *list.Element, pinned bool) error {
+	ent := elem.Value.(*entry)
+	switch {
+	case ent.pinned == pinned:
+		return nil
+	case pinned && ent.fence != 0:
+		return errPinningLock // A lease has to be able to run out
+	case pinned && c.pinned >= c.maxPinned:
+		return errPinLimit
+	}
+	ent.pinned = pinned
+	if pinned {
+		c.pinned++
+	} else {
+		c.pinned--
+	}
+	return nil
+}
+
+// unpinnedBack returns the least recently used entry that is not pinned, or
+// nil if there is none. Pinned entries found at the tail are moved to the
+// front on the way, so later scans do not walk past them again.
+// MUST be called with the mutex held.
+func (c *LRUCache) unpinnedBack() *list.Element {
+	for range c.pinned + 1 {
+		elem := c.evictList.Back()
+		if elem == nil || !elem.Value.(*entry).pinned {
+			return elem
+		}
+		c.evictList.MoveToFront(elem)
+	}
+	return nil
+}
+
+// PinnedKeys counts the pinned keys over all shards.
+func (sc *ShardedCache) PinnedKeys() int {
+	total := 0
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		total += shard.pinned
+		shard.mutex.Unlock()
+	}
+	return total
+}
+
+// HandlePin handles POST /pin?key=... (pinned true) and POST /unpin?key=...
+// (pinned false).
+func HandlePin(cache *ShardedCache, pinned bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := queryKey(r, cache)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if msg := validateKey(key); msg != "" {
+			writeJSONError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		if err := cache.Pin(key, pinned); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(PinResponse{
+			Status: "OK",
+			Key:    key,
+			Pinned: pinned,
+		})
+	}
+}
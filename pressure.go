@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pressureWindowSeconds is the length of the sliding window eviction pressure
+// is measured over.
+const pressureWindowSeconds = 10
+
+// Pressure level names used in the X-Cache-Pressure header.
+const (
+	PressureLow    = "low"
+	PressureMedium = "medium"
+	PressureHigh   = "high"
+)
+
+// pressureSlot counts writes during one wall-clock second.
+type pressureSlot struct {
+	second    int64 // Unix second the counts belong to
+	puts      uint64
+	evictions uint64
+}
+
+// pressureWindow is a fixed ring of per-second put/eviction counters. It is
+// owned by a shard and guarded by the shard mutex.
+type pressureWindow struct {
+	slots [pressureWindowSeconds]pressureSlot
+}
+
+// record counts one put at now (UnixNano), and whether it caused an eviction.
+func (p *pressureWindow) record(now int64, evicted bool) {
+	sec := now / int64(time.Second)
+	slot := &p.slots[sec%pressureWindowSeconds]
+	if slot.second != sec {
+		*slot = pressureSlot{second: sec}
+	}
+	slot.puts++
+	if evicted {
+		slot.evictions++
+	}
+}
+
+// ratio returns evictions per put over the window ending at now (UnixNano):
+// 0 when nothing is being pushed out, 1 when every write evicts something.
+func (p *pressureWindow) ratio(now int64) float64 {
+	sec := now / int64(time.Second)
+	var puts, evictions uint64
+	for _, slot := range p.slots {
+		if sec-slot.second < pressureWindowSeconds {
+			puts += slot.puts
+			evictions += slot.evictions
+		}
+	}
+	if puts == 0 {
+		return 0
+	}
+	return float64(evictions) / float64(puts)
+}
+
+// Pressure returns the shard's current eviction pressure ratio.
+func (c *LRUCache) Pressure() float64 {
+	now := c.now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pressure.ratio(now)
+}
+
+// ShardPressure returns the eviction pressure ratio of every shard, in shard order.
+func (sc *ShardedCache) ShardPressure() []float64 {
+	out := make([]float64, len(sc.shards))
+	for i, shard := range sc.shards {
+		out[i] = shard.Pressure()
+	}
+	return out
+}
+
+// PressurePolicy maps a pressure ratio to a level name and decides how writes
+// are throttled while a shard is under high pressure.
+type PressurePolicy struct {
+	Medium float64 // Ratio at or above which pressure is "medium"
+	High   float64 // Ratio at or above which pressure is "high"
+
+	// ShedFraction of writes to a high-pressure shard are rejected with 429.
+	ShedFraction float64
+	// MaxBackoff is the backoff suggested at a ratio of 1; the hint scales
+	// linearly with the ratio.
+	MaxBackoff time.Duration
+}
+
+// Level returns the pressure level name for ratio.
+func (p PressurePolicy) Level(ratio float64) string {
+	switch {
+	case ratio >= p.High:
+		return PressureHigh
+	case ratio >= p.Medium:
+		return PressureMedium
+	default:
+		return PressureLow
+	}
+}
+
+// Backoff returns how long clients should hold off writing at ratio, or 0
+// when pressure is below high.
+func (p PressurePolicy) Backoff(ratio float64) time.Duration {
+	if ratio < p.High {
+		return 0
+	}
+	return time.Duration(ratio * float64(p.MaxBackoff))
+}
+
+// ShouldShed decides whether to reject a write at ratio.
+func (p PressurePolicy) ShouldShed(ratio float64) bool {
+	return p.ShedFraction > 0 && ratio >= p.High && rand.Float64() < p.ShedFraction
+}
+
+// PressureFor returns the current eviction pressure of key's shard.
+func (sc *ShardedCache) PressureFor(key string) float64 {
+	return sc.shards[sc.getShardIndex(key)].Pressure()
+}
+
+// setBackoffHeaders advertises the pressure level and, under high pressure,
+// the suggested backoff on a write response.
+func setBackoffHeaders(w http.ResponseWriter, policy PressurePolicy, ratio float64) {
+	w.Header().Set("X-Cache-Pressure", policy.Level(ratio))
+	if backoff := policy.Backoff(ratio); backoff > 0 {
+		w.Header().Set("X-Cache-Backoff-Ms", strconv.FormatInt(backoff.Milliseconds(), 10))
+	}
+}
+
+// writeShedError rejects a write with 429 and a Retry-After hint.
+func writeShedError(w http.ResponseWriter, policy PressurePolicy, ratio float64) {
+	retryAfter := max(int((policy.Backoff(ratio)+time.Second-1)/time.Second), 1) // Round up
+	setBackoffHeaders(w, policy, ratio)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJSONError(w, "Cache is under eviction pressure, retry later.", http.StatusTooManyRequests)
+}
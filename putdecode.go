@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// PutDecodeFailure classifies why a PUT body could not be decoded.
+type PutDecodeFailure int
+
+const (
+	DecodeTooLarge       PutDecodeFailure = iota // Body over the size limit
+	DecodeSyntax                                 // Not valid JSON
+	DecodeNotObject                              // Valid JSON, but not an object
+	DecodeTrailingData                           // Anything after the object
+	DecodeDuplicateField                         // A field given twice
+	DecodeUnknownField                           // A field PutRequest does not have (strict mode only)
+	DecodeFieldType                              // A field of the wrong JSON type
+	DecodeNullValue                              // "value": null, when rejected
+	numDecodeFailures
+)
+
+var decodeFailureNames = [numDecodeFailures]string{
+	"too_large", "syntax", "not_object", "trailing_data", "duplicate_field", "unknown_field", "field_type", "null_value",
+}
+
+// Policies for an explicit "value": null in a PUT body.
+const (
+	NullValueReject = "reject"
+	NullValueEmpty  = "empty" // Store the empty string, as if value were missing
+)
+
+// PutDecoder decodes PUT bodies, telling apart the ways a client can get
+// them wrong, and counts each kind of failure in the metrics.
+type PutDecoder struct {
+	StrictFields bool   // Reject fields PutRequest does not define
+	NullValue    string // NullValueReject or NullValueEmpty
+	metrics      *Metrics
+}
+
+// NewPutDecoder creates a decoder that counts failures in m.
+func NewPutDecoder(m *Metrics, strictFields bool, nullValue string) (*PutDecoder, error) {
+	if nullValue != NullValueReject && nullValue != NullValueEmpty {
+		return nil, fmt.Errorf("unknown null value policy %q, expected %s or %s", nullValue, NullValueReject, NullValueEmpty)
+	}
+	return &PutDecoder{StrictFields: strictFields, NullValue: nullValue, metrics: m}, nil
+}
+
+// putDecodeError is a rejected PUT body: its category and the message sent
+// back to the client.
+type putDecodeError struct {
+	failure PutDecodeFailure
+	message string
+}
+
+// status is the HTTP status of the reply to a body rejected for e.
+func (e *putDecodeError) status() int {
+	if e.failure == DecodeTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Decode reads one PutRequest from body. The body must hold exactly one JSON
+// object without repeated fields; in strict mode it may only hold fields
+// PutRequest defines.
+func (d *PutDecoder) Decode(body io.Reader, req *PutRequest) *putDecodeError {
+	derr := d.decode(body, req)
+	if derr != nil {
+		d.metrics.ObserveDecodeFailure(derr.failure)
+	}
+	return derr
+}
+
+func (d *PutDecoder) decode(body io.Reader, req *PutRequest) *putDecodeError {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &putDecodeError{DecodeTooLarge, "Request body exceeds limit (1MB)."}
+		}
+		return &putDecodeError{DecodeSyntax, "Invalid JSON format."}
+	}
+
+	// First pass: check the shape of the document token by token.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return &putDecodeError{DecodeSyntax, "Invalid JSON format."}
+	}
+	if tok != json.Delim('{') {
+		return &putDecodeError{DecodeNotObject, "Request body must be a JSON object."}
+	}
+	seen := make(map[string]bool)
+	nullValue := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return &putDecodeError{DecodeSyntax, "Invalid JSON format."}
+		}
+		name := tok.(string)            // Object keys are always strings
+		folded := strings.ToLower(name) // encoding/json matches fields case-insensitively
+		if seen[folded] {
+			return &putDecodeError{DecodeDuplicateField, fmt.Sprintf("Field '%s' is given more than once.", name)}
+		}
+		seen[folded] = true
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return &putDecodeError{DecodeSyntax, "Invalid JSON format."}
+		}
+		if folded == "value" && string(raw) == "null" {
+			nullValue = true
+		}
+	}
+	if _, err := dec.Token(); err != nil { // Closing brace
+		return &putDecodeError{DecodeSyntax, "Invalid JSON format."}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &putDecodeError{DecodeTrailingData, "Unexpected data after the JSON object."}
+	}
+	if nullValue && d.NullValue == NullValueReject {
+		return &putDecodeError{DecodeNullValue, "Field 'value' cannot be null."}
+	}
+
+	// Second pass: fill in the request.
+	dec = json.NewDecoder(bytes.NewReader(data))
+	if d.StrictFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &putDecodeError{DecodeFieldType, fmt.Sprintf("Field '%s' must be %s, not %s.", typeErr.Field, jsonKind(typeErr.Type), typeErr.Value)}
+		}
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return &putDecodeError{DecodeUnknownField, fmt.Sprintf("Unknown field %s.", field)}
+		}
+		return &putDecodeError{DecodeSyntax, "Invalid JSON format."}
+	}
+	return nil
+}
+
+// jsonKind describes the JSON type expected for a Go type.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	default:
+		return "a " + t.Kind().String()
+	}
+}
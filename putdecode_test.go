@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPutDecodeFailuresReplyWithTheirCode(t *testing.T) {
+	for _, tc := range []struct {
+		failure PutDecodeFailure
+		body    string
+		status  int
+	}{
+		{DecodeTooLarge, `{"key": "a", "value": "` + strings.Repeat("x", 1<<20) + `"}`, http.StatusRequestEntityTooLarge},
+		{DecodeSyntax, `{"key": "a",`, http.StatusBadRequest},
+		{DecodeNotObject, `["a", "1"]`, http.StatusBadRequest},
+		{DecodeTrailingData, `{"key": "a", "value": "1"} x`, http.StatusBadRequest},
+		{DecodeDuplicateField, `{"key": "a", "Key": "b", "value": "1"}`, http.StatusBadRequest},
+		{DecodeUnknownField, `{"key": "a", "value": "1", "tll": 5}`, http.StatusBadRequest},
+		{DecodeFieldType, `{"key": "a", "value": 5}`, http.StatusBadRequest},
+		{DecodeNullValue, `{"key": "a", "value": null}`, http.StatusBadRequest},
+	} {
+		code := decodeFailureNames[tc.failure]
+		metrics := NewMetrics()
+		decoder, err := NewPutDecoder(metrics, true, NullValueReject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache := NewShardedCache(1, 10, false)
+		rec := httptest.NewRecorder()
+		HandlePut(cache, decoder, WritePolicy{}, PressurePolicy{}, nil, false)(rec, httptest.NewRequest(http.MethodPut, "/put", strings.NewReader(tc.body)))
+
+		var reply GenericErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if rec.Code != tc.status || reply.Code != code {
+			t.Errorf("%s: status %d, code %q, want %d and %q", code, rec.Code, reply.Code, tc.status, code)
+		}
+		if n := metrics.decodeFailures[tc.failure].Load(); n != 1 {
+			t.Errorf("%s: counted %d times, want once", code, n)
+		}
+		if cache.Exists("a") {
+			t.Errorf("%s: the key was stored", code)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// errKeyEncoding reports a key query parameter that cannot be decoded into
+// the key a client meant. url.Values drops such parameters without a word,
+// which turned a badly encoded key into "missing key" or a lookup of some
+// other key.
+var errKeyEncoding = fmt.Errorf("the 'key' query parameter is not percent-encoded correctly")
+
+// queryKey returns the first key query parameter of r, percent-decoded
+// exactly once with the same rules as url.Values, so "+" reads as a space
+// and a literal "+" must be sent as %2B. The key is trimmed and normalized
+// for cache like the key of a PUT body, so any key PUT stored can be named
+// in a query. Escapes that do
+// not decode, or decode to invalid UTF-8, which no stored key can be, fail
+// with errKeyEncoding; a missing parameter returns "".
+func queryKey(r *http.Request, cache *ShardedCache) (string, error) {
+	keys, err := queryKeys(r, cache, 1)
+	if err != nil || len(keys) == 0 {
+		return "", err
+	}
+	return keys[0], nil
+}
+
+// queryKeys is queryKey for up to limit repeated key parameters, returned
+// in query order.
+func queryKeys(r *http.Request, cache *ShardedCache, limit int) ([]string, error) {
+	var keys []string
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		if len(keys) == limit {
+			break
+		}
+		name, raw, _ := strings.Cut(pair, "=")
+		if n, err := url.QueryUnescape(name); err != nil || n != "key" {
+			continue
+		}
+		key, err := url.QueryUnescape(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q has an invalid escape", errKeyEncoding, raw)
+		}
+		if !utf8.ValidString(key) {
+			return nil, fmt.Errorf("%w: %q does not decode to UTF-8", errKeyEncoding, raw)
+		}
+		keys = append(keys, cache.trimKey(key))
+	}
+	return keys, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// trickyKeys are keys that break when a query string is built by hand.
+var trickyKeys = []string{
+	"a b",
+	"a+b",
+	"a/b/c",
+	"a%2Fb", // A literal escape: must not read back as a/b
+	"100%",
+	"%",
+	"a&b=c",
+	"a=b",
+	"a#frag",
+	"a?b",
+	"key=x&key=y",
+	"привет мир",
+	"日本語/キー",
+	"emoji 🎉+",
+	"tab\there",
+	`quote"and'apostrophe`,
+	"a;b,c",
+}
+
+func TestTrickyKeysRoundTrip(t *testing.T) {
+	cache := NewShardedCache(8, 100, false)
+	for _, key := range trickyKeys {
+		if rec := doPut(t, cache, PutRequest{Key: key, Value: "value of " + key}); rec.Code != http.StatusOK {
+			t.Fatalf("PUT %q: status %d: %s", key, rec.Code, rec.Body)
+		}
+	}
+	if n := cache.Len(); n != len(trickyKeys) {
+		t.Fatalf("%d entries stored, want %d distinct keys", n, len(trickyKeys))
+	}
+	for _, key := range trickyKeys {
+		rec, resp := doGet(t, cache, "key="+url.QueryEscape(key))
+		if rec.Code != http.StatusOK || resp.Key != key || resp.Value != "value of "+key {
+			t.Errorf("GET %q: status %d, key %q, value %q", key, rec.Code, resp.Key, resp.Value)
+		}
+	}
+}
+
+func TestQueryKeyDecodesOnce(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	for _, key := range []string{"a/b", "a b", "a+b", "%2F"} {
+		cache.Put(key, key)
+	}
+	for query, want := range map[string]string{
+		"key=a%2Fb":                 "a/b",
+		"key=a/b":                   "a/b", // Slashes need no escape in a query
+		"key=a+b":                   "a b", // Form encoding: + is a space
+		"key=a%20b":                 "a b",
+		"key=a%2Bb":                 "a+b",
+		"key=%252F":                 "%2F",
+		"key=++a+b+":                "a b", // Trimmed like a PUT body key
+		"other=x&key=a%2Bb&key=a/b": "a+b", // The first key parameter
+	} {
+		rec, resp := doGet(t, cache, query)
+		if rec.Code != http.StatusOK || resp.Value != want {
+			t.Errorf("%s: status %d, value %q, want %q", query, rec.Code, resp.Value, want)
+		}
+	}
+}
+
+func TestQueryKeyRejectsBadEncodings(t *testing.T) {
+	cache := NewShardedCache(1, 10, false)
+	cache.Put("%", "v")
+	for _, query := range []string{"key=%", "key=100%", "key=%zz", "key=%C3%28", "key=%ff"} {
+		rec, _ := doGet(t, cache, query)
+		var reply GenericErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if rec.Code != http.StatusBadRequest || reply.Code != "key_encoding" {
+			t.Errorf("%s: status %d, code %q, want 400 key_encoding", query, rec.Code, reply.Code)
+		}
+	}
+	if rec, _ := doGet(t, cache, "other=1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing key: status %d, want 400", rec.Code)
+	}
+}
+
+func TestDeleteDecodesKeysLikeGet(t *testing.T) {
+	cache := NewShardedCache(8, 100, false)
+	for _, key := range trickyKeys {
+		cache.Put(key, "v")
+	}
+	for _, key := range trickyKeys {
+		rec := httptest.NewRecorder()
+		HandleDelete(cache)(rec, httptest.NewRequest(http.MethodPost, "/delete?key="+url.QueryEscape(key), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("DELETE %q: status %d", key, rec.Code)
+		}
+	}
+	if n := cache.Len(); n != 0 {
+		t.Errorf("%d entries left after deleting every key", n)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rebalanceHeadroom is the share of its entries a shard keeps free when it
+// gives capacity away, so that a donor does not start evicting as soon as
+// it grows again.
+const rebalanceHeadroom = 0.1
+
+// rebalanceHistory is how many rebalance decisions /stats/shards lists.
+const rebalanceHistory = 20
+
+// RebalancePolicy configures capacity rebalancing between shards.
+type RebalancePolicy struct {
+	Interval    time.Duration // How often the shards are compared; 0 = never
+	MinCapacity int           // No shard is shrunk below this
+	MaxCapacity int           // No shard is grown above this
+	Damping     float64       // Share (0-1] of the computed shift applied per round
+}
+
+// CapacityChange is one shard's capacity before and after a rebalance.
+type CapacityChange struct {
+	Shard  int `json:"shard"`
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+// RebalanceDecision is a rebalance round that moved capacity.
+type RebalanceDecision struct {
+	Time    time.Time        `json:"time"`
+	Moved   int              `json:"moved"`             // Capacity taken from idle shards and given to evicting ones
+	Evicted int              `json:"evicted,omitempty"` // Entries evicted by donors that filled up since they were measured
+	Changes []CapacityChange `json:"changes"`           // By shard
+}
+
+// RebalanceStats reports capacity rebalancing in /stats/shards.
+type RebalanceStats struct {
+	IntervalMs  int64               `json:"interval_ms"`
+	MinCapacity int                 `json:"min_capacity"`
+	MaxCapacity int                 `json:"max_capacity"`
+	Damping     float64             `json:"damping"`
+	Rounds      uint64              `json:"rounds"` // Rounds that moved capacity
+	Moved       uint64              `json:"moved"`  // Capacity moved by them in total
+	Recent      []RebalanceDecision `json:"recent"` // Newest first
+}
+
+// ShardStats is one shard in /stats/shards.
+type ShardStats struct {
+	Shard    int     `json:"shard"`
+	Capacity int     `json:"capacity"`
+	Items    int     `json:"items"`
+	Pressure float64 `json:"pressure"` // Evictions per put over the last pressureWindowSeconds
+	FillPct  float64 `json:"fill_pct"` // Items as a percentage of capacity
+}
+
+// FillStats summarises how full the shards are, in percent of their own
+// capacity. A large spread means keys are unevenly distributed.
+type FillStats struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"` // Population standard deviation
+}
+
+// ShardStatsResponse structure for GET /stats/shards replies
+type ShardStatsResponse struct {
+	Status   string       `json:"status"`
+	Capacity int          `json:"capacity"` // Sum over all shards, which rebalancing keeps as it is
+	Shards   []ShardStats `json:"shards"`
+
+	// Only present when capacity rebalancing is enabled.
+	Rebalance *RebalanceStats `json:"rebalance,omitempty"`
+
+	Fill FillStats `json:"fill"` // Over Shards[].FillPct
+}
+
+// fillPct returns items as a percentage of capacity.
+func fillPct(items, capacity int) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return 100 * float64(items) / float64(capacity)
+}
+
+// summariseFill computes the spread of the shards' fill percentages.
+func summariseFill(shards []ShardStats) FillStats {
+	if len(shards) == 0 {
+		return FillStats{}
+	}
+	stats := FillStats{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, s := range shards {
+		stats.Min = min(stats.Min, s.FillPct)
+		stats.Max = max(stats.Max, s.FillPct)
+		stats.Mean += s.FillPct
+	}
+	stats.Mean /= float64(len(shards))
+	var variance float64
+	for _, s := range shards {
+		variance += (s.FillPct - stats.Mean) * (s.FillPct - stats.Mean)
+	}
+	stats.StdDev = math.Sqrt(variance / float64(len(shards)))
+	return stats
+}
+
+// Resize sets the shard's capacity, scaling its pin limit and writer fair
+// share with it, and evicts entries until the shard fits. Pinned entries are
+// not evicted, so a shard holding more of them than the new capacity stays
+// over it until they are unpinned. It returns the number of entries evicted.
+func (c *LRUCache) Resize(capacity int) int {
+	c.mutex.Lock()
+	c.capacity = capacity
+	c.maxPinned = int(c.pinFraction * float64(capacity))
+	if c.fairLimit > 0 {
+		c.fairShare = max(1, int(c.fairLimit*float64(capacity)))
+	}
+	var evicted []*entry
+	for c.lenLocked() > capacity {
+		e := c.evictOne()
+		if e == nil {
+			break // Only pinned entries are left
+		}
+		evicted = append(evicted, e)
+	}
+	c.mutex.Unlock()
+
+	for _, e := range evicted {
+		c.notifyEvict(e, EvictionCapacity)
+	}
+	return len(evicted)
+}
+
+// Rebalancer moves capacity from shards with room to spare to shards that
+// keep evicting, within the cache's fixed total. Each round compares the
+// shards' eviction pressure and occupancy: a shard that evicted during the
+// pressure window asks for capacity in proportion to its pressure, and a
+// shard that did not offers what it does not use, minus some headroom. The
+// smaller of the two totals, scaled by the damping factor, is then moved.
+type Rebalancer struct {
+	cache  *ShardedCache
+	policy RebalancePolicy
+
+	mutex  sync.Mutex
+	rounds uint64
+	moved  uint64
+	recent []RebalanceDecision // Newest first, at most rebalanceHistory
+}
+
+// NewRebalancer creates a rebalancer for cache. The caller checks policy.
+func NewRebalancer(cache *ShardedCache, policy RebalancePolicy) *Rebalancer {
+	return &Rebalancer{cache: cache, policy: policy}
+}
+
+// Start rebalances every interval in the background.
+func (r *Rebalancer) Start() {
+	r.cache.workers.Go("rebalancer", func() {
+		ticks, stop := r.cache.clock.NewTicker(r.policy.Interval)
+		defer stop()
+		for range ticks {
+			r.Run()
+		}
+	})
+	log.Printf("Rebalancing shard capacity every %s (%d to %d entries per shard, damping %.2g)",
+		r.policy.Interval, r.policy.MinCapacity, r.policy.MaxCapacity, r.policy.Damping)
+}
+
+// Run performs one rebalance round and returns what it did, or nil if no
+// capacity was moved. Donors are shrunk before the evicting shards grow, so
+// the total never exceeds the budget on the way.
+func (r *Rebalancer) Run() *RebalanceDecision {
+	shards := r.cache.shards
+	capacities := make([]int, len(shards))
+	spare := make([]int, len(shards))
+	demand := make([]int, len(shards))
+	now := r.cache.now()
+	for i, shard := range shards {
+		shard.mutex.Lock()
+		capacity, items, pressure := shard.capacity, shard.lenLocked(), shard.pressure.ratio(now)
+		shard.mutex.Unlock()
+
+		capacities[i] = capacity
+		if pressure > 0 {
+			demand[i] = max(min(int(math.Ceil(pressure*float64(capacity))), r.policy.MaxCapacity-capacity), 0)
+		} else {
+			keep := max(r.policy.MinCapacity, items+int(math.Ceil(rebalanceHeadroom*float64(items))))
+			spare[i] = max(capacity-keep, 0)
+		}
+	}
+	shift := int(r.policy.Damping * float64(min(sumInts(spare), sumInts(demand))))
+	if shift == 0 {
+		return nil
+	}
+
+	decision := RebalanceDecision{Time: time.Unix(0, now), Moved: shift}
+	take, give := apportion(shift, spare), apportion(shift, demand)
+	for i, n := range take {
+		if n > 0 {
+			decision.Evicted += shards[i].Resize(capacities[i] - n)
+			decision.Changes = append(decision.Changes, CapacityChange{Shard: i, Before: capacities[i], After: capacities[i] - n})
+		}
+	}
+	for i, n := range give {
+		if n > 0 {
+			shards[i].Resize(capacities[i] + n)
+			decision.Changes = append(decision.Changes, CapacityChange{Shard: i, Before: capacities[i], After: capacities[i] + n})
+		}
+	}
+	slices.SortFunc(decision.Changes, func(a, b CapacityChange) int { return cmp.Compare(a.Shard, b.Shard) })
+
+	changes := make([]string, len(decision.Changes))
+	for i, c := range decision.Changes {
+		changes[i] = fmt.Sprintf("%d: %d->%d", c.Shard, c.Before, c.After)
+	}
+	log.Printf("Rebalanced shard capacity, moved %d (%s)", shift, strings.Join(changes, ", "))
+	if decision.Evicted > 0 {
+		log.Printf("Rebalancing evicted %d entries from shards that filled up during the round", decision.Evicted)
+	}
+
+	r.mutex.Lock()
+	r.rounds++
+	r.moved += uint64(shift)
+	r.recent = slices.Insert(r.recent, 0, decision)
+	if len(r.recent) > rebalanceHistory {
+		r.recent = r.recent[:rebalanceHistory]
+	}
+	r.mutex.Unlock()
+	return &decision
+}
+
+// Stats returns a copy of the rebalancing stats.
+func (r *Rebalancer) Stats() *RebalanceStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &RebalanceStats{
+		IntervalMs:  r.policy.Interval.Milliseconds(),
+		MinCapacity: r.policy.MinCapacity,
+		MaxCapacity: r.policy.MaxCapacity,
+		Damping:     r.policy.Damping,
+		Rounds:      r.rounds,
+		Moved:       r.moved,
+		Recent:      append([]RebalanceDecision{}, r.recent...),
+	}
+}
+
+// apportion splits total into whole shares proportional to weights, whose
+// sum must be at least total; no share exceeds its weight. What rounding
+// down leaves over goes to the largest weights, one each.
+func apportion(total int, weights []int) []int {
+	sum := sumInts(weights)
+	shares := make([]int, len(weights))
+	given := 0
+	for i, w := range weights {
+		shares[i] = total * w / sum
+		given += shares[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return cmp.Compare(weights[b], weights[a]) })
+	for _, i := range order {
+		if given == total {
+			break
+		}
+		if shares[i] < weights[i] {
+			shares[i]++
+			given++
+		}
+	}
+	return shares
+}
+
+func sumInts(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// HandleShardStats handles GET /stats/shards: the capacity, size, fill and
+// eviction pressure of every shard, the spread of fill across them, and with
+// rebalancing enabled its recent decisions. Each shard is locked only while
+// it is read, so the figures of different shards come from slightly
+// different moments.
+func HandleShardStats(cache *ShardedCache, rebalancer *Rebalancer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := cache.now()
+		resp := ShardStatsResponse{Status: "OK", Shards: make([]ShardStats, len(cache.shards))}
+		for i, shard := range cache.shards {
+			shard.mutex.Lock()
+			resp.Shards[i] = ShardStats{Shard: i, Capacity: shard.capacity, Items: shard.lenLocked(), Pressure: shard.pressure.ratio(now)}
+			shard.mutex.Unlock()
+			resp.Shards[i].FillPct = fillPct(resp.Shards[i].Items, resp.Shards[i].Capacity)
+			resp.Capacity += resp.Shards[i].Capacity
+		}
+		resp.Fill = summariseFill(resp.Shards)
+		if rebalancer != nil {
+			resp.Rebalance = rebalancer.Stats()
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// totalCapacity sums the capacity of cache's shards.
+func totalCapacity(cache *ShardedCache) int {
+	total := 0
+	for _, shard := range cache.shards {
+		shard.mutex.Lock()
+		total += shard.capacity
+		shard.mutex.Unlock()
+	}
+	return total
+}
+
+// TestRebalancingRelievesTheHotShard cycles more keys than a shard holds
+// through shard 0, and a few keys through each other shard, then rebalances
+// after every window of that workload.
+func TestRebalancingRelievesTheHotShard(t *testing.T) {
+	const perShard = 100
+	cache, clock := newFakeClockCache(4, perShard)
+	hot, cold := []string{}, []string{}
+	for i := 0; len(hot) < 150 || len(cold) < 60; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if cache.getShardIndex(key) == 0 {
+			if len(hot) < 150 {
+				hot = append(hot, key)
+			}
+		} else if len(cold) < 60 {
+			cold = append(cold, key)
+		}
+	}
+	// evictionRate replays the workload twice, so the shards are warm, and
+	// returns the hot shard's evictions per put during the second pass.
+	evictionRate := func() float64 {
+		evictions := 0
+		for pass := range 2 {
+			for _, key := range cold {
+				cache.PutWithOptions(key, "v", PutOptions{})
+			}
+			for _, key := range hot {
+				if cache.PutWithOptions(key, "v", PutOptions{}).Evicted && pass == 1 {
+					evictions++
+				}
+			}
+		}
+		return float64(evictions) / float64(len(hot))
+	}
+
+	rebalancer := NewRebalancer(cache, RebalancePolicy{Interval: time.Minute, MinCapacity: 10, MaxCapacity: 400, Damping: 0.5})
+	before := evictionRate()
+	if before < 0.9 {
+		t.Fatalf("hot shard evicts %.2f per put before rebalancing, want it thrashing", before)
+	}
+	rate := before
+	for round := 0; round < 5 && rate > 0; round++ {
+		if decision := rebalancer.Run(); decision == nil {
+			t.Fatalf("round %d moved nothing at eviction rate %.2f", round, rate)
+		}
+		if got := totalCapacity(cache); got != 4*perShard {
+			t.Fatalf("round %d: total capacity %d, want %d", round, got, 4*perShard)
+		}
+		clock.Advance(pressureWindowSeconds * time.Second) // Measure the new allocation only
+		rate = evictionRate()
+	}
+	if rate >= before/2 {
+		t.Errorf("hot shard evicts %.2f per put after rebalancing, %.2f before", rate, before)
+	}
+	for i, shard := range cache.shards {
+		if shard.capacity < 10 || shard.capacity > 400 {
+			t.Errorf("shard %d has capacity %d, outside the policy's bounds", i, shard.capacity)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	HandleShardStats(cache, rebalancer)(rec, httptest.NewRequest(http.MethodGet, "/stats/shards", nil))
+	var stats ShardStatsResponse
+	json.Unmarshal(rec.Body.Bytes(), &stats)
+	if stats.Capacity != 4*perShard || stats.Rebalance == nil || stats.Rebalance.Rounds == 0 || len(stats.Rebalance.Recent) == 0 {
+		t.Fatalf("/stats/shards: %s", rec.Body)
+	}
+	latest := stats.Rebalance.Recent[0]
+	for _, change := range latest.Changes {
+		if change.Shard == 0 && change.After <= change.Before {
+			t.Errorf("latest decision shrank the hot shard: %+v", latest)
+		}
+	}
+}
+
+func TestRebalancerLeavesBalancedShardsAlone(t *testing.T) {
+	cache, _ := newFakeClockCache(4, 100)
+	for _, key := range bulkKeys(200) {
+		cache.Put(key, "v")
+	}
+	rebalancer := NewRebalancer(cache, RebalancePolicy{Interval: time.Minute, MinCapacity: 10, MaxCapacity: 400, Damping: 0.5})
+	if decision := rebalancer.Run(); decision != nil {
+		t.Errorf("moved capacity without any evictions: %+v", decision)
+	}
+	if got := totalCapacity(cache); got != 400 {
+		t.Errorf("total capacity %d, want 400", got)
+	}
+}
+
+func TestApportion(t *testing.T) {
+	for _, tc := range []struct {
+		total   int
+		weights []int
+	}{
+		{10, []int{5, 5}},
+		{7, []int{3, 3, 3}},
+		{1, []int{0, 4, 1}},
+		{9, []int{2, 7}},
+	} {
+		shares := apportion(tc.total, tc.weights)
+		if sumInts(shares) != tc.total {
+			t.Errorf("apportion(%d, %v) = %v, does not add up", tc.total, tc.weights, shares)
+		}
+		for i, share := range shares {
+			if share > tc.weights[i] {
+				t.Errorf("apportion(%d, %v) = %v, share %d over its weight", tc.total, tc.weights, shares, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// refreshQueueSize bounds how many refreshes can wait for a worker.
+const refreshQueueSize = 1024
+
+// RefreshSource records where an entry filled by /fetch came from, so it can
+// be re-fetched before it expires. It is immutable once stored.
+type RefreshSource struct {
+	Origin   *url.URL
+	TTL      time.Duration // TTL applied to each refreshed value
+	StaleFor time.Duration // Stale window applied to each refreshed value
+	Timeout  time.Duration // Origin request timeout
+	Ahead    bool          // Also refresh on reads late in the TTL, not only stale reads
+}
+
+// RefreshStats structure for the refresh-ahead section of /stats
+type RefreshStats struct {
+	Performed uint64 `json:"performed"`
+	Skipped   uint64 `json:"skipped"` // Already pending or queue full
+	Failed    uint64 `json:"failed"`  // Origin error; the old value expires normally
+}
+
+// refreshJob is one queued refresh.
+type refreshJob struct {
+	key string
+	src *RefreshSource
+}
+
+// Refresher re-fetches entries that are read close to their expiry, using a
+// bounded queue and a fixed number of workers, with at most one refresh per
+// key in flight. Keys that are not read during the last part of their TTL are
+// never refreshed, so cold data is simply left to expire.
+type Refresher struct {
+	fetcher *Fetcher
+	queue   chan refreshJob
+
+	mutex   sync.Mutex
+	pending map[string]bool
+
+	performed atomic.Uint64
+	skipped   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewRefresher starts workers goroutines refreshing through fetcher.
+func NewRefresher(fetcher *Fetcher, workers int) *Refresher {
+	r := &Refresher{
+		fetcher: fetcher,
+		queue:   make(chan refreshJob, refreshQueueSize),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		fetcher.cache.workers.Go(fmt.Sprintf("refresh-ahead/%d", i), r.work)
+	}
+	return r
+}
+
+// Schedule queues a refresh of key unless one is already pending. It never
+// blocks the reader that triggered it.
+func (r *Refresher) Schedule(key string, src *RefreshSource) {
+	r.mutex.Lock()
+	if r.pending[key] {
+		r.mutex.Unlock()
+		r.skipped.Add(1)
+		return
+	}
+	r.pending[key] = true
+	r.mutex.Unlock()
+
+	select {
+	case r.queue <- refreshJob{key: key, src: src}:
+	default:
+		r.done(key)
+		r.skipped.Add(1)
+	}
+}
+
+func (r *Refresher) done(key string) {
+	r.mutex.Lock()
+	delete(r.pending, key)
+	r.mutex.Unlock()
+}
+
+func (r *Refresher) work() {
+	for job := range r.queue {
+		r.refresh(job)
+	}
+}
+
+// refresh performs one job. The key is released even if the job panics, so
+// that it can be scheduled again once the worker restarts.
+func (r *Refresher) refresh(job refreshJob) {
+	defer r.done(job.key)
+	value, err := r.fetcher.fetchOrigin(job.src.Origin, job.src.Timeout)
+	var transforms []string
+	if err == nil {
+		value, transforms, err = r.fetcher.transforms.Apply(job.key, value)
+	}
+	if err != nil {
+		r.failed.Add(1)
+		log.Printf("Refresh-ahead of %q failed: %v", job.key, err)
+		return
+	}
+	r.fetcher.cache.PutWithOptions(job.key, value, PutOptions{TTL: job.src.TTL, StaleFor: job.src.StaleFor, Refresh: job.src, Transforms: transforms})
+	r.performed.Add(1)
+}
+
+// Stats returns the refresh counters.
+func (r *Refresher) Stats() *RefreshStats {
+	return &RefreshStats{
+		Performed: r.performed.Load(),
+		Skipped:   r.skipped.Load(),
+		Failed:    r.failed.Load(),
+	}
+}
+
+// OnRefreshDue makes reads within the last fraction of an entry's TTL hand
+// entries that have a RefreshSource to fn. Must be called before the cache
+// starts serving requests.
+func (sc *ShardedCache) OnRefreshDue(fraction float64, fn func(key string, src *RefreshSource)) {
+	for _, shard := range sc.shards {
+		shard.refreshFraction = fraction
+		shard.onRefreshDue = fn
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staleEntryCache returns a cache holding key, filled from an origin that
+// holds each request until release is closed, past its 10s TTL and within
+// its 30s stale window.
+func staleEntryCache(t *testing.T, key string) (cache *ShardedCache, hits *atomic.Int32, release chan struct{}) {
+	t.Helper()
+	hits, release = new(atomic.Int32), make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Write([]byte("fresh"))
+	}))
+	t.Cleanup(origin.Close)
+	u, _ := url.Parse(origin.URL)
+
+	cache, clock := newFakeClockCache(4, 100)
+	fetcher := NewFetcher(cache, []string{u.Host}, nil)
+	cache.OnRefreshDue(0.2, NewRefresher(fetcher, 4).Schedule)
+	src := &RefreshSource{Origin: u, TTL: 10 * time.Second, StaleFor: 30 * time.Second, Timeout: 5 * time.Second}
+	cache.PutWithOptions(key, "old", PutOptions{TTL: src.TTL, StaleFor: src.StaleFor, Refresh: src})
+	clock.Advance(15 * time.Second)
+	return cache, hits, release
+}
+
+// getItem looks key up like a GET without stale=allow.
+func getItem(cache *ShardedCache, key string) (Item, bool) {
+	item, found, _ := cache.GetCtx(context.Background(), key, false)
+	return item, found
+}
+
+func TestStaleReadsRefreshOnce(t *testing.T) {
+	cache, hits, release := staleEntryCache(t, "report")
+
+	var wg sync.WaitGroup
+	var stale atomic.Int32
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, found, err := cache.GetCtx(context.Background(), "report", false)
+			if err == nil && found && item.Stale && item.Value == "old" {
+				stale.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := stale.Load(); n != 64 {
+		t.Errorf("%d of 64 concurrent reads got the stale value", n)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if item, _ := getItem(cache, "report"); item.Value == "fresh" && !item.Stale {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if item, _ := getItem(cache, "report"); item.Value != "fresh" || item.Stale {
+		t.Fatalf("after the refresh: %+v", item)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("origin fetched %d times, want once", n)
+	}
+}
+
+func TestStaleWindowEnds(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.PutWithOptions("k", "v", PutOptions{TTL: 10 * time.Second, StaleFor: 30 * time.Second})
+
+	clock.Advance(39 * time.Second)
+	rec, _ := doGet(t, cache, "key=k")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("within the window: status %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	clock.Advance(time.Second)
+	if rec, _ := doGet(t, cache, "key=k"); rec.Code != http.StatusNotFound {
+		t.Errorf("past the window: status %d, want a miss", rec.Code)
+	}
+	if n := cache.Len(); n != 0 {
+		t.Errorf("%d entries left after the window", n)
+	}
+}
+
+func TestStaleAllowUsesTheCacheWindow(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.SetStaleWindow(time.Minute)
+	cache.PutWithOptions("k", "v", PutOptions{TTL: 10 * time.Second})
+	clock.Advance(30 * time.Second)
+
+	// A reader that does not accept stale values misses, but must not take
+	// the value away from one that does.
+	if rec, _ := doGet(t, cache, "key=k"); rec.Code != http.StatusNotFound {
+		t.Errorf("without stale=allow: status %d, want a miss", rec.Code)
+	}
+	rec, resp := doGet(t, cache, "key=k&stale=allow")
+	if rec.Code != http.StatusOK || resp.Value != "v" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("with stale=allow: status %d, value %q, X-Cache %q", rec.Code, resp.Value, rec.Header().Get("X-Cache"))
+	}
+	if rec, _ := doGet(t, cache, "key=k&stale=maybe"); rec.Code != http.StatusBadRequest {
+		t.Errorf("stale=maybe: status %d, want 400", rec.Code)
+	}
+}
+
+func TestSweepersKeepStaleEntries(t *testing.T) {
+	cache, clock := newFakeClockCache(1, 10)
+	cache.SetMaxEntryAge(time.Hour)
+	cache.PutWithOptions("k", "v", PutOptions{TTL: 10 * time.Second, StaleFor: 30 * time.Second})
+	clock.Advance(20 * time.Second)
+
+	if n := cache.EnforceMaxAge(); n != 0 {
+		t.Errorf("the max-age sweep removed %d entries within their stale window", n)
+	}
+	if item, found := getItem(cache, "k"); !found || !item.Stale {
+		t.Errorf("GetItem = %+v, %v, want the stale value", item, found)
+	}
+}
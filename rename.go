@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RenameRequest structure for POST /rename bodies
+type RenameRequest struct {
+	OldKey string `json:"old_key"`
+	NewKey string `json:"new_key"`
+}
+
+// Rename moves the entry stored under oldKey to newKey, replacing any value
+// newKey already had, and reports whether oldKey was present. The entry keeps
+// its value, timestamps, cost and expiry, and becomes the most recently used
+// entry of its new shard (which may evict another entry if that shard is full).
+// A value newKey already had is reported as deleted. It fails with ErrNotFound
+// if oldKey is absent, with ErrEntryForbidden if either key holds a live entry
+// whose read ACL reader (see requestReader) is not on, and with ErrImmutable
+// if either key holds an immutable entry.
+//
+// When the keys live on different shards both locks are taken, lower shard
+// index first, so concurrent renames cannot deadlock and readers see the entry
+// under exactly one of the two keys at any moment.
+func (sc *ShardedCache) Rename(oldKey, newKey, reader string) error {
+	if !sc.directory.mayContain(oldKey) {
+		return fmt.Errorf("%w: %s", ErrNotFound, oldKey) // Definitely absent, no need to lock anything
+	}
+	srcIndex, dstIndex := sc.getShardIndex(oldKey), sc.getShardIndex(newKey)
+	src, dst := sc.shards[srcIndex], sc.shards[dstIndex]
+
+	switch {
+	case srcIndex == dstIndex:
+		src.mutex.Lock()
+	case srcIndex < dstIndex:
+		src.mutex.Lock()
+		dst.mutex.Lock()
+	default:
+		dst.mutex.Lock()
+		src.mutex.Lock()
+	}
+
+	var moved, evicted, expired, replaced *entry
+	var item Item // Copied under the lock; moved may be rewritten once it is released
+	var refused, denied string
+	replacedReason := EvictionExpired // Unless newKey held a live entry
+	now := sc.now()
+	if elem, hit := src.lookupLocked(oldKey); hit {
+		ent := elem.Value.(*entry)
+		var target *entry // Live entry under newKey, if any
+		if existing, taken := dst.lookupLocked(newKey); taken && oldKey != newKey && dst.live(existing.Value.(*entry), now) {
+			target = existing.Value.(*entry)
+		}
+		switch {
+		case !src.live(ent, now):
+			expired = src.removeElement(elem)
+		case !readableBy(ent.readers, reader):
+			denied = oldKey
+		case oldKey == newKey:
+			moved = ent
+		case target != nil && !readableBy(target.readers, reader):
+			denied = newKey
+		case ent.immutable:
+			refused = oldKey
+		case target != nil && target.immutable:
+			refused = newKey
+		default:
+			src.removeElement(elem)
+			if existing, taken := dst.lookupLocked(newKey); taken {
+				replaced = dst.removeElement(existing)
+				if target != nil {
+					replacedReason = EvictionDeleted
+				}
+			} else if dst.lenLocked() >= dst.capacity {
+				evicted = dst.evictOne()
+			}
+			ent.key = newKey
+			dst.insertFront(ent)
+			moved, item = ent, ent.item()
+		}
+	}
+
+	src.mutex.Unlock()
+	if srcIndex != dstIndex {
+		dst.mutex.Unlock()
+	}
+
+	if expired != nil {
+		src.notifyEvict(expired, EvictionExpired)
+	}
+	if evicted != nil {
+		dst.notifyEvict(evicted, EvictionCapacity)
+	}
+	if replaced != nil {
+		dst.notifyEvict(replaced, replacedReason)
+	}
+	if moved != nil && oldKey != newKey {
+		src.notifyEvict(&entry{key: oldKey, value: item.Value}, EvictionRenamed)
+		sc.waiters.wake(newKey, item)
+	}
+	switch {
+	case denied != "":
+		return forbidden(denied)
+	case refused != "":
+		return fmt.Errorf("%w: %s", ErrImmutable, refused)
+	case moved == nil:
+		return fmt.Errorf("%w: %s", ErrNotFound, oldKey)
+	}
+	return nil
+}
+
+func HandleRename(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RenameRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+
+		oldKey, newKey := cache.trimKey(req.OldKey), cache.trimKey(req.NewKey)
+		for _, key := range []string{oldKey, newKey} {
+			if msg := validateKey(key); msg != "" {
+				writeJSONError(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := cache.Rename(oldKey, newKey, requestReader(r)); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(PutSuccessResponse{
+			Status:  "OK",
+			Message: "Key renamed successfully.",
+		})
+	}
+}
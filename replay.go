@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// replayEntryOverhead estimates the memory an entry costs besides its key and
+// value: the entry itself, its list element and its slot in the shard map.
+const replayEntryOverhead = int(unsafe.Sizeof(entry{})) + int(unsafe.Sizeof(list.Element{})) +
+	int(unsafe.Sizeof("")) + int(unsafe.Sizeof((*list.Element)(nil)))
+
+// replayReport sums up a replay.
+type replayReport struct {
+	gets, hits, puts, deletes int
+	evictions                 uint64
+	entries                   int
+	residentBytes             int // Estimated from the recorded key and value sizes
+	duration                  time.Duration
+}
+
+func (r replayReport) print(w io.Writer) {
+	ratio := 0.0
+	if r.gets > 0 {
+		ratio = float64(r.hits) / float64(r.gets)
+	}
+	fmt.Fprintf(w, "replay: %d gets, %d hits (hit ratio %.4f), %d puts, %d deletes in %v\n",
+		r.gets, r.hits, ratio, r.puts, r.deletes, r.duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "replay: %d capacity evictions, %d entries resident, ~%d bytes\n",
+		r.evictions, r.entries, r.residentBytes)
+}
+
+// runReplay implements `kvcache replay`: it feeds a trace recorded with
+// -trace-path into a fresh in-process cache of the given shape and reports
+// the hit ratio, evictions and estimated resident memory. Keys are replayed
+// as their hashes and values as filler of the recorded size, so a trace can
+// be replayed against several configurations to compare them before one is
+// deployed.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	tracePath := fs.String("trace", "", "Trace file recorded with -trace-path")
+	shards := fs.Int("shards", NumShards, "Cache shards")
+	capacity := fs.Int("capacity", MaxCapacityPerShard, "Entries per shard")
+	eviction := fs.String("eviction", EvictionPolicyLRU, "Eviction policy: lru or cost-aware")
+	candidates := fs.Int("candidates", 8, "Least recently used entries cost-aware eviction chooses from")
+	realtime := fs.Bool("realtime", false, "Keep the recorded timing between operations instead of replaying as fast as possible")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *tracePath == "" || *shards <= 0 || *capacity <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: kvcache replay --trace FILE [--shards 64] [--capacity 4096] [--eviction lru|cost-aware] [--candidates 8] [--realtime]")
+		return 2
+	}
+
+	f, err := os.Open(*tracePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	tr, err := newTraceReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s: %v\n", *tracePath, err)
+		return 1
+	}
+
+	cache := NewShardedCache(*shards, *capacity, false)
+	if err := cache.SetEvictionPolicy(*eviction, *candidates); err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 2
+	}
+	var evictions atomic.Uint64
+	cache.OnEvict(func(_, _ string, reason EvictionReason) {
+		if reason == EvictionCapacity {
+			evictions.Add(1)
+		}
+	})
+
+	var (
+		report  replayReport
+		filler  string
+		keyLens = make(map[string]int) // Recorded length of each replayed key
+	)
+	start := time.Now()
+	for {
+		rec, err := tr.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %s: %v\n", *tracePath, err)
+			return 1
+		}
+		if *realtime {
+			time.Sleep(time.Until(start.Add(time.Duration(rec.at - tr.start))))
+		}
+		key := strconv.FormatUint(rec.keyHash, 16)
+		switch rec.op {
+		case traceGet:
+			report.gets++
+			if _, found := cache.Get(key); found {
+				report.hits++
+			}
+		case tracePut:
+			report.puts++
+			if len(filler) < rec.size {
+				filler = strings.Repeat("x", rec.size)
+			}
+			keyLens[key] = rec.keyLen
+			cache.PutWithOptions(key, filler[:rec.size], PutOptions{Cost: rec.cost})
+		case traceDelete:
+			report.deletes++
+			cache.Delete(key)
+		}
+	}
+	report.duration = time.Since(start)
+	report.evictions = evictions.Load()
+	for _, entries := range cache.entriesPerShard() {
+		for _, e := range entries {
+			report.entries++
+			report.residentBytes += keyLens[e.key] + len(e.value) + replayEntryOverhead
+		}
+	}
+
+	fmt.Printf("replay: %s into %d shards of %d, %s eviction\n", *tracePath, *shards, *capacity, cache.EvictionPolicy())
+	report.print(os.Stdout)
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreReportsProgress(t *testing.T) {
+	_, path := writeTestSnapshot(t, 4, 200)
+	cache := NewShardedCache(4, 200, false)
+	drainer := NewDrainer(cache, time.Second, nil)
+	drainer.restored.Store(7) // Left over from an earlier restore
+
+	drainer.BeginRestore()
+	if got := drainer.RestoreProgress(); got != 0 {
+		t.Fatalf("progress at the start of a restore = %d, want 0", got)
+	}
+	stats, err := importRedisFile(cache, path, &drainer.restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drainer.RestoreProgress(); got != int64(stats.Imported) || got != 200 {
+		t.Errorf("progress after loading %d entries = %d, want 200", stats.Imported, got)
+	}
+	drainer.EndRestore()
+	if drainer.Restoring() {
+		t.Error("still restoring after EndRestore")
+	}
+
+	stats, err = NewRestorer(cache, drainer, path).Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drainer.RestoreProgress(); got != int64(stats.Imported) {
+		t.Errorf("progress after /admin/restore = %d, want %d", got, stats.Imported)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseSchemaVersion identifies the shape of the JSON response bodies and
+// is sent in every reply as X-KVCache-Schema-Version. Bump it whenever a
+// body gains, loses or reorders a field; new fields go at the end of their
+// struct, and are listed in schemaAdditions so ?schema= can hide them from
+// older clients. `kvcache schema --check response-schema.txt` fails when the
+// shapes no longer match the file while the version is unchanged.
+const responseSchemaVersion = 16
+
+const schemaHeader = "X-KVCache-Schema-Version"
+
+// schemaAddition is an optional field that appeared in a schema version.
+type schemaAddition struct {
+	Version int    // First version with the field
+	Path    string // Request path the field is returned by, such as "/put"
+	Field   string // JSON name, dotted for fields of nested objects
+}
+
+// schemaAdditions lists the fields added since version 1, which hides them
+// from clients asking for an older schema. Version 1 is the shape of every
+// body when versioning was introduced.
+var schemaAdditions = []schemaAddition{
+	{Version: 2, Path: "/stats", Field: "workers"},
+	{Version: 3, Path: "/put", Field: "ttl_rule"},
+	{Version: 5, Path: "/admin/ttl-report", Field: "oldest_age_ms"},
+	{Version: 5, Path: "/admin/ttl-report", Field: "max_entry_age_ms"},
+	{Version: 5, Path: "/admin/ttl-report", Field: "over_max_age"},
+	{Version: 6, Path: "/put", Field: "unchanged"},
+	{Version: 6, Path: "/stats", Field: "unchanged_puts"},
+	{Version: 7, Path: "/put", Field: "transforms"},
+	{Version: 7, Path: "/get", Field: "transforms"},
+	{Version: 9, Path: "/put", Field: "generation"},
+	{Version: 9, Path: "/stats", Field: "generation"},
+	{Version: 10, Path: "/get", Field: "acl"},
+	{Version: 10, Path: "/get/bulk", Field: "forbidden"},
+	{Version: 10, Path: "/get/bulk", Field: "results.forbidden"},
+	{Version: 13, Path: "/stats/shards", Field: "shards.fill_pct"},
+	{Version: 13, Path: "/stats/shards", Field: "fill"},
+	{Version: 15, Path: "/claim", Field: "forbidden"},
+	{Version: 16, Path: "/release", Field: "forbidden"},
+}
+
+// schemaTypes are the JSON response bodies covered by the schema version.
+var schemaTypes = []any{
+	GenericErrorResponse{},
+	OversizedErrorResponse{},
+	PutSuccessResponse{},
+	GetSuccessResponse{},
+	StatsResponse{},
+	AddBulkResponse{},
+	BulkDeleteResponse{},
+	RejectionsResponse{},
+	AlertsResponse{},
+	CaptureResponse{},
+	ClaimResponse{},
+	ReleaseResponse{},
+	DigestResponse{},
+	ExistsResponse{},
+	DrainStatusResponse{},
+	EvictionLogResponse{},
+	ErrorStatsResponse{},
+	FetchResponse{},
+	FlushResponse{},
+	GenerationResponse{},
+	GetBulkResponse{},
+	GetBulkListResponse{},
+	GetFallbackResponse{},
+	HealthScoreResponse{},
+	HotKeysResponse{},
+	ImportResponse{},
+	StreamImportResponse{},
+	LockResponse{},
+	MaintenanceResponse{},
+	MergeResponse{},
+	MissesResponse{},
+	PinResponse{},
+	DeleteResponse{},
+	ShardMapResponse{},
+	ShardStatsResponse{},
+	SimulateResponse{},
+	SearchResponse{},
+	TTLReportResponse{},
+}
+
+// schemaFieldsAfter returns the fields of replies to path that were added
+// after version.
+func schemaFieldsAfter(version int, path string) []string {
+	var fields []string
+	for _, a := range schemaAdditions {
+		if a.Version > version && a.Path == path {
+			fields = append(fields, a.Field)
+		}
+	}
+	return fields
+}
+
+// schemaRecorder holds back a reply so fields can be removed from it.
+type schemaRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (s *schemaRecorder) WriteHeader(status int) { s.status = status }
+
+func (s *schemaRecorder) Write(p []byte) (int, error) { return s.body.Write(p) }
+
+// withSchema sets X-KVCache-Schema-Version on every reply. A ?schema=N
+// query parameter asks for an older version, whose JSON replies leave out
+// the fields added since; the header then names the version served.
+func withSchema(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := responseSchemaVersion
+		if raw := r.URL.Query().Get("schema"); raw != "" {
+			v, err := strconv.Atoi(raw)
+			if err != nil || v < 1 || v > responseSchemaVersion {
+				w.Header().Set(schemaHeader, strconv.Itoa(responseSchemaVersion))
+				writeJSONError(w, fmt.Sprintf("Unsupported schema version '%s'; this server serves 1 to %d.", raw, responseSchemaVersion), http.StatusBadRequest)
+				return
+			}
+			version = v
+		}
+		w.Header().Set(schemaHeader, strconv.Itoa(version))
+		fields := schemaFieldsAfter(version, r.URL.Path)
+		if len(fields) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &schemaRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		body := rec.body.Bytes()
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			if trimmed, err := dropJSONFields(body, fields); err == nil {
+				body = append(trimmed, '\n')
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	})
+}
+
+// dropJSONFields removes fields from the JSON document raw, keeping the
+// order of the rest. Dotted fields name fields of nested objects; fields of
+// an array apply to each of its elements.
+func dropJSONFields(raw []byte, fields []string) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			trimmed, err := dropJSONFields(items[i], fields)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = trimmed
+		}
+		return json.Marshal(items)
+	}
+	if len(raw) == 0 || raw[0] != '{' {
+		return raw, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		var nested []string
+		drop := false
+		for _, f := range fields {
+			if f == key {
+				drop = true
+			} else if rest, ok := strings.CutPrefix(f, key+"."); ok {
+				nested = append(nested, rest)
+			}
+		}
+		if drop {
+			continue
+		}
+		if len(nested) > 0 {
+			if value, err = dropJSONFields(value, nested); err != nil {
+				return nil, err
+			}
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// describeSchema lists every field of the schemaTypes in the order they are
+// encoded, one per line, after the schema version.
+func describeSchema() []string {
+	lines := []string{fmt.Sprintf("version %d", responseSchemaVersion)}
+	for _, v := range schemaTypes {
+		t := reflect.TypeOf(v)
+		lines = describeSchemaType(lines, t.Name(), t, nil)
+	}
+	return lines
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// describeSchemaType appends the fields of t, named prefix, to lines. seen
+// holds the struct types being described, so recursive types end.
+func describeSchemaType(lines []string, prefix string, t reflect.Type, seen []reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType || t.Implements(reflect.TypeFor[json.Marshaler]()):
+		return append(lines, prefix+" "+t.String())
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8:
+		return describeSchemaType(lines, prefix+"[]", t.Elem(), seen)
+	case t.Kind() == reflect.Map:
+		return describeSchemaType(lines, prefix+"{}", t.Elem(), seen)
+	case t.Kind() != reflect.Struct:
+		return append(lines, prefix+" "+t.Kind().String())
+	case slices.Contains(seen, t):
+		return append(lines, prefix+" "+t.Name())
+	}
+	seen = append(seen, t)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			lines = describeSchemaType(lines, prefix, f.Type, seen)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if opts != "" {
+			name += "," + opts
+		}
+		lines = describeSchemaType(lines, prefix+"."+name, f.Type, seen)
+	}
+	return lines
+}
+
+// runSchema implements `kvcache schema`: it prints the response shapes, or
+// with --check compares them with a file printed earlier and exits with 1
+// when they differ. A difference under the same version means a body shape
+// changed without a bump of responseSchemaVersion.
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	check := fs.String("check", "", "File holding the expected output")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	current := describeSchema()
+	if *check == "" {
+		for _, line := range current {
+			fmt.Println(line)
+		}
+		return 0
+	}
+
+	expected, err := readSchemaFile(*check)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if slices.Equal(current, expected) {
+		fmt.Printf("schema: response shapes match %s (version %d)\n", *check, responseSchemaVersion)
+		return 0
+	}
+	for _, line := range diffSchema(expected, current) {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	if len(expected) > 0 && expected[0] == current[0] {
+		fmt.Fprintf(os.Stderr, "schema: response shapes changed but the version is still %d; bump responseSchemaVersion, list new fields in schemaAdditions and regenerate %s\n",
+			responseSchemaVersion, *check)
+	} else {
+		fmt.Fprintf(os.Stderr, "schema: %s is out of date; regenerate it with `kvcache schema`\n", *check)
+	}
+	return 1
+}
+
+// readSchemaFile reads the non-blank lines of a file written by
+// `kvcache schema`.
+func readSchemaFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// diffSchema lists the lines of expected missing from current, marked "- ",
+// then the lines of current missing from expected, marked "+ ".
+func diffSchema(expected, current []string) []string {
+	var diff []string
+	for _, line := range expected {
+		if !slices.Contains(current, line) {
+			diff = append(diff, "- "+line)
+		}
+	}
+	for _, line := range current {
+		if !slices.Contains(expected, line) {
+			diff = append(diff, "+ "+line)
+		}
+	}
+	return diff
+}
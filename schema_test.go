@@ -0,0 +1,24 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResponseSchemaMatchesTheFile(t *testing.T) {
+	expected, err := readSchemaFile("response-schema.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := describeSchema()
+	if slices.Equal(current, expected) {
+		return
+	}
+	diff := diffSchema(expected, current)
+	if len(diff) == 0 {
+		diff = []string{"(the same fields, in another order)"}
+	}
+	t.Errorf("response shapes differ from response-schema.txt; bump responseSchemaVersion if needed and regenerate it with `go run . schema > response-schema.txt`:\n%s",
+		strings.Join(diff, "\n"))
+}
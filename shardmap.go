@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxShardMapKeys bounds how many keys one POST /shard-map may look up.
+const maxShardMapKeys = 1000
+
+// ShardMapRequest structure for POST /shard-map bodies
+type ShardMapRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// KeyShard is the shard one key is routed to.
+type KeyShard struct {
+	Key   string `json:"key"`
+	Shard int    `json:"shard"`
+}
+
+// ShardMapResponse structure for POST /shard-map replies
+type ShardMapResponse struct {
+	Status string     `json:"status"`
+	Shards int        `json:"shards"` // Number of shards in the cache
+	Hash   string     `json:"hash"`   // Shard hash in use (see -shard-hash)
+	Keys   []KeyShard `json:"keys"`   // In request order
+}
+
+// HandleShardMap handles POST /shard-map: report the shard each key is routed
+// to, without touching the cache, so clients can group bulk requests by
+// shard. Indexes are only stable while the shard count and hash stay the same.
+func HandleShardMap(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ShardMapRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) == 0 {
+			writeJSONError(w, "Keys cannot be empty.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) > maxShardMapKeys {
+			writeJSONError(w, fmt.Sprintf("At most %d keys may be mapped at once.", maxShardMapKeys), http.StatusBadRequest)
+			return
+		}
+		resp := ShardMapResponse{
+			Status: "OK",
+			Shards: len(cache.shards),
+			Hash:   cache.ShardHash(),
+			Keys:   make([]KeyShard, len(req.Keys)),
+		}
+		for i, key := range req.Keys {
+			key = cache.trimKey(key)
+			if msg := validateKey(key); msg != "" {
+				writeJSONError(w, msg, http.StatusBadRequest)
+				return
+			}
+			resp.Keys[i] = KeyShard{Key: key, Shard: cache.getShardIndex(key)}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
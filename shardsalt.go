@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"log"
+)
+
+// shardSaltSize is the length of the random salt generated by newShardSalt.
+const shardSaltSize = 16
+
+// newShardSalt returns a random salt for SetShardSalt.
+func newShardSalt() ([]byte, error) {
+	salt := make([]byte, shardSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// SetShardSalt mixes salt into every key before it is hashed to pick a
+// shard, so that clients who know the hash cannot craft keys that all land
+// on one shard. Placement then differs between caches with different salts,
+// so it must be called before the cache holds any keys, and the salt must
+// stay the same for the cache's lifetime.
+func (sc *ShardedCache) SetShardSalt(salt []byte) {
+	sc.salt = salt
+	log.Printf("Sharding keys by a salted hash, %s", sc.ShardHash())
+}
+
+// shardSaltID identifies salt in logs, snapshot headers and /shard-map
+// without revealing it.
+func shardSaltID(salt []byte) string {
+	sum := sha256.Sum256(salt)
+	return hex.EncodeToString(sum[:4])
+}
+
+// saltedKeyHash hashes salt followed by key with fnv64a or fnv32a, then
+// mixes the sum. Without the final mix the low bits a shard index is taken
+// from would only depend on the low bits of the salted state, leaving as few
+// distinct placements as there are shards.
+func saltedKeyHash(key string, hash64 bool, salt []byte) uint64 {
+	var h uint64
+	if hash64 {
+		hasher := fnv.New64a()
+		hasher.Write(salt)
+		hasher.Write([]byte(key))
+		h = hasher.Sum64()
+	} else {
+		hasher := fnv.New32a()
+		hasher.Write(salt)
+		hasher.Write([]byte(key))
+		h = uint64(hasher.Sum32())
+	}
+	// Finalizer of MurmurHash3: every input bit affects every output bit.
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
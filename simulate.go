@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+const (
+	maxSimulateShards     = 65536
+	maxSimulateSampleKeys = 100000
+)
+
+// SimulateRequest structure for POST /simulate bodies
+type SimulateRequest struct {
+	Shards           int      `json:"shards"`
+	CapacityPerShard int      `json:"capacity_per_shard"`
+	Keys             []string `json:"keys,omitempty"` // Sample to distribute; the live keys when empty
+	Hash             string   `json:"hash,omitempty"` // Shard hash to project with; the cache's own when empty
+}
+
+// SimulateResponse structure for POST /simulate replies
+type SimulateResponse struct {
+	Status           string `json:"status"`
+	Source           string `json:"source"` // "sample" or "live"
+	Hash             string `json:"hash"`
+	Keys             int    `json:"keys"`
+	Shards           int    `json:"shards"`
+	CapacityPerShard int    `json:"capacity_per_shard"`
+	TotalCapacity    int    `json:"total_capacity"`
+
+	Distribution []int   `json:"distribution"` // Keys per proposed shard
+	Min          int     `json:"min"`
+	Max          int     `json:"max"`
+	Mean         float64 `json:"mean"`
+	StdDev       float64 `json:"stddev"`
+
+	OverCapacityShards int `json:"over_capacity_shards"`
+	ProjectedEvictions int `json:"projected_evictions"` // Keys that would not fit their proposed shard
+	Remapped           int `json:"remapped"`            // Keys whose shard index would change
+}
+
+// Keys returns a copy of every key currently stored, shard by shard.
+func (sc *ShardedCache) Keys() []string {
+	var keys []string
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		for key := range shard.items {
+			keys = append(keys, key)
+		}
+		shard.cold.each(func(e *entry) { keys = append(keys, e.key) })
+		shard.mutex.Unlock()
+	}
+	return keys
+}
+
+// simulateLayout projects how keys would spread over a cache with the given
+// shard count, per-shard capacity and hash, compared with the current layout.
+// Keys are salted with the cache's salt, if any, for both layouts.
+func simulateLayout(keys []string, shards, capacityPerShard int, hash64 bool, currentShards int, currentHash64 bool, salt []byte) SimulateResponse {
+	report := SimulateResponse{
+		Status:           "OK",
+		Keys:             len(keys),
+		Shards:           shards,
+		CapacityPerShard: capacityPerShard,
+		TotalCapacity:    shards * capacityPerShard,
+		Distribution:     make([]int, shards),
+	}
+	for _, key := range keys {
+		index := shardIndexFor(key, shards, hash64, salt)
+		report.Distribution[index]++
+		if index != shardIndexFor(key, currentShards, currentHash64, salt) {
+			report.Remapped++
+		}
+	}
+
+	report.Min = math.MaxInt
+	for _, n := range report.Distribution {
+		report.Min = min(report.Min, n)
+		report.Max = max(report.Max, n)
+		if n > capacityPerShard {
+			report.OverCapacityShards++
+			report.ProjectedEvictions += n - capacityPerShard
+		}
+	}
+	report.Mean = float64(len(keys)) / float64(shards)
+	var variance float64
+	for _, n := range report.Distribution {
+		variance += (float64(n) - report.Mean) * (float64(n) - report.Mean)
+	}
+	report.StdDev = math.Sqrt(variance / float64(shards))
+	return report
+}
+
+// HandleSimulate reports how a proposed shard count and capacity would
+// distribute a key sample (or the live keys) without touching the cache.
+func HandleSimulate(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SimulateRequest
+
+		r.Body = http.MaxBytesReader(w, r.Body, 16*1024*1024) // 16MB limit, room for a large sample
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+		if req.Shards <= 0 || req.Shards > maxSimulateShards {
+			writeJSONError(w, fmt.Sprintf("Shards must be between 1 and %d.", maxSimulateShards), http.StatusBadRequest)
+			return
+		}
+		if req.CapacityPerShard <= 0 {
+			writeJSONError(w, "Capacity per shard must be positive.", http.StatusBadRequest)
+			return
+		}
+		if len(req.Keys) > maxSimulateSampleKeys {
+			writeJSONError(w, fmt.Sprintf("Sample exceeds %d keys.", maxSimulateSampleKeys), http.StatusBadRequest)
+			return
+		}
+
+		hash := req.Hash
+		if hash == "" {
+			hash = ShardHashFNV32a
+			if cache.hash64 {
+				hash = ShardHashFNV64a
+			}
+		}
+		if hash != ShardHashFNV32a && hash != ShardHashFNV64a {
+			writeJSONError(w, fmt.Sprintf("Unknown hash %q, expected %q or %q.", hash, ShardHashFNV32a, ShardHashFNV64a), http.StatusBadRequest)
+			return
+		}
+
+		keys, source := req.Keys, "sample"
+		if len(keys) == 0 {
+			keys, source = cache.Keys(), "live"
+		}
+		report := simulateLayout(keys, req.Shards, req.CapacityPerShard, hash == ShardHashFNV64a, len(cache.shards), cache.hash64, cache.salt)
+		report.Source = source
+		report.Hash = hash
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"testing"
+)
+
+// sessionKeys returns n keys of the form user:N:session.
+func sessionKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d:session", i)
+	}
+	return keys
+}
+
+func TestShardHashDistribution(t *testing.T) {
+	keys := sessionKeys(100_000)
+	for _, shards := range []int{64, 4096} {
+		mean := float64(len(keys)) / float64(shards)
+		uniform := math.Sqrt(mean * (1 - 1/float64(shards))) // Standard deviation of a uniform spread
+		for _, hash64 := range []bool{false, true} {
+			report := simulateLayout(keys, shards, 1<<20, hash64, shards, hash64, nil)
+			t.Logf("%d shards, fnv64a=%v: stddev %.2f (uniform %.2f), min %d, max %d", shards, hash64, report.StdDev, uniform, report.Min, report.Max)
+			if report.StdDev > 1.25*uniform {
+				t.Errorf("%d shards, fnv64a=%v: stddev %.2f, want close to the uniform %.2f", shards, hash64, report.StdDev, uniform)
+			}
+			if report.Min == 0 {
+				t.Errorf("%d shards, fnv64a=%v: a shard got no keys", shards, hash64)
+			}
+		}
+	}
+}
+
+func TestShardHashSelection(t *testing.T) {
+	cache := NewShardedCache(4096, 1, false)
+	if got := cache.ShardHash(); got != ShardHashFNV32a {
+		t.Errorf("default shard hash %s, want %s", got, ShardHashFNV32a)
+	}
+	keys := sessionKeys(1000)
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		if got, want := cache.getShardIndex(key), int(h.Sum32()%4096); got != want {
+			t.Fatalf("fnv32a shard of %s = %d, want %d", key, got, want)
+		}
+	}
+
+	if err := cache.SetShardHash(ShardHashFNV64a); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		if got, want := cache.getShardIndex(key), int(h.Sum64()&4095); got != want {
+			t.Fatalf("fnv64a shard of %s = %d, want the low bits %d", key, got, want)
+		}
+	}
+	if report := simulateLayout(keys, 4096, 1, true, 4096, false, nil); report.Remapped < len(keys)*9/10 {
+		t.Errorf("only %d of %d keys change shard with the hash", report.Remapped, len(keys))
+	}
+
+	if err := cache.SetShardHash("crc32"); err == nil {
+		t.Error("unknown shard hash accepted")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotStats reports automatic snapshotting in /stats.
+type SnapshotStats struct {
+	Path           string     `json:"path"`
+	IntervalMs     int64      `json:"interval_ms"`
+	LastAt         *time.Time `json:"last_at,omitempty"` // When the last successful snapshot finished
+	LastDurationMs int64      `json:"last_duration_ms"`
+	LastEntries    int        `json:"last_entries"`
+	LastError      string     `json:"last_error,omitempty"` // Error of the most recent attempt, if it failed
+	Skipped        uint64     `json:"skipped"`              // Ticks skipped because a snapshot or restore was still running
+}
+
+// Snapshotter periodically writes the cache to a file as a Redis SET line
+// dump, which -import-redis loads back at startup. Each snapshot is written
+// to a temporary file in the same directory and renamed over the old one, so
+// a crash never leaves a partial file behind.
+type Snapshotter struct {
+	cache    *ShardedCache
+	path     string
+	interval time.Duration
+
+	writing sync.Mutex // Held while a snapshot is being written
+	skipped atomic.Uint64
+	paused  func() bool // Snapshots are skipped while this reports true
+
+	mutex sync.Mutex
+	stats SnapshotStats
+}
+
+// NewSnapshotter creates a snapshotter writing to path every interval.
+func NewSnapshotter(cache *ShardedCache, path string, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		cache:    cache,
+		path:     path,
+		interval: interval,
+		stats:    SnapshotStats{Path: path, IntervalMs: interval.Milliseconds()},
+	}
+}
+
+// Start snapshots every interval of the cache's clock in the background.
+func (s *Snapshotter) Start() {
+	s.cache.workers.Go("snapshotter", func() {
+		ticks, stop := s.cache.clock.NewTicker(s.interval)
+		defer stop()
+		for range ticks {
+			s.Run()
+		}
+	})
+	log.Printf("Writing snapshots to %s every %s", s.path, s.interval)
+}
+
+// SkipWhile makes the snapshotter skip snapshots, including the final one,
+// while paused reports true.
+func (s *Snapshotter) SkipWhile(paused func() bool) {
+	s.paused = paused
+}
+
+// Run writes one snapshot, unless another one is still in progress or
+// snapshots are paused, and records the outcome in the stats.
+func (s *Snapshotter) Run() {
+	if s.paused != nil && s.paused() {
+		s.skipped.Add(1)
+		log.Printf("Skipping snapshot to %s while a restore is in progress", s.path)
+		return
+	}
+	if !s.writing.TryLock() {
+		s.skipped.Add(1)
+		log.Printf("Warning: skipping snapshot to %s, the previous one is still running", s.path)
+		return
+	}
+	defer s.writing.Unlock()
+	s.snapshot()
+}
+
+// Final writes a last snapshot at shutdown, waiting for a running one first.
+func (s *Snapshotter) Final() {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	if s.paused != nil && s.paused() {
+		log.Printf("Not writing a final snapshot to %s, a restore is still in progress", s.path)
+		return
+	}
+	s.snapshot()
+	log.Printf("Wrote final snapshot to %s", s.path)
+}
+
+// Save writes a snapshot right away, waiting for a running one first, and
+// returns its error. It fails while snapshots are paused.
+func (s *Snapshotter) Save() error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	if s.paused != nil && s.paused() {
+		return errors.New("snapshots are paused while a restore is in progress")
+	}
+	return s.snapshot()
+}
+
+// snapshot writes a snapshot and records the outcome. MUST be called with
+// writing held.
+func (s *Snapshotter) snapshot() error {
+	start := time.Now()
+	entries, err := s.write()
+	took := time.Since(start)
+	finished := s.cache.clock.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.stats.LastError = err.Error()
+		log.Printf("Snapshot to %s failed: %v", s.path, err)
+		return err
+	}
+	s.stats.LastAt = &finished
+	s.stats.LastDurationMs = took.Milliseconds()
+	s.stats.LastEntries = entries
+	s.stats.LastError = ""
+	return nil
+}
+
+// write dumps the cache to the snapshot file, one section per shard. The
+// least recently used entries of a shard come first, so that loading the
+// file rebuilds the same LRU order.
+func (s *Snapshotter) write() (int, error) {
+	generation := s.cache.Generation() // Before the dump, which leaves out older entries
+	sections := s.cache.entriesPerShard()
+	total := 0
+	for _, entries := range sections {
+		slices.Reverse(entries)
+		total += len(entries)
+	}
+	if err := writeSnapshotFile(s.path, s.cache.ShardHash(), generation, sections); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Stats returns a copy of the snapshot stats.
+func (s *Snapshotter) Stats() *SnapshotStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Skipped = s.skipped.Load()
+	return &stats
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotEntries returns every entry of cache by key.
+func snapshotEntries(cache *ShardedCache) map[string]dumpEntry {
+	entries := make(map[string]dumpEntry)
+	for _, shard := range cache.entriesPerShard() {
+		for _, e := range shard {
+			entries[e.key] = e
+		}
+	}
+	return entries
+}
+
+// The fixtures in testdata hold one snapshot per format version, laid out as
+// the builds named in their headers wrote them. Each version's entries are
+// those of the version before plus one using the option it introduced.
+func TestLoadSnapshotFixtures(t *testing.T) {
+	aclHash := hashACLToken("t0k3n")
+	for version := 1; version <= snapshotFormatVersion; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			cache := NewShardedCache(2, 100, false)
+			load, err := loadSnapshot(cache, filepath.Join("testdata", fmt.Sprintf("snapshot-v%d.txt", version)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if load.Info.Version != version {
+				t.Errorf("format version %d, want %d", load.Info.Version, version)
+			}
+			if (load.Info.Writer == "") != (version == 1) {
+				t.Errorf("writer %q", load.Info.Writer)
+			}
+			if load.Stats.Rejected != 0 {
+				t.Errorf("%d lines rejected", load.Stats.Rejected)
+			}
+
+			entries := snapshotEntries(cache)
+			want := []string{"user:1", "user:2"}
+			if version >= 2 {
+				want = append(want, "report:q3")
+			}
+			if version >= 3 {
+				want = append(want, "profile:1")
+			}
+			if version >= 4 {
+				want = append(want, "blob:9f86d0")
+			}
+			if version >= 6 {
+				want = append(want, "secret:1")
+			}
+			if version >= 7 {
+				want = append(want, "event:1")
+			}
+			if len(entries) != len(want) || load.Stats.Imported != len(want) {
+				t.Fatalf("loaded %d entries (%d imported), want %v", len(entries), load.Stats.Imported, want)
+			}
+			for _, key := range want {
+				if _, ok := entries[key]; !ok {
+					t.Errorf("%s missing", key)
+				}
+			}
+
+			if e := entries["user:1"]; e.value != "alice" || e.ttl != 0 {
+				t.Errorf("user:1 = %+v", e)
+			}
+			if ttl := entries["user:2"].ttl; ttl <= 59*time.Minute || ttl > time.Hour {
+				t.Errorf("user:2 ttl %s, want about an hour", ttl)
+			}
+			if e := entries["report:q3"]; version >= 2 && e.cost != 40 {
+				t.Errorf("report:q3 cost %d, want 40", e.cost)
+			}
+			if e := entries["profile:1"]; version >= 3 && (e.encoding != EncodingJSON || e.value != `{"name":"alice"}`) {
+				t.Errorf("profile:1 = %+v", e)
+			}
+			if e := entries["blob:9f86d0"]; version >= 4 && !e.immutable {
+				t.Error("blob:9f86d0 is not immutable")
+			}
+			if e := entries["secret:1"]; version >= 6 && !slices.Equal(e.readers, []string{aclHash}) {
+				t.Errorf("secret:1 readers %v", e.readers)
+			}
+			if version >= 6 && cache.Generation() != 3 {
+				t.Errorf("generation %d, want the file's 3", cache.Generation())
+			}
+			if e := entries["event:1"]; version >= 7 && e.createdAt != time.UnixMilli(1699990000000).UnixNano() {
+				t.Errorf("event:1 created at %v", time.Unix(0, e.createdAt))
+			}
+		})
+	}
+}
+
+func TestRestoredEntriesKeepTheirAge(t *testing.T) {
+	source, clock := newFakeClockCache(2, 100)
+	source.Put("old", "v")
+	clock.Advance(2 * time.Hour)
+	source.Put("new", "v")
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := NewSnapshotter(source, path, time.Hour).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		kept  string
+	}{
+		{"older_than=90m", "new"},
+		{"newer_than=90m", "old"},
+	} {
+		// Restarted an hour after the snapshot, so both entries are older
+		// than they would be if the load had reset their age.
+		restored, restoredClock := newFakeClockCache(2, 100)
+		restoredClock.Advance(3 * time.Hour)
+		if _, err := loadSnapshot(restored, path); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		HandleFlush(restored)(rec, httptest.NewRequest(http.MethodPost, "/flush?"+tc.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.query, rec.Code, rec.Body)
+		}
+		if keys := slices.Sorted(maps.Keys(snapshotEntries(restored))); !slices.Equal(keys, []string{tc.kept}) {
+			t.Errorf("%s: left %v, want only %s", tc.query, keys, tc.kept)
+		}
+	}
+}
+
+func TestSnapshotFixturesHaveValidIndexes(t *testing.T) {
+	for version := 5; version <= snapshotFormatVersion; version++ {
+		path := filepath.Join("testdata", fmt.Sprintf("snapshot-v%d.txt", version))
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := f.Stat()
+		sections, err := readSnapshotIndex(f, fi.Size(), 2)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		if len(sections) == 2 && sections[0].entries+sections[1].entries < 5 {
+			t.Errorf("%s: index lists %+v", path, sections)
+		}
+	}
+}
+
+func TestReadSnapshotRefusesFutureVersions(t *testing.T) {
+	for _, header := range []string{
+		fmt.Sprintf("version=%d writer=kv-go-cache@v9.0.0", snapshotFormatVersion+1),
+		"writer=kv-go-cache@v9.0.0",           // No version
+		"version=5 writer=kv-go-cache@v0.5.0", // No shard layout
+	} {
+		path := filepath.Join(t.TempDir(), "snapshot")
+		os.WriteFile(path, []byte(snapshotHeaderPrefix+header+"\nSET k v\n"), 0o644)
+		calls := 0
+		if _, _, err := readSnapshot(path, func(dumpEntry) bool { calls++; return true }); err == nil {
+			t.Errorf("%q: loaded", header)
+		}
+		if calls > 0 {
+			t.Errorf("%q: %d entries read before refusing the file", header, calls)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	os.WriteFile(path, []byte(fmt.Sprintf("%sversion=%d\n", snapshotHeaderPrefix, snapshotFormatVersion+1)), 0o644)
+	_, _, err := readSnapshot(path, func(dumpEntry) bool { return true })
+	if err == nil || !strings.Contains(err.Error(), "not supported by this build") {
+		t.Errorf("error %v, want it to name the unsupported version", err)
+	}
+}
+
+func TestMigrateSnapshotRewritesOldVersions(t *testing.T) {
+	for version := 1; version < snapshotFormatVersion; version++ {
+		in := filepath.Join("testdata", fmt.Sprintf("snapshot-v%d.txt", version))
+		out := filepath.Join(t.TempDir(), "migrated")
+		if code := runMigrateSnapshot([]string{"--in", in, "--out", out, "--shards", "4"}); code != 0 {
+			t.Fatalf("v%d: migrate-snapshot exited %d", version, code)
+		}
+
+		before, after := NewShardedCache(2, 100, false), NewShardedCache(4, 100, false)
+		if _, err := loadSnapshot(before, in); err != nil {
+			t.Fatal(err)
+		}
+		load, err := loadSnapshot(after, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if load.Info.Version != snapshotFormatVersion || load.Info.Shards != 4 {
+			t.Errorf("v%d: migrated file has version %d and %d shards", version, load.Info.Version, load.Info.Shards)
+		}
+		want, got := snapshotEntries(before), snapshotEntries(after)
+		if len(got) != len(want) {
+			t.Errorf("v%d: %d entries after migrating, want %d", version, len(got), len(want))
+		}
+		for key, w := range want {
+			g := got[key]
+			if g.value != w.value || g.cost != w.cost || g.encoding != w.encoding || g.immutable != w.immutable || (g.ttl > 0) != (w.ttl > 0) {
+				t.Errorf("v%d: %s = %+v after migrating, want %+v", version, key, g, w)
+			}
+		}
+	}
+}
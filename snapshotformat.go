@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Snapshot file format versions. Version 1 files are plain Redis SET line
+// dumps without a header. From version 2 on the first line is a header,
+//
+//	# kvcache-snapshot version=7 writer=<build info> shards=64 hash=fnv32a
+//
+// and SET lines may carry a COST option; version 3 adds ENCODING and version 4
+// IMMUTABLE. Version 5 groups the SET lines into one section per shard, in
+// shard order, and ends with an index of the sections (see
+// readSnapshotIndex); the header names the shard count and hash they were
+// partitioned by. Version 6 adds ACL, the hashed read tokens of an entry, and
+// version 7 CREATED, when the entry was stored, in Unix milliseconds. A
+// header may also name the cache generation the entries were written under
+// (generation=N, see BumpGeneration); readers that do not know the field
+// ignore it, so it needs no format version of its own.
+const (
+	snapshotFormatVersion = 7
+	snapshotHeaderPrefix  = "# kvcache-snapshot "
+)
+
+// snapshotLoaders converts the records of each supported format version into
+// dump entries of the current in-memory form. A format change adds a loader
+// here; files newer than snapshotFormatVersion are refused.
+var snapshotLoaders = map[int]func(r io.Reader, fn func(e dumpEntry) bool) (ImportStats, error){
+	1: scanRedisLines, // SET key value [EX|PX n]
+	2: scanRedisLines, // Adds the header and SET ... COST n
+	3: scanRedisLines, // Adds SET ... ENCODING json|base64
+	4: scanRedisLines, // Adds SET ... IMMUTABLE
+	5: scanRedisLines, // Adds shard sections and their index, as comment lines
+	6: scanRedisLines, // Adds SET ... ACL hash,...
+	7: scanRedisLines, // Adds SET ... CREATED unix-ms
+}
+
+// SnapshotInfo describes a snapshot file's header.
+type SnapshotInfo struct {
+	Version int
+	Writer  string // Build that wrote the file; empty for version 1
+
+	// Layout of the shard sections of version 5 files; zero before.
+	Shards    int
+	ShardHash string
+
+	Generation uint64 // Cache generation of the entries; 0 = not recorded
+}
+
+// buildInfo identifies this binary in snapshot headers.
+func buildInfo() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	parts := []string{info.Main.Path + "@" + info.Main.Version, info.GoVersion}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			parts = append(parts, "rev="+setting.Value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// readSnapshotHeader consumes the header line of r, if there is one, and
+// reports the file's format version. Files newer than this build are refused.
+func readSnapshotHeader(r *bufio.Reader) (SnapshotInfo, error) {
+	peek, _ := r.Peek(len(snapshotHeaderPrefix))
+	if string(peek) != snapshotHeaderPrefix {
+		return SnapshotInfo{Version: 1}, nil
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return SnapshotInfo{}, err
+	}
+	info := SnapshotInfo{}
+	for _, field := range strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), snapshotHeaderPrefix)) {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "version":
+			if info.Version, err = strconv.Atoi(value); err != nil || info.Version < 1 {
+				return SnapshotInfo{}, fmt.Errorf("invalid snapshot format version %q", value)
+			}
+		case "writer":
+			info.Writer = value
+		case "shards":
+			if info.Shards, err = strconv.Atoi(value); err != nil || info.Shards < 1 {
+				return SnapshotInfo{}, fmt.Errorf("invalid snapshot shard count %q", value)
+			}
+		case "hash":
+			info.ShardHash = value
+		case "generation":
+			if info.Generation, err = strconv.ParseUint(value, 10, 64); err != nil || info.Generation < 1 {
+				return SnapshotInfo{}, fmt.Errorf("invalid snapshot generation %q", value)
+			}
+		}
+	}
+	if info.Version == 0 {
+		return SnapshotInfo{}, fmt.Errorf("snapshot header without a format version")
+	}
+	if _, ok := snapshotLoaders[info.Version]; !ok {
+		return SnapshotInfo{}, fmt.Errorf("snapshot format version %d is not supported by this build (newest supported: %d)",
+			info.Version, snapshotFormatVersion)
+	}
+	if info.Version >= 5 && (info.Shards == 0 || info.ShardHash == "") {
+		return SnapshotInfo{}, fmt.Errorf("snapshot header without a shard layout")
+	}
+	return info, nil
+}
+
+// readSnapshot loads a snapshot file of any supported version, calling fn
+// for each entry in file order. Entries fn refuses count as rejected.
+func readSnapshot(path string, fn func(e dumpEntry) bool) (SnapshotInfo, ImportStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return SnapshotInfo{}, ImportStats{}, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	info, err := readSnapshotHeader(r)
+	if err != nil {
+		return SnapshotInfo{}, ImportStats{}, fmt.Errorf("%s: %w", path, err)
+	}
+	stats, err := snapshotLoaders[info.Version](r, fn)
+	return info, stats, err
+}
+
+// writeSnapshotFile writes a current-version snapshot with one section per
+// shard of a cache sharded by hash, sections[i] holding the entries of shard
+// i in order, all of them written under generation (0 = not recorded). The file is written to a temporary name in the same directory,
+// synced and renamed into place, so a crash never leaves a partial file
+// behind.
+func writeSnapshotFile(path, hash string, generation uint64, sections [][]dumpEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	w := bufio.NewWriter(tmp)
+	header := fmt.Sprintf("%sversion=%d writer=%s shards=%d hash=%s",
+		snapshotHeaderPrefix, snapshotFormatVersion, buildInfo(), len(sections), hash)
+	if generation > 0 {
+		header += fmt.Sprintf(" generation=%d", generation)
+	}
+	header += "\n"
+	w.WriteString(header)
+	offset := int64(len(header))
+	index := make([]snapshotSection, len(sections))
+	var line []byte
+	for i, entries := range sections {
+		index[i] = snapshotSection{offset: offset, entries: len(entries)}
+		for _, e := range entries {
+			line = appendRedisSet(line[:0], e)
+			w.Write(line)
+			offset += int64(len(line))
+		}
+	}
+	w.Write(appendSnapshotIndex(line[:0], index, offset))
+	if err := w.Flush(); err != nil { // Reports the first failed write too
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// runMigrateSnapshot implements `kvcache migrate-snapshot --in old --out new`,
+// rewriting a snapshot of any supported version in the current format,
+// partitioned for a cache with the given shard count and hash.
+func runMigrateSnapshot(args []string) int {
+	fs := flag.NewFlagSet("migrate-snapshot", flag.ContinueOnError)
+	in := fs.String("in", "", "Snapshot file to read")
+	out := fs.String("out", "", "File to write the migrated snapshot to")
+	shards := fs.Int("shards", NumShards, "Shard count of the cache that will load the file")
+	hash := fs.String("shard-hash", ShardHashFNV32a, "Shard hash of the cache that will load the file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" || *out == "" || *shards < 1 || (*hash != ShardHashFNV32a && *hash != ShardHashFNV64a) {
+		fmt.Fprintln(os.Stderr, "usage: kvcache migrate-snapshot --in <old> --out <new> [--shards 64] [--shard-hash fnv32a|fnv64a]")
+		return 2
+	}
+
+	sections := make([][]dumpEntry, *shards)
+	migrated := 0
+	info, stats, err := readSnapshot(*in, func(e dumpEntry) bool {
+		i := shardIndexFor(e.key, *shards, *hash == ShardHashFNV64a, nil)
+		sections[i] = append(sections[i], e)
+		migrated++
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-snapshot: %v\n", err)
+		return 1
+	}
+	if err := writeSnapshotFile(*out, *hash, info.Generation, sections); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-snapshot: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Migrated %d entries from format version %d to %d (%d rejected)\n",
+		migrated, info.Version, snapshotFormatVersion, stats.Rejected)
+	return 0
+}
+
+// runInspectSnapshot implements `kvcache inspect-snapshot <file>`.
+func runInspectSnapshot(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: kvcache inspect-snapshot <file>")
+		return 2
+	}
+	withTTL, immutable, withACL := 0, 0, 0
+	info, stats, err := readSnapshot(args[0], func(e dumpEntry) bool {
+		if e.ttl > 0 {
+			withTTL++
+		}
+		if e.immutable {
+			immutable++
+		}
+		if e.readers != nil {
+			withACL++
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect-snapshot: %v\n", err)
+		return 1
+	}
+	writer := info.Writer
+	if writer == "" {
+		writer = "unknown (no header)"
+	}
+	fmt.Printf("format version: %d (current: %d)\n", info.Version, snapshotFormatVersion)
+	fmt.Printf("writer:         %s\n", writer)
+	if info.Shards > 0 {
+		fmt.Printf("sections:       %d shards by %s, %s\n", info.Shards, info.ShardHash, describeSnapshotIndex(args[0], info.Shards))
+	}
+	if info.Generation > 0 {
+		fmt.Printf("generation:     %d\n", info.Generation)
+	}
+	fmt.Printf("entries:        %d (%d with a TTL, %d immutable, %d with an ACL)\n", stats.Imported, withTTL, immutable, withACL)
+	fmt.Printf("rejected lines: %d\n", stats.Rejected)
+	return 0
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A version 5 snapshot ends with an index of its shard sections,
+//
+//	# kvcache-index <offset>:<entries> <offset>:<entries> ...
+//	# kvcache-index-at <offset of the line above, 20 digits>
+//
+// with one pair per shard, in shard order. The last line has a fixed length,
+// so a loader finds the index by reading the end of the file. Both lines are
+// comments to a plain line reader, which can still load the file in order.
+const (
+	snapshotIndexPrefix   = "# kvcache-index "
+	snapshotIndexAtPrefix = "# kvcache-index-at "
+	snapshotIndexAtLen    = len(snapshotIndexAtPrefix) + 20 + 1
+)
+
+// snapshotSection locates the SET lines of one shard in a version 5 snapshot.
+type snapshotSection struct {
+	offset, end int64 // Byte range in the file
+	entries     int
+}
+
+// appendSnapshotIndex appends the index of sections, followed by the line
+// pointing at it, to b; at is the offset the index starts at.
+func appendSnapshotIndex(b []byte, sections []snapshotSection, at int64) []byte {
+	b = append(b, snapshotIndexPrefix...)
+	for i, s := range sections {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = strconv.AppendInt(b, s.offset, 10)
+		b = append(b, ':')
+		b = strconv.AppendInt(b, int64(s.entries), 10)
+	}
+	b = append(b, '\n')
+	return fmt.Appendf(b, "%s%020d\n", snapshotIndexAtPrefix, at)
+}
+
+// readSnapshotIndex reads the section index of a version 5 snapshot of size
+// bytes partitioned into shards sections, and checks that the sections are
+// in order and inside the file.
+func readSnapshotIndex(f io.ReaderAt, size int64, shards int) ([]snapshotSection, error) {
+	tailAt := size - int64(snapshotIndexAtLen)
+	if tailAt < 0 {
+		return nil, errors.New("no section index: file too short")
+	}
+	tail := make([]byte, snapshotIndexAtLen)
+	if _, err := f.ReadAt(tail, tailAt); err != nil {
+		return nil, err
+	}
+	digits, ok := strings.CutPrefix(strings.TrimSuffix(string(tail), "\n"), snapshotIndexAtPrefix)
+	at, err := strconv.ParseInt(digits, 10, 64)
+	if !ok || err != nil || at < 0 || at >= tailAt {
+		return nil, errors.New("no section index at the end of the file")
+	}
+
+	line := make([]byte, tailAt-at)
+	if _, err := f.ReadAt(line, at); err != nil {
+		return nil, err
+	}
+	fields, ok := strings.CutPrefix(strings.TrimSuffix(string(line), "\n"), snapshotIndexPrefix)
+	pairs := strings.Fields(fields)
+	if !ok || len(pairs) != shards {
+		return nil, fmt.Errorf("section index lists %d sections for %d shards", len(pairs), shards)
+	}
+	sections := make([]snapshotSection, shards)
+	for i, pair := range pairs {
+		offset, entries, _ := strings.Cut(pair, ":")
+		s := &sections[i]
+		var offErr, entriesErr error
+		s.offset, offErr = strconv.ParseInt(offset, 10, 64)
+		s.entries, entriesErr = strconv.Atoi(entries)
+		if offErr != nil || entriesErr != nil || s.entries < 0 || s.offset < 0 || s.offset > at ||
+			(i > 0 && s.offset < sections[i-1].offset) {
+			return nil, fmt.Errorf("invalid section index entry %q", pair)
+		}
+	}
+	for i := range sections {
+		sections[i].end = at
+		if i+1 < len(sections) {
+			sections[i].end = sections[i+1].offset
+		}
+	}
+	return sections, nil
+}
+
+// describeSnapshotIndex summarises the section index of the snapshot at path
+// for inspect-snapshot.
+func describeSnapshotIndex(path string, shards int) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Sprintf("index unreadable: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Sprintf("index unreadable: %v", err)
+	}
+	sections, err := readSnapshotIndex(f, fi.Size(), shards)
+	if err != nil {
+		return fmt.Sprintf("index unusable (loads sequentially): %v", err)
+	}
+	largest := 0
+	for _, s := range sections {
+		largest = max(largest, s.entries)
+	}
+	return fmt.Sprintf("indexed, largest section %d entries", largest)
+}
+
+// add accumulates the counts of o into s.
+func (s *ImportStats) add(o ImportStats) {
+	s.Imported += o.Imported
+	s.Rejected += o.Rejected
+	for cmd, n := range o.Skipped {
+		s.Skipped[cmd] += n
+	}
+}
+
+// snapshotLoad describes how loadSnapshot loaded a file.
+type snapshotLoad struct {
+	Info     SnapshotInfo
+	Stats    ImportStats
+	Workers  []int // Entries stored by each worker; a single one for a sequential load
+	Duration time.Duration
+}
+
+// loadSnapshot stores the snapshot at path in cache. A version 5 file
+// partitioned like cache, by shard count and hash, is loaded by a pool of up
+// to GOMAXPROCS workers that each take whole shard sections, so every shard
+// is written by exactly one worker and in file order. Older files, files
+// partitioned differently and files whose index is damaged are loaded
+// sequentially. A file written under an older cache generation than the
+// running one is read but none of its entries are stored; they count as
+// rejected.
+func loadSnapshot(cache *ShardedCache, path string) (snapshotLoad, error) {
+	return loadSnapshotCounting(cache, path, nil)
+}
+
+// loadSnapshotCounting is loadSnapshot, also adding every stored entry to
+// loaded, if not nil, while the load runs.
+func loadSnapshotCounting(cache *ShardedCache, path string, loaded *atomic.Int64) (snapshotLoad, error) {
+	start := time.Now()
+	store := func(e dumpEntry) bool {
+		if !e.store(cache) {
+			return false
+		}
+		if loaded != nil {
+			loaded.Add(1)
+		}
+		return true
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return snapshotLoad{}, err
+	}
+	defer f.Close()
+	info, err := readSnapshotHeader(bufio.NewReader(f))
+	if err != nil {
+		return snapshotLoad{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if info.Generation > 0 && !cache.adoptGeneration(info.Generation) {
+		log.Printf("Warning: not loading the entries of %s, they were written under generation %d and the cache is at %d",
+			path, info.Generation, cache.Generation())
+		store = func(dumpEntry) bool { return false }
+	}
+	var sections []snapshotSection
+	switch {
+	case info.Shards == 0:
+	case info.Shards != len(cache.shards) || info.ShardHash != cache.ShardHash():
+		log.Printf("Loading %s sequentially: it is partitioned into %d shards by %s, this cache has %d by %s",
+			path, info.Shards, info.ShardHash, len(cache.shards), cache.ShardHash())
+	default:
+		fi, err := f.Stat()
+		if err == nil {
+			sections, err = readSnapshotIndex(f, fi.Size(), info.Shards)
+		}
+		if err != nil {
+			log.Printf("Warning: loading %s sequentially: %v", path, err)
+		}
+	}
+
+	if sections == nil {
+		info, stats, err := readSnapshot(path, store)
+		return snapshotLoad{Info: info, Stats: stats, Workers: []int{stats.Imported}, Duration: time.Since(start)}, err
+	}
+
+	load := snapshotLoad{
+		Info:    info,
+		Stats:   ImportStats{Skipped: make(map[string]int)},
+		Workers: make([]int, min(runtime.GOMAXPROCS(0), len(sections))),
+	}
+	work := make(chan snapshotSection, len(sections))
+	for _, s := range sections {
+		work <- s
+	}
+	close(work)
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	for w := range load.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range work {
+				stats, err := scanRedisLines(io.NewSectionReader(f, s.offset, s.end-s.offset), store)
+				mutex.Lock()
+				load.Stats.add(stats)
+				load.Workers[w] += stats.Imported
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	load.Duration = time.Since(start)
+	return load, firstErr
+}
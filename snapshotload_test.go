@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeTestSnapshot fills a cache with entries and saves it to a file in a
+// temporary directory.
+func writeTestSnapshot(tb testing.TB, shards, entries int) (*ShardedCache, string) {
+	tb.Helper()
+	cache := NewShardedCache(shards, entries, false)
+	for i := range entries {
+		opts := PutOptions{Cost: 1 + i%MaxCost}
+		if i%3 == 0 {
+			opts.TTL = time.Hour
+		}
+		cache.PutWithOptions(fmt.Sprintf("key:%d", i), fmt.Sprintf("value:%d", i), opts)
+	}
+	path := filepath.Join(tb.TempDir(), "snapshot")
+	if err := NewSnapshotter(cache, path, time.Hour).Save(); err != nil {
+		tb.Fatal(err)
+	}
+	return cache, path
+}
+
+// shardKeys returns the keys of each shard of cache, least recently used first.
+func shardKeys(cache *ShardedCache) [][]string {
+	var keys [][]string
+	for _, entries := range cache.entriesPerShard() {
+		var shard []string
+		for _, e := range entries {
+			shard = append(shard, e.key)
+		}
+		slices.Reverse(shard)
+		keys = append(keys, shard)
+	}
+	return keys
+}
+
+func TestParallelLoadMatchesTheSource(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	source, path := writeTestSnapshot(t, 16, 5000)
+
+	cache := NewShardedCache(16, 5000, false)
+	load, err := loadSnapshot(cache, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(load.Workers) != 4 {
+		t.Errorf("loaded by %d workers, want 4", len(load.Workers))
+	}
+	total := 0
+	for _, n := range load.Workers {
+		total += n
+	}
+	if total != 5000 || load.Stats.Imported != 5000 || load.Stats.Rejected != 0 {
+		t.Errorf("workers stored %v (%d), stats %+v, want 5000 entries", load.Workers, total, load.Stats)
+	}
+	// Each shard was filled by one worker in file order, so the LRU order
+	// of every shard comes back as it was.
+	want, got := shardKeys(source), shardKeys(cache)
+	for i := range want {
+		if !slices.Equal(got[i], want[i]) {
+			t.Errorf("shard %d holds %d keys in another order than the source's %d", i, len(got[i]), len(want[i]))
+		}
+	}
+}
+
+func TestSequentialLoadFallbacks(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	_, path := writeTestSnapshot(t, 16, 2000)
+
+	damaged := filepath.Join(t.TempDir(), "damaged")
+	data, _ := os.ReadFile(path)
+	os.WriteFile(damaged, data[:len(data)-snapshotIndexAtLen], 0o644) // Drop the index pointer
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		shards int
+		hash   string
+	}{
+		{"other shard count", path, 8, ShardHashFNV32a},
+		{"other shard hash", path, 16, ShardHashFNV64a},
+		{"damaged index", damaged, 16, ShardHashFNV32a},
+		{"version 4 file", filepath.Join("testdata", "snapshot-v4.txt"), 16, ShardHashFNV32a},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := NewShardedCache(tc.shards, 2000, false)
+			if err := cache.SetShardHash(tc.hash); err != nil {
+				t.Fatal(err)
+			}
+			load, err := loadSnapshot(cache, tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(load.Workers) != 1 {
+				t.Errorf("loaded by %d workers, want a sequential load", len(load.Workers))
+			}
+			if load.Stats.Imported == 0 || cache.Len() != load.Stats.Imported {
+				t.Errorf("imported %d, cache holds %d", load.Stats.Imported, cache.Len())
+			}
+		})
+	}
+}
+
+func TestSaltedSnapshotsLoadSequentiallyAfterARestart(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	salt, _ := newShardSalt()
+	source := NewShardedCache(16, 2000, false)
+	source.SetShardSalt(salt)
+	for i := range 2000 {
+		source.Put(fmt.Sprintf("key:%d", i), "v")
+	}
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := NewSnapshotter(source, path, time.Hour).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restartSalt, _ := newShardSalt()
+	for _, tc := range []struct {
+		name     string
+		salt     []byte
+		parallel bool
+	}{
+		{"same salt", salt, true},
+		{"salt of a restarted process", restartSalt, false},
+	} {
+		cache := NewShardedCache(16, 2000, false)
+		cache.SetShardSalt(tc.salt)
+		load, err := loadSnapshot(cache, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parallel := len(load.Workers) > 1; parallel != tc.parallel {
+			t.Errorf("%s: loaded by %d workers", tc.name, len(load.Workers))
+		}
+		// Either way every key is placed by the loading cache's own salt.
+		for i, keys := range shardKeys(cache) {
+			for _, key := range keys {
+				if cache.getShardIndex(key) != i {
+					t.Fatalf("%s: %s loaded into shard %d, its salt places it in %d", tc.name, key, i, cache.getShardIndex(key))
+				}
+			}
+		}
+		if cache.Len() != 2000 {
+			t.Errorf("%s: loaded %d of 2000 entries", tc.name, cache.Len())
+		}
+	}
+}
+
+func TestReadSnapshotIndexRejectsBadSections(t *testing.T) {
+	for _, index := range []string{
+		"# kvcache-index 10:1\n",        // One section for two shards
+		"# kvcache-index 40:1 20:1\n",   // Out of order
+		"# kvcache-index 10:1 9999:1\n", // Past the index
+		"# kvcache-index 10:x 20:1\n",   // Not a count
+	} {
+		at := int64(100)
+		data := make([]byte, at)
+		data = append(data, index...)
+		data = fmt.Appendf(data, "%s%020d\n", snapshotIndexAtPrefix, at)
+		path := filepath.Join(t.TempDir(), "snapshot")
+		os.WriteFile(path, data, 0o644)
+		f, _ := os.Open(path)
+		if _, err := readSnapshotIndex(f, int64(len(data)), 2); err == nil {
+			t.Errorf("%q accepted", index)
+		}
+		f.Close()
+	}
+}
+
+// BenchmarkLoadSnapshot loads 250,000 entries from a file partitioned for
+// the loading cache, and from the same file into a cache sharded by another
+// hash, which must read it sequentially.
+func BenchmarkLoadSnapshot(b *testing.B) {
+	_, path := writeTestSnapshot(b, 64, 250_000)
+	for _, partitioned := range []bool{true, false} {
+		name := "partitioned"
+		if !partitioned {
+			name = "sequential"
+		}
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				cache := NewShardedCache(64, 250_000/64+1, false)
+				if !partitioned {
+					cache.SetShardHash(ShardHashFNV64a)
+				}
+				if _, err := loadSnapshot(cache, path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
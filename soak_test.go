@@ -0,0 +1,317 @@
+//go:build soak
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run with go test -race -tags soak -run TestSoak [-soak.duration 10m ...].
+var (
+	soakDuration = flag.Duration("soak.duration", 30*time.Second, "How long to run")
+	soakWorkers  = flag.Int("soak.workers", 32, "Concurrent goroutines")
+	soakKeys     = flag.Int("soak.keys", 4096, "Distinct keys; more than the capacity forces evictions")
+	soakShards   = flag.Int("soak.shards", 8, "Cache shards")
+	soakCapacity = flag.Int("soak.capacity", 256, "Entries per shard")
+	soakSeed     = flag.Int64("soak.seed", 0, "Seed for the operation mix (0 = from the clock)")
+)
+
+// soakLogSize is how many recent operations are kept per key for the report
+// of a failed invariant.
+const soakLogSize = 32
+
+// Weighted operations of a soak run.
+var soakOps = []struct {
+	name   string
+	weight int
+}{
+	{"get", 35}, {"put", 25}, {"put-ttl", 10}, {"update", 10},
+	{"delete", 8}, {"pin", 5}, {"unpin", 4}, {"flush", 3},
+	{"resize", 1}, {"demote", 1},
+}
+
+// soakKey is the reference model of one key. Operations on a key hold mu, so
+// the model always knows the last value written; the cache may only have
+// lost it, to eviction, expiry or a flush.
+type soakKey struct {
+	mu      sync.Mutex
+	value   string // Last value written, "" after a delete
+	version uint64 // Last version seen since the last write; 0 = no floor
+	pinned  bool
+
+	logMu sync.Mutex // Separate, as eviction callbacks run under other keys' locks
+	log   []string
+}
+
+func (k *soakKey) record(format string, args ...any) {
+	k.logMu.Lock()
+	defer k.logMu.Unlock()
+	if len(k.log) == soakLogSize {
+		k.log = k.log[1:]
+	}
+	k.log = append(k.log, time.Now().Format("15:04:05.000000")+" "+fmt.Sprintf(format, args...))
+}
+
+// soakRun drives one cache and collects the first violated invariant.
+type soakRun struct {
+	cache    *ShardedCache
+	capacity int // Per-shard capacity resizes vary around
+	keys     []*soakKey
+	ops      atomic.Uint64
+
+	pinnedValues sync.Map // key -> value of the pinned entry, for eviction checks
+
+	failOnce sync.Once
+	failure  string
+	stop     context.CancelFunc
+}
+
+func soakKeyName(i int) string { return "soak:" + strconv.Itoa(i) }
+
+// fail records the first violation, with the operation log of the key
+// involved, and stops the run.
+func (s *soakRun) fail(i int, format string, args ...any) {
+	s.failOnce.Do(func() {
+		var b strings.Builder
+		if i < 0 {
+			fmt.Fprintf(&b, "invariant violated: %s\n", fmt.Sprintf(format, args...))
+		} else {
+			fmt.Fprintf(&b, "invariant violated on %s: %s\n", soakKeyName(i), fmt.Sprintf(format, args...))
+			k := s.keys[i]
+			k.logMu.Lock()
+			for _, line := range k.log {
+				fmt.Fprintf(&b, "  %s\n", line)
+			}
+			k.logMu.Unlock()
+		}
+		s.failure = b.String()
+		s.stop()
+	})
+}
+
+// onEvict checks that pinned entries only leave the cache when asked to.
+func (s *soakRun) onEvict(key, value string, reason EvictionReason) {
+	i, err := strconv.Atoi(strings.TrimPrefix(key, "soak:"))
+	if err != nil {
+		return
+	}
+	s.keys[i].record("removed %s (%s)", value, reason)
+	if pinned, ok := s.pinnedValues.Load(key); ok && pinned == value &&
+		(reason == EvictionCapacity || reason == EvictionExpired) {
+		s.fail(i, "pinned value %s was removed (%s)", value, reason)
+	}
+}
+
+// repin restores the model's pin after a write, since a write may have
+// recreated an entry that a flush had removed.
+// MUST be called with k.mu held.
+func (s *soakRun) repin(i int, k *soakKey) {
+	if !k.pinned {
+		return
+	}
+	key := soakKeyName(i)
+	if err := s.cache.Pin(key, true); err != nil {
+		k.pinned = false
+		s.pinnedValues.Delete(key)
+		k.record("pin lost: %v", err)
+		return
+	}
+	s.pinnedValues.Store(key, k.value)
+}
+
+// step performs one operation on key i and checks what it observed.
+func (s *soakRun) step(rng *rand.Rand, worker int, seq *uint64, op string, i int) {
+	k := s.keys[i]
+	key := soakKeyName(i)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	*seq++
+	value := fmt.Sprintf("w%d-%d", worker, *seq)
+
+	switch op {
+	case "get":
+		before := time.Now().UnixNano()
+		item, found, _ := s.cache.GetCtx(context.Background(), key, false)
+		k.record("get -> %q found=%v expires=%d", item.Value, found, item.ExpiresAt)
+		switch {
+		case !found:
+		case item.Value != k.value:
+			s.fail(i, "read %q, but the last write was %q", item.Value, k.value)
+		case item.ExpiresAt != 0 && item.ExpiresAt <= before && !k.pinned:
+			s.fail(i, "read %q, which expired %v before the read", item.Value, time.Duration(before-item.ExpiresAt))
+		}
+	case "put", "put-ttl":
+		var opts PutOptions
+		if op == "put-ttl" {
+			opts.TTL = time.Duration(1+rng.Intn(20)) * time.Millisecond
+		}
+		s.cache.PutWithOptions(key, value, opts)
+		k.record("%s %s ttl=%v", op, value, opts.TTL)
+		k.value, k.version = value, 0
+		s.repin(i, k)
+	case "update":
+		version, _, err := s.cache.Update(key, "", nil, func(string) (string, error) { return value, nil })
+		k.record("update %s -> version %d err=%v", value, version, err)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			k.version = 0
+		case err != nil:
+			s.fail(i, "update failed: %v", err)
+		case version <= k.version:
+			s.fail(i, "version went from %d to %d", k.version, version)
+		default:
+			k.value, k.version = value, version
+			if k.pinned {
+				s.pinnedValues.Store(key, value)
+			}
+		}
+	case "delete":
+		s.cache.Delete(key)
+		k.record("delete")
+		k.value, k.version, k.pinned = "", 0, false
+		s.pinnedValues.Delete(key)
+	case "pin":
+		err := s.cache.Pin(key, true)
+		k.record("pin err=%v", err)
+		if err == nil {
+			k.pinned = true
+			s.pinnedValues.Store(key, k.value)
+		}
+	case "unpin":
+		k.pinned = false
+		s.pinnedValues.Delete(key)
+		err := s.cache.Pin(key, false)
+		k.record("unpin err=%v", err)
+	case "flush":
+		// Flush keys sharing the last digit of this one, without their locks;
+		// flushing only removes entries, which the model allows at any time.
+		digit := key[len(key)-1:]
+		n := s.cache.RemoveMatching(func(e *entry) bool { return strings.HasSuffix(e.key, digit) })
+		k.record("flush *%s -> %d removed", digit, n)
+	case "resize":
+		// Resize this key's shard to between half and one and a half times
+		// the base capacity; like a flush, it only removes entries.
+		shard := s.cache.shards[s.cache.getShardIndex(key)]
+		capacity := max(1, s.capacity/2+rng.Intn(s.capacity+1))
+		n := shard.Resize(capacity)
+		k.record("resize shard %d to %d -> %d evicted", shard.index, capacity, n)
+	case "demote":
+		// Move this key's shard's idle entries to the cold tier, so reads,
+		// writes and evictions also go through the arena.
+		shard := s.cache.shards[s.cache.getShardIndex(key)]
+		n := shard.demoteIdle(time.Now().Add(-time.Millisecond).UnixNano())
+		k.record("demote shard %d -> %d demoted", shard.index, n)
+	}
+	s.ops.Add(1)
+}
+
+// checkShards verifies each shard's accounting against a recount: no shard
+// holds more entries than it may, the pinned count matches the pinned
+// entries, and the cold arena's size is its live records plus its dead bytes.
+// A shard over capacity is allowed only when pinned entries, which are never
+// evicted, leave it no choice: a shrink below their number, or one new entry
+// added next to them.
+func (s *soakRun) checkShards() {
+	for _, shard := range s.cache.shards {
+		shard.mutex.Lock()
+		n, capacity, pinnedCount := shard.lenLocked(), shard.capacity, shard.pinned
+		pinned := 0
+		for elem := shard.evictList.Front(); elem != nil; elem = elem.Next() {
+			if elem.Value.(*entry).pinned {
+				pinned++
+			}
+		}
+		arena, dead, live := 0, 0, 0
+		if t := shard.cold; t != nil {
+			arena, dead = len(t.arena), t.dead
+			for _, ref := range t.index {
+				_, _, size := t.record(ref.off)
+				live += size
+			}
+		}
+		shard.mutex.Unlock()
+
+		switch {
+		case pinnedCount != pinned:
+			s.fail(-1, "shard %d counts %d pinned entries, but holds %d", shard.index, pinnedCount, pinned)
+		case n > max(capacity, pinned+1):
+			s.fail(-1, "shard %d holds %d entries, capacity %d, %d pinned", shard.index, n, capacity, pinned)
+		case live+dead != arena:
+			s.fail(-1, "shard %d cold arena is %d bytes, but holds %d live and %d dead", shard.index, arena, live, dead)
+		}
+	}
+}
+
+// TestSoak has dozens of goroutines perform weighted random operations on one
+// cache while invariants are checked against a reference model. It fails
+// with the offending key's operation log on the first violation.
+func TestSoak(t *testing.T) {
+	seed := *soakSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ctx, stop := context.WithTimeout(context.Background(), *soakDuration)
+	defer stop()
+	s := &soakRun{cache: NewShardedCache(*soakShards, *soakCapacity, false), capacity: *soakCapacity, stop: stop}
+	s.cache.SetPinLimit(0.5)
+	s.cache.EnableColdTier(time.Hour) // Demoted by the demote operation, not the background worker
+	s.cache.OnEvict(s.onEvict)
+	s.keys = make([]*soakKey, *soakKeys)
+	for i := range s.keys {
+		s.keys[i] = &soakKey{}
+	}
+	totalWeight := 0
+	for _, op := range soakOps {
+		totalWeight += op.weight
+	}
+	t.Logf("seed %d, %d workers, %d keys, %d shards of %d, for %v",
+		seed, *soakWorkers, *soakKeys, *soakShards, *soakCapacity, *soakDuration)
+
+	var wg sync.WaitGroup
+	for w := range *soakWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed + int64(w)))
+			var seq uint64
+			for ctx.Err() == nil {
+				pick := rng.Intn(totalWeight)
+				op := soakOps[0].name
+				for _, candidate := range soakOps {
+					if pick < candidate.weight {
+						op = candidate.name
+						break
+					}
+					pick -= candidate.weight
+				}
+				s.step(rng, w, &seq, op, rng.Intn(*soakKeys))
+			}
+		}()
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+			s.checkShards()
+		case <-ctx.Done():
+		}
+	}
+	wg.Wait()
+	s.checkShards()
+
+	if s.failure != "" {
+		t.Fatalf("seed %d: %s", seed, s.failure)
+	}
+	t.Logf("%d operations, no invariant violated", s.ops.Load())
+}
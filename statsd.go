@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsD line formats accepted by NewStatsDEmitter.
+const (
+	StatsDFormatPlain = "statsd"
+	StatsDFormatDog   = "dogstatsd" // Per-operation metrics carry an op tag instead of the op in their name
+)
+
+// statsdMaxPacket is the largest datagram sent, small enough to avoid IP
+// fragmentation on a standard Ethernet MTU.
+const statsdMaxPacket = 1432
+
+// statsdPercentiles are the latency percentiles sent per operation.
+var statsdPercentiles = [...]struct {
+	name     string
+	fraction float64
+}{{"p50", 0.5}, {"p95", 0.95}, {"p99", 0.99}}
+
+// statsdCounters holds the cumulative counts of the previous flush, which
+// the next one sends the difference to.
+type statsdCounters struct {
+	hits, misses, evictions uint64
+	latency                 [numOps][len(latencyBuckets) + 1]uint64
+}
+
+// StatsDEmitter periodically pushes the cache's counters and gauges to a
+// StatsD or DogStatsD server over UDP. Counters are sent as the increase
+// since the previous flush; latency percentiles are computed over the
+// requests of the flush interval.
+type StatsDEmitter struct {
+	conn     net.Conn
+	addr     string
+	prefix   string
+	format   string
+	tags     []string // DogStatsD tags added to every metric
+	interval time.Duration
+	metrics  *Metrics
+	cache    *ShardedCache
+
+	mutex    sync.Mutex // Serialises flushes
+	last     statsdCounters
+	warnedAt time.Time // Last logged send failure
+}
+
+// NewStatsDEmitter creates an emitter sending to the UDP address addr every
+// interval. Metric names start with prefix followed by a dot, unless prefix
+// is empty. tags are only valid with the dogstatsd format.
+func NewStatsDEmitter(addr, prefix, format string, tags []string, interval time.Duration, metrics *Metrics, cache *ShardedCache) (*StatsDEmitter, error) {
+	if interval <= 0 {
+		return nil, errors.New("the flush interval must be positive")
+	}
+	switch format {
+	case StatsDFormatPlain:
+		if len(tags) > 0 {
+			return nil, errors.New("tags need the dogstatsd format")
+		}
+	case StatsDFormatDog:
+	default:
+		return nil, fmt.Errorf("unknown format %q (want statsd or dogstatsd)", format)
+	}
+	if strings.ContainsAny(prefix, ":|@# \t") {
+		return nil, fmt.Errorf("invalid metric prefix %q", prefix)
+	}
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, ",|#@ \t") {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	return &StatsDEmitter{
+		conn:     conn,
+		addr:     addr,
+		prefix:   prefix,
+		format:   format,
+		tags:     tags,
+		interval: interval,
+		metrics:  metrics,
+		cache:    cache,
+	}, nil
+}
+
+// Start flushes every interval in the background.
+func (e *StatsDEmitter) Start() {
+	e.cache.workers.Go("statsd", func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.flush()
+		}
+	})
+	log.Printf("Sending %s metrics to %s every %s", e.format, e.addr, e.interval)
+}
+
+// Final sends what changed since the last flush, at shutdown.
+func (e *StatsDEmitter) Final() {
+	e.flush()
+}
+
+// flush sends one round of metrics.
+func (e *StatsDEmitter) flush() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var now statsdCounters
+	now.hits = e.metrics.requests[OpGet][OutcomeHit].Load()
+	now.misses = e.metrics.requests[OpGet][OutcomeMiss].Load()
+	for _, n := range e.cache.EvictionsByCost() {
+		now.evictions += n
+	}
+	for op := range numOps {
+		for i := range now.latency[op] {
+			now.latency[op][i] = e.metrics.latency[op].buckets[i].Load()
+		}
+	}
+
+	var lines []string
+	add := func(name, value, kind, op string) {
+		tags := e.tags
+		if op != "" {
+			if e.format == StatsDFormatDog {
+				tags = append(tags[:len(tags):len(tags)], "op:"+op)
+			} else {
+				name = strings.Replace(name, ".", "."+op+".", 1)
+			}
+		}
+		line := e.prefix + name + ":" + value + "|" + kind
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+	count := func(n uint64) string { return strconv.FormatUint(n, 10) }
+
+	add("hits", count(now.hits-e.last.hits), "c", "")
+	add("misses", count(now.misses-e.last.misses), "c", "")
+	add("evictions", count(now.evictions-e.last.evictions), "c", "")
+	add("items", strconv.Itoa(e.cache.Len()), "g", "")
+	add("capacity", strconv.Itoa(e.cache.Capacity()), "g", "")
+	add("in_flight", strconv.FormatInt(e.metrics.inFlight.Load(), 10), "g", "")
+	for op := range numOps {
+		var delta [len(latencyBuckets) + 1]uint64
+		var total uint64
+		for i := range delta {
+			delta[i] = now.latency[op][i] - e.last.latency[op][i]
+			total += delta[i]
+		}
+		if total == 0 {
+			continue
+		}
+		for _, p := range statsdPercentiles {
+			ms := percentileUpperBound(delta[:], total, p.fraction) * 1000
+			add("latency."+p.name, strconv.FormatFloat(ms, 'g', -1, 64), "g", opNames[op])
+		}
+	}
+	e.last = now
+	e.send(lines)
+}
+
+// percentileUpperBound returns the upper bound, in seconds, of the histogram
+// bucket holding the given fraction of total observations. Observations
+// beyond the last bound are reported as that bound.
+func percentileUpperBound(buckets []uint64, total uint64, fraction float64) float64 {
+	rank := uint64(fraction * float64(total))
+	var cumulative uint64
+	for i, n := range buckets {
+		cumulative += n
+		if cumulative > rank && i < len(latencyBuckets) {
+			return latencyBuckets[i]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// send writes lines in as few datagrams as fit statsdMaxPacket.
+func (e *StatsDEmitter) send(lines []string) {
+	var packet []byte
+	var err error
+	for i, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			if _, werr := e.conn.Write(packet); werr != nil && err == nil {
+				err = werr
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+		if i == len(lines)-1 {
+			if _, werr := e.conn.Write(packet); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	// A refused datagram is only reported by a later write, so failures come
+	// and go with an unreachable server; log them at most once a minute.
+	if err != nil && time.Since(e.warnedAt) >= time.Minute {
+		log.Printf("Warning: sending metrics to %s failed: %v", e.addr, err)
+		e.warnedAt = time.Now()
+	}
+}
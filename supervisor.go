@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default restart policy of supervised workers.
+const (
+	workerBackoffMin   = time.Second
+	workerBackoffMax   = time.Minute
+	workerRestartLimit = 5 // Panics in a row before a worker is given up on
+)
+
+// Worker states reported in /stats.
+const (
+	WorkerRunning    = "running"
+	WorkerRestarting = "restarting" // Waiting out the backoff after a panic
+	WorkerFailed     = "failed"     // Given up on after too many panics in a row
+	WorkerStopped    = "stopped"    // Returned without panicking
+)
+
+// WorkerStats reports one background worker in /stats.
+type WorkerStats struct {
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	Restarts      int        `json:"restarts"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// supervisedWorker is the state of one worker, guarded by the supervisor's
+// mutex.
+type supervisedWorker struct {
+	stats    WorkerStats
+	failures int // Panics in a row
+}
+
+// Supervisor runs the cache's background workers, so that a panic in one of
+// them neither kills the process nor silently turns its feature off. A
+// worker that panics is logged with its stack and restarted after a backoff
+// that doubles from backoffMin up to backoffMax. After limit panics in a row
+// it is given up on and reported as failed; a worker that ran for longer
+// than backoffMax before panicking starts counting afresh.
+//
+// A panic raised while a shard mutex is held still leaves that shard
+// locked; supervision only contains panics of the worker's own code.
+type Supervisor struct {
+	backoffMin, backoffMax time.Duration
+	limit                  int
+
+	mutex   sync.Mutex
+	workers []*supervisedWorker
+}
+
+// NewSupervisor creates a supervisor with the default restart policy.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{backoffMin: workerBackoffMin, backoffMax: workerBackoffMax, limit: workerRestartLimit}
+}
+
+// Go runs run in a new goroutine under supervision. run is restarted from
+// the beginning after a panic, so it must set up whatever it needs, such as
+// tickers, itself.
+func (s *Supervisor) Go(name string, run func()) {
+	w := &supervisedWorker{stats: WorkerStats{Name: name, State: WorkerRunning}}
+	s.mutex.Lock()
+	s.workers = append(s.workers, w)
+	s.mutex.Unlock()
+	go s.supervise(w, run)
+}
+
+func (s *Supervisor) supervise(w *supervisedWorker, run func()) {
+	backoff := s.backoffMin
+	for {
+		started := time.Now()
+		stack, err := runRecovered(run)
+		now := time.Now()
+
+		s.mutex.Lock()
+		if err == nil {
+			w.stats.State = WorkerStopped
+			s.mutex.Unlock()
+			return
+		}
+		if now.Sub(started) > s.backoffMax {
+			w.failures = 0
+			backoff = s.backoffMin
+		}
+		w.failures++
+		w.stats.LastError = err.Error()
+		w.stats.LastFailureAt = &now
+		if w.failures > s.limit {
+			w.stats.State = WorkerFailed
+			s.mutex.Unlock()
+			log.Printf("Worker %s failed %d times in a row, giving up: %v\n%s", w.stats.Name, w.failures, err, stack)
+			return
+		}
+		w.stats.Restarts++
+		w.stats.State = WorkerRestarting
+		s.mutex.Unlock()
+
+		log.Printf("Worker %s failed, restarting in %s (%d/%d): %v\n%s", w.stats.Name, backoff, w.failures, s.limit, err, stack)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, s.backoffMax)
+		s.mutex.Lock()
+		w.stats.State = WorkerRunning
+		s.mutex.Unlock()
+	}
+}
+
+// runRecovered calls run and turns a panic into an error, with the stack of
+// the panicking goroutine.
+func runRecovered(run func()) (stack []byte, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack = debug.Stack()
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	run()
+	return nil, nil
+}
+
+// Stats returns the state of every worker, in the order they were started.
+func (s *Supervisor) Stats() []WorkerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make([]WorkerStats, len(s.workers))
+	for i, w := range s.workers {
+		stats[i] = w.stats
+	}
+	return stats
+}
+
+// WorkerSummary is the worker line of the /health body.
+type WorkerSummary struct {
+	Running, Restarting int
+	Failed              []string // Names of the workers given up on
+}
+
+func (s WorkerSummary) String() string {
+	failed := "none"
+	if len(s.Failed) > 0 {
+		failed = strings.Join(s.Failed, ",")
+	}
+	return fmt.Sprintf("workers running=%d restarting=%d failed=%s", s.Running, s.Restarting, failed)
+}
+
+// Summary counts the workers by state for /health.
+func (s *Supervisor) Summary() WorkerSummary {
+	var sum WorkerSummary
+	for _, w := range s.Stats() {
+		switch w.State {
+		case WorkerRunning:
+			sum.Running++
+		case WorkerRestarting:
+			sum.Restarting++
+		case WorkerFailed:
+			sum.Failed = append(sum.Failed, w.Name)
+		}
+	}
+	return sum
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSupervisor returns a supervisor with a fast restart policy.
+func testSupervisor(backoffMin, backoffMax time.Duration, limit int) *Supervisor {
+	return &Supervisor{backoffMin: backoffMin, backoffMax: backoffMax, limit: limit}
+}
+
+// waitForState waits until the only worker of s reaches state.
+func waitForState(t *testing.T, s *Supervisor, state string) WorkerStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := s.Stats(); stats[0].State == state {
+			return stats[0]
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("worker still %s, want %s", s.Stats()[0].State, state)
+	return WorkerStats{}
+}
+
+func TestSupervisorRestartsWithBackoffThenGivesUp(t *testing.T) {
+	s := testSupervisor(5*time.Millisecond, 20*time.Millisecond, 4)
+	var mutex sync.Mutex
+	var starts []time.Time
+	s.Go("flaky", func() {
+		mutex.Lock()
+		starts = append(starts, time.Now())
+		mutex.Unlock()
+		panic("injected")
+	})
+
+	stats := waitForState(t, s, WorkerFailed)
+	if stats.Restarts != 4 || stats.LastError != "panic: injected" || stats.LastFailureAt == nil {
+		t.Errorf("stats %+v, want 4 restarts and the panic", stats)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(starts) != 5 {
+		t.Fatalf("worker ran %d times, want the first run and 4 restarts", len(starts))
+	}
+	for i, want := range []time.Duration{5, 10, 20, 20} { // Doubling, capped at backoffMax
+		if gap := starts[i+1].Sub(starts[i]); gap < want*time.Millisecond {
+			t.Errorf("restart %d after %s, want a backoff of at least %dms", i+1, gap, want)
+		}
+	}
+	if sum := s.Summary(); !slices.Equal(sum.Failed, []string{"flaky"}) || sum.Running != 0 {
+		t.Errorf("summary %+v, want flaky failed", sum)
+	}
+}
+
+func TestSupervisorRecoversFromOnePanic(t *testing.T) {
+	s := testSupervisor(time.Millisecond, 10*time.Millisecond, 3)
+	var runs int
+	release := make(chan struct{})
+	s.Go("once", func() {
+		runs++ // Runs are sequential
+		if runs == 1 {
+			panic("first run")
+		}
+		<-release
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := s.Stats()[0]; stats.State == WorkerRunning && stats.Restarts == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stats := s.Stats()[0]
+	if stats.State != WorkerRunning || stats.Restarts != 1 || stats.LastError != "panic: first run" {
+		t.Errorf("after one panic: %+v", stats)
+	}
+	if sum := s.Summary(); sum.Running != 1 || len(sum.Failed) != 0 {
+		t.Errorf("summary %+v", sum)
+	}
+	close(release)
+	waitForState(t, s, WorkerStopped)
+}
+
+func TestSupervisorForgetsOldPanics(t *testing.T) {
+	s := testSupervisor(time.Millisecond, 5*time.Millisecond, 1)
+	var runs int
+	s.Go("slow", func() {
+		runs++
+		if runs <= 3 {
+			time.Sleep(10 * time.Millisecond) // Longer than backoffMax: not in a row
+			panic("late")
+		}
+	})
+	stats := waitForState(t, s, WorkerStopped)
+	if stats.Restarts != 3 {
+		t.Errorf("restarts %d, want 3: panics far apart must not add up to the limit", stats.Restarts)
+	}
+}
+
+func TestSupervisorStatsKeepStartOrder(t *testing.T) {
+	s := NewSupervisor()
+	block := make(chan struct{})
+	defer close(block)
+	for _, name := range []string{"a", "b", "c"} {
+		s.Go(name, func() { <-block })
+	}
+	var names []string
+	for _, w := range s.Stats() {
+		names = append(names, w.Name)
+	}
+	if !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Errorf("workers %v, want them in start order", names)
+	}
+	if got := s.Summary().String(); got != "workers running=3 restarting=0 failed=none" {
+		t.Errorf("summary line %q", got)
+	}
+}
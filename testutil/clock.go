@@ -0,0 +1,69 @@
+// Package testutil holds helpers shared by the cache's tests.
+package testutil
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock that stands still until Advance moves it. It
+// satisfies the cache's Clock interface, so tests can expire entries and fire
+// background sweeps without sleeping.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	c     chan time.Time
+	every time.Duration
+	next  time.Time
+}
+
+// NewFakeClock returns a clock that reads start until it is advanced.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a channel that receives a tick each time Advance moves
+// the clock past another multiple of d, and a function that stops it. Like
+// time.Ticker, it holds one tick and drops the rest while nobody reads.
+func (c *FakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		panic("testutil: non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{c: make(chan time.Time, 1), every: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t.c, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.tickers = slices.DeleteFunc(c.tickers, func(other *fakeTicker) bool { return other == t })
+	}
+}
+
+// Advance moves the clock forward by d and delivers the ticks that fall due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default: // Dropped, as time.Ticker does
+			}
+			t.next = t.next.Add(t.every)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockTicks(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	ticks, stop := clock.NewTicker(time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case tick := <-ticks:
+		t.Fatalf("tick at %v before the interval passed", tick)
+	default:
+	}
+
+	clock.Advance(3 * time.Second) // Three ticks fall due; one is kept
+	if tick := <-ticks; !tick.Equal(start.Add(time.Second)) {
+		t.Errorf("first tick at %v, want %v", tick, start.Add(time.Second))
+	}
+	select {
+	case tick := <-ticks:
+		t.Errorf("ticks were not dropped: got another at %v", tick)
+	default:
+	}
+	if now := clock.Now(); !now.Equal(start.Add(3999 * time.Millisecond)) {
+		t.Errorf("Now() = %v after advancing 3.999s", now)
+	}
+
+	stop()
+	clock.Advance(time.Hour)
+	select {
+	case tick := <-ticks:
+		t.Errorf("stopped ticker delivered %v", tick)
+	default:
+	}
+}
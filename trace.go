@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations recorded in a trace.
+const (
+	traceGet    byte = 'G'
+	tracePut    byte = 'P'
+	traceDelete byte = 'D'
+)
+
+// traceMagic starts every trace file, followed by the UnixNano start time
+// as 8 little-endian bytes. Each record is then
+//
+//	op byte | uvarint µs since the previous record | key hash, 8 bytes LE |
+//	uvarint key length | uvarint value size | uvarint cost (puts only)
+//
+// Value sizes are those written, or read on a GET hit; a miss has size 0.
+// Keys and values themselves are never written.
+const traceMagic = "KVTRACE1"
+
+// traceQueueSize is how many records may wait for the writer before new ones
+// are dropped.
+const traceQueueSize = 8192
+
+// traceRecord is one recorded operation.
+type traceRecord struct {
+	op      byte
+	at      int64 // UnixNano
+	keyHash uint64
+	keyLen  int
+	size    int
+	cost    int
+}
+
+// TraceStats reports the trace recorder in /stats.
+type TraceStats struct {
+	Path     string  `json:"path"`
+	Sample   float64 `json:"sample"`
+	Recorded uint64  `json:"recorded"`
+	Dropped  uint64  `json:"dropped"` // Records lost because the writer fell behind
+}
+
+// TraceRecorder writes the shape of cache traffic to a file: which
+// operation, a keyed hash of the key, the key length and value size and
+// when. Keys are sampled by hash, so a sampled key has its whole history in
+// the trace and a replay sees realistic hits for it. Records are handed to
+// a background writer and dropped, never waited for, when it falls behind.
+//
+// All methods are safe to call on a nil *TraceRecorder, which records
+// nothing.
+type TraceRecorder struct {
+	path   string
+	secret []byte
+	sample float64
+	cutoff uint64 // Keys whose hash is at most this are recorded
+
+	queue chan traceRecord
+	done  chan struct{}
+	close sync.Once
+
+	recorded atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// NewTraceRecorder creates path and starts recording the given fraction of
+// keys into it. The key hash is keyed with secret, so traces can be shared
+// without revealing keys to anyone who does not hold it.
+func NewTraceRecorder(path string, secret []byte, sample float64) (*TraceRecorder, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("a trace key secret is required")
+	}
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("trace sample must be in (0, 1], got %v", sample)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &TraceRecorder{
+		path:   path,
+		secret: secret,
+		sample: sample,
+		cutoff: ^uint64(0),
+		queue:  make(chan traceRecord, traceQueueSize),
+		done:   make(chan struct{}),
+	}
+	if sample < 1 {
+		t.cutoff = uint64(sample * (1 << 64))
+	}
+	go t.write(f)
+	log.Printf("Recording a trace of %.4g%% of keys to %s", sample*100, path)
+	return t, nil
+}
+
+// hashKey returns the keyed hash a trace stores instead of key.
+func (t *TraceRecorder) hashKey(key string) uint64 {
+	mac := hmac.New(sha256.New, t.secret)
+	io.WriteString(mac, key)
+	return binary.LittleEndian.Uint64(mac.Sum(nil))
+}
+
+// record queues one operation on key, if the key is sampled.
+func (t *TraceRecorder) record(op byte, key string, size, cost int) {
+	if t == nil {
+		return
+	}
+	h := t.hashKey(key)
+	if h > t.cutoff {
+		return
+	}
+	select {
+	case t.queue <- traceRecord{op: op, at: time.Now().UnixNano(), keyHash: h, keyLen: len(key), size: size, cost: cost}:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// write drains the queue into f until Close.
+func (t *TraceRecorder) write(f *os.File) {
+	defer close(t.done)
+	w := bufio.NewWriter(f)
+	start := time.Now().UnixNano()
+	w.WriteString(traceMagic)
+	w.Write(binary.LittleEndian.AppendUint64(nil, uint64(start)))
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	last := start
+	var buf []byte
+	for {
+		select {
+		case rec, ok := <-t.queue:
+			if !ok {
+				if err := w.Flush(); err != nil {
+					log.Printf("Trace to %s failed: %v", t.path, err)
+				}
+				f.Close()
+				return
+			}
+			// Records from concurrent requests may arrive slightly out of
+			// order; those are stamped with the time of the one before.
+			delta := max(rec.at-last, 0) / int64(time.Microsecond)
+			last += delta * int64(time.Microsecond)
+			buf = appendTraceRecord(buf[:0], rec, uint64(delta))
+			w.Write(buf)
+			t.recorded.Add(1)
+		case <-flush.C:
+			w.Flush()
+		}
+	}
+}
+
+// appendTraceRecord encodes rec, delta microseconds after the record before
+// it.
+func appendTraceRecord(b []byte, rec traceRecord, delta uint64) []byte {
+	b = append(b, rec.op)
+	b = binary.AppendUvarint(b, delta)
+	b = binary.LittleEndian.AppendUint64(b, rec.keyHash)
+	b = binary.AppendUvarint(b, uint64(rec.keyLen))
+	b = binary.AppendUvarint(b, uint64(rec.size))
+	if rec.op == tracePut {
+		b = binary.AppendUvarint(b, uint64(rec.cost))
+	}
+	return b
+}
+
+// Close stops recording and flushes the file.
+func (t *TraceRecorder) Close() {
+	if t == nil {
+		return
+	}
+	t.close.Do(func() { close(t.queue) })
+	<-t.done
+}
+
+// Stats returns the recorder's counters, or nil when not recording.
+func (t *TraceRecorder) Stats() *TraceStats {
+	if t == nil {
+		return nil
+	}
+	return &TraceStats{Path: t.path, Sample: t.sample, Recorded: t.recorded.Load(), Dropped: t.dropped.Load()}
+}
+
+// EnableTrace records the cache's GETs, PUTs and deletes into t. Must be
+// called before the cache starts serving requests.
+func (sc *ShardedCache) EnableTrace(t *TraceRecorder) {
+	sc.trace = t
+}
+
+// traceReader decodes a trace file.
+type traceReader struct {
+	r     *bufio.Reader
+	start int64 // UnixNano the recording started
+	at    int64 // UnixNano of the last record read
+}
+
+func newTraceReader(r io.Reader) (*traceReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(traceMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(traceMagic)]) != traceMagic {
+		return nil, errors.New("not a kvcache trace")
+	}
+	start := int64(binary.LittleEndian.Uint64(header[len(traceMagic):]))
+	return &traceReader{r: br, start: start, at: start}, nil
+}
+
+// next returns the next record, or io.EOF after the last one.
+func (tr *traceReader) next() (traceRecord, error) {
+	op, err := tr.r.ReadByte()
+	if err != nil {
+		return traceRecord{}, err
+	}
+	if op != traceGet && op != tracePut && op != traceDelete {
+		return traceRecord{}, fmt.Errorf("unknown trace operation %q", op)
+	}
+	delta, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return traceRecord{}, truncated(err)
+	}
+	var hash [8]byte
+	if _, err := io.ReadFull(tr.r, hash[:]); err != nil {
+		return traceRecord{}, truncated(err)
+	}
+	var sizes [3]uint64 // Key length, value size and, for puts, cost
+	n := 2
+	if op == tracePut {
+		n = 3
+	}
+	for i := range n {
+		if sizes[i], err = binary.ReadUvarint(tr.r); err != nil {
+			return traceRecord{}, truncated(err)
+		}
+	}
+	tr.at += int64(delta) * int64(time.Microsecond)
+	return traceRecord{
+		op:      op,
+		at:      tr.at,
+		keyHash: binary.LittleEndian.Uint64(hash[:]),
+		keyLen:  int(sizes[0]),
+		size:    int(sizes[1]),
+		cost:    int(sizes[2]),
+	}, nil
+}
+
+// truncated reports an end of file inside a record as an error of its own.
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// errTransformRejected fails a write refused by a write transform.
+var errTransformRejected = errors.New("rejected by write transform")
+
+// redactedText replaces what redact-pattern matches.
+const redactedText = "[REDACTED]"
+
+// Transform rewrites a value before it is stored. It returns the value to
+// store, which may be value itself, or an error to refuse the write.
+type Transform func(key, value string) (string, error)
+
+// writeTransform is one step of a TransformChain.
+type writeTransform struct {
+	prefix string // Keys the step applies to; "" = every key
+	name   string // Built-in name, reported in replies and errors
+	apply  Transform
+}
+
+// TransformChain applies the configured write transforms to PUT values: every
+// step whose prefix matches the key, in the order they were configured. A
+// nil chain leaves values alone.
+type TransformChain struct {
+	steps []writeTransform
+}
+
+// Apply runs the chain over value and returns the result together with the
+// names of the steps that changed it, in order. An error names the step
+// that refused the value.
+func (c *TransformChain) Apply(key, value string) (string, []string, error) {
+	if c == nil {
+		return value, nil, nil
+	}
+	var changed []string
+	for _, step := range c.steps {
+		if !strings.HasPrefix(key, step.prefix) {
+			continue
+		}
+		out, err := step.apply(key, value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w %s: %v", errTransformRejected, step.name, err)
+		}
+		if out != value {
+			changed = append(changed, step.name)
+			value = out
+		}
+	}
+	return value, changed, nil
+}
+
+// applyEncoded is Apply for a value that must stay valid for encoding. A
+// result that no longer is fails the write with errTransformRejected too.
+func (c *TransformChain) applyEncoded(key, value string, encoding Encoding) (string, []string, error) {
+	value, changed, err := c.Apply(key, value)
+	if err == nil && !encoding.valid(value) {
+		err = fmt.Errorf("%w %s: the value is no longer valid %s", errTransformRejected, strings.Join(changed, ","), encoding)
+	}
+	return value, changed, err
+}
+
+// transformValue applies opts.Transform to value, if there is one, and
+// clears it so that a put passed on is not transformed twice.
+func (opts *PutOptions) transformValue(key, value string) (string, error) {
+	if opts.Transform == nil {
+		return value, nil
+	}
+	out, err := opts.Transform(key, value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errTransformRejected, err)
+	}
+	opts.Transform = nil
+	return out, nil
+}
+
+// newWriteTransform builds the built-in transform called name, with its
+// argument.
+func newWriteTransform(name, arg string) (Transform, error) {
+	switch name {
+	case "trim":
+		if arg != "" {
+			return nil, fmt.Errorf("trim takes no argument")
+		}
+		return func(_, value string) (string, error) {
+			return strings.TrimSpace(value), nil
+		}, nil
+	case "reject-pattern", "redact-pattern":
+		if arg == "" {
+			return nil, fmt.Errorf("%s needs a regular expression", name)
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		if name == "redact-pattern" {
+			return func(_, value string) (string, error) {
+				return re.ReplaceAllLiteralString(value, redactedText), nil
+			}, nil
+		}
+		return func(_, value string) (string, error) {
+			if re.MatchString(value) {
+				return "", fmt.Errorf("value matches %s", re)
+			}
+			return value, nil
+		}, nil
+	case "truncate":
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("truncate needs a length of at least 1")
+		}
+		return func(_, value string) (string, error) {
+			if utf8.RuneCountInString(value) <= limit {
+				return value, nil
+			}
+			return string([]rune(value)[:limit]), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q, expected trim, reject-pattern, redact-pattern or truncate", name)
+}
+
+// LoadTransformChain reads write transforms from path, one per line:
+//
+//	<key prefix> <transform> [argument]
+//
+// A prefix of * matches every key. The argument is the rest of the line, so
+// a regular expression may contain spaces. Blank lines and lines starting
+// with # are skipped.
+func LoadTransformChain(path string) (*TransformChain, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chain := &TransformChain{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a key prefix and a transform", line)
+		}
+		prefix, name := fields[0], fields[1]
+		arg := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(text, prefix)), name))
+		if prefix == "*" {
+			prefix = ""
+		}
+		apply, err := newWriteTransform(name, arg)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		chain.steps = append(chain.steps, writeTransform{prefix: prefix, name: name, apply: apply})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TTLPolicy bounds the TTLs clients may ask for when writing. A zero bound is
+// disabled. Writes without a TTL get the TTL of the first rule matching their
+// key, and otherwise never expire unless MaxAge is set.
+type TTLPolicy struct {
+	Min    time.Duration // Shorter TTLs are raised to this
+	Max    time.Duration // Longer TTLs are lowered to this
+	Rules  []TTLRule     // Default TTLs by key pattern, in order
+	MaxAge time.Duration // Longest any entry lives, TTL or not (see SetMaxEntryAge)
+}
+
+// TTLRule gives keys matching a pattern a default TTL.
+type TTLRule struct {
+	Pattern string // As configured, reported in PUT replies
+	TTL     time.Duration
+	re      *regexp.Regexp
+}
+
+// parseTTLRules compiles rules of the form "pattern=ttl". A pattern is a
+// glob, where * matches any run of characters and ? a single one, or a
+// regular expression after "re:"; either must match the whole key. A TTL of
+// 0 or "never" means keys matching the rule never expire.
+func parseTTLRules(specs []string) ([]TTLRule, error) {
+	var rules []TTLRule
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("rule %q is not pattern=ttl", spec)
+		}
+		pattern, raw := spec[:i], spec[i+1:]
+		var ttl time.Duration
+		if raw != "never" {
+			var err error
+			ttl, err = time.ParseDuration(raw)
+			if err != nil || ttl < 0 || ttl%time.Second != 0 {
+				return nil, fmt.Errorf("rule %q needs a TTL of whole seconds or never", spec)
+			}
+		}
+		expr, isRegexp := strings.CutPrefix(pattern, "re:")
+		if !isRegexp {
+			expr = globToRegexp(pattern)
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("rule %q: %v", spec, err)
+		}
+		rules = append(rules, TTLRule{Pattern: pattern, TTL: ttl, re: regexp.MustCompile("^(?:" + expr + ")$")})
+	}
+	return rules, nil
+}
+
+// globToRegexp translates a glob into a regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString("(?s:.*)")
+		case '?':
+			b.WriteString("(?s:.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
+
+// Resolve returns the TTL to apply to a write of key that asked for
+// requested, whether the bounds or MaxAge adjusted it, and the pattern of the rule it
+// came from when requested was 0.
+func (p TTLPolicy) Resolve(key string, requested time.Duration) (time.Duration, bool, string) {
+	var pattern string
+	if requested == 0 {
+		for _, rule := range p.Rules {
+			if rule.re.MatchString(key) {
+				requested, pattern = rule.TTL, rule.Pattern
+				break
+			}
+		}
+	}
+	ttl, adjusted := p.Clamp(requested)
+	if p.MaxAge > 0 && (ttl == 0 || ttl > p.MaxAge) {
+		ttl, adjusted = p.MaxAge, true
+	}
+	return ttl, adjusted, pattern
+}
+
+// Validate checks that the bounds are whole seconds, as TTLs are, and that
+// they do not cross.
+func (p TTLPolicy) Validate() error {
+	for _, bound := range []time.Duration{p.Min, p.Max} {
+		if bound < 0 || bound%time.Second != 0 {
+			return fmt.Errorf("TTL bound %s must be a whole number of seconds", bound)
+		}
+	}
+	if p.Max > 0 && p.Min > p.Max {
+		return fmt.Errorf("minimum TTL %s exceeds maximum TTL %s", p.Min, p.Max)
+	}
+	return nil
+}
+
+// Clamp returns the TTL to apply for requested, and whether it was adjusted.
+func (p TTLPolicy) Clamp(requested time.Duration) (time.Duration, bool) {
+	switch {
+	case requested == 0:
+		return 0, false
+	case p.Min > 0 && requested < p.Min:
+		return p.Min, true
+	case p.Max > 0 && requested > p.Max:
+		return p.Max, true
+	}
+	return requested, false
+}
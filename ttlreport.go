@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// defaultTTLReportSample is how many entries per shard GET /admin/ttl-report
+// examines by default (-ttl-report-sample), which bounds how long it holds
+// each shard lock.
+const defaultTTLReportSample = 1000
+
+// TTLBuckets counts entries by the time left until their TTL runs out.
+type TTLBuckets struct {
+	Under1m  int `json:"under_1m"`
+	Under10m int `json:"under_10m"`
+	Under1h  int `json:"under_1h"`
+	Under1d  int `json:"under_1d"`
+	Longer   int `json:"longer"`
+}
+
+// add counts an entry with remaining time left.
+func (b *TTLBuckets) add(remaining time.Duration) {
+	switch {
+	case remaining < time.Minute:
+		b.Under1m++
+	case remaining < 10*time.Minute:
+		b.Under10m++
+	case remaining < time.Hour:
+		b.Under1h++
+	case remaining < 24*time.Hour:
+		b.Under1d++
+	default:
+		b.Longer++
+	}
+}
+
+// TTLReportResponse structure for GET /admin/ttl-report replies. Apart from
+// Entries, the counts are over the sampled entries.
+type TTLReportResponse struct {
+	Status     string `json:"status"`
+	Entries    int    `json:"entries"`
+	WithoutTTL int    `json:"without_ttl"`
+	Expired    int    `json:"expired"` // Past their TTL but not yet removed
+
+	Sampled        int `json:"sampled"`          // Entries examined
+	SamplePerShard int `json:"sample_per_shard"` // 0 = every entry
+
+	WithoutTTLPct       float64 `json:"without_ttl_pct"`
+	WithoutTTLPctMargin float64 `json:"without_ttl_pct_margin"` // ± percentage points at 95% confidence; 0 when every entry was examined
+
+	Remaining TTLBuckets `json:"remaining"`        // Entries with a TTL still to run, by time left
+	Caveat    string     `json:"caveat,omitempty"` // Only when some entries were not examined
+
+	OldestAgeMs   int64 `json:"oldest_age_ms"`
+	MaxEntryAgeMs int64 `json:"max_entry_age_ms,omitempty"`
+	OverMaxAge    int   `json:"over_max_age"` // Older than max_entry_age_ms, awaiting the sweeper
+}
+
+// TTLReport examines up to perShard entries of every shard, hot and cold in
+// proportion to their number, one shard at a time; perShard 0 examines them
+// all. The sample bounds how long each shard lock is held.
+func (sc *ShardedCache) TTLReport(perShard int) TTLReportResponse {
+	report := TTLReportResponse{Status: "OK", SamplePerShard: perShard, MaxEntryAgeMs: sc.maxAge.Milliseconds()}
+	now := sc.now()
+	oldest := now
+	for _, shard := range sc.shards {
+		count := func(e *entry) {
+			report.Sampled++
+			switch {
+			case e.expiresAt == 0:
+				report.WithoutTTL++
+			case e.expired(now):
+				report.Expired++
+			default:
+				report.Remaining.add(time.Duration(e.expiresAt - now))
+			}
+			if e.createdAt != 0 {
+				oldest = min(oldest, e.createdAt)
+			}
+			if sc.maxAge > 0 && shard.tooOld(e, now) {
+				report.OverMaxAge++
+			}
+		}
+		shard.mutex.Lock()
+		hot, cold := len(shard.items), shard.cold.len()
+		report.Entries += hot + cold
+		hotTake, coldTake := hot, cold
+		if perShard > 0 && hot+cold > perShard {
+			hotTake = perShard * hot / (hot + cold)
+			coldTake = perShard - hotTake
+		}
+		for _, elem := range shard.items {
+			if hotTake == 0 {
+				break
+			}
+			count(elem.Value.(*entry))
+			hotTake--
+		}
+		shard.cold.walk(func(e *entry) bool {
+			if coldTake == 0 {
+				return false
+			}
+			count(e)
+			coldTake--
+			return true
+		})
+		shard.mutex.Unlock()
+	}
+	report.OldestAgeMs = time.Duration(now - oldest).Milliseconds()
+
+	if report.Sampled > 0 {
+		p := float64(report.WithoutTTL) / float64(report.Sampled)
+		report.WithoutTTLPct = 100 * p
+		if report.Sampled < report.Entries {
+			n, total := float64(report.Sampled), float64(report.Entries)
+			report.WithoutTTLPctMargin = 100 * 1.96 * math.Sqrt(p*(1-p)/n*(total-n)/(total-1))
+		}
+	}
+	if report.Sampled < report.Entries {
+		report.Caveat = fmt.Sprintf("Counts other than entries are from %d of %d entries, at most %d per shard. "+
+			"Entries are taken in map order, and cold ones oldest first, not uniformly at random, so the margin, which assumes a random sample, is a guide only.",
+			report.Sampled, report.Entries, perShard)
+	}
+	return report
+}
+
+// HandleTTLReport handles GET /admin/ttl-report, examining up to perShard
+// entries of each shard.
+func HandleTTLReport(cache *ShardedCache, perShard int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(cache.TTLReport(perShard))
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiPage is the inspection page served at GET /ui. It is self-contained and
+// only talks to the JSON API, with relative URLs, sending the token the
+// operator enters as "Authorization: Bearer <token>".
+//
+//go:embed ui.html
+var uiPage []byte
+
+// HandleUI serves the inspection page.
+func HandleUI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.WriteHeader(http.StatusOK)
+		w.Write(uiPage)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"slices"
+	"time"
+)
+
+// UnchangedPutStats reports skipped unchanged puts in /stats.
+type UnchangedPutStats struct {
+	TTLToleranceMs int64  `json:"ttl_tolerance_ms"`
+	Coalesced      uint64 `json:"coalesced"` // Puts that left their entry as it was
+}
+
+// SkipUnchangedPuts makes puts with PutOptions.Coalesce leave a live entry
+// alone when they would store the same value with the same options and a
+// TTL within tolerance of the entry's, instead of bumping its version and
+// creation time. Such a put still restarts the entry's TTL and, with
+// touch-on-write, counts as a use. Must be called before the cache starts
+// serving requests.
+func (sc *ShardedCache) SkipUnchangedPuts(tolerance time.Duration) {
+	for _, shard := range sc.shards {
+		shard.skipUnchanged = true
+		shard.unchangedTolerance = tolerance
+	}
+	log.Printf("Skipping puts that do not change their entry (TTL tolerance %s)", tolerance)
+}
+
+// unchangedLocked reports whether writing value with opts to the live entry
+// ent would store what it already holds. Lock entries, entries that refresh
+// themselves and entries written by someone else never match.
+// MUST be called with the mutex held.
+func (c *LRUCache) unchangedLocked(ent *entry, value string, opts PutOptions, immutable bool, now int64) bool {
+	if !c.live(ent, now) || ent.fence != 0 || ent.refresh != nil || opts.Refresh != nil {
+		return false
+	}
+	if ent.value != value || ent.encoding != opts.Encoding || ent.immutable != immutable || ent.writer != opts.Writer {
+		return false
+	}
+	if !slices.Equal(ent.readers, opts.Readers) {
+		return false
+	}
+	cost := max(opts.Cost, MinCost)
+	if ent.cost != cost || ent.staleFor != opts.StaleFor || ent.idleTTL != opts.IdleTTL {
+		return false
+	}
+	if (ent.ttl == 0) != (opts.TTL == 0) {
+		return false
+	}
+	diff := ent.ttl - opts.TTL
+	return diff <= c.unchangedTolerance && -diff <= c.unchangedTolerance
+}
+
+// coalesceLocked applies an unchanged put to elem's entry: the TTL restarts
+// with expiresAt, still bounded by the entry's maximum age, and recency is
+// refreshed when writes count as a use.
+// MUST be called with the mutex held.
+func (c *LRUCache) coalesceLocked(elem *list.Element, ttl time.Duration, expiresAt, now int64) PutResult {
+	ent := elem.Value.(*entry)
+	if c.maxAge > 0 {
+		expiresAt = min(expiresAt, ent.createdAt+int64(c.maxAge))
+	}
+	ent.ttl = ttl
+	ent.expiresAt = expiresAt
+	if ent.idleTTL > 0 {
+		ent.hardExpiresAt = expiresAt
+		ent.slideExpiry(now)
+	}
+	if c.touchOnWrite {
+		c.touch(elem)
+	}
+	c.unchangedPuts.Add(1)
+	c.pressure.record(now, false)
+	return PutResult{Unchanged: true, Pressure: c.pressure.ratio(now), Generation: ent.generation}
+}
+
+// UnchangedPutStats sums skipped puts over all shards, or returns nil when
+// puts are always written.
+func (sc *ShardedCache) UnchangedPutStats() *UnchangedPutStats {
+	if len(sc.shards) == 0 || !sc.shards[0].skipUnchanged {
+		return nil
+	}
+	stats := &UnchangedPutStats{TTLToleranceMs: sc.shards[0].unchangedTolerance.Milliseconds()}
+	for _, shard := range sc.shards {
+		stats.Coalesced += shard.unchangedPuts.Load()
+	}
+	return stats
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchLimit = 100  // Keys returned by GET /search without ?limit=
+	maxSearchLimit     = 1000 // Upper bound for ?limit=
+)
+
+// ValueIndex is an optional secondary index from the first prefixLen runes of
+// each value to the keys holding such values. Like the key directory it is
+// updated under the owning shard's lock, so it follows every write, removal
+// and eviction exactly. At most maxKeys keys are indexed; once full, new keys
+// are left out until others are removed.
+//
+// All methods are safe to call on a nil *ValueIndex, which indexes nothing.
+type ValueIndex struct {
+	prefixLen int
+	maxKeys   int
+
+	mutex    sync.Mutex
+	byKey    map[string]string              // key -> indexed prefix
+	byPrefix map[string]map[string]struct{} // prefix -> keys
+	full     bool                           // A key was left out since the index was last below maxKeys
+}
+
+// NewValueIndex creates an index over value prefixes of prefixLen runes.
+func NewValueIndex(prefixLen, maxKeys int) *ValueIndex {
+	return &ValueIndex{
+		prefixLen: prefixLen,
+		maxKeys:   maxKeys,
+		byKey:     make(map[string]string),
+		byPrefix:  make(map[string]map[string]struct{}),
+	}
+}
+
+// truncate returns the first prefixLen runes of s.
+func (x *ValueIndex) truncate(s string) string {
+	n := 0
+	for i := range s {
+		if n == x.prefixLen {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// set records that key now holds value.
+func (x *ValueIndex) set(key, value string) {
+	if x == nil {
+		return
+	}
+	prefix := x.truncate(value)
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	old, indexed := x.byKey[key]
+	if indexed && old == prefix {
+		return
+	}
+	if indexed {
+		x.unlink(key, old)
+	} else if len(x.byKey) >= x.maxKeys {
+		x.full = true
+		return
+	}
+	x.byKey[key] = prefix
+	keys := x.byPrefix[prefix]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		x.byPrefix[prefix] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// remove forgets key.
+func (x *ValueIndex) remove(key string) {
+	if x == nil {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if prefix, indexed := x.byKey[key]; indexed {
+		delete(x.byKey, key)
+		x.unlink(key, prefix)
+		x.full = false
+	}
+}
+
+// unlink drops key from the prefix bucket. MUST be called with the mutex held.
+func (x *ValueIndex) unlink(key, prefix string) {
+	keys := x.byPrefix[prefix]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(x.byPrefix, prefix)
+	}
+}
+
+// candidates returns the keys whose indexed prefix is compatible with a
+// search for values starting with prefix, and whether the index is full.
+func (x *ValueIndex) candidates(prefix string) ([]string, bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	var out []string
+	if utf8.RuneCountInString(prefix) >= x.prefixLen {
+		// At least as long as the indexed prefix: exactly one bucket can match.
+		for key := range x.byPrefix[x.truncate(prefix)] {
+			out = append(out, key)
+		}
+		return out, x.full
+	}
+	// Shorter than the indexed prefix: every bucket starting with it.
+	for indexed, keys := range x.byPrefix {
+		if strings.HasPrefix(indexed, prefix) {
+			for key := range keys {
+				out = append(out, key)
+			}
+		}
+	}
+	return out, x.full
+}
+
+// Len returns the number of indexed keys.
+func (x *ValueIndex) Len() int {
+	if x == nil {
+		return 0
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return len(x.byKey)
+}
+
+// EnableValueIndex builds the value prefix index from the current contents
+// and keeps it updated from then on. Must be called before the cache starts
+// serving requests.
+func (sc *ShardedCache) EnableValueIndex(prefixLen, maxKeys int) {
+	if prefixLen <= 0 {
+		return
+	}
+	index := NewValueIndex(prefixLen, maxKeys)
+	for _, shard := range sc.shards {
+		shard.mutex.Lock()
+		for key, elem := range shard.items {
+			index.set(key, elem.Value.(*entry).value)
+		}
+		shard.cold.each(func(e *entry) { index.set(e.key, e.value) })
+		shard.valueIndex = index
+		shard.mutex.Unlock()
+	}
+	sc.valueIndex = index
+	log.Printf("Value prefix index enabled (%d-character prefixes, up to %d keys)", prefixLen, maxKeys)
+}
+
+// Peek returns the value of key if it is present and unexpired, without
+// updating LRU order or rehydrating cold entries. An entry whose read ACL
+// does not list reader (see requestReader) counts as absent.
+func (c *LRUCache) Peek(key, reader string) (string, bool) {
+	now := c.now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, hit := c.items[key]; hit {
+		ent := elem.Value.(*entry)
+		return ent.value, c.live(ent, now) && readableBy(ent.readers, reader)
+	}
+	if ref, _, cold := c.cold.find(key); cold && (ref.expiresAt == 0 || now < ref.expiresAt) && ref.generation >= c.generation.Load() {
+		return c.cold.entryAt(ref).value, true
+	}
+	return "", false
+}
+
+// SearchValuePrefix returns up to limit keys, sorted, whose current value
+// starts with prefix, and whether the index was full (so matches may be
+// missing). Each candidate is re-checked against its shard. Keys reader may
+// not read are left out.
+func (sc *ShardedCache) SearchValuePrefix(prefix string, limit int, reader string) ([]string, bool) {
+	candidates, full := sc.valueIndex.candidates(prefix)
+	sort.Strings(candidates)
+	keys := []string{}
+	for _, key := range candidates {
+		if len(keys) == limit {
+			break
+		}
+		value, ok := sc.shards[sc.getShardIndex(key)].Peek(key, reader)
+		if ok && strings.HasPrefix(value, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, full
+}
+
+// SearchResponse structure for GET /search replies
+type SearchResponse struct {
+	Status    string   `json:"status"`
+	Keys      []string `json:"keys"`
+	IndexFull bool     `json:"index_full"` // Some keys were not indexed, results may be incomplete
+}
+
+func HandleSearch(cache *ShardedCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		prefix := query.Get("value-prefix")
+		if prefix == "" {
+			writeJSONError(w, "Missing 'value-prefix' query parameter.", http.StatusBadRequest)
+			return
+		}
+		limit := defaultSearchLimit
+		if raw := query.Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 || n > maxSearchLimit {
+				writeJSONError(w, fmt.Sprintf("Invalid 'limit' parameter, expected 1 to %d.", maxSearchLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		keys, full := cache.SearchValuePrefix(prefix, limit, requestReader(r))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(SearchResponse{
+			Status:    "OK",
+			Keys:      keys,
+			IndexFull: full,
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// maxWaitSeconds caps the ?wait= parameter of GET /get.
+const maxWaitSeconds = 60
+
+// errTooManyWaiters is returned when the waiter limit has been reached.
+var errTooManyWaiters = fmt.Errorf("%w: too many requests are already waiting for keys", ErrCapacityExhausted)
+
+// WaitList holds the GETs blocked until a key is written. Writers call wake
+// after releasing the shard lock; with nobody waiting that costs one atomic load.
+//
+// All methods are safe to call on a nil *WaitList, which accepts no waiters.
+type WaitList struct {
+	max   int
+	count atomic.Int64
+
+	mutex   sync.Mutex
+	waiters map[string][]chan Item
+}
+
+// NewWaitList creates a list that admits at most max concurrent waiters.
+func NewWaitList(max int) *WaitList {
+	return &WaitList{max: max, waiters: make(map[string][]chan Item)}
+}
+
+// register adds a waiter for key. The returned channel receives the item
+// written next; cancel must be called once the caller stops waiting.
+func (l *WaitList) register(key string) (<-chan Item, func(), error) {
+	if l == nil {
+		return nil, nil, errTooManyWaiters
+	}
+	ch := make(chan Item, 1)
+	l.mutex.Lock()
+	if int(l.count.Load()) >= l.max {
+		l.mutex.Unlock()
+		return nil, nil, errTooManyWaiters
+	}
+	l.waiters[key] = append(l.waiters[key], ch)
+	l.count.Add(1)
+	l.mutex.Unlock()
+
+	cancel := func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		list := l.waiters[key]
+		for i, c := range list {
+			if c == ch {
+				list = append(list[:i], list[i+1:]...)
+				l.count.Add(-1)
+				break
+			}
+		}
+		if len(list) == 0 {
+			delete(l.waiters, key)
+		} else {
+			l.waiters[key] = list
+		}
+	}
+	return ch, cancel, nil
+}
+
+// wake hands item to everyone waiting for key.
+func (l *WaitList) wake(key string, item Item) {
+	if l == nil || l.count.Load() == 0 {
+		return
+	}
+	l.mutex.Lock()
+	list := l.waiters[key]
+	delete(l.waiters, key)
+	l.count.Add(-int64(len(list)))
+	l.mutex.Unlock()
+
+	for _, ch := range list {
+		ch <- item // Buffered and used once, never blocks
+	}
+}
+
+// Len returns the number of requests currently waiting.
+func (l *WaitList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.count.Load())
+}
+
+// EnableWaiters allows up to max GETs at a time to wait for a missing key to
+// be written (see WaitFor). Must be called before the cache starts serving
+// requests.
+func (sc *ShardedCache) EnableWaiters(max int) {
+	if max <= 0 {
+		return
+	}
+	sc.waiters = NewWaitList(max)
+	for _, shard := range sc.shards {
+		shard.waiters = sc.waiters
+	}
+}
+
+// WaitFor blocks until key is written or ctx is done, and returns the value
+// if it was written. It returns errTooManyWaiters when the waiter limit is
+// reached (or waiting is disabled).
+func (sc *ShardedCache) WaitFor(ctx context.Context, key string) (Item, bool, error) {
+	ch, cancel, err := sc.waiters.register(key)
+	if err != nil {
+		return Item{}, false, err
+	}
+	defer cancel()
+
+	// Look again now that we are registered, against the shard itself rather
+	// than a read snapshot, so a write that landed after the caller's miss is
+	// not lost.
+	if item, found, err := sc.shards[sc.getShardIndex(key)].GetCtx(ctx, key, staleOwnWindow); err == nil && found {
+		return item, true, nil
+	}
+
+	select {
+	case item := <-ch:
+		return item, true, nil
+	case <-ctx.Done():
+		return Item{}, false, nil
+	}
+}
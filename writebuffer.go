@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// bufferedPut is a write staged in a shard's write buffer.
+type bufferedPut struct {
+	key, value string
+	opts       PutOptions
+}
+
+// writeBuffer stages PUTs of one shard in a bounded queue, so that a worker
+// can apply them in batches under a single acquisition of the shard mutex.
+// Writers only touch the channel, never the shard mutex, unless the queue is
+// full.
+type writeBuffer struct {
+	queue chan bufferedPut
+
+	batches   atomic.Uint64 // Batches applied
+	applied   atomic.Uint64 // Staged puts written
+	coalesced atomic.Uint64 // Staged puts superseded by a later one of the same key in their batch
+	fallbacks atomic.Uint64 // Puts applied synchronously because the queue was full
+	refused   atomic.Uint64 // Staged puts dropped because the key holds an immutable or forbidden entry
+}
+
+// stage queues p and reports whether there was room for it.
+func (b *writeBuffer) stage(p bufferedPut) bool {
+	select {
+	case b.queue <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// takeLocked removes everything queued, keeping only the last put of each
+// key. Puts of one key made with different tokens are not merged, so one
+// refused by the entry's read ACL cannot drop the write before it. Taking
+// and applying under the shard mutex keeps staged puts in order with the
+// synchronous ones that drain the queue on overflow.
+// MUST be called with the mutex held.
+func (b *writeBuffer) takeLocked() []bufferedPut {
+	var batch []bufferedPut
+	var seen map[string]int
+	for {
+		select {
+		case p := <-b.queue:
+			if i, ok := seen[p.key]; ok && batch[i].opts.Reader == p.opts.Reader {
+				batch[i] = p
+				b.coalesced.Add(1)
+				continue
+			}
+			if seen == nil {
+				seen = make(map[string]int)
+			}
+			seen[p.key] = len(batch)
+			batch = append(batch, p)
+		default:
+			return batch
+		}
+	}
+}
+
+// stagedWrite is the outcome of one applied put, reported once the mutex is
+// released.
+type stagedWrite struct {
+	key     string
+	item    Item
+	evicted *entry
+}
+
+// drainWritesLocked applies everything staged in the shard's write buffer.
+// MUST be called with the mutex held; pass the result to finishWrites after
+// releasing it.
+func (c *LRUCache) drainWritesLocked() []stagedWrite {
+	if c.writes == nil {
+		return nil
+	}
+	batch := c.writes.takeLocked()
+	if len(batch) == 0 {
+		return nil
+	}
+	done := make([]stagedWrite, 0, len(batch))
+	for _, p := range batch {
+		result, evicted := c.putLocked(p.key, p.value, p.opts)
+		if result.Refused {
+			c.writes.refused.Add(1)
+			continue
+		}
+		done = append(done, stagedWrite{key: p.key, item: c.items[p.key].Value.(*entry).item(), evicted: evicted})
+	}
+	c.writes.batches.Add(1)
+	c.writes.applied.Add(uint64(len(done)))
+	return done
+}
+
+// finishWrites reports evictions and wakes waiters for puts applied by
+// drainWritesLocked.
+func (c *LRUCache) finishWrites(done []stagedWrite) {
+	for _, w := range done {
+		if w.evicted != nil {
+			c.notifyEvict(w.evicted, EvictionCapacity)
+		}
+		c.waiters.wake(w.key, w.item)
+	}
+}
+
+// flushWrites applies the shard's staged puts in one batch.
+func (c *LRUCache) flushWrites() {
+	if c.writes == nil || len(c.writes.queue) == 0 {
+		return
+	}
+	c.mutex.Lock()
+	done := c.drainWritesLocked()
+	c.mutex.Unlock()
+	c.finishWrites(done)
+}
+
+// PutBuffered stages a put for the shard's worker and reports true, or, when
+// the buffer is full, applies the staged puts and then this one before
+// returning false with the result of PutWithOptionsCtx. A staged put becomes
+// visible within the flush interval; if the key then holds an immutable
+// entry, or one opts.CheckACL forbids overwriting, it is dropped and counted
+// in the stats. Puts that make an entry
+// immutable are never staged, so coalescing cannot let a later put replace
+// one that would have refused it.
+func (c *LRUCache) PutBuffered(ctx context.Context, key, value string, opts PutOptions) (bool, PutResult, error) {
+	if !opts.Immutable && !c.immutablePrefix(key) {
+		if c.writes.stage(bufferedPut{key: key, value: value, opts: opts}) {
+			return true, PutResult{}, nil
+		}
+		c.writes.fallbacks.Add(1)
+	}
+	if err := c.lockCtx(ctx); err != nil {
+		return false, PutResult{}, err
+	}
+	done := c.drainWritesLocked()
+	result, evicted := c.putLocked(key, value, opts)
+	item := c.items[key].Value.(*entry).item()
+	c.mutex.Unlock()
+
+	c.finishWrites(done)
+	if result.Refused {
+		return false, result, refusal(key, result)
+	}
+	if evicted != nil {
+		c.notifyEvict(evicted, EvictionCapacity)
+	}
+	c.waiters.wake(key, item)
+	return false, result, nil
+}
+
+// EnableWriteBuffer gives every shard a queue of size puts, which a worker
+// per shard applies in one batch each interval, keeping only the last put of
+// each key. PUT /put requests then only wait for the shard lock when the
+// queue is full. Other operations do not wait for staged puts: a read may
+// miss a write for up to interval, and a delete may be undone by a put
+// staged before it. Must be called before the cache starts serving requests.
+func (sc *ShardedCache) EnableWriteBuffer(size int, interval time.Duration) {
+	if size <= 0 || interval <= 0 {
+		return
+	}
+	for _, shard := range sc.shards {
+		shard.writes = &writeBuffer{queue: make(chan bufferedPut, size)}
+		sc.workers.Go(fmt.Sprintf("write-buffer/%d", shard.index), func() {
+			ticks, stop := sc.clock.NewTicker(interval)
+			defer stop()
+			for range ticks {
+				shard.flushWrites()
+			}
+		})
+	}
+	sc.writeBufferInterval = interval
+	log.Printf("Buffering up to %d puts per shard, applied every %s", size, interval)
+}
+
+// PutBuffered stages a put in the key's shard when write buffering is
+// enabled, and otherwise behaves as PutWithOptionsCtx. It reports whether
+// the put was staged; a staged put carries no result.
+func (sc *ShardedCache) PutBuffered(ctx context.Context, key, value string, opts PutOptions) (bool, PutResult, error) {
+	value, err := opts.transformValue(key, value)
+	if err != nil {
+		return false, PutResult{}, err
+	}
+	if err := checkLengths(key, value); err != nil {
+		return false, PutResult{}, err
+	}
+	sc.trace.record(tracePut, key, len(value), opts.Cost)
+	shard := sc.shards[sc.getShardIndex(key)]
+	if shard.writes == nil {
+		result, err := shard.PutWithOptionsCtx(ctx, key, value, opts)
+		return false, result, err
+	}
+	return shard.PutBuffered(ctx, key, value, opts)
+}
+
+// FlushWriteBuffers applies every shard's staged puts, so that nothing
+// accepted is lost at shutdown.
+func (sc *ShardedCache) FlushWriteBuffers() {
+	for _, shard := range sc.shards {
+		shard.flushWrites()
+	}
+}
+
+// WriteBufferStats reports write buffer activity in /stats.
+type WriteBufferStats struct {
+	Size          int    `json:"size"` // Queue length per shard
+	IntervalMs    int64  `json:"interval_ms"`
+	Depth         int    `json:"depth"`           // Puts staged right now, over all shards
+	MaxShardDepth int    `json:"max_shard_depth"` // Puts staged in the fullest shard
+	Batches       uint64 `json:"batches"`
+	Applied       uint64 `json:"applied"`
+	Coalesced     uint64 `json:"coalesced"`
+	SyncFallbacks uint64 `json:"sync_fallbacks"`
+	Refused       uint64 `json:"refused"`
+}
+
+// WriteBufferStats sums write buffer activity over all shards, or returns
+// nil when buffering is disabled.
+func (sc *ShardedCache) WriteBufferStats() *WriteBufferStats {
+	if sc.writeBufferInterval <= 0 {
+		return nil
+	}
+	stats := &WriteBufferStats{IntervalMs: sc.writeBufferInterval.Milliseconds()}
+	for _, shard := range sc.shards {
+		b := shard.writes
+		depth := len(b.queue)
+		stats.Size = cap(b.queue)
+		stats.Depth += depth
+		stats.MaxShardDepth = max(stats.MaxShardDepth, depth)
+		stats.Batches += b.batches.Load()
+		stats.Applied += b.applied.Load()
+		stats.Coalesced += b.coalesced.Load()
+		stats.SyncFallbacks += b.fallbacks.Load()
+		stats.Refused += b.refused.Load()
+	}
+	return stats
+}
@@ -0,0 +1,45 @@
+package main
+
+import "time"
+
+// WritePolicy is what the server applies to a value before storing it: the
+// write transforms, the TTL bounds and rules, writer fairness and the read
+// ACL of the entry being replaced. /put, /import/ndjson and the binary PUT
+// go through it, so they accept and store a value alike. Other writes apply
+// Transforms themselves.
+type WritePolicy struct {
+	TTL        TTLPolicy
+	Transforms *TransformChain // nil = none
+	Fairness   *FairnessGuard  // nil = writers are not told apart
+}
+
+// preparedPut is a write the policy has been applied to.
+type preparedPut struct {
+	value       string
+	opts        PutOptions
+	ttlAdjusted bool   // The requested TTL was clamped
+	ttlRule     string // Pattern of the TTL rule that chose the TTL
+}
+
+// prepare transforms value, which must be valid opts.Encoding, resolves the
+// TTL of the write and fills in who makes it: writer, from FairnessGuard,
+// and reader, from requestReader, whose ACL check the write is then subject
+// to. It fails with errTransformRejected if a transform refuses the value
+// or leaves it invalid for its encoding.
+func (p WritePolicy) prepare(key, value string, opts PutOptions, writer uint16, reader string) (preparedPut, error) {
+	value, transformed, err := p.Transforms.applyEncoded(key, value, opts.Encoding)
+	if err != nil {
+		return preparedPut{}, err
+	}
+	put := preparedPut{value: value, opts: opts}
+	put.opts.Transforms = transformed
+	put.opts.TTL, put.ttlAdjusted, put.ttlRule = p.TTL.Resolve(key, opts.TTL)
+	put.opts.Writer = writer
+	put.opts.CheckACL, put.opts.Reader = true, reader
+	return put, nil
+}
+
+// ttlSeconds is the TTL of the prepared write, in whole seconds.
+func (put preparedPut) ttlSeconds() int {
+	return int(put.opts.TTL / time.Second)
+}